@@ -11,9 +11,12 @@ import (
 
 	"github.com/ksindhwani/imagegram/pkg/app"
 	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/database"
 	"github.com/ksindhwani/imagegram/pkg/database/mysql"
 	"github.com/ksindhwani/imagegram/pkg/filesystem"
 	"github.com/ksindhwani/imagegram/pkg/router"
+	"github.com/ksindhwani/imagegram/pkg/service"
+	"github.com/ksindhwani/imagegram/pkg/worker"
 	"go.uber.org/zap"
 )
 
@@ -32,15 +35,25 @@ func main() {
 	db, err := initializeDB(cfg)
 	fatalOnError(err, "error initializing database")
 
-	localFileSystem, err := filesystem.New(filesystem.LOCAL, cfg)
-	fatalOnError(err, "error initializing database")
+	fileSystem, err := filesystem.New(cfg.FileSystemType, cfg)
+	fatalOnError(err, "error initializing filesystem")
+
+	// start the workers converting images of new posts
+	conversionPool := worker.New(cfg.ConversionWorkers, cfg.ConversionQueueSize)
+	conversionPool.Start(context.Background())
+
+	// delete resumable uploads left idle past UPLOAD_SESSION_TTL
+	cleanupCtx, stopCleanup := context.WithCancel(context.Background())
+	uploadCleanup := service.NewUploadSessionService(cfg, database.New(db), fileSystem, nil)
+	go uploadCleanup.RunUploadCleanup(cleanupCtx)
 
 	// initialize application and handlers
 	deps := &app.Dependencies{
-		Revision:        revision,
-		Config:          cfg,
-		DB:              db,
-		LocalFileSystem: localFileSystem,
+		Revision:       revision,
+		Config:         cfg,
+		DB:             db,
+		FileSystem:     fileSystem,
+		ConversionPool: conversionPool,
 	}
 	r, err := router.New(deps)
 	fatalOnError(err, "could not instantiate router")
@@ -54,7 +67,7 @@ func main() {
 	}
 
 	go func(server *http.Server) {
-		log.Print("server running on: %s", cfg.Addr)
+		log.Printf("server running on: %s", cfg.Addr)
 
 		err := server.ListenAndServe()
 		if err != nil && err != http.ErrServerClosed {
@@ -66,9 +79,16 @@ func main() {
 	signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
 	<-stopCh
 	log.Print("gracefully shutting down server")
-	if err := server.Shutdown(context.Background()); err != nil {
+	stopCleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("error shutting server down gracefully: %v", err)
 	}
+	// finish conversions already queued, anything left over is picked up by the backfill
+	if err := conversionPool.Shutdown(ctx); err != nil {
+		log.Printf("conversion workers did not finish in time: %v", err)
+	}
 
 }
 
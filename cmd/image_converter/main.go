@@ -1,17 +1,30 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/ksindhwani/imagegram/pkg/config"
 	"github.com/ksindhwani/imagegram/pkg/database"
 	"github.com/ksindhwani/imagegram/pkg/database/mysql"
+	"github.com/ksindhwani/imagegram/pkg/filesystem"
 	"github.com/ksindhwani/imagegram/pkg/service"
 	"go.uber.org/zap"
 )
 
+// jobs claimed at once
+const conversionBatchSize = 10
+
 func main() {
+	daemon := flag.Bool("daemon", false, "keep running and convert new images as their jobs become due")
+	flag.Parse()
+
 	cfg, err := config.New()
 	fatalOnError(err, "error loading configuration")
 
@@ -19,25 +32,68 @@ func main() {
 	db, err := initializeDB(cfg)
 	fatalOnError(err, "error initializing database")
 
+	// The converter runs on the host, where the images volume is mounted at HOST_IMAGE_DIRECTORY
+	cfg.LocalImageDirectory = cfg.HostImageDirectory
+	fileSystem, err := filesystem.New(cfg.FileSystemType, cfg)
+	fatalOnError(err, "error initializing filesystem")
+
 	database := database.New(db)
-	imageConverterService := service.NewImageConvertorService(cfg, database)
-	imageService := service.NewImageService(cfg, database)
+	imageConverterService := service.NewImageConvertorService(cfg, database, fileSystem, service.NewDecodeOptions(cfg))
 
-	successfulConversions, failedConversions, err := imageConverterService.ConvertImages()
+	// Queue images uploaded before conversion jobs existed or missing a newly added rendition
+	err = imageConverterService.EnqueueUnconvertedImages()
 	if err != nil {
 		// In Production instead of logging we can log it on log stream
-		log.Fatalf("Unable to process images - %w", &err)
+		log.Fatalf("Unable to queue images - %s", err)
 	}
-	if len(failedConversions) > 0 {
-		log.Print("Unable to convert some images")
-		for _, image := range failedConversions {
-			// In Production instead of logging we can log it on log stream or generate alert
-			println(image.ToString())
+
+	if *daemon {
+		runDaemon(cfg, imageConverterService)
+		return
+	}
+
+	// Run due jobs until none are left. Failed jobs are scheduled for a later retry,
+	// jobs failing too often are dead and listed by GET /admin/conversion-jobs
+	processed := 0
+	for {
+		count, err := imageConverterService.RunConversionJobs(context.Background(), conversionBatchSize)
+		if err != nil {
+			log.Fatalf("Unable to process images - %s", err)
 		}
+		if count == 0 {
+			break
+		}
+		processed += count
+	}
+	log.Printf("Conversion completed, %d jobs processed", processed)
+}
+
+// Convert with a pool of workers until SIGINT or SIGTERM. Running jobs are then given
+// SHUTDOWN_TIMEOUT to finish, after which they are interrupted and go back to pending.
+func runDaemon(cfg *config.Config, imageConverterService *service.ImageConvertorService) {
+	ctx, stop := context.WithCancel(context.Background())
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	done := make(chan struct{})
+	go func() {
+		log.Printf("converter running with %d workers", cfg.ConversionWorkers)
+		imageConverterService.RunConversionWorkers(ctx, workCtx, cfg.ConversionWorkers, cfg.ConversionPollInterval)
+		close(done)
+	}()
+
+	stopCh := make(chan os.Signal, 2)
+	signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
+	<-stopCh
+	log.Print("gracefully shutting down converter")
+	stop()
+	select {
+	case <-done:
+	case <-time.After(cfg.ShutdownTimeout):
+		log.Print("running conversions did not finish in time, interrupting them")
+		cancelWork()
+		<-done
 	}
-	err = imageService.UpdateConvertedLocationsForImages(successfulConversions)
-	log.Print("Conversion completed")
-	fatalOnError(err, "error saving converted image in database")
 }
 
 func fatalOnError(err error, msg string) {
@@ -1,12 +1,23 @@
 DROP TABLE IF EXISTS posts;
 DROP TABLE IF EXISTS images;
 DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS conversion_jobs;
+DROP TABLE IF EXISTS image_renditions;
+DROP TABLE IF EXISTS image_metadata;
+DROP TABLE IF EXISTS image_hash_bands;
+DROP TABLE IF EXISTS blocked_hashes;
+DROP TABLE IF EXISTS moderation_events;
+DROP TABLE IF EXISTS upload_sessions;
+DROP TABLE IF EXISTS upload_parts;
+DROP TABLE IF EXISTS direct_uploads;
 
 CREATE TABLE `posts` (
     `post_id` INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
     `user_id` INT NOT NULL,
     `caption` TEXT,
-    `created_at`  DATETIME DEFAULT CURRENT_TIMESTAMP
+    `comment_count` INT NOT NULL DEFAULT 0,
+    `created_at`  DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX `idx_posts_comment_count` (`comment_count`, `post_id`)
 );
 
 CREATE TABLE `comments` (
@@ -14,15 +25,136 @@ CREATE TABLE `comments` (
     `user_id` INT NOT NULL,
     `post_id` INT NOT NULL,
     `comment` TEXT,
-    `created_at`  DATETIME DEFAULT CURRENT_TIMESTAMP
+    `created_at`  DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX `idx_comments_post_id` (`post_id`, `comment_id`)
 );
 
 CREATE TABLE `images` (
     `image_id` INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
     `post_id` INT NOT NULL,
     `image_file_name` VARCHAR(255),
-    `location` VARCHAR(255),
-    `converted_image_name` VARCHAR(255),
-    `converted_image_location` VARCHAR(255),
-    `uploaded_at`  DATETIME DEFAULT CURRENT_TIMESTAMP
-);
\ No newline at end of file
+    `storage_key` VARCHAR(255) NOT NULL,
+    `content_hash` CHAR(64) NOT NULL,
+    `location` VARCHAR(1024),
+    `width` INT,
+    `height` INT,
+    `blurhash` VARCHAR(64),
+    `dominant_color` CHAR(7),
+    `perceptual_hash` BIGINT,
+    `duplicate_of` INT,
+    `quarantined_at` DATETIME,
+    `uploaded_at`  DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX `idx_images_post_id` (`post_id`),
+    INDEX `idx_images_content_hash` (`content_hash`)
+);
+
+CREATE TABLE `conversion_jobs` (
+    `job_id` INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    `image_id` INT NOT NULL,
+    `status` VARCHAR(16) NOT NULL DEFAULT 'pending',
+    `attempts` INT NOT NULL DEFAULT 0,
+    `last_error` TEXT,
+    `next_attempt_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `lease_owner` VARCHAR(255),
+    `lease_expires_at` DATETIME,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE INDEX `idx_conversion_jobs_image_id` (`image_id`),
+    INDEX `idx_conversion_jobs_next_attempt` (`status`, `next_attempt_at`),
+    INDEX `idx_conversion_jobs_lease` (`status`, `lease_expires_at`)
+);
+
+CREATE TABLE `image_renditions` (
+    `image_id` INT NOT NULL,
+    `name` VARCHAR(32) NOT NULL,
+    `mode` VARCHAR(32) NOT NULL,
+    `storage_key` VARCHAR(255) NOT NULL,
+    `location` VARCHAR(1024),
+    `width` INT NOT NULL,
+    `height` INT NOT NULL,
+    `size_bytes` BIGINT NOT NULL,
+    `quality` TINYINT NOT NULL DEFAULT 75,
+    `progressive` BOOLEAN NOT NULL DEFAULT FALSE,
+    `chroma_subsampling` VARCHAR(8) NOT NULL DEFAULT '4:2:0',
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`image_id`, `name`)
+);
+
+CREATE TABLE `image_metadata` (
+    `image_id` INT NOT NULL PRIMARY KEY,
+    `width` INT NOT NULL,
+    `height` INT NOT NULL,
+    `orientation` TINYINT NOT NULL DEFAULT 1,
+    `captured_at` DATETIME,
+    `camera_make` VARCHAR(255),
+    `camera_model` VARCHAR(255),
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Each byte of an image's perceptual hash, two hashes at most 7 bits apart share at least one
+CREATE TABLE `image_hash_bands` (
+    `band` TINYINT NOT NULL,
+    `value` TINYINT UNSIGNED NOT NULL,
+    `image_id` INT NOT NULL,
+    PRIMARY KEY (`band`, `value`, `image_id`),
+    INDEX `idx_image_hash_bands_image_id` (`image_id`)
+);
+
+CREATE TABLE `blocked_hashes` (
+    `blocked_hash_id` INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    `perceptual_hash` BIGINT NOT NULL,
+    `reason` VARCHAR(255),
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE INDEX `idx_blocked_hashes_perceptual_hash` (`perceptual_hash`)
+);
+
+CREATE TABLE `moderation_events` (
+    `event_id` INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    `action` VARCHAR(16) NOT NULL,
+    `source` VARCHAR(16) NOT NULL,
+    `blocked_hash_id` INT NOT NULL,
+    `distance` TINYINT NOT NULL,
+    `image_id` INT,
+    `post_id` INT,
+    `user_id` INT,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Resumable uploads, upload_offset is the number of bytes received so far
+CREATE TABLE `upload_sessions` (
+    `upload_id` CHAR(32) NOT NULL PRIMARY KEY,
+    `user_id` INT NOT NULL,
+    `caption` TEXT,
+    `file_name` VARCHAR(255) NOT NULL,
+    `upload_length` BIGINT NOT NULL,
+    `upload_offset` BIGINT NOT NULL DEFAULT 0,
+    `post_id` INT,
+    `finalized_at` DATETIME,
+    `expires_at` DATETIME NOT NULL,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX `idx_upload_sessions_expires_at` (`expires_at`)
+);
+
+-- The chunks of a resumable upload, each stored as its own file until the upload is finalized
+CREATE TABLE `upload_parts` (
+    `upload_id` CHAR(32) NOT NULL,
+    `part_offset` BIGINT NOT NULL,
+    `size_bytes` BIGINT NOT NULL,
+    `storage_key` VARCHAR(255) NOT NULL,
+    PRIMARY KEY (`upload_id`, `part_offset`)
+);
+
+-- Uploads clients send straight to storage with a presigned url, claimed_at is set
+-- while the upload is being turned into a post
+CREATE TABLE `direct_uploads` (
+    `upload_id` CHAR(32) NOT NULL PRIMARY KEY,
+    `user_id` INT NOT NULL,
+    `file_name` VARCHAR(255) NOT NULL,
+    `content_type` VARCHAR(64) NOT NULL,
+    `upload_length` BIGINT NOT NULL,
+    `post_id` INT,
+    `claimed_at` DATETIME,
+    `expires_at` DATETIME NOT NULL,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX `idx_direct_uploads_expires_at` (`expires_at`)
+);
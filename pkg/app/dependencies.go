@@ -5,13 +5,16 @@ import (
 
 	"github.com/ksindhwani/imagegram/pkg/config"
 	"github.com/ksindhwani/imagegram/pkg/filesystem"
+	"github.com/ksindhwani/imagegram/pkg/worker"
 )
 
 // Dependencies holds the primitives and structs/interfaces that are required
 // for the application's business logic.
 type Dependencies struct {
-	Revision        string
-	Config          *config.Config
-	DB              *sql.DB
-	LocalFileSystem filesystem.FileSystem
+	Revision   string
+	Config     *config.Config
+	DB         *sql.DB
+	FileSystem filesystem.FileSystem
+	// ConversionPool runs image conversions of new posts
+	ConversionPool *worker.Pool
 }
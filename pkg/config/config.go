@@ -1,66 +1,308 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v8"
 )
 
 const (
-	defaultAddr                 = "0.0.0.0:8000"
-	defaultRemoteTimeout        = 30 * time.Second
-	defaultServerReadTimeout    = 2 * time.Minute
-	defaultServerWriteTimeout   = 2 * time.Minute
-	defaultServerIdleTimeout    = 5 * time.Minute
-	defaultDBMaxIdleConnections = 10
-	defaultDBMaxOpenConnections = 5
-	defaultDBMaxConnLifeTime    = 30 * time.Minute
-	defaultDBUserID             = "root"
-	defaultDBPassword           = ""
-	defaultDBHostName           = "localhost"
-	defaultDBPort               = 3306
-	defaultDBDatabaseName       = "database"
-	defaultHostImageDirectory   = "/etc/images"
-	defaultLocalImageDirectory  = "/images"
+	defaultAddr                     = "0.0.0.0:8000"
+	defaultRemoteTimeout            = 30 * time.Second
+	defaultServerReadTimeout        = 2 * time.Minute
+	defaultServerWriteTimeout       = 2 * time.Minute
+	defaultServerIdleTimeout        = 5 * time.Minute
+	defaultDBMaxIdleConnections     = 10
+	defaultDBMaxOpenConnections     = 5
+	defaultDBMaxConnLifeTime        = 30 * time.Minute
+	defaultDBUserID                 = "root"
+	defaultDBPassword               = ""
+	defaultDBHostName               = "localhost"
+	defaultDBPort                   = 3306
+	defaultDBDatabaseName           = "database"
+	defaultHostImageDirectory       = "/etc/images"
+	defaultLocalImageDirectory      = "/images"
+	defaultCursorSecret             = ""
+	defaultPageSize                 = 10
+	defaultMaxPageSize              = 50
+	defaultFeedCommentsPerPost      = 2
+	defaultPublicBaseURL            = ""
+	defaultImageCacheMaxAge         = 24 * time.Hour
+	defaultFileSystemType           = "local"
+	defaultS3Region                 = "us-east-1"
+	defaultConversionWorkers        = 2
+	defaultConversionQueueSize      = 100
+	defaultShutdownTimeout          = 30 * time.Second
+	defaultConversionMaxAttempts    = 5
+	defaultConversionRetryBaseDelay = 30 * time.Second
+	defaultConversionRetryMaxDelay  = time.Hour
+	defaultConversionLeaseDuration  = 10 * time.Minute
+	defaultAdminToken               = ""
+	defaultConversionPollInterval   = 5 * time.Second
+	defaultConversionMaxDecodes     = 2
+	defaultRenditions               = "thumb:150x150:fill:entropy:q=70,feed:600x600:fit:q=80:progressive:max=150kb,large:1080x1080:fit:q=85"
+	defaultRendition                = "feed"
+	defaultImageMaxWidth            = 12000
+	defaultImageMaxHeight           = 12000
+	defaultImageMaxMegapixels       = 50
+	defaultConversionDecodeMemoryMB = 1024
+	defaultImageFormats             = "jpeg,png,bmp,gif,webp,tiff"
+	defaultGifPosterFrame           = 0
+	defaultDerivativeCacheMB        = 1024
+	defaultSimilarMaxDistance       = 6
+	defaultDuplicatePolicy          = DUPLICATE_POLICY_OFF
+	defaultDuplicateMaxDistance     = 4
+	defaultBlocklistMaxDistance     = 4
+	defaultBlocklistCheckUploads    = true
+	defaultUploadMaxBytes           = 100 << 20
+	defaultUploadSessionTTL         = 24 * time.Hour
+	defaultUploadCleanupInterval    = 10 * time.Minute
+	defaultUploadClaimTimeout       = 10 * time.Minute
+	defaultUploadURLExpiry          = 15 * time.Minute
+	defaultUploadSigningSecret      = ""
 )
 
+// Longest a presigned upload url may be valid for, S3 refuses longer
+const maxUploadURLExpiry = 7 * 24 * time.Hour
+
+// What happens to uploads close to an image already posted
+const (
+	DUPLICATE_POLICY_OFF    = "off"
+	DUPLICATE_POLICY_FLAG   = "flag"   // the post is created and marked as a duplicate
+	DUPLICATE_POLICY_REJECT = "reject" // the upload is refused
+)
+
+// Farthest perceptual hashes the image index finds reliably, in bits
+const maxHashDistance = 7
+
+// Widths, heights and qualities derivatives may be asked for
+var (
+	defaultDerivativeSizes     = []int{64, 128, 256, 320, 480, 640, 750, 828, 1080, 1280, 1600, 2048}
+	defaultDerivativeQualities = []int{50, 60, 70, 75, 80, 85, 90}
+)
+
+// Image formats there is a decoder for
+var supportedImageFormats = []string{"jpeg", "png", "bmp", "gif", "webp", "tiff"}
+
 type Config struct {
-	Addr                 string        `env:"ADDR"` // e.g. 0.0.0.0:8000
-	ServerReadTimeout    time.Duration `env:"SERVER_READ_TIMEOUT"`
-	ServerWriteTimeout   time.Duration `env:"SERVER_WRITE_TIMEOUT"`
-	ServerIdleTimeout    time.Duration `env:"SERVER_IDLE_TIMEOUT"`
-	DBUserID             string        `env:"DB_USER"`
-	DBPassword           string        `env:"DB_PASSWORD"`
-	DBHostName           string        `env:"DB_HOST"`
-	DBPort               int           `env:"DB_PORT"`
-	DBDatabaseName       string        `env:"DB_NAME"`
-	DBMaxIdleConnections int           `env:"DB_MAX_IDLE_CONNECTIONS"`
-	DBMaxOpenConnections int           `env:"DB_MAX_OPEN_CONNECTIONS"`
-	DBMaxConnLifetime    time.Duration `env:"DB_MAX_CONN_LIFETIME"`
-	HostImageDirectory   string        `env:"HOST_IMAGE_DIRECTORY"`
-	LocalImageDirectory  string        `env:"LOCAL_IMAGE_DIRECTORY"`
+	Addr                     string        `env:"ADDR"` // e.g. 0.0.0.0:8000
+	ServerReadTimeout        time.Duration `env:"SERVER_READ_TIMEOUT"`
+	ServerWriteTimeout       time.Duration `env:"SERVER_WRITE_TIMEOUT"`
+	ServerIdleTimeout        time.Duration `env:"SERVER_IDLE_TIMEOUT"`
+	DBUserID                 string        `env:"DB_USER"`
+	DBPassword               string        `env:"DB_PASSWORD"`
+	DBHostName               string        `env:"DB_HOST"`
+	DBPort                   int           `env:"DB_PORT"`
+	DBDatabaseName           string        `env:"DB_NAME"`
+	DBMaxIdleConnections     int           `env:"DB_MAX_IDLE_CONNECTIONS"`
+	DBMaxOpenConnections     int           `env:"DB_MAX_OPEN_CONNECTIONS"`
+	DBMaxConnLifetime        time.Duration `env:"DB_MAX_CONN_LIFETIME"`
+	HostImageDirectory       string        `env:"HOST_IMAGE_DIRECTORY"`
+	LocalImageDirectory      string        `env:"LOCAL_IMAGE_DIRECTORY"`
+	CursorSecret             string        `env:"CURSOR_SECRET"` // HMAC key for pagination cursors
+	DefaultPageSize          int           `env:"DEFAULT_PAGE_SIZE"`
+	MaxPageSize              int           `env:"MAX_PAGE_SIZE"`
+	FeedCommentsPerPost      int           `env:"FEED_COMMENTS_PER_POST"` // latest comments shown with each post
+	PublicBaseURL            string        `env:"PUBLIC_BASE_URL"`        // e.g. https://cdn.imagegram.com, empty for relative urls
+	ImageCacheMaxAge         time.Duration `env:"IMAGE_CACHE_MAX_AGE"`
+	FileSystemType           string        `env:"FILESYSTEM_TYPE"` // local or s3
+	S3Endpoint               string        `env:"S3_ENDPOINT"`     // e.g. http://minio:9000, empty for AWS
+	S3Bucket                 string        `env:"S3_BUCKET"`
+	S3Region                 string        `env:"S3_REGION"`
+	S3PathStyle              bool          `env:"S3_PATH_STYLE"`
+	S3AccessKeyID            string        `env:"AWS_ACCESS_KEY_ID"`
+	S3SecretAccessKey        string        `env:"AWS_SECRET_ACCESS_KEY"`
+	ConversionWorkers        int           `env:"CONVERSION_WORKERS"`    // images converted in parallel after upload
+	ConversionQueueSize      int           `env:"CONVERSION_QUEUE_SIZE"` // uploads waiting for a worker before falling back to the backfill
+	ShutdownTimeout          time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	ConversionMaxAttempts    int           `env:"CONVERSION_MAX_ATTEMPTS"` // failed attempts before a job is dead
+	ConversionRetryBaseDelay time.Duration `env:"CONVERSION_RETRY_BASE_DELAY"`
+	ConversionRetryMaxDelay  time.Duration `env:"CONVERSION_RETRY_MAX_DELAY"`
+	ConversionLeaseDuration  time.Duration `env:"CONVERSION_LEASE_DURATION"` // a job held longer is handed to another worker
+	AdminToken               string        `env:"ADMIN_TOKEN"`               // bearer token of the admin endpoints, empty disables them
+	ConversionPollInterval   time.Duration `env:"CONVERSION_POLL_INTERVAL"`  // how often an idle converter daemon worker looks for jobs
+	ConversionMaxDecodes     int           `env:"CONVERSION_MAX_DECODES"`    // images held in memory at once
+	Renditions               Renditions    `env:"RENDITIONS"`                // sizes every image is converted to
+	DefaultRendition         string        `env:"DEFAULT_RENDITION"`         // rendition served when none is asked for
+	ImageMaxWidth            int           `env:"IMAGE_MAX_WIDTH"`           // larger images are rejected before decoding
+	ImageMaxHeight           int           `env:"IMAGE_MAX_HEIGHT"`
+	ImageMaxMegapixels       int           `env:"IMAGE_MAX_MEGAPIXELS"`
+	ConversionDecodeMemoryMB int           `env:"CONVERSION_DECODE_MEMORY_MB"`           // memory all images being decoded may take together
+	ImageFormats             []string      `env:"IMAGE_FORMATS" envSeparator:","`        // formats accepted at upload and converted
+	GifPosterFrame           int           `env:"GIF_POSTER_FRAME"`                      // frame of animated GIFs shown in renditions, 0 for the first
+	DerivativeSizes          []int         `env:"DERIVATIVE_SIZES" envSeparator:","`     // widths and heights images are resized to on demand
+	DerivativeQualities      []int         `env:"DERIVATIVE_QUALITIES" envSeparator:","` // JPEG qualities of on demand resizes
+	DerivativeCacheMB        int           `env:"DERIVATIVE_CACHE_MB"`                   // space on demand resizes are kept in
+	SimilarMaxDistance       int           `env:"SIMILAR_MAX_DISTANCE"`                  // bits perceptual hashes of similar images may differ by
+	DuplicatePolicy          string        `env:"DUPLICATE_POLICY"`                      // off, flag or reject near duplicate uploads
+	DuplicateMaxDistance     int           `env:"DUPLICATE_MAX_DISTANCE"`                // bits an upload may differ by to be a near duplicate
+	BlocklistMaxDistance     int           `env:"BLOCKLIST_MAX_DISTANCE"`                // bits an image may differ by from a blocked hash to match it
+	BlocklistCheckUploads    bool          `env:"BLOCKLIST_CHECK_UPLOADS"`               // refuse blocked uploads, the converter checks every image regardless
+	UploadMaxBytes           int64         `env:"UPLOAD_MAX_BYTES"`                      // largest image file accepted
+	UploadSessionTTL         time.Duration `env:"UPLOAD_SESSION_TTL"`                    // resumable uploads left idle this long are deleted
+	UploadCleanupInterval    time.Duration `env:"UPLOAD_CLEANUP_INTERVAL"`               // how often expired resumable uploads are looked for
+	UploadClaimTimeout       time.Duration `env:"UPLOAD_CLAIM_TIMEOUT"`                  // an upload being posted longer can be posted again
+	UploadURLExpiry          time.Duration `env:"UPLOAD_URL_EXPIRY"`                     // how long a url for uploading straight to storage works
+	UploadSigningSecret      string        `env:"UPLOAD_SIGNING_SECRET"`                 // HMAC key of upload urls of the local file system
 }
 
 func New() (*Config, error) {
 	cfg := Config{
-		Addr:                 defaultAddr,
-		ServerReadTimeout:    defaultServerReadTimeout,
-		ServerWriteTimeout:   defaultServerWriteTimeout,
-		ServerIdleTimeout:    defaultServerIdleTimeout,
-		DBUserID:             defaultDBUserID,
-		DBPassword:           defaultDBPassword,
-		DBHostName:           defaultDBHostName,
-		DBPort:               defaultDBPort,
-		DBDatabaseName:       defaultDBDatabaseName,
-		DBMaxIdleConnections: defaultDBMaxIdleConnections,
-		DBMaxOpenConnections: defaultDBMaxOpenConnections,
-		DBMaxConnLifetime:    defaultDBMaxConnLifeTime,
-		HostImageDirectory:   defaultHostImageDirectory,
-		LocalImageDirectory:  defaultLocalImageDirectory,
+		Addr:                     defaultAddr,
+		ServerReadTimeout:        defaultServerReadTimeout,
+		ServerWriteTimeout:       defaultServerWriteTimeout,
+		ServerIdleTimeout:        defaultServerIdleTimeout,
+		DBUserID:                 defaultDBUserID,
+		DBPassword:               defaultDBPassword,
+		DBHostName:               defaultDBHostName,
+		DBPort:                   defaultDBPort,
+		DBDatabaseName:           defaultDBDatabaseName,
+		DBMaxIdleConnections:     defaultDBMaxIdleConnections,
+		DBMaxOpenConnections:     defaultDBMaxOpenConnections,
+		DBMaxConnLifetime:        defaultDBMaxConnLifeTime,
+		HostImageDirectory:       defaultHostImageDirectory,
+		LocalImageDirectory:      defaultLocalImageDirectory,
+		CursorSecret:             defaultCursorSecret,
+		DefaultPageSize:          defaultPageSize,
+		MaxPageSize:              defaultMaxPageSize,
+		FeedCommentsPerPost:      defaultFeedCommentsPerPost,
+		PublicBaseURL:            defaultPublicBaseURL,
+		ImageCacheMaxAge:         defaultImageCacheMaxAge,
+		FileSystemType:           defaultFileSystemType,
+		S3Region:                 defaultS3Region,
+		ConversionWorkers:        defaultConversionWorkers,
+		ConversionQueueSize:      defaultConversionQueueSize,
+		ShutdownTimeout:          defaultShutdownTimeout,
+		ConversionMaxAttempts:    defaultConversionMaxAttempts,
+		ConversionRetryBaseDelay: defaultConversionRetryBaseDelay,
+		ConversionRetryMaxDelay:  defaultConversionRetryMaxDelay,
+		ConversionLeaseDuration:  defaultConversionLeaseDuration,
+		AdminToken:               defaultAdminToken,
+		ConversionPollInterval:   defaultConversionPollInterval,
+		ConversionMaxDecodes:     defaultConversionMaxDecodes,
+		DefaultRendition:         defaultRendition,
+		ImageMaxWidth:            defaultImageMaxWidth,
+		ImageMaxHeight:           defaultImageMaxHeight,
+		ImageMaxMegapixels:       defaultImageMaxMegapixels,
+		ConversionDecodeMemoryMB: defaultConversionDecodeMemoryMB,
+		ImageFormats:             strings.Split(defaultImageFormats, ","),
+		GifPosterFrame:           defaultGifPosterFrame,
+		DerivativeSizes:          defaultDerivativeSizes,
+		DerivativeQualities:      defaultDerivativeQualities,
+		DerivativeCacheMB:        defaultDerivativeCacheMB,
+		SimilarMaxDistance:       defaultSimilarMaxDistance,
+		DuplicatePolicy:          defaultDuplicatePolicy,
+		DuplicateMaxDistance:     defaultDuplicateMaxDistance,
+		BlocklistMaxDistance:     defaultBlocklistMaxDistance,
+		BlocklistCheckUploads:    defaultBlocklistCheckUploads,
+		UploadMaxBytes:           defaultUploadMaxBytes,
+		UploadSessionTTL:         defaultUploadSessionTTL,
+		UploadCleanupInterval:    defaultUploadCleanupInterval,
+		UploadClaimTimeout:       defaultUploadClaimTimeout,
+		UploadURLExpiry:          defaultUploadURLExpiry,
+		UploadSigningSecret:      defaultUploadSigningSecret,
+	}
+	if err := cfg.Renditions.UnmarshalText([]byte(defaultRenditions)); err != nil {
+		return nil, err
 	}
 	// load .env file
 	if err := env.Parse(&cfg); err != nil {
 		return nil, err
 	}
+	if cfg.DefaultPageSize <= 0 || cfg.DefaultPageSize > cfg.MaxPageSize {
+		return nil, fmt.Errorf("default page size %d should be positive and at most the max page size %d", cfg.DefaultPageSize, cfg.MaxPageSize)
+	}
+	if cfg.CursorSecret == "" {
+		// Cursors signed with a random key only work with this process
+		secret, err := randomSecret()
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate cursor secret - %w", err)
+		}
+		cfg.CursorSecret = secret
+	}
+	if cfg.UploadSigningSecret == "" {
+		// Upload urls signed with a random key only work with this process
+		secret, err := randomSecret()
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate upload signing secret - %w", err)
+		}
+		cfg.UploadSigningSecret = secret
+	}
+	if _, ok := cfg.Renditions.Get(cfg.DefaultRendition); !ok {
+		return nil, fmt.Errorf("default rendition %s is not one of the renditions", cfg.DefaultRendition)
+	}
+	imageFormats, err := parseImageFormats(cfg.ImageFormats)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ImageFormats = imageFormats
+	for _, size := range cfg.DerivativeSizes {
+		if size <= 0 {
+			return nil, fmt.Errorf("derivative size %d should be positive", size)
+		}
+	}
+	for _, quality := range cfg.DerivativeQualities {
+		if quality < 1 || quality > 100 {
+			return nil, fmt.Errorf("derivative quality %d should be between 1 and 100", quality)
+		}
+	}
+	switch cfg.DuplicatePolicy {
+	case DUPLICATE_POLICY_OFF, DUPLICATE_POLICY_FLAG, DUPLICATE_POLICY_REJECT:
+	default:
+		return nil, fmt.Errorf("duplicate policy %q should be off, flag or reject", cfg.DuplicatePolicy)
+	}
+	for _, distance := range []int{cfg.SimilarMaxDistance, cfg.DuplicateMaxDistance, cfg.BlocklistMaxDistance} {
+		if distance < 0 || distance > maxHashDistance {
+			return nil, fmt.Errorf("hash distance %d should be between 0 and %d", distance, maxHashDistance)
+		}
+	}
+	if cfg.UploadMaxBytes <= 0 {
+		return nil, fmt.Errorf("upload max bytes %d should be positive", cfg.UploadMaxBytes)
+	}
+	if cfg.UploadSessionTTL <= 0 || cfg.UploadCleanupInterval <= 0 || cfg.UploadClaimTimeout <= 0 {
+		return nil, fmt.Errorf("upload session ttl, cleanup interval and claim timeout should be positive")
+	}
+	if cfg.UploadURLExpiry <= 0 || cfg.UploadURLExpiry > cfg.UploadSessionTTL || cfg.UploadURLExpiry > maxUploadURLExpiry {
+		return nil, fmt.Errorf("upload url expiry %s should be positive and at most the upload session ttl and %s", cfg.UploadURLExpiry, maxUploadURLExpiry)
+	}
 	return &cfg, nil
 }
+
+// Generate a key for signing when none is configured
+func randomSecret() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// Clean up the configured formats and check there is a decoder for each
+func parseImageFormats(formats []string) ([]string, error) {
+	var parsed []string
+	for _, format := range formats {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		supported := false
+		for _, name := range supportedImageFormats {
+			if format == name {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return nil, fmt.Errorf("image format %q is not one of %s", format, strings.Join(supportedImageFormats, ", "))
+		}
+		parsed = append(parsed, format)
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("no image format is allowed")
+	}
+	return parsed, nil
+}
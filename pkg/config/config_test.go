@@ -1,7 +1,9 @@
 package config
 
 import (
+	"image/color"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -15,20 +17,64 @@ func TestNewConfig(t *testing.T) {
 		{
 			Name: "Test Default Config",
 			Expected: &Config{
-				Addr:                 defaultAddr,
-				ServerReadTimeout:    defaultServerReadTimeout,
-				ServerWriteTimeout:   defaultServerWriteTimeout,
-				ServerIdleTimeout:    defaultServerIdleTimeout,
-				DBUserID:             defaultDBUserID,
-				DBPassword:           defaultDBPassword,
-				DBHostName:           defaultDBHostName,
-				DBPort:               defaultDBPort,
-				DBDatabaseName:       defaultDBDatabaseName,
-				DBMaxIdleConnections: defaultDBMaxIdleConnections,
-				DBMaxOpenConnections: defaultDBMaxOpenConnections,
-				DBMaxConnLifetime:    defaultDBMaxConnLifeTime,
-				HostImageDirectory:   defaultHostImageDirectory,
-				LocalImageDirectory:  defaultLocalImageDirectory,
+				Addr:                     defaultAddr,
+				ServerReadTimeout:        defaultServerReadTimeout,
+				ServerWriteTimeout:       defaultServerWriteTimeout,
+				ServerIdleTimeout:        defaultServerIdleTimeout,
+				DBUserID:                 defaultDBUserID,
+				DBPassword:               defaultDBPassword,
+				DBHostName:               defaultDBHostName,
+				DBPort:                   defaultDBPort,
+				DBDatabaseName:           defaultDBDatabaseName,
+				DBMaxIdleConnections:     defaultDBMaxIdleConnections,
+				DBMaxOpenConnections:     defaultDBMaxOpenConnections,
+				DBMaxConnLifetime:        defaultDBMaxConnLifeTime,
+				HostImageDirectory:       defaultHostImageDirectory,
+				LocalImageDirectory:      defaultLocalImageDirectory,
+				CursorSecret:             defaultCursorSecret,
+				DefaultPageSize:          defaultPageSize,
+				MaxPageSize:              defaultMaxPageSize,
+				FeedCommentsPerPost:      defaultFeedCommentsPerPost,
+				PublicBaseURL:            defaultPublicBaseURL,
+				ImageCacheMaxAge:         defaultImageCacheMaxAge,
+				FileSystemType:           defaultFileSystemType,
+				S3Region:                 defaultS3Region,
+				ConversionWorkers:        defaultConversionWorkers,
+				ConversionQueueSize:      defaultConversionQueueSize,
+				ShutdownTimeout:          defaultShutdownTimeout,
+				ConversionMaxAttempts:    defaultConversionMaxAttempts,
+				ConversionRetryBaseDelay: defaultConversionRetryBaseDelay,
+				ConversionRetryMaxDelay:  defaultConversionRetryMaxDelay,
+				ConversionLeaseDuration:  defaultConversionLeaseDuration,
+				AdminToken:               defaultAdminToken,
+				ConversionPollInterval:   defaultConversionPollInterval,
+				ConversionMaxDecodes:     defaultConversionMaxDecodes,
+				Renditions: Renditions{
+					{Name: "thumb", Width: 150, Height: 150, Mode: RESIZE_FILL, Crop: CROP_ENTROPY, Quality: 70},
+					{Name: "feed", Width: 600, Height: 600, Mode: RESIZE_FIT, Quality: 80, Progressive: true, MaxBytes: 150 << 10},
+					{Name: "large", Width: 1080, Height: 1080, Mode: RESIZE_FIT, Quality: 85},
+				},
+				DefaultRendition:         defaultRendition,
+				ImageMaxWidth:            defaultImageMaxWidth,
+				ImageMaxHeight:           defaultImageMaxHeight,
+				ImageMaxMegapixels:       defaultImageMaxMegapixels,
+				ConversionDecodeMemoryMB: defaultConversionDecodeMemoryMB,
+				ImageFormats:             []string{"jpeg", "png", "bmp", "gif", "webp", "tiff"},
+				GifPosterFrame:           defaultGifPosterFrame,
+				DerivativeSizes:          defaultDerivativeSizes,
+				DerivativeQualities:      defaultDerivativeQualities,
+				DerivativeCacheMB:        defaultDerivativeCacheMB,
+				SimilarMaxDistance:       defaultSimilarMaxDistance,
+				DuplicatePolicy:          DUPLICATE_POLICY_OFF,
+				DuplicateMaxDistance:     defaultDuplicateMaxDistance,
+				BlocklistMaxDistance:     defaultBlocklistMaxDistance,
+				BlocklistCheckUploads:    defaultBlocklistCheckUploads,
+				UploadMaxBytes:           defaultUploadMaxBytes,
+				UploadSessionTTL:         defaultUploadSessionTTL,
+				UploadCleanupInterval:    defaultUploadCleanupInterval,
+				UploadClaimTimeout:       defaultUploadClaimTimeout,
+				UploadURLExpiry:          defaultUploadURLExpiry,
+				UploadSigningSecret:      defaultUploadSigningSecret,
 			},
 		},
 	}
@@ -36,6 +82,219 @@ func TestNewConfig(t *testing.T) {
 	for _, test := range tests {
 		config, err := New()
 		assert.Equal(t, test.ExpectedError, err, test.Name)
+		// Random secrets are generated when none are set
+		assert.NotEmpty(t, config.CursorSecret, test.Name)
+		config.CursorSecret = defaultCursorSecret
+		assert.NotEmpty(t, config.UploadSigningSecret, test.Name)
+		config.UploadSigningSecret = defaultUploadSigningSecret
 		assert.Equal(t, test.Expected, config, test.Name)
 	}
 }
+
+func TestNewConfigPaginationFromEnv(t *testing.T) {
+	t.Setenv("CURSOR_SECRET", "cursor secret")
+	t.Setenv("DEFAULT_PAGE_SIZE", "20")
+	t.Setenv("MAX_PAGE_SIZE", "20")
+	config, err := New()
+	assert.Nil(t, err)
+	assert.Equal(t, "cursor secret", config.CursorSecret)
+	assert.Equal(t, 20, config.DefaultPageSize)
+
+	t.Setenv("DEFAULT_PAGE_SIZE", "21")
+	_, err = New()
+	assert.NotNil(t, err)
+
+	t.Setenv("DEFAULT_PAGE_SIZE", "0")
+	_, err = New()
+	assert.NotNil(t, err)
+}
+
+func TestNewConfigRenditionsFromEnv(t *testing.T) {
+	t.Setenv("RENDITIONS", "small:100x50, big:2000x1000")
+	t.Setenv("DEFAULT_RENDITION", "big")
+	config, err := New()
+	assert.Nil(t, err)
+	assert.Equal(t, Renditions{
+		{Name: "small", Width: 100, Height: 50, Mode: RESIZE_FIT},
+		{Name: "big", Width: 2000, Height: 1000, Mode: RESIZE_FIT},
+	}, config.Renditions)
+
+	t.Setenv("DEFAULT_RENDITION", "feed")
+	_, err = New()
+	assert.NotNil(t, err)
+}
+
+func TestNewConfigImageFormatsFromEnv(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Input         string
+		Expected      []string
+		ExpectedError bool
+	}{
+		{Name: "Test formats are cleaned up", Input: "JPEG, png,,webp", Expected: []string{"jpeg", "png", "webp"}},
+		{Name: "Test unknown format", Input: "jpeg,jpg", ExpectedError: true},
+		{Name: "Test no format", Input: " , ", ExpectedError: true},
+	}
+	for _, test := range tests {
+		t.Setenv("IMAGE_FORMATS", test.Input)
+		config, err := New()
+		assert.Equal(t, test.ExpectedError, err != nil, test.Name)
+		if err == nil {
+			assert.Equal(t, test.Expected, config.ImageFormats, test.Name)
+		}
+	}
+}
+
+func TestNewConfigDerivativesFromEnv(t *testing.T) {
+	t.Setenv("DERIVATIVE_SIZES", "100,200")
+	t.Setenv("DERIVATIVE_QUALITIES", "60,80")
+	config, err := New()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{100, 200}, config.DerivativeSizes)
+	assert.Equal(t, []int{60, 80}, config.DerivativeQualities)
+
+	t.Setenv("DERIVATIVE_QUALITIES", "60,101")
+	_, err = New()
+	assert.NotNil(t, err)
+
+	t.Setenv("DERIVATIVE_QUALITIES", "60")
+	t.Setenv("DERIVATIVE_SIZES", "100,0")
+	_, err = New()
+	assert.NotNil(t, err)
+}
+
+func TestNewConfigDuplicatePolicyFromEnv(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Policy        string
+		Distance      string
+		ExpectedError bool
+	}{
+		{Name: "Test reject", Policy: "reject", Distance: "3"},
+		{Name: "Test flag", Policy: "flag", Distance: "7"},
+		{Name: "Test unknown policy", Policy: "block", Distance: "3", ExpectedError: true},
+		{Name: "Test distance past the index", Policy: "flag", Distance: "8", ExpectedError: true},
+	}
+	for _, test := range tests {
+		t.Setenv("DUPLICATE_POLICY", test.Policy)
+		t.Setenv("DUPLICATE_MAX_DISTANCE", test.Distance)
+		config, err := New()
+		assert.Equal(t, test.ExpectedError, err != nil, test.Name)
+		if err == nil {
+			assert.Equal(t, test.Policy, config.DuplicatePolicy, test.Name)
+		}
+	}
+}
+
+func TestNewConfigBlocklistFromEnv(t *testing.T) {
+	t.Setenv("BLOCKLIST_MAX_DISTANCE", "2")
+	t.Setenv("BLOCKLIST_CHECK_UPLOADS", "false")
+	config, err := New()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, config.BlocklistMaxDistance)
+	assert.False(t, config.BlocklistCheckUploads)
+
+	t.Setenv("BLOCKLIST_MAX_DISTANCE", "8")
+	_, err = New()
+	assert.NotNil(t, err)
+}
+
+func TestNewConfigUploadsFromEnv(t *testing.T) {
+	t.Setenv("UPLOAD_MAX_BYTES", "1048576")
+	t.Setenv("UPLOAD_SESSION_TTL", "2h")
+	config, err := New()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1<<20), config.UploadMaxBytes)
+	assert.Equal(t, 2*time.Hour, config.UploadSessionTTL)
+
+	t.Setenv("UPLOAD_CLAIM_TIMEOUT", "5m")
+	config, err = New()
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Minute, config.UploadClaimTimeout)
+
+	t.Setenv("UPLOAD_URL_EXPIRY", "1h")
+	t.Setenv("UPLOAD_SIGNING_SECRET", "upload secret")
+	config, err = New()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, config.UploadURLExpiry)
+	assert.Equal(t, "upload secret", config.UploadSigningSecret)
+
+	t.Setenv("UPLOAD_URL_EXPIRY", "3h")
+	_, err = New()
+	assert.NotNil(t, err)
+	t.Setenv("UPLOAD_URL_EXPIRY", "1h")
+
+	t.Setenv("UPLOAD_CLAIM_TIMEOUT", "0s")
+	_, err = New()
+	assert.NotNil(t, err)
+	t.Setenv("UPLOAD_CLAIM_TIMEOUT", "5m")
+
+	t.Setenv("UPLOAD_MAX_BYTES", "0")
+	_, err = New()
+	assert.NotNil(t, err)
+}
+
+func TestRenditionsUnmarshalText(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Input         string
+		Expected      Renditions
+		ExpectedError bool
+	}{
+		{
+			Name:     "Test valid renditions",
+			Input:    "thumb:150x150,wide:1200x600",
+			Expected: Renditions{{Name: "thumb", Width: 150, Height: 150, Mode: RESIZE_FIT}, {Name: "wide", Width: 1200, Height: 600, Mode: RESIZE_FIT}},
+		},
+		{
+			Name:  "Test resize modes",
+			Input: "a:10x10:fill,b:10x10:fill:entropy,c:10x10:pad,d:10x10:pad:#102030",
+			Expected: Renditions{
+				{Name: "a", Width: 10, Height: 10, Mode: RESIZE_FILL, Crop: CROP_CENTER},
+				{Name: "b", Width: 10, Height: 10, Mode: RESIZE_FILL, Crop: CROP_ENTROPY},
+				{Name: "c", Width: 10, Height: 10, Mode: RESIZE_PAD, Background: color.RGBA{R: 255, G: 255, B: 255, A: 255}},
+				{Name: "d", Width: 10, Height: 10, Mode: RESIZE_PAD, Background: color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 255}},
+			},
+		},
+		{
+			Name:  "Test encoding settings",
+			Input: "a:10x10:q=60,b:10x10:fill:entropy:progressive:max=150kb,c:10x10:pad:102030:chroma=444:q=95,d:10x10:fit:max=2MB:chroma=420",
+			Expected: Renditions{
+				{Name: "a", Width: 10, Height: 10, Mode: RESIZE_FIT, Quality: 60},
+				{Name: "b", Width: 10, Height: 10, Mode: RESIZE_FILL, Crop: CROP_ENTROPY, Progressive: true, MaxBytes: 150 << 10},
+				{Name: "c", Width: 10, Height: 10, Mode: RESIZE_PAD, Background: color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 255}, Chroma: CHROMA_444, Quality: 95},
+				{Name: "d", Width: 10, Height: 10, Mode: RESIZE_FIT, MaxBytes: 2 << 20, Chroma: CHROMA_420},
+			},
+		},
+		{Name: "Test invalid quality", Input: "thumb:150x150:q=0", ExpectedError: true},
+		{Name: "Test invalid chroma", Input: "thumb:150x150:chroma=422", ExpectedError: true},
+		{Name: "Test invalid max", Input: "thumb:150x150:max=big", ExpectedError: true},
+		{Name: "Test unknown setting", Input: "thumb:150x150:speed=fast", ExpectedError: true},
+		{Name: "Test progressive 4:2:0", Input: "thumb:150x150:progressive:chroma=420", ExpectedError: true},
+		{Name: "Test setting before mode", Input: "thumb:150x150:q=80:fill", ExpectedError: true},
+		{Name: "Test unknown mode", Input: "thumb:150x150:stretch", ExpectedError: true},
+		{Name: "Test unknown crop", Input: "thumb:150x150:fill:top", ExpectedError: true},
+		{Name: "Test invalid background", Input: "thumb:150x150:pad:white", ExpectedError: true},
+		{Name: "Test option on fit", Input: "thumb:150x150:fit:center", ExpectedError: true},
+		{Name: "Test missing size", Input: "thumb", ExpectedError: true},
+		{Name: "Test missing name", Input: ":150x150", ExpectedError: true},
+		{Name: "Test invalid width", Input: "thumb:0x150", ExpectedError: true},
+		{Name: "Test invalid height", Input: "thumb:150xabc", ExpectedError: true},
+		{Name: "Test duplicate name", Input: "thumb:150x150,thumb:300x300", ExpectedError: true},
+		{Name: "Test empty list", Input: " , ", ExpectedError: true},
+	}
+	for _, test := range tests {
+		var renditions Renditions
+		err := renditions.UnmarshalText([]byte(test.Input))
+		assert.Equal(t, test.ExpectedError, err != nil, test.Name)
+		assert.Equal(t, test.Expected, renditions, test.Name)
+	}
+}
+
+func TestRenditionResizeMode(t *testing.T) {
+	var renditions Renditions
+	assert.Nil(t, renditions.UnmarshalText([]byte("a:10x10,b:10x10:fill:entropy,c:10x10:pad:#102030")))
+	assert.Equal(t, "fit", renditions[0].ResizeMode())
+	assert.Equal(t, "fill:entropy", renditions[1].ResizeMode())
+	assert.Equal(t, "pad:102030", renditions[2].ResizeMode())
+}
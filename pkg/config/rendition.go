@@ -0,0 +1,237 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// Resize modes of a rendition
+const (
+	RESIZE_FIT  = "fit"  // scale down to fit within the box, keeping the aspect ratio
+	RESIZE_FILL = "fill" // scale to cover the box and crop what overflows
+	RESIZE_PAD  = "pad"  // fit within the box and fill the rest with a background color
+)
+
+// Crops of the fill mode
+const (
+	CROP_CENTER  = "center"
+	CROP_ENTROPY = "entropy" // keep the most detailed part of the image
+)
+
+// Chroma subsampling of a rendition
+const (
+	CHROMA_420 = "4:2:0"
+	CHROMA_444 = "4:4:4"
+)
+
+// Rendition is a named size images are converted to
+type Rendition struct {
+	Name        string
+	Width       int
+	Height      int
+	Mode        string
+	Crop        string     // fill mode only
+	Background  color.RGBA // pad mode only
+	Quality     int        // JPEG quality from 1 to 100, 0 for the encoder's default
+	Progressive bool       // progressive JPEG, always 4:4:4
+	Chroma      string     // CHROMA_420 or CHROMA_444, empty for the encoder's default
+	MaxBytes    int64      // lower the quality until the JPEG fits, 0 for no budget
+}
+
+// Renditions is the list of renditions, written as comma separated
+// name:WIDTHxHEIGHT[:mode[:option]][:setting...] entries. The mode is fit (the
+// default), fill with an optional center (the default) or entropy crop, or pad with
+// an optional hex background color, white by default. The JPEG settings are q=QUALITY,
+// progressive, chroma=420 or chroma=444 and max=SIZE with a b, kb or mb unit.
+// e.g. "thumb:150x150:fill:entropy:q=70,feed:600x600:progressive:max=150kb"
+type Renditions []Rendition
+
+func (r *Renditions) UnmarshalText(text []byte) error {
+	var renditions Renditions
+	for _, entry := range strings.Split(string(text), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		rendition, err := parseRendition(entry)
+		if err != nil {
+			return err
+		}
+		if _, ok := renditions.Get(rendition.Name); ok {
+			return fmt.Errorf("rendition %s is listed twice", rendition.Name)
+		}
+		renditions = append(renditions, rendition)
+	}
+	if len(renditions) == 0 {
+		return fmt.Errorf("no renditions in %q", string(text))
+	}
+	*r = renditions
+	return nil
+}
+
+func parseRendition(entry string) (Rendition, error) {
+	// The JPEG settings follow the mode and option
+	parts := strings.Split(entry, ":")
+	settings := len(parts)
+	for settings > 2 && isEncodingSetting(parts[settings-1]) {
+		settings--
+	}
+	if settings > 4 || parts[0] == "" {
+		return Rendition{}, fmt.Errorf("rendition %q should look like name:WIDTHxHEIGHT[:mode[:option]][:setting...]", entry)
+	}
+	if len(parts) < 2 {
+		return Rendition{}, fmt.Errorf("rendition %q should look like name:WIDTHxHEIGHT[:mode[:option]][:setting...]", entry)
+	}
+	widthParam, heightParam, ok := strings.Cut(parts[1], "x")
+	if !ok {
+		return Rendition{}, fmt.Errorf("rendition %q should look like name:WIDTHxHEIGHT[:mode[:option]][:setting...]", entry)
+	}
+	width, err := strconv.Atoi(widthParam)
+	if err != nil || width <= 0 {
+		return Rendition{}, fmt.Errorf("rendition %q has an invalid width", entry)
+	}
+	height, err := strconv.Atoi(heightParam)
+	if err != nil || height <= 0 {
+		return Rendition{}, fmt.Errorf("rendition %q has an invalid height", entry)
+	}
+	rendition := Rendition{
+		Name:   parts[0],
+		Width:  width,
+		Height: height,
+		Mode:   RESIZE_FIT,
+	}
+	if settings > 2 {
+		rendition.Mode = parts[2]
+	}
+	option := ""
+	if settings > 3 {
+		option = parts[3]
+	}
+	for _, setting := range parts[settings:] {
+		if err := rendition.setEncoding(setting); err != nil {
+			return Rendition{}, fmt.Errorf("rendition %q: %w", entry, err)
+		}
+	}
+	if rendition.Progressive && rendition.Chroma == CHROMA_420 {
+		return Rendition{}, fmt.Errorf("rendition %q: progressive renditions are always 4:4:4", entry)
+	}
+
+	switch rendition.Mode {
+	case RESIZE_FIT:
+		if option != "" {
+			return Rendition{}, fmt.Errorf("rendition %q: fit takes no option", entry)
+		}
+	case RESIZE_FILL:
+		rendition.Crop = CROP_CENTER
+		if option != "" {
+			rendition.Crop = option
+		}
+		if rendition.Crop != CROP_CENTER && rendition.Crop != CROP_ENTROPY {
+			return Rendition{}, fmt.Errorf("rendition %q: crop should be center or entropy", entry)
+		}
+	case RESIZE_PAD:
+		rendition.Background = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+		if option != "" {
+			background, err := parseColor(option)
+			if err != nil {
+				return Rendition{}, fmt.Errorf("rendition %q: %w", entry, err)
+			}
+			rendition.Background = background
+		}
+	default:
+		return Rendition{}, fmt.Errorf("rendition %q: mode should be fit, fill or pad", entry)
+	}
+	return rendition, nil
+}
+
+func isEncodingSetting(part string) bool {
+	return part == "progressive" || strings.Contains(part, "=")
+}
+
+// Apply a q=, chroma=, max= or progressive setting
+func (r *Rendition) setEncoding(setting string) error {
+	if setting == "progressive" {
+		r.Progressive = true
+		return nil
+	}
+	key, value, _ := strings.Cut(setting, "=")
+	switch key {
+	case "q":
+		quality, err := strconv.Atoi(value)
+		if err != nil || quality < 1 || quality > 100 {
+			return fmt.Errorf("quality %q should be between 1 and 100", value)
+		}
+		r.Quality = quality
+	case "chroma":
+		switch value {
+		case "420":
+			r.Chroma = CHROMA_420
+		case "444":
+			r.Chroma = CHROMA_444
+		default:
+			return fmt.Errorf("chroma %q should be 420 or 444", value)
+		}
+	case "max":
+		maxBytes, err := parseByteSize(value)
+		if err != nil {
+			return err
+		}
+		r.MaxBytes = maxBytes
+	default:
+		return fmt.Errorf("unknown setting %q", setting)
+	}
+	return nil
+}
+
+// Parse a size such as 150kb, 2mb or 90000b
+func parseByteSize(value string) (int64, error) {
+	lower := strings.ToLower(value)
+	unit := int64(1)
+	for _, suffix := range []struct {
+		name string
+		size int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"b", 1}} {
+		if strings.HasSuffix(lower, suffix.name) {
+			lower, unit = strings.TrimSuffix(lower, suffix.name), suffix.size
+			break
+		}
+	}
+	size, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("max %q should be a size such as 150kb", value)
+	}
+	return size * unit, nil
+}
+
+// Parse a RRGGBB hex color, a leading # is optional
+func parseColor(value string) (color.RGBA, error) {
+	rgb, err := hex.DecodeString(strings.TrimPrefix(value, "#"))
+	if err != nil || len(rgb) != 3 {
+		return color.RGBA{}, fmt.Errorf("background %q should be a RRGGBB hex color", value)
+	}
+	return color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255}, nil
+}
+
+// ResizeMode describes how the rendition is resized, e.g. fit, fill:entropy or pad:ffffff
+func (r Rendition) ResizeMode() string {
+	switch r.Mode {
+	case RESIZE_FILL:
+		return r.Mode + ":" + r.Crop
+	case RESIZE_PAD:
+		return r.Mode + ":" + hex.EncodeToString([]byte{r.Background.R, r.Background.G, r.Background.B})
+	}
+	return r.Mode
+}
+
+// Get a rendition by name
+func (r Renditions) Get(name string) (Rendition, bool) {
+	for _, rendition := range r {
+		if rendition.Name == name {
+			return rendition, true
+		}
+	}
+	return Rendition{}, false
+}
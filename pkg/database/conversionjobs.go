@@ -0,0 +1,287 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/pagination"
+)
+
+const conversionJobColumns = "`job_id`, " +
+	"`image_id`, " +
+	"`status`, " +
+	"`attempts`, " +
+	"IFNULL(`last_error`, ''), " +
+	"`next_attempt_at`, " +
+	"IFNULL(`lease_owner`, ''), " +
+	"`lease_expires_at`, " +
+	"`created_at`, " +
+	"`updated_at` "
+
+// Queue images that miss one of the named renditions, their placeholder or their
+// perceptual hash, e.g. images uploaded before jobs existed or before a rendition was
+// added. Images without a job get one and done jobs are made pending again, jobs
+// already pending, running or dead are kept. Quarantined images are left out.
+func (d *database) EnqueueImagesMissingRenditions(names []string) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+	args := make([]interface{}, 0, len(names)+3)
+	for _, name := range names {
+		args = append(args, name)
+	}
+	args = append(args, len(names), tables.CONVERSION_JOB_DONE, tables.CONVERSION_JOB_DONE, tables.CONVERSION_JOB_DONE, tables.CONVERSION_JOB_PENDING)
+	// status is assigned last as the other assignments read its old value
+	insertQuery := "INSERT INTO `conversion_jobs` (`image_id`) " +
+		"SELECT i.`image_id` FROM `images` i " +
+		"WHERE ((SELECT COUNT(*) FROM `image_renditions` r " +
+		"WHERE r.`image_id` = i.`image_id` AND r.`name` IN (" + placeholders + ")) < ? " +
+		"OR i.`blurhash` IS NULL OR i.`perceptual_hash` IS NULL) " +
+		"AND i.`quarantined_at` IS NULL " +
+		"ON DUPLICATE KEY UPDATE " +
+		"`attempts` = IF(`status` = ?, 0, `attempts`), " +
+		"`next_attempt_at` = IF(`status` = ?, NOW(), `next_attempt_at`), " +
+		"`status` = IF(`status` = ?, ?, `status`)"
+	_, err := d.Db.Exec(insertQuery, args...)
+	return err
+}
+
+// Lease up to limit due jobs to owner. Pending jobs whose next attempt is due and
+// running jobs whose lease ran out are claimed, rows locked by other workers are
+// skipped so workers never wait on each other. Running jobs whose lease ran out after
+// maxAttempts are dead instead, their worker likely crashed on the image, and are
+// left out of the jobs returned.
+func (d *database) ClaimConversionJobs(owner string, limit int, lease time.Duration, maxAttempts int) ([]tables.ConversionJobTable, error) {
+	return d.claimConversionJobs("", nil, owner, limit, lease, maxAttempts)
+}
+
+// Lease the job of a post's image to owner like ClaimConversionJobs, so the post is
+// converted right after its upload. sql.ErrNoRows is returned when the job isn't due
+// or another worker has it.
+func (d *database) ClaimPostConversionJob(owner string, postId int64, lease time.Duration, maxAttempts int) (tables.ConversionJobTable, error) {
+	filter := "AND `image_id` IN (SELECT `image_id` FROM `images` WHERE `post_id` = ?) "
+	jobs, err := d.claimConversionJobs(filter, []interface{}{postId}, owner, 1, lease, maxAttempts)
+	if err != nil {
+		return tables.ConversionJobTable{}, err
+	}
+	if len(jobs) == 0 {
+		return tables.ConversionJobTable{}, sql.ErrNoRows
+	}
+	return jobs[0], nil
+}
+
+// Claim due jobs matching filter, a condition on the job's columns
+func (d *database) claimConversionJobs(filter string, filterArgs []interface{}, owner string, limit int, lease time.Duration, maxAttempts int) ([]tables.ConversionJobTable, error) {
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
+
+	selectQuery := "SELECT " + conversionJobColumns +
+		"FROM `conversion_jobs` " +
+		"WHERE ((`status` = ? AND `next_attempt_at` <= NOW()) " +
+		"OR (`status` = ? AND `lease_expires_at` <= NOW())) " + filter +
+		"ORDER BY `next_attempt_at`, `job_id` " +
+		"LIMIT ? FOR UPDATE SKIP LOCKED"
+	selectArgs := []interface{}{tables.CONVERSION_JOB_PENDING, tables.CONVERSION_JOB_RUNNING}
+	selectArgs = append(selectArgs, filterArgs...)
+	rows, err := tx.Query(selectQuery, append(selectArgs, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := scanConversionJobs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the rows locked above are marked dead, so no worker waits on another
+	var jobs []tables.ConversionJobTable
+	var deadIds []interface{}
+	for _, job := range locked {
+		if job.Status == tables.CONVERSION_JOB_RUNNING && job.Attempts >= maxAttempts {
+			deadIds = append(deadIds, job.JobId)
+		} else {
+			jobs = append(jobs, job)
+		}
+	}
+	if len(deadIds) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(deadIds)), ", ")
+		deadQuery := "UPDATE `conversion_jobs` SET " +
+			"`status` = ?, " +
+			"`last_error` = CONCAT('lease expired after ', `attempts`, ' attempts, the worker stopped while converting'), " +
+			"`lease_owner` = NULL, " +
+			"`lease_expires_at` = NULL " +
+			"WHERE `job_id` IN (" + placeholders + ")"
+		if _, err = tx.Exec(deadQuery, append([]interface{}{tables.CONVERSION_JOB_DEAD}, deadIds...)...); err != nil {
+			return nil, err
+		}
+	}
+	if len(jobs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(jobs)), ", ")
+		args := []interface{}{tables.CONVERSION_JOB_RUNNING, owner, int64(lease.Seconds())}
+		for _, job := range jobs {
+			args = append(args, job.JobId)
+		}
+		updateQuery := "UPDATE `conversion_jobs` SET " +
+			"`status` = ?, " +
+			"`attempts` = `attempts` + 1, " +
+			"`lease_owner` = ?, " +
+			"`lease_expires_at` = DATE_ADD(NOW(), INTERVAL ? SECOND) " +
+			"WHERE `job_id` IN (" + placeholders + ")"
+		if _, err = tx.Exec(updateQuery, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for i := range jobs {
+		jobs[i].Status = tables.CONVERSION_JOB_RUNNING
+		jobs[i].Attempts++
+		jobs[i].LeaseOwner = owner
+	}
+	return jobs, nil
+}
+
+// Mark a leased job as done
+func (d *database) CompleteConversionJob(job tables.ConversionJobTable) error {
+	updateQuery := "UPDATE `conversion_jobs` SET " +
+		"`status` = ?, " +
+		"`last_error` = NULL, " +
+		"`lease_owner` = NULL, " +
+		"`lease_expires_at` = NULL " +
+		"WHERE `job_id` = ? AND `status` = ? AND `lease_owner` = ?"
+	result, err := d.Db.Exec(updateQuery, tables.CONVERSION_JOB_DONE, job.JobId, tables.CONVERSION_JOB_RUNNING, job.LeaseOwner)
+	if err != nil {
+		return err
+	}
+	return checkLease(result)
+}
+
+// Release a leased job after a failed attempt. The job moves to job.Status, pending
+// jobs become due again after retryAfter.
+func (d *database) FailConversionJob(job tables.ConversionJobTable, retryAfter time.Duration) error {
+	updateQuery := "UPDATE `conversion_jobs` SET " +
+		"`status` = ?, " +
+		"`last_error` = ?, " +
+		"`next_attempt_at` = DATE_ADD(NOW(), INTERVAL ? SECOND), " +
+		"`lease_owner` = NULL, " +
+		"`lease_expires_at` = NULL " +
+		"WHERE `job_id` = ? AND `status` = ? AND `lease_owner` = ?"
+	result, err := d.Db.Exec(updateQuery,
+		job.Status,
+		job.LastError,
+		int64(retryAfter.Seconds()),
+		job.JobId,
+		tables.CONVERSION_JOB_RUNNING,
+		job.LeaseOwner,
+	)
+	if err != nil {
+		return err
+	}
+	return checkLease(result)
+}
+
+func checkLease(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("conversion job is no longer leased by this worker")
+	}
+	return nil
+}
+
+// Get jobs with the given status newest first. The cursor's id is the job id, a PREV
+// cursor returns the newer jobs before it in ascending order.
+func (d *database) GetConversionJobs(status string, cursor *pagination.Cursor, limit int) ([]tables.ConversionJobTable, error) {
+	query := "SELECT " + conversionJobColumns +
+		"FROM `conversion_jobs` WHERE `status` = ? "
+	args := []interface{}{status}
+	order := "ORDER BY `job_id` DESC "
+	if cursor.IsPrev() {
+		query += "AND `job_id` > ? "
+		args = append(args, cursor.Id)
+		order = "ORDER BY `job_id` ASC "
+	} else if cursor != nil {
+		query += "AND `job_id` < ? "
+		args = append(args, cursor.Id)
+	}
+	query += order + "LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := d.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanConversionJobs(rows)
+}
+
+// Move a dead or rejected job back to pending with a fresh attempt budget. Returns
+// sql.ErrNoRows when there is no dead or rejected job with the id.
+func (d *database) RequeueConversionJob(jobId int64) error {
+	updateQuery := "UPDATE `conversion_jobs` SET " +
+		"`status` = ?, " +
+		"`attempts` = 0, " +
+		"`next_attempt_at` = NOW() " +
+		"WHERE `job_id` = ? AND `status` IN (?, ?)"
+	result, err := d.Db.Exec(updateQuery, tables.CONVERSION_JOB_PENDING, jobId, tables.CONVERSION_JOB_DEAD, tables.CONVERSION_JOB_REJECTED)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Move every dead job back to pending. Returns the number of jobs requeued.
+func (d *database) RequeueDeadConversionJobs() (int64, error) {
+	updateQuery := "UPDATE `conversion_jobs` SET " +
+		"`status` = ?, " +
+		"`attempts` = 0, " +
+		"`next_attempt_at` = NOW() " +
+		"WHERE `status` = ?"
+	result, err := d.Db.Exec(updateQuery, tables.CONVERSION_JOB_PENDING, tables.CONVERSION_JOB_DEAD)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func scanConversionJobs(rows *sql.Rows) ([]tables.ConversionJobTable, error) {
+	defer rows.Close()
+
+	var jobs []tables.ConversionJobTable
+	for rows.Next() {
+		var job tables.ConversionJobTable
+		err := rows.Scan(
+			&job.JobId,
+			&job.ImageId,
+			&job.Status,
+			&job.Attempts,
+			&job.LastError,
+			&job.NextAttemptAt,
+			&job.LeaseOwner,
+			&job.LeaseExpiresAt,
+			&job.CreatedAt,
+			&job.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
@@ -3,19 +3,63 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
-	"github.com/ksindhwani/imagegram/pkg/internal/converter"
 	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/pagination"
 )
 
 type Database interface {
 	InsertNewPost(postTableRow tables.PostTable, imageTableRow tables.ImageTable) (int64, error)
 	SaveComment(comment tables.CommentTable) (int64, error)
 	DeleteComment(commentId int64) error
-	GetAllPostWithLast2Comments(cursor int, pageSize int) ([]AllPostsJoinQueryResult, error)
-	GetAllImages() ([]tables.ImageTable, error)
-	UpdateImageConvertedData(image converter.ImageConversionResponse) error
+	GetPosts(cursor *pagination.Cursor, limit int) ([]PostQueryResult, error)
+	GetLastCommentsForPosts(postIds []int64, commentsPerPost int) ([]tables.CommentTable, error)
+	GetCommentsForPost(postId int64, cursor *pagination.Cursor, limit int) ([]tables.CommentTable, error)
+	GetImage(imageId int64) (tables.ImageTable, error)
+	GetImageForPost(postId int64) (tables.ImageTable, error)
+	GetImageByContentHash(contentHash string) (tables.ImageTable, error)
+	GetImageByStorageKey(storageKey string) (tables.ImageTable, error)
+	SaveImagePlaceholder(image tables.ImageTable) error
+	SaveImageHash(imageId int64, hash uint64) error
+	GetSimilarImages(hash uint64, maxDistance int, limit int) ([]SimilarImageResult, error)
+	SaveImageRenditions(renditions []tables.ImageRenditionTable) error
+	GetImageRenditions(imageId int64) ([]tables.ImageRenditionTable, error)
+	GetImageRendition(imageId int64, name string) (tables.ImageRenditionTable, error)
+	SaveImageMetadata(metadata tables.ImageMetadataTable) error
+	EnqueueImagesMissingRenditions(names []string) error
+	ClaimConversionJobs(owner string, limit int, lease time.Duration, maxAttempts int) ([]tables.ConversionJobTable, error)
+	ClaimPostConversionJob(owner string, postId int64, lease time.Duration, maxAttempts int) (tables.ConversionJobTable, error)
+	CompleteConversionJob(job tables.ConversionJobTable) error
+	FailConversionJob(job tables.ConversionJobTable, retryAfter time.Duration) error
+	GetConversionJobs(status string, cursor *pagination.Cursor, limit int) ([]tables.ConversionJobTable, error)
+	RequeueConversionJob(jobId int64) error
+	RequeueDeadConversionJobs() (int64, error)
+	SaveBlockedHashes(hashes []tables.BlockedHashTable) ([]tables.BlockedHashTable, error)
+	DeleteBlockedHash(blockedHashId int64) error
+	GetBlockedHashes(cursor *pagination.Cursor, limit int) ([]tables.BlockedHashTable, error)
+	HasBlockedHashes() (bool, error)
+	GetBlockedHashMatch(hash uint64, maxDistance int) (tables.BlockedHashTable, int, error)
+	QuarantineImages(storageKey string, quarantineKey string, location string, event tables.ModerationEventTable) ([]tables.ImageTable, error)
+	SaveModerationEvent(event tables.ModerationEventTable) error
+	GetModerationEvents(cursor *pagination.Cursor, limit int) ([]tables.ModerationEventTable, error)
+	CreateUploadSession(session tables.UploadSessionTable, ttl time.Duration) error
+	GetUploadSession(uploadId string) (tables.UploadSessionTable, error)
+	SaveUploadPart(part tables.UploadPartTable, ttl time.Duration) error
+	GetUploadParts(uploadId string) ([]tables.UploadPartTable, error)
+	ClaimUploadSession(uploadId string, timeout time.Duration) error
+	ReleaseUploadSession(uploadId string) error
+	FinishUploadSession(uploadId string, postId int64) error
+	DeleteUploadSession(uploadId string) error
+	GetExpiredUploadSessions(limit int) ([]string, error)
+	CreateDirectUpload(upload tables.DirectUploadTable, ttl time.Duration) error
+	GetDirectUpload(uploadId string) (tables.DirectUploadTable, error)
+	ClaimDirectUpload(uploadId string, timeout time.Duration) error
+	ReleaseDirectUpload(uploadId string) error
+	FinishDirectUpload(uploadId string, postId int64) error
+	DeleteDirectUpload(uploadId string) error
+	GetExpiredDirectUploads(limit int) ([]string, error)
 }
 
 type database struct {
@@ -28,17 +72,18 @@ func New(db *sql.DB) Database {
 	}
 }
 
-type AllPostsJoinQueryResult struct {
-	PostId            int64
-	UserId            int64
-	Caption           string
-	CreatedAt         time.Time
-	PostImageName     string
-	PostImageLocation string
-	CommentId         int64
-	CommentUserId     int64
-	Comment           string
-	CommentCreatedAt  time.Time
+type PostQueryResult struct {
+	PostId        int64
+	UserId        int64
+	Caption       string
+	CommentCount  int64
+	CreatedAt     time.Time
+	ImageId       int64
+	PostImageName string
+	ImageWidth    int // 0 and empty placeholder until the image is converted
+	ImageHeight   int
+	BlurHash      string
+	DominantColor string
 }
 
 // Insert New Post and image in database
@@ -70,14 +115,32 @@ func (d *database) InsertNewPost(postTableRow tables.PostTable, imageTableRow ta
 	// Insert Image
 	imageTableRow.PostId = postId
 
-	insertImageQuery := "INSERT INTO `images` (`post_id`, image_file_name, location) VALUES (?, ?, ?)"
+	insertImageQuery := "INSERT INTO `images` (`post_id`, image_file_name, storage_key, content_hash, location, duplicate_of) " +
+		"VALUES (?, ?, ?, ?, ?, NULLIF(?, 0))"
 	stmt, err = tx.Prepare(insertImageQuery)
 	if err != nil {
 		return 0, err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(imageTableRow.PostId, imageTableRow.ImageFileName, imageTableRow.Location)
+	result, err = stmt.Exec(
+		imageTableRow.PostId,
+		imageTableRow.ImageFileName,
+		imageTableRow.StorageKey,
+		imageTableRow.ContentHash,
+		imageTableRow.Location,
+		imageTableRow.DuplicateOf,
+	)
+	if err != nil {
+		return 0, err
+	}
+	imageId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// Queue the conversion of the image with the post so it can't get lost
+	_, err = tx.Exec("INSERT INTO `conversion_jobs` (`image_id`) VALUES (?)", imageId)
 	if err != nil {
 		return 0, err
 	}
@@ -90,10 +153,30 @@ func (d *database) InsertNewPost(postTableRow tables.PostTable, imageTableRow ta
 	return postId, nil
 }
 
-// Save new comment in database
+// Save new comment in database and increment the comment counter of its post
 func (d *database) SaveComment(comment tables.CommentTable) (int64, error) {
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
+
+	// Bump the counter first so the post row is locked for the rest of the transaction
+	updateQuery := "UPDATE `posts` SET `comment_count` = `comment_count` + 1 WHERE `post_id` = ?"
+	result, err := tx.Exec(updateQuery, comment.PostId)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected == 0 {
+		return 0, errors.New("no post found with the given post id")
+	}
+
 	insertQuery := "INSERT INTO comments (post_id, user_id, comment) VALUES (?, ?, ?)"
-	result, err := d.Db.Exec(insertQuery, comment.PostId, comment.UserId, comment.Comment)
+	result, err = tx.Exec(insertQuery, comment.PostId, comment.UserId, comment.Comment)
 	if err != nil {
 		return 0, err
 	}
@@ -102,66 +185,99 @@ func (d *database) SaveComment(comment tables.CommentTable) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
 	return commentId, nil
 }
 
-// Delete Comment from database
+// Delete Comment from database and decrement the comment counter of its post
 func (d *database) DeleteComment(commentId int64) error {
-	deleteQuery := "DELETE FROM comments where comment_id = ?"
-	result, err := d.Db.Exec(deleteQuery, commentId)
+	tx, err := d.Db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
 
-	// Check the number of rows affected by the delete operation
-	rowsAffected, err := result.RowsAffected()
-	if rowsAffected == 0 {
+	var postId int64
+	selectQuery := "SELECT post_id FROM comments WHERE comment_id = ? FOR UPDATE"
+	err = tx.QueryRow(selectQuery, commentId).Scan(&postId)
+	if err == sql.ErrNoRows {
 		return errors.New("no row found with the given comment id")
 	}
-	return err
+	if err != nil {
+		return err
+	}
+
+	deleteQuery := "DELETE FROM comments where comment_id = ?"
+	if _, err := tx.Exec(deleteQuery, commentId); err != nil {
+		return err
+	}
 
+	updateQuery := "UPDATE `posts` SET `comment_count` = `comment_count` - 1 WHERE `post_id` = ? AND `comment_count` > 0"
+	if _, err := tx.Exec(updateQuery, postId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (d *database) GetAllPostWithLast2Comments(cursor int, limit int) ([]AllPostsJoinQueryResult, error) {
-	// Sql Query to get all posts with last 2 comments
+// Get a page of posts ordered by comment count (desc). The cursor's sort key is the
+// comment count and its id the post id. A nil cursor returns the first page, a PREV
+// cursor returns the posts before it in ascending order. The count a cursor holds is
+// the one when its page was read, a post whose count changed since may be listed
+// again or skipped on the pages that follow.
+func (d *database) GetPosts(cursor *pagination.Cursor, limit int) ([]PostQueryResult, error) {
 	query := "SELECT " +
-		"p.post_id, p.user_id, p.caption, p.created_at, " +
-		"IFNULL(i.converted_image_name, ''), IFNULL(i.converted_image_location, ''), " +
-		"c.comment_id, c.user_id,c.comment,c.created_at " +
+		"p.post_id, p.user_id, IFNULL(p.caption, ''), p.comment_count, p.created_at, " +
+		"i.image_id, IFNULL(i.image_file_name, ''), " +
+		"IFNULL(i.width, 0), IFNULL(i.height, 0), IFNULL(i.blurhash, ''), IFNULL(i.dominant_color, '') " +
 		"FROM posts p " +
-		"LEFT JOIN ( " +
-		"SELECT comment_id, post_id,user_id, comment, created_at, " +
-		"ROW_NUMBER() OVER (PARTITION BY post_id ORDER BY comment_id DESC) AS rn FROM comments" +
-		") c ON p.post_id = c.post_id " +
 		"INNER JOIN images i on p.post_id = i.post_id " +
-		"WHERE (c.rn <= 2 OR c.comment_id IS NULL) AND p.post_id > ? " +
-		"ORDER BY p.post_id, c.comment_id DESC " +
-		"LIMIT ?"
+		// Posts whose image matched the blocklist are hidden
+		"WHERE i.quarantined_at IS NULL "
+	args := []interface{}{}
+	order := "ORDER BY p.comment_count DESC, p.post_id DESC "
+	if cursor.IsPrev() {
+		query += "AND (p.comment_count > ? OR (p.comment_count = ? AND p.post_id > ?)) "
+		args = append(args, cursor.SortKey, cursor.SortKey, cursor.Id)
+		order = "ORDER BY p.comment_count ASC, p.post_id ASC "
+	} else if cursor != nil {
+		// Keyset condition on (comment_count, post_id), pages don't overlap as long as
+		// the counts don't change
+		query += "AND (p.comment_count < ? OR (p.comment_count = ? AND p.post_id < ?)) "
+		args = append(args, cursor.SortKey, cursor.SortKey, cursor.Id)
+	}
+	query += order + "LIMIT ?"
+	args = append(args, limit)
 
 	// Execute the query
-	rows, err := d.Db.Query(query, cursor, limit)
+	rows, err := d.Db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	// Create a slice to store the results
-	var results []AllPostsJoinQueryResult
+	var results []PostQueryResult
 
 	// Iterate over the rows and map the results to the struct
 	for rows.Next() {
-		var result AllPostsJoinQueryResult
+		var result PostQueryResult
 		err := rows.Scan(
 			&result.PostId,
 			&result.UserId,
 			&result.Caption,
+			&result.CommentCount,
 			&result.CreatedAt,
+			&result.ImageId,
 			&result.PostImageName,
-			&result.PostImageLocation,
-			&result.CommentId,
-			&result.CommentUserId,
-			&result.Comment,
-			&result.CommentCreatedAt,
+			&result.ImageWidth,
+			&result.ImageHeight,
+			&result.BlurHash,
+			&result.DominantColor,
 		)
 		if err != nil {
 			return nil, err
@@ -175,60 +291,161 @@ func (d *database) GetAllPostWithLast2Comments(cursor int, limit int) ([]AllPost
 	return results, nil
 }
 
-func (d *database) GetAllImages() ([]tables.ImageTable, error) {
-	var images []tables.ImageTable
-	selectQuery := "SELECT " +
-		"`image_id`, " +
-		"`post_id`, " +
-		"`image_file_name`, " +
-		"`location`, " +
-		"IFNULL(`converted_image_name`, ''), " +
-		"IFNULL(`converted_image_location`, ''), " +
-		"`uploaded_at` " +
-		"FROM `images` " +
-		"WHERE `converted_image_name` is NULL"
-	// Execute the query
-	rows, err := d.Db.Query(selectQuery)
+// Get the last commentsPerPost comments of each of the given posts, ordered by post
+// and then newest comment first.
+func (d *database) GetLastCommentsForPosts(postIds []int64, commentsPerPost int) ([]tables.CommentTable, error) {
+	if len(postIds) == 0 || commentsPerPost <= 0 {
+		return nil, nil
+	}
+	placeholders := strings.Repeat("?, ", len(postIds)-1) + "?"
+	query := "SELECT comment_id, post_id, user_id, comment, created_at FROM ( " +
+		"SELECT comment_id, post_id, user_id, IFNULL(comment, '') AS comment, created_at, " +
+		"ROW_NUMBER() OVER (PARTITION BY post_id ORDER BY comment_id DESC) AS rn " +
+		"FROM comments WHERE post_id IN (" + placeholders + ")" +
+		") c WHERE c.rn <= ? " +
+		"ORDER BY c.post_id, c.comment_id DESC"
+	args := make([]interface{}, 0, len(postIds)+1)
+	for _, postId := range postIds {
+		args = append(args, postId)
+	}
+	args = append(args, commentsPerPost)
+
+	rows, err := d.Db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	// Iterate over the rows and map the results to the struct
+	var comments []tables.CommentTable
 	for rows.Next() {
-		var image tables.ImageTable
+		var comment tables.CommentTable
 		err := rows.Scan(
-			&image.ImageId,
-			&image.PostId,
-			&image.ImageFileName,
-			&image.Location,
-			&image.ConvertedImageName,
-			&image.ConvertedImageLocation,
-			&image.UploadedAt,
+			&comment.CommentId,
+			&comment.PostId,
+			&comment.UserId,
+			&comment.Comment,
+			&comment.CreatedAt,
 		)
 		if err != nil {
 			return nil, err
 		}
-		images = append(images, image)
+		comments = append(comments, comment)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return images, nil
+	return comments, nil
 }
 
-func (d *database) UpdateImageConvertedData(image converter.ImageConversionResponse) error {
-	updateQuery := "UPDATE `images` SET `converted_image_name` = ?, converted_image_location = ? WHERE `image_id` = ?"
-	result, err := d.Db.Exec(updateQuery, image.ConvertedImageName, image.ConvertedImageLocation, image.ImageId)
+// Get comments of a post newest first. The cursor's id is the comment id, a PREV
+// cursor returns the newer comments before it in ascending order.
+func (d *database) GetCommentsForPost(postId int64, cursor *pagination.Cursor, limit int) ([]tables.CommentTable, error) {
+	query := "SELECT comment_id, post_id, user_id, IFNULL(comment, ''), created_at " +
+		"FROM comments WHERE post_id = ? "
+	args := []interface{}{postId}
+	order := "ORDER BY comment_id DESC "
+	if cursor.IsPrev() {
+		query += "AND comment_id > ? "
+		args = append(args, cursor.Id)
+		order = "ORDER BY comment_id ASC "
+	} else if cursor != nil {
+		query += "AND comment_id < ? "
+		args = append(args, cursor.Id)
+	}
+	query += order + "LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := d.Db.Query(query, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Check the number of rows affected by the delete operation
-	rowsAffected, err := result.RowsAffected()
-	if rowsAffected == 0 {
-		return errors.New("no row updated with the given image id")
+	var comments []tables.CommentTable
+	for rows.Next() {
+		var comment tables.CommentTable
+		err := rows.Scan(
+			&comment.CommentId,
+			&comment.PostId,
+			&comment.UserId,
+			&comment.Comment,
+			&comment.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
 	}
-	return err
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// Get an image by its id, sql.ErrNoRows is returned when it does not exist
+func (d *database) GetImage(imageId int64) (tables.ImageTable, error) {
+	return d.getImage("`image_id` = ?", imageId)
+}
+
+// Get the image of a post, sql.ErrNoRows is returned when it does not exist
+func (d *database) GetImageForPost(postId int64) (tables.ImageTable, error) {
+	return d.getImage("`post_id` = ?", postId)
+}
 
+// Get the oldest image stored with the given content hash, sql.ErrNoRows is returned
+// when these bytes were never uploaded. Quarantined images are left out, their
+// original is no longer where new posts could share it.
+func (d *database) GetImageByContentHash(contentHash string) (tables.ImageTable, error) {
+	return d.getImage("`content_hash` = ? AND `quarantined_at` IS NULL ORDER BY `image_id` LIMIT 1", contentHash)
+}
+
+// Get an image whose original is stored under storageKey, sql.ErrNoRows is returned
+// when no image points to it
+func (d *database) GetImageByStorageKey(storageKey string) (tables.ImageTable, error) {
+	return d.getImage("`storage_key` = ? ORDER BY `image_id` LIMIT 1", storageKey)
+}
+
+func (d *database) getImage(condition string, arg interface{}) (tables.ImageTable, error) {
+	var image tables.ImageTable
+	selectQuery := "SELECT " +
+		"`image_id`, " +
+		"`post_id`, " +
+		"`image_file_name`, " +
+		"`storage_key`, " +
+		"`content_hash`, " +
+		"`location`, " +
+		"IFNULL(`width`, 0), " +
+		"IFNULL(`height`, 0), " +
+		"IFNULL(`blurhash`, ''), " +
+		"IFNULL(`dominant_color`, ''), " +
+		"`perceptual_hash`, " +
+		"IFNULL(`duplicate_of`, 0), " +
+		"`quarantined_at`, " +
+		"`uploaded_at` " +
+		"FROM `images` " +
+		"WHERE " + condition
+	err := d.Db.QueryRow(selectQuery, arg).Scan(
+		&image.ImageId,
+		&image.PostId,
+		&image.ImageFileName,
+		&image.StorageKey,
+		&image.ContentHash,
+		&image.Location,
+		&image.Width,
+		&image.Height,
+		&image.BlurHash,
+		&image.DominantColor,
+		&image.PerceptualHash,
+		&image.DuplicateOf,
+		&image.QuarantinedAt,
+		&image.UploadedAt,
+	)
+	return image, err
+}
+
+// Save the size and placeholder of a converted image
+func (d *database) SaveImagePlaceholder(image tables.ImageTable) error {
+	updateQuery := "UPDATE `images` SET `width` = ?, `height` = ?, `blurhash` = ?, `dominant_color` = ? WHERE `image_id` = ?"
+	_, err := d.Db.Exec(updateQuery, image.Width, image.Height, image.BlurHash, image.DominantColor, image.ImageId)
+	return err
 }
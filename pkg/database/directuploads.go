@@ -0,0 +1,105 @@
+package database
+
+import (
+	"time"
+
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+)
+
+const directUploadColumns = "`upload_id`, " +
+	"`user_id`, " +
+	"`file_name`, " +
+	"`content_type`, " +
+	"`upload_length`, " +
+	"IFNULL(`post_id`, 0), " +
+	"`claimed_at`, " +
+	"`expires_at`, " +
+	"`created_at` "
+
+// Create an upload sent straight to storage, expiring after ttl
+func (d *database) CreateDirectUpload(upload tables.DirectUploadTable, ttl time.Duration) error {
+	insertQuery := "INSERT INTO `direct_uploads` " +
+		"(`upload_id`, `user_id`, `file_name`, `content_type`, `upload_length`, `expires_at`) " +
+		"VALUES (?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))"
+	_, err := d.Db.Exec(insertQuery,
+		upload.UploadId,
+		upload.UserId,
+		upload.FileName,
+		upload.ContentType,
+		upload.Length,
+		int64(ttl.Seconds()),
+	)
+	return err
+}
+
+// Get an upload sent straight to storage, sql.ErrNoRows is returned when it doesn't
+// exist or expired
+func (d *database) GetDirectUpload(uploadId string) (tables.DirectUploadTable, error) {
+	query := "SELECT " + directUploadColumns + "FROM `direct_uploads` " +
+		"WHERE `upload_id` = ? AND `expires_at` > NOW()"
+	var upload tables.DirectUploadTable
+	err := d.Db.QueryRow(query, uploadId).Scan(
+		&upload.UploadId,
+		&upload.UserId,
+		&upload.FileName,
+		&upload.ContentType,
+		&upload.Length,
+		&upload.PostId,
+		&upload.ClaimedAt,
+		&upload.ExpiresAt,
+		&upload.CreatedAt,
+	)
+	return upload, err
+}
+
+// Claim an upload to turn it into a post, sql.ErrNoRows is returned when it is posted,
+// expired or claimed less than timeout ago. A claim older than that was left by a
+// process that stopped while posting and is taken over.
+func (d *database) ClaimDirectUpload(uploadId string, timeout time.Duration) error {
+	updateQuery := "UPDATE `direct_uploads` SET `claimed_at` = NOW() " +
+		"WHERE `upload_id` = ? AND `post_id` IS NULL AND `expires_at` > NOW() " +
+		"AND (`claimed_at` IS NULL OR `claimed_at` <= DATE_SUB(NOW(), INTERVAL ? SECOND))"
+	return execOneRow(d.Db, updateQuery, uploadId, int64(timeout.Seconds()))
+}
+
+// Give up the claim on an upload whose post couldn't be created, so it can be retried
+func (d *database) ReleaseDirectUpload(uploadId string) error {
+	updateQuery := "UPDATE `direct_uploads` SET `claimed_at` = NULL WHERE `upload_id` = ? AND `post_id` IS NULL"
+	_, err := d.Db.Exec(updateQuery, uploadId)
+	return err
+}
+
+// Record the post a claimed upload became. The upload is kept until it expires so
+// creating the post again returns the same post.
+func (d *database) FinishDirectUpload(uploadId string, postId int64) error {
+	_, err := d.Db.Exec("UPDATE `direct_uploads` SET `post_id` = ? WHERE `upload_id` = ?", postId, uploadId)
+	return err
+}
+
+// Delete an upload, sql.ErrNoRows is returned when it doesn't exist
+func (d *database) DeleteDirectUpload(uploadId string) error {
+	return execOneRow(d.Db, "DELETE FROM `direct_uploads` WHERE `upload_id` = ?", uploadId)
+}
+
+// Get the ids of up to limit expired uploads sent straight to storage, oldest first
+func (d *database) GetExpiredDirectUploads(limit int) ([]string, error) {
+	query := "SELECT `upload_id` FROM `direct_uploads` WHERE `expires_at` <= NOW() ORDER BY `expires_at` LIMIT ?"
+	rows, err := d.Db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploadIds []string
+	for rows.Next() {
+		var uploadId string
+		if err := rows.Scan(&uploadId); err != nil {
+			return nil, err
+		}
+		uploadIds = append(uploadIds, uploadId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return uploadIds, nil
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"strings"
+)
+
+// Perceptual hashes are indexed by their bytes. By the pigeonhole principle two
+// hashes at most HASH_BANDS-1 bits apart have at least one byte in common, so the
+// candidates of a search are the images sharing a byte with the hash.
+const HASH_BANDS = 8
+
+type SimilarImageResult struct {
+	ImageId  int64
+	PostId   int64
+	Distance int // bits the perceptual hashes differ by
+}
+
+// Save the perceptual hash of an image and index it
+func (d *database) SaveImageHash(imageId int64, hash uint64) error {
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
+
+	updateQuery := "UPDATE `images` SET `perceptual_hash` = ? WHERE `image_id` = ?"
+	if _, err := tx.Exec(updateQuery, int64(hash), imageId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM `image_hash_bands` WHERE `image_id` = ?", imageId); err != nil {
+		return err
+	}
+	args := make([]interface{}, 0, 3*HASH_BANDS)
+	for band, value := range hashBands(hash) {
+		args = append(args, band, value, imageId)
+	}
+	insertQuery := "INSERT INTO `image_hash_bands` (`band`, `value`, `image_id`) VALUES " +
+		strings.TrimSuffix(strings.Repeat("(?, ?, ?), ", HASH_BANDS), ", ")
+	if _, err := tx.Exec(insertQuery, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get up to limit images whose perceptual hash is at most maxDistance bits from
+// hash, closest first. Quarantined images are left out. maxDistance is capped at
+// HASH_BANDS-1, past which the index can miss matches.
+func (d *database) GetSimilarImages(hash uint64, maxDistance int, limit int) ([]SimilarImageResult, error) {
+	if maxDistance > HASH_BANDS-1 {
+		maxDistance = HASH_BANDS - 1
+	}
+	args := make([]interface{}, 0, 2*HASH_BANDS+4)
+	args = append(args, int64(hash))
+	for band, value := range hashBands(hash) {
+		args = append(args, band, value)
+	}
+	args = append(args, int64(hash), maxDistance, limit)
+	query := "SELECT i.`image_id`, i.`post_id`, BIT_COUNT(i.`perceptual_hash` ^ ?) AS distance " +
+		"FROM `images` i " +
+		"WHERE i.`image_id` IN (SELECT b.`image_id` FROM `image_hash_bands` b WHERE (b.`band`, b.`value`) IN (" +
+		strings.TrimSuffix(strings.Repeat("(?, ?), ", HASH_BANDS), ", ") + ")) " +
+		"AND BIT_COUNT(i.`perceptual_hash` ^ ?) <= ? " +
+		"AND i.`quarantined_at` IS NULL " +
+		"ORDER BY distance, i.`image_id` " +
+		"LIMIT ?"
+	rows, err := d.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SimilarImageResult
+	for rows.Next() {
+		var result SimilarImageResult
+		if err := rows.Scan(&result.ImageId, &result.PostId, &result.Distance); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Bytes of a hash, most significant first
+func hashBands(hash uint64) [HASH_BANDS]uint8 {
+	var bands [HASH_BANDS]uint8
+	for i := range bands {
+		bands[i] = uint8(hash >> (56 - 8*i))
+	}
+	return bands
+}
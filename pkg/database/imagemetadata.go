@@ -0,0 +1,30 @@
+package database
+
+import (
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+)
+
+// Save the metadata of an image, replacing what was recorded before
+func (d *database) SaveImageMetadata(metadata tables.ImageMetadataTable) error {
+	insertQuery := "INSERT INTO `image_metadata` " +
+		"(`image_id`, `width`, `height`, `orientation`, `captured_at`, `camera_make`, `camera_model`) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE " +
+		"`width` = VALUES(`width`), " +
+		"`height` = VALUES(`height`), " +
+		"`orientation` = VALUES(`orientation`), " +
+		"`captured_at` = VALUES(`captured_at`), " +
+		"`camera_make` = VALUES(`camera_make`), " +
+		"`camera_model` = VALUES(`camera_model`)"
+	_, err := d.Db.Exec(
+		insertQuery,
+		metadata.ImageId,
+		metadata.Width,
+		metadata.Height,
+		metadata.Orientation,
+		metadata.CapturedAt,
+		metadata.CameraMake,
+		metadata.CameraModel,
+	)
+	return err
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+)
+
+const imageRenditionColumns = "`image_id`, " +
+	"`name`, " +
+	"`mode`, " +
+	"`storage_key`, " +
+	"IFNULL(`location`, ''), " +
+	"`width`, " +
+	"`height`, " +
+	"`size_bytes`, " +
+	"`quality`, " +
+	"`progressive`, " +
+	"`chroma_subsampling`, " +
+	"`created_at` "
+
+// Save the renditions of an image, replacing ones with the same name
+func (d *database) SaveImageRenditions(renditions []tables.ImageRenditionTable) error {
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
+
+	insertQuery := "INSERT INTO `image_renditions` " +
+		"(`image_id`, `name`, `mode`, `storage_key`, `location`, `width`, `height`, `size_bytes`, " +
+		"`quality`, `progressive`, `chroma_subsampling`) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE " +
+		"`mode` = VALUES(`mode`), " +
+		"`storage_key` = VALUES(`storage_key`), " +
+		"`location` = VALUES(`location`), " +
+		"`width` = VALUES(`width`), " +
+		"`height` = VALUES(`height`), " +
+		"`size_bytes` = VALUES(`size_bytes`), " +
+		"`quality` = VALUES(`quality`), " +
+		"`progressive` = VALUES(`progressive`), " +
+		"`chroma_subsampling` = VALUES(`chroma_subsampling`)"
+	stmt, err := tx.Prepare(insertQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, rendition := range renditions {
+		_, err = stmt.Exec(
+			rendition.ImageId,
+			rendition.Name,
+			rendition.Mode,
+			rendition.StorageKey,
+			rendition.Location,
+			rendition.Width,
+			rendition.Height,
+			rendition.SizeBytes,
+			rendition.Quality,
+			rendition.Progressive,
+			rendition.Chroma,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get all renditions of an image
+func (d *database) GetImageRenditions(imageId int64) ([]tables.ImageRenditionTable, error) {
+	selectQuery := "SELECT " + imageRenditionColumns +
+		"FROM `image_renditions` WHERE `image_id` = ? ORDER BY `name`"
+	rows, err := d.Db.Query(selectQuery, imageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var renditions []tables.ImageRenditionTable
+	for rows.Next() {
+		var rendition tables.ImageRenditionTable
+		err := rows.Scan(
+			&rendition.ImageId,
+			&rendition.Name,
+			&rendition.Mode,
+			&rendition.StorageKey,
+			&rendition.Location,
+			&rendition.Width,
+			&rendition.Height,
+			&rendition.SizeBytes,
+			&rendition.Quality,
+			&rendition.Progressive,
+			&rendition.Chroma,
+			&rendition.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		renditions = append(renditions, rendition)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return renditions, nil
+}
+
+// Get one rendition of an image, sql.ErrNoRows is returned when it does not exist or
+// the image is quarantined
+func (d *database) GetImageRendition(imageId int64, name string) (tables.ImageRenditionTable, error) {
+	var rendition tables.ImageRenditionTable
+	selectQuery := "SELECT " + imageRenditionColumns +
+		"FROM `image_renditions` WHERE `image_id` = ? AND `name` = ? " +
+		"AND NOT EXISTS (SELECT 1 FROM `images` i " +
+		"WHERE i.`image_id` = `image_renditions`.`image_id` AND i.`quarantined_at` IS NOT NULL)"
+	err := d.Db.QueryRow(selectQuery, imageId, name).Scan(
+		&rendition.ImageId,
+		&rendition.Name,
+		&rendition.Mode,
+		&rendition.StorageKey,
+		&rendition.Location,
+		&rendition.Width,
+		&rendition.Height,
+		&rendition.SizeBytes,
+		&rendition.Quality,
+		&rendition.Progressive,
+		&rendition.Chroma,
+		&rendition.CreatedAt,
+	)
+	return rendition, err
+}
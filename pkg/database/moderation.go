@@ -0,0 +1,268 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/pagination"
+)
+
+const moderationEventColumns = "`event_id`, " +
+	"`action`, " +
+	"`source`, " +
+	"`blocked_hash_id`, " +
+	"`distance`, " +
+	"`image_id`, " +
+	"`post_id`, " +
+	"`user_id`, " +
+	"`created_at` "
+
+// Add hashes to the blocklist. Returns the hashes that were added with their ids,
+// hashes already on the blocklist are left as they are.
+func (d *database) SaveBlockedHashes(hashes []tables.BlockedHashTable) ([]tables.BlockedHashTable, error) {
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
+
+	insertQuery := "INSERT INTO `blocked_hashes` (`perceptual_hash`, `reason`) VALUES (?, NULLIF(?, '')) " +
+		"ON DUPLICATE KEY UPDATE `blocked_hash_id` = `blocked_hash_id`"
+	stmt, err := tx.Prepare(insertQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var added []tables.BlockedHashTable
+	for _, hash := range hashes {
+		result, err := stmt.Exec(int64(hash.PerceptualHash), hash.Reason)
+		if err != nil {
+			return nil, err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if rowsAffected == 0 {
+			continue
+		}
+		hash.BlockedHashId, err = result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, hash)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// Remove a hash from the blocklist, sql.ErrNoRows is returned when it isn't on it.
+// Images quarantined because of it stay quarantined.
+func (d *database) DeleteBlockedHash(blockedHashId int64) error {
+	result, err := d.Db.Exec("DELETE FROM `blocked_hashes` WHERE `blocked_hash_id` = ?", blockedHashId)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Get a page of the blocklist, newest first. The cursor's id is the blocked hash id.
+func (d *database) GetBlockedHashes(cursor *pagination.Cursor, limit int) ([]tables.BlockedHashTable, error) {
+	query := "SELECT `blocked_hash_id`, `perceptual_hash`, IFNULL(`reason`, ''), `created_at` FROM `blocked_hashes` "
+	args := []interface{}{}
+	order := "ORDER BY `blocked_hash_id` DESC "
+	if cursor.IsPrev() {
+		query += "WHERE `blocked_hash_id` > ? "
+		args = append(args, cursor.Id)
+		order = "ORDER BY `blocked_hash_id` ASC "
+	} else if cursor != nil {
+		query += "WHERE `blocked_hash_id` < ? "
+		args = append(args, cursor.Id)
+	}
+	query += order + "LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := d.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []tables.BlockedHashTable
+	for rows.Next() {
+		var hash tables.BlockedHashTable
+		var value int64
+		if err := rows.Scan(&hash.BlockedHashId, &value, &hash.Reason, &hash.CreatedAt); err != nil {
+			return nil, err
+		}
+		hash.PerceptualHash = uint64(value)
+		hashes = append(hashes, hash)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// Tell whether any hash is blocked
+func (d *database) HasBlockedHashes() (bool, error) {
+	var exists bool
+	err := d.Db.QueryRow("SELECT EXISTS (SELECT 1 FROM `blocked_hashes`)").Scan(&exists)
+	return exists, err
+}
+
+// Get the blocked hash closest to hash and the bits they differ by, sql.ErrNoRows is
+// returned when none is within maxDistance. The blocklist is scanned, it is small
+// next to the images.
+func (d *database) GetBlockedHashMatch(hash uint64, maxDistance int) (tables.BlockedHashTable, int, error) {
+	query := "SELECT `blocked_hash_id`, `perceptual_hash`, IFNULL(`reason`, ''), `created_at`, " +
+		"BIT_COUNT(`perceptual_hash` ^ ?) AS distance " +
+		"FROM `blocked_hashes` " +
+		"WHERE BIT_COUNT(`perceptual_hash` ^ ?) <= ? " +
+		"ORDER BY distance, `blocked_hash_id` " +
+		"LIMIT 1"
+	var blocked tables.BlockedHashTable
+	var value int64
+	var distance int
+	err := d.Db.QueryRow(query, int64(hash), int64(hash), maxDistance).Scan(
+		&blocked.BlockedHashId,
+		&value,
+		&blocked.Reason,
+		&blocked.CreatedAt,
+		&distance,
+	)
+	if err != nil {
+		return tables.BlockedHashTable{}, 0, err
+	}
+	blocked.PerceptualHash = uint64(value)
+	return blocked, distance, nil
+}
+
+// Quarantine every image whose original is stored under storageKey, now moved to
+// quarantineKey, and record event for each of them. Returns the images quarantined,
+// none when they already were.
+func (d *database) QuarantineImages(storageKey string, quarantineKey string, location string, event tables.ModerationEventTable) ([]tables.ImageTable, error) {
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
+
+	selectQuery := "SELECT `image_id`, `post_id` FROM `images` " +
+		"WHERE `storage_key` = ? AND `quarantined_at` IS NULL FOR UPDATE"
+	rows, err := tx.Query(selectQuery, storageKey)
+	if err != nil {
+		return nil, err
+	}
+	var images []tables.ImageTable
+	for rows.Next() {
+		var image tables.ImageTable
+		if err := rows.Scan(&image.ImageId, &image.PostId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	updateQuery := "UPDATE `images` SET `quarantined_at` = NOW(), `storage_key` = ?, `location` = ? WHERE `image_id` = ?"
+	for _, image := range images {
+		if _, err := tx.Exec(updateQuery, quarantineKey, location, image.ImageId); err != nil {
+			return nil, err
+		}
+		event.ImageId = sql.NullInt64{Int64: image.ImageId, Valid: true}
+		event.PostId = sql.NullInt64{Int64: image.PostId, Valid: true}
+		if err := insertModerationEvent(tx, event); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// Record a moderation event that concerns no stored image, e.g. a refused upload
+func (d *database) SaveModerationEvent(event tables.ModerationEventTable) error {
+	return insertModerationEvent(d.Db, event)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertModerationEvent(db execer, event tables.ModerationEventTable) error {
+	insertQuery := "INSERT INTO `moderation_events` " +
+		"(`action`, `source`, `blocked_hash_id`, `distance`, `image_id`, `post_id`, `user_id`) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := db.Exec(insertQuery,
+		event.Action,
+		event.Source,
+		event.BlockedHashId,
+		event.Distance,
+		event.ImageId,
+		event.PostId,
+		event.UserId,
+	)
+	return err
+}
+
+// Get a page of moderation events, newest first. The cursor's id is the event id.
+func (d *database) GetModerationEvents(cursor *pagination.Cursor, limit int) ([]tables.ModerationEventTable, error) {
+	query := "SELECT " + moderationEventColumns + "FROM `moderation_events` "
+	args := []interface{}{}
+	order := "ORDER BY `event_id` DESC "
+	if cursor.IsPrev() {
+		query += "WHERE `event_id` > ? "
+		args = append(args, cursor.Id)
+		order = "ORDER BY `event_id` ASC "
+	} else if cursor != nil {
+		query += "WHERE `event_id` < ? "
+		args = append(args, cursor.Id)
+	}
+	query += order + "LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := d.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []tables.ModerationEventTable
+	for rows.Next() {
+		var event tables.ModerationEventTable
+		err := rows.Scan(
+			&event.EventId,
+			&event.Action,
+			&event.Source,
+			&event.BlockedHashId,
+			&event.Distance,
+			&event.ImageId,
+			&event.PostId,
+			&event.UserId,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+)
+
+const uploadSessionColumns = "`upload_id`, " +
+	"`user_id`, " +
+	"IFNULL(`caption`, ''), " +
+	"`file_name`, " +
+	"`upload_length`, " +
+	"`upload_offset`, " +
+	"IFNULL(`post_id`, 0), " +
+	"`finalized_at`, " +
+	"`expires_at`, " +
+	"`created_at` "
+
+// Create a resumable upload expiring after ttl unless a chunk arrives before
+func (d *database) CreateUploadSession(session tables.UploadSessionTable, ttl time.Duration) error {
+	insertQuery := "INSERT INTO `upload_sessions` " +
+		"(`upload_id`, `user_id`, `caption`, `file_name`, `upload_length`, `expires_at`) " +
+		"VALUES (?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))"
+	_, err := d.Db.Exec(insertQuery,
+		session.UploadId,
+		session.UserId,
+		session.Caption,
+		session.FileName,
+		session.Length,
+		int64(ttl.Seconds()),
+	)
+	return err
+}
+
+// Get a resumable upload, sql.ErrNoRows is returned when it doesn't exist or expired
+func (d *database) GetUploadSession(uploadId string) (tables.UploadSessionTable, error) {
+	query := "SELECT " + uploadSessionColumns + "FROM `upload_sessions` " +
+		"WHERE `upload_id` = ? AND `expires_at` > NOW()"
+	var session tables.UploadSessionTable
+	err := d.Db.QueryRow(query, uploadId).Scan(
+		&session.UploadId,
+		&session.UserId,
+		&session.Caption,
+		&session.FileName,
+		&session.Length,
+		&session.Offset,
+		&session.PostId,
+		&session.FinalizedAt,
+		&session.ExpiresAt,
+		&session.CreatedAt,
+	)
+	return session, err
+}
+
+// Record a chunk stored for an upload and move its offset past it, pushing back its
+// expiry to ttl from now. sql.ErrNoRows is returned when the upload's offset is no
+// longer the part's, e.g. another request wrote the same chunk first, or when the
+// upload expired or is being finalized.
+func (d *database) SaveUploadPart(part tables.UploadPartTable, ttl time.Duration) error {
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
+
+	updateQuery := "UPDATE `upload_sessions` " +
+		"SET `upload_offset` = `upload_offset` + ?, `expires_at` = DATE_ADD(NOW(), INTERVAL ? SECOND) " +
+		"WHERE `upload_id` = ? AND `upload_offset` = ? AND `upload_offset` + ? <= `upload_length` " +
+		"AND `finalized_at` IS NULL AND `expires_at` > NOW()"
+	result, err := tx.Exec(updateQuery, part.Size, int64(ttl.Seconds()), part.UploadId, part.Offset, part.Size)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	insertQuery := "INSERT INTO `upload_parts` (`upload_id`, `part_offset`, `size_bytes`, `storage_key`) VALUES (?, ?, ?, ?)"
+	if _, err := tx.Exec(insertQuery, part.UploadId, part.Offset, part.Size, part.StorageKey); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get the chunks of an upload in the order they make up the file
+func (d *database) GetUploadParts(uploadId string) ([]tables.UploadPartTable, error) {
+	query := "SELECT `upload_id`, `part_offset`, `size_bytes`, `storage_key` FROM `upload_parts` " +
+		"WHERE `upload_id` = ? ORDER BY `part_offset`"
+	rows, err := d.Db.Query(query, uploadId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []tables.UploadPartTable
+	for rows.Next() {
+		var part tables.UploadPartTable
+		if err := rows.Scan(&part.UploadId, &part.Offset, &part.Size, &part.StorageKey); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// Claim a complete upload to turn it into a post, sql.ErrNoRows is returned when it
+// is posted, incomplete, expired or claimed less than timeout ago. A claim older than
+// that was left by a process that stopped while posting and is taken over. No more
+// chunks are accepted once claimed.
+func (d *database) ClaimUploadSession(uploadId string, timeout time.Duration) error {
+	updateQuery := "UPDATE `upload_sessions` SET `finalized_at` = NOW() " +
+		"WHERE `upload_id` = ? AND `post_id` IS NULL AND `upload_offset` = `upload_length` AND `expires_at` > NOW() " +
+		"AND (`finalized_at` IS NULL OR `finalized_at` <= DATE_SUB(NOW(), INTERVAL ? SECOND))"
+	return execOneRow(d.Db, updateQuery, uploadId, int64(timeout.Seconds()))
+}
+
+// Give up the claim on an upload whose post couldn't be created, so it can be retried
+func (d *database) ReleaseUploadSession(uploadId string) error {
+	updateQuery := "UPDATE `upload_sessions` SET `finalized_at` = NULL WHERE `upload_id` = ? AND `post_id` IS NULL"
+	_, err := d.Db.Exec(updateQuery, uploadId)
+	return err
+}
+
+// Record the post a claimed upload became and forget its chunks. The upload itself is
+// kept until it expires so finalizing it again returns the same post.
+func (d *database) FinishUploadSession(uploadId string, postId int64) error {
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
+
+	if _, err := tx.Exec("UPDATE `upload_sessions` SET `post_id` = ? WHERE `upload_id` = ?", postId, uploadId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM `upload_parts` WHERE `upload_id` = ?", uploadId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete an upload and its chunks, sql.ErrNoRows is returned when it doesn't exist
+func (d *database) DeleteUploadSession(uploadId string) error {
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Rollback the transaction if there is an error
+
+	if _, err := tx.Exec("DELETE FROM `upload_parts` WHERE `upload_id` = ?", uploadId); err != nil {
+		return err
+	}
+	if err := execOneRow(tx, "DELETE FROM `upload_sessions` WHERE `upload_id` = ?", uploadId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get the ids of up to limit expired uploads, oldest first
+func (d *database) GetExpiredUploadSessions(limit int) ([]string, error) {
+	query := "SELECT `upload_id` FROM `upload_sessions` WHERE `expires_at` <= NOW() ORDER BY `expires_at` LIMIT ?"
+	rows, err := d.Db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploadIds []string
+	for rows.Next() {
+		var uploadId string
+		if err := rows.Scan(&uploadId); err != nil {
+			return nil, err
+		}
+		uploadIds = append(uploadIds, uploadId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return uploadIds, nil
+}
+
+// Run a statement expected to change exactly one row, sql.ErrNoRows is returned when
+// it changed none
+func execOneRow(db execer, query string, args ...interface{}) error {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
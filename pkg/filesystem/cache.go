@@ -0,0 +1,153 @@
+package filesystem
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Cache keeps files under a prefix of a FileSystem within a size budget, the least
+// recently used files are deleted to make room. Files written by other processes
+// are picked up when they are opened.
+type Cache struct {
+	fileSystem FileSystem
+	budget     int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element // oldest at the back
+	order   *list.List
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// NewCache indexes the files already stored under prefix, oldest first, and trims
+// them to budget bytes. Files deleted while they are indexed, e.g. evicted by another
+// process, are left out.
+func NewCache(fileSystem FileSystem, prefix string, budget int64) (*Cache, error) {
+	cache := &Cache{
+		fileSystem: fileSystem,
+		budget:     budget,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+	listed, err := fileSystem.List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list cached files - %w", err)
+	}
+	keys := make([]string, 0, len(listed))
+	infos := make([]fs.FileInfo, 0, len(listed))
+	for _, key := range listed {
+		info, err := fileSystem.Stat(key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read cached file %s - %w", key, err)
+		}
+		keys = append(keys, key)
+		infos = append(infos, info)
+	}
+	indexes := make([]int, len(keys))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return infos[indexes[a]].ModTime().Before(infos[indexes[b]].ModTime())
+	})
+	for _, i := range indexes {
+		cache.add(keys[i], infos[i].Size())
+	}
+	cache.evict()
+	return cache, nil
+}
+
+// Open a cached file, marking it as recently used
+func (c *Cache) Open(key string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	file, info, err := c.fileSystem.Open(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		c.remove(key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	c.add(key, info.Size())
+	c.evict()
+	return file, info, nil
+}
+
+// Save a file into the cache, deleting the least recently used files over budget
+func (c *Cache) Save(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	counter := &countingReader{reader: reader}
+	location, err := c.fileSystem.Save(ctx, key, counter, metadata)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(key, counter.count)
+	c.evict()
+	return location, nil
+}
+
+// Size of all cached files
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Record a file as the most recently used one
+func (c *Cache) add(key string, size int64) {
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		c.size += size - entry.size
+		entry.size = size
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+}
+
+func (c *Cache) remove(key string) {
+	if element, ok := c.entries[key]; ok {
+		c.size -= element.Value.(*cacheEntry).size
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// Delete the least recently used files until the cache fits its budget. The most
+// recent file is kept even when it alone is over budget.
+func (c *Cache) evict() {
+	for c.size > c.budget && c.order.Len() > 1 {
+		entry := c.order.Back().Value.(*cacheEntry)
+		c.remove(entry.key)
+		if err := c.fileSystem.Delete(entry.key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("unable to delete cached file %s: %s", entry.key, err.Error())
+		}
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
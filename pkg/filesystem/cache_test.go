@@ -0,0 +1,95 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	directory := t.TempDir()
+	fileSystem := local.New("test host directory", directory)
+	ctx := context.Background()
+
+	// Files from an earlier run are indexed oldest first
+	for i, key := range []string{"cache/old", "cache/older"} {
+		_, err := fileSystem.Save(ctx, key, bytes.NewReader(make([]byte, 10)), nil)
+		assert.Nil(t, err)
+		modTime := time.Now().Add(-time.Duration(i+1) * time.Hour)
+		assert.Nil(t, os.Chtimes(filepath.Join(directory, key), modTime, modTime))
+	}
+	_, err := fileSystem.Save(ctx, "originals/kept", bytes.NewReader(make([]byte, 100)), nil)
+	assert.Nil(t, err)
+
+	cache, err := NewCache(fileSystem, "cache/", 30)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), cache.Size())
+
+	_, err = cache.Save(ctx, "cache/a", bytes.NewReader(make([]byte, 10)), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(30), cache.Size())
+
+	// Using the oldest file makes cache/old the least recently used one
+	file, _, err := cache.Open("cache/older")
+	assert.Nil(t, err)
+	file.Close()
+
+	_, err = cache.Save(ctx, "cache/b", bytes.NewReader(make([]byte, 10)), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(30), cache.Size())
+	_, err = fileSystem.Stat("cache/old")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	for _, key := range []string{"cache/older", "cache/a", "cache/b", "originals/kept"} {
+		_, err = fileSystem.Stat(key)
+		assert.Nil(t, err, key)
+	}
+
+	// A file larger than the budget pushes everything else out
+	_, err = cache.Save(ctx, "cache/large", bytes.NewReader(make([]byte, 50)), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(50), cache.Size())
+	keys, err := fileSystem.List("cache/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"cache/large"}, keys)
+
+	// Files deleted behind the cache's back are forgotten
+	assert.Nil(t, fileSystem.Delete("cache/large"))
+	_, _, err = cache.Open("cache/large")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Equal(t, int64(0), cache.Size())
+}
+
+// Deletes a file right before it is looked at, as another replica evicting it would
+type deletingFileSystem struct {
+	FileSystem
+	deleted string
+}
+
+func (d *deletingFileSystem) Stat(key string) (fs.FileInfo, error) {
+	if key == d.deleted {
+		if err := d.FileSystem.Delete(key); err != nil {
+			return nil, err
+		}
+	}
+	return d.FileSystem.Stat(key)
+}
+
+func TestNewCacheSkipsDeletedFiles(t *testing.T) {
+	fileSystem := local.New("test host directory", t.TempDir())
+	ctx := context.Background()
+	for _, key := range []string{"cache/a", "cache/b"} {
+		_, err := fileSystem.Save(ctx, key, bytes.NewReader(make([]byte, 10)), nil)
+		assert.Nil(t, err)
+	}
+
+	cache, err := NewCache(&deletingFileSystem{FileSystem: fileSystem, deleted: "cache/a"}, "cache/", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), cache.Size())
+}
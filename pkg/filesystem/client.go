@@ -1,10 +1,14 @@
 package filesystem
 
 import (
-	"mime/multipart"
+	"context"
+	"io"
+	"io/fs"
+	"time"
 
 	"github.com/ksindhwani/imagegram/pkg/config"
 	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/ksindhwani/imagegram/pkg/filesystem/s3"
 )
 
 const (
@@ -12,8 +16,29 @@ const (
 	S3    = "s3"
 )
 
+// FileSystem stores files under slash separated keys. Every method reports a
+// missing file with an error wrapping fs.ErrNotExist.
 type FileSystem interface {
-	SaveFile(fileName string, file multipart.File) (string, error)
+	// Save writes the content of reader under key, replacing any existing file,
+	// and returns its location. Backends keep metadata where they support it.
+	Save(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error)
+	// Open returns a seekable reader over the file stored under key.
+	Open(key string) (io.ReadSeekCloser, fs.FileInfo, error)
+	Stat(key string) (fs.FileInfo, error)
+	Delete(key string) error
+	// Move puts the file stored under from under the key to, replacing any file there,
+	// and returns its new location. Metadata stays with the file.
+	Move(ctx context.Context, from string, to string) (string, error)
+	// List returns the sorted keys of all files starting with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// Presigner is implemented by file systems clients can upload to without going
+// through this process.
+type Presigner interface {
+	// PresignPut returns a url the file under key can be written to with a PUT until
+	// expires. The PUT must send headers as given.
+	PresignPut(key string, headers map[string]string, expires time.Duration) (string, error)
 }
 
 func New(fileSystemType string, config *config.Config) (FileSystem, error) {
@@ -23,6 +48,19 @@ func New(fileSystemType string, config *config.Config) (FileSystem, error) {
 			HostDirectory:  config.HostImageDirectory,
 			LocalDirectory: config.LocalImageDirectory,
 		}, nil
+	case S3:
+		s3FileSystem, err := s3.New(s3.Params{
+			Endpoint:        config.S3Endpoint,
+			Bucket:          config.S3Bucket,
+			Region:          config.S3Region,
+			PathStyle:       config.S3PathStyle,
+			AccessKeyID:     config.S3AccessKeyID,
+			SecretAccessKey: config.S3SecretAccessKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s3FileSystem, nil
 	default:
 		return &local.LocalFileSystem{
 			HostDirectory:  config.HostImageDirectory,
@@ -30,3 +68,14 @@ func New(fileSystemType string, config *config.Config) (FileSystem, error) {
 		}, nil
 	}
 }
+
+// Copy the file stored under from to the key to and return its new location. The
+// file systems have no native copy, so the content goes through this process.
+func Copy(ctx context.Context, fileSystem FileSystem, from string, to string, metadata map[string]string) (string, error) {
+	file, _, err := fileSystem.Open(from)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return fileSystem.Save(ctx, to, file, metadata)
+}
@@ -1,21 +1,28 @@
 package filesystem
 
 import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
 	"testing"
 
 	"github.com/ksindhwani/imagegram/pkg/config"
 	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/ksindhwani/imagegram/pkg/filesystem/s3"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewFileSystem(t *testing.T) {
 	tests := []struct {
 		Name          string
+		Type          string
 		ExpectedError error
 		Expected      FileSystem
 	}{
 		{
 			Name:          "Test New Local FileSystem",
+			Type:          LOCAL,
 			ExpectedError: nil,
 			Expected: &local.LocalFileSystem{
 				HostDirectory:  "test host directory",
@@ -24,6 +31,7 @@ func TestNewFileSystem(t *testing.T) {
 		},
 		{
 			Name:          "Test New Default FileSystem",
+			Type:          "unknown",
 			ExpectedError: nil,
 			Expected: &local.LocalFileSystem{
 				HostDirectory:  "test host directory",
@@ -38,8 +46,43 @@ func TestNewFileSystem(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result, err := New(LOCAL, &config)
+		result, err := New(test.Type, &config)
 		assert.Equal(t, test.Expected, result, test.Name)
 		assert.Equal(t, test.ExpectedError, err, test.Name)
 	}
 }
+
+func TestNewS3FileSystem(t *testing.T) {
+	config := config.Config{
+		S3Endpoint:  "http://minio:9000",
+		S3Bucket:    "images",
+		S3Region:    "us-east-1",
+		S3PathStyle: true,
+	}
+	result, err := New(S3, &config)
+	assert.Nil(t, err)
+	s3FileSystem, ok := result.(*s3.S3FileSystem)
+	assert.True(t, ok)
+	assert.Equal(t, "images", s3FileSystem.Bucket)
+	assert.Equal(t, "minio:9000", s3FileSystem.Endpoint.Host)
+
+	config.S3Bucket = ""
+	_, err = New(S3, &config)
+	assert.Equal(t, errors.New("s3 bucket is not configured"), err)
+}
+
+func TestCopy(t *testing.T) {
+	fileSystem := local.New("test host directory", t.TempDir())
+	_, err := fileSystem.Save(context.Background(), "originals/a.png", strings.NewReader("image bytes"), nil)
+	assert.Nil(t, err)
+
+	location, err := Copy(context.Background(), fileSystem, "originals/a.png", "quarantine/originals/a.png", nil)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(location, "/quarantine/originals/a.png"))
+	keys, err := fileSystem.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"originals/a.png", "quarantine/originals/a.png"}, keys)
+
+	_, err = Copy(context.Background(), fileSystem, "originals/missing.png", "quarantine/originals/missing.png", nil)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -1,10 +1,15 @@
 package local
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type LocalFileSystem struct {
@@ -20,19 +25,163 @@ func New(hostDirectory string, localDirectory string) *LocalFileSystem {
 	}
 }
 
-// Saving file in a host directory and returning its location
-func (lfs *LocalFileSystem) SaveFile(fileName string, file multipart.File) (string, error) {
-	// Create a new file on the host machine to store the uploaded image
-	dst, err := os.Create(lfs.LocalDirectory + fileName)
+// Saving content under key in the local directory and returning its location.
+// The file is written to a temporary file first so readers never see a partial file.
+// The local file system has nowhere to keep metadata so it is ignored.
+func (lfs *LocalFileSystem) Save(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	path, err := lfs.resolve(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("error creating the directory in local - %w", err)
+	}
+
+	// Create a new file on the host machine to store the content
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
 	if err != nil {
 		return "", fmt.Errorf("error creating the file in local - %w", err)
 	}
-	defer dst.Close()
+	defer os.Remove(tmp.Name()) // no-op once the file has been renamed
 
-	// Copy the contents of the uploaded file to the destination file
-	if _, err := io.Copy(dst, file); err != nil {
+	// Copy the content to the temporary file
+	if _, err := io.Copy(tmp, contextReader{ctx: ctx, reader: reader}); err != nil {
+		tmp.Close()
 		return "", fmt.Errorf("error copying the file - %w", err)
 	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("error copying the file - %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("error moving the file in place - %w", err)
+	}
+	return path, nil
+}
 
-	return dst.Name(), nil
+// Opening a file relative to the local directory along with its file info
+func (lfs *LocalFileSystem) Open(key string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	path, err := lfs.resolve(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening the file in local - %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error reading file info - %w", err)
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, nil, fmt.Errorf("%s is a directory - %w", key, fs.ErrNotExist)
+	}
+	return file, info, nil
+}
+
+// Getting the file info of a file relative to the local directory
+func (lfs *LocalFileSystem) Stat(key string) (fs.FileInfo, error) {
+	path, err := lfs.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file info - %w", err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory - %w", key, fs.ErrNotExist)
+	}
+	return info, nil
+}
+
+// Deleting a file relative to the local directory
+func (lfs *LocalFileSystem) Delete(key string) error {
+	path, err := lfs.resolve(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("error deleting the file in local - %w", err)
+	}
+	return nil
+}
+
+// Moving a file to another key by renaming it, replacing any file already there
+func (lfs *LocalFileSystem) Move(ctx context.Context, from string, to string) (string, error) {
+	fromPath, err := lfs.resolve(from)
+	if err != nil {
+		return "", err
+	}
+	toPath, err := lfs.resolve(to)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(toPath), 0755); err != nil {
+		return "", fmt.Errorf("error creating the directory in local - %w", err)
+	}
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return "", fmt.Errorf("error moving the file in local - %w", err)
+	}
+	return toPath, nil
+}
+
+// Listing the keys of all files starting with prefix, sorted
+func (lfs *LocalFileSystem) List(prefix string) ([]string, error) {
+	root := filepath.Clean(lfs.LocalDirectory)
+	// Only walk the directory the prefix lives in instead of the whole tree
+	walkRoot, err := lfs.resolve(prefix[:strings.LastIndex(prefix, "/")+1])
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	err = filepath.WalkDir(walkRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing files in local - %w", err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Resolving a key to a path inside the local directory, rejecting keys that escape it
+func (lfs *LocalFileSystem) resolve(key string) (string, error) {
+	root := filepath.Clean(lfs.LocalDirectory)
+	path := filepath.Join(root, filepath.FromSlash(key))
+	if path != root && !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return "", errors.New("key " + key + " is outside the local directory")
+	}
+	return path, nil
+}
+
+// contextReader stops a copy once its context is cancelled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.reader.Read(p)
 }
@@ -0,0 +1,96 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveOpenStatDelete(t *testing.T) {
+	directory := t.TempDir()
+	localFileSystem := New("test host directory", directory)
+
+	location, err := localFileSystem.Save(context.Background(), "converted/1.jpg", strings.NewReader("jpeg bytes"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(directory, "converted", "1.jpg"), location)
+
+	file, info, err := localFileSystem.Open("converted/1.jpg")
+	assert.Nil(t, err)
+	content, err := io.ReadAll(file)
+	file.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "jpeg bytes", string(content))
+	assert.Equal(t, int64(len("jpeg bytes")), info.Size())
+
+	info, err = localFileSystem.Stat("converted/1.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, "1.jpg", info.Name())
+
+	assert.Nil(t, localFileSystem.Delete("converted/1.jpg"))
+	_, err = localFileSystem.Stat("converted/1.jpg")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), err)
+	_, _, err = localFileSystem.Open("converted/1.jpg")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), err)
+}
+
+func TestList(t *testing.T) {
+	localFileSystem := New("test host directory", t.TempDir())
+	for _, key := range []string{"converted/2.jpg", "converted/1.jpg", "original.png", "converted/nested/3.jpg"} {
+		_, err := localFileSystem.Save(context.Background(), key, strings.NewReader(key), nil)
+		assert.Nil(t, err)
+	}
+
+	keys, err := localFileSystem.List("converted/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"converted/1.jpg", "converted/2.jpg", "converted/nested/3.jpg"}, keys)
+
+	keys, err = localFileSystem.List("orig")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"original.png"}, keys)
+
+	keys, err = localFileSystem.List("missing/")
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestMove(t *testing.T) {
+	localFileSystem := New("test host directory", t.TempDir())
+	_, err := localFileSystem.Save(context.Background(), "staging/abc", strings.NewReader("content"), nil)
+	assert.Nil(t, err)
+
+	location, err := localFileSystem.Move(context.Background(), "staging/abc", "originals/ab/abc.png")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(location, filepath.Join("originals", "ab", "abc.png")), location)
+	keys, err := localFileSystem.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"originals/ab/abc.png"}, keys)
+
+	_, err = localFileSystem.Move(context.Background(), "staging/abc", "originals/ab/abc.png")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), err)
+}
+
+func TestKeysCannotEscapeDirectory(t *testing.T) {
+	localFileSystem := New("test host directory", t.TempDir())
+
+	_, err := localFileSystem.Save(context.Background(), "../../etc/x", strings.NewReader("x"), nil)
+	assert.Equal(t, errors.New("key ../../etc/x is outside the local directory"), err)
+	_, _, err = localFileSystem.Open("../secret")
+	assert.Equal(t, errors.New("key ../secret is outside the local directory"), err)
+}
+
+func TestSaveStopsOnCancelledContext(t *testing.T) {
+	localFileSystem := New("test host directory", t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := localFileSystem.Save(ctx, "cancelled.png", strings.NewReader("x"), nil)
+	assert.True(t, errors.Is(err, context.Canceled), err)
+	_, err = localFileSystem.Stat("cancelled.png")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), err)
+}
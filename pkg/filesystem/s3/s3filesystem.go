@@ -0,0 +1,519 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files of unknown size are uploaded in parts of this size, the smallest S3 accepts
+// for all but the last part. It bounds the memory an upload takes.
+const multipartPartSize = 5 << 20
+
+// S3FileSystem stores files in a bucket of any S3 compatible object storage
+// such as AWS S3 or MinIO.
+type S3FileSystem struct {
+	Endpoint  *url.URL
+	Bucket    string
+	PathStyle bool
+	Client    *http.Client
+	signer    signer
+}
+
+// Params is the configuration needed to reach a bucket.
+type Params struct {
+	Endpoint        string // e.g. http://minio:9000, defaults to AWS for the region
+	Bucket          string
+	Region          string
+	PathStyle       bool // address the bucket as endpoint/bucket instead of bucket.endpoint
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// Getting instance of s3 file system
+func New(params Params) (*S3FileSystem, error) {
+	if params.Bucket == "" {
+		return nil, errors.New("s3 bucket is not configured")
+	}
+	if params.Region == "" {
+		params.Region = "us-east-1"
+	}
+	if params.Endpoint == "" {
+		params.Endpoint = "https://s3." + params.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(params.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", params.Endpoint)
+	}
+	return &S3FileSystem{
+		Endpoint:  endpoint,
+		Bucket:    params.Bucket,
+		PathStyle: params.PathStyle,
+		Client:    &http.Client{},
+		signer: signer{
+			accessKeyID:     params.AccessKeyID,
+			secretAccessKey: params.SecretAccessKey,
+			region:          params.Region,
+		},
+	}, nil
+}
+
+// Uploading content to the bucket under key and returning its object url. The
+// Content-Type metadata entry becomes the object content type, every other entry
+// is stored as x-amz-meta-* user metadata.
+func (sfs *S3FileSystem) Save(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	size, known, err := readerSize(reader)
+	if err != nil {
+		return "", fmt.Errorf("error reading the file size - %w", err)
+	}
+	if !known {
+		// S3 needs the content length upfront. Content fitting in one part is sent as
+		// is, anything larger is streamed a part at a time.
+		part := make([]byte, multipartPartSize)
+		n, err := io.ReadFull(reader, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", fmt.Errorf("error reading the file - %w", err)
+		}
+		if err == nil {
+			return sfs.saveMultipart(ctx, key, part, reader, metadata)
+		}
+		reader, size = bytes.NewReader(part[:n]), int64(n)
+	}
+
+	req, err := sfs.newRequest(ctx, http.MethodPut, key, nil, io.NopCloser(reader))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	setMetadata(req, metadata)
+	resp, err := sfs.do(req, unsignedPayload)
+	if err != nil {
+		return "", fmt.Errorf("error uploading the file to s3 - %w", err)
+	}
+	resp.Body.Close()
+	return sfs.objectURL(key).String(), nil
+}
+
+// Uploading content of unknown size as a multipart upload. part is the buffer the
+// parts are read into, it holds the first part already.
+func (sfs *S3FileSystem) saveMultipart(ctx context.Context, key string, part []byte, reader io.Reader, metadata map[string]string) (string, error) {
+	req, err := sfs.newRequest(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	setMetadata(req, metadata)
+	resp, err := sfs.do(req, emptyPayloadHash)
+	if err != nil {
+		return "", fmt.Errorf("error starting the upload to s3 - %w", err)
+	}
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadId == "" {
+		return "", fmt.Errorf("error parsing the s3 upload id - %v", err)
+	}
+
+	parts, err := sfs.uploadParts(ctx, key, initiated.UploadId, part, reader)
+	if err == nil {
+		err = sfs.completeMultipart(ctx, key, initiated.UploadId, parts)
+	}
+	if err != nil {
+		// Not ctx, it may be the reason the upload failed
+		sfs.abortMultipart(key, initiated.UploadId)
+		return "", fmt.Errorf("error uploading the file to s3 - %w", err)
+	}
+	return sfs.objectURL(key).String(), nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (sfs *S3FileSystem) uploadParts(ctx context.Context, key string, uploadId string, part []byte, reader io.Reader) ([]completedPart, error) {
+	var parts []completedPart
+	size := len(part)
+	for number := 1; size > 0; number++ {
+		query := url.Values{}
+		query.Set("partNumber", strconv.Itoa(number))
+		query.Set("uploadId", uploadId)
+		req, err := sfs.newRequest(ctx, http.MethodPut, key, query, io.NopCloser(bytes.NewReader(part[:size])))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(size)
+		resp, err := sfs.do(req, unsignedPayload)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		size, err = io.ReadFull(reader, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func (sfs *S3FileSystem) completeMultipart(ctx context.Context, key string, uploadId string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("uploadId", uploadId)
+	req, err := sfs.newRequest(ctx, http.MethodPost, key, query, io.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	resp, err := sfs.do(req, hashHex(body))
+	if err != nil {
+		return err
+	}
+	return checkResultBody(resp)
+}
+
+func (sfs *S3FileSystem) abortMultipart(key string, uploadId string) {
+	query := url.Values{}
+	query.Set("uploadId", uploadId)
+	req, err := sfs.newRequest(context.Background(), http.MethodDelete, key, query, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := sfs.do(req, emptyPayloadHash); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Moving an object by copying it within the bucket and deleting the original. The
+// copy keeps the metadata of the original.
+func (sfs *S3FileSystem) Move(ctx context.Context, from string, to string) (string, error) {
+	req, err := sfs.newRequest(ctx, http.MethodPut, to, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("x-amz-copy-source", "/"+uriEncode(sfs.Bucket)+"/"+escapeKey(from))
+	resp, err := sfs.do(req, emptyPayloadHash)
+	if err != nil {
+		return "", fmt.Errorf("error copying the file in s3 - %w", err)
+	}
+	if err := checkResultBody(resp); err != nil {
+		return "", fmt.Errorf("error copying the file in s3 - %w", err)
+	}
+	if err := sfs.Delete(from); err != nil {
+		return "", err
+	}
+	return sfs.objectURL(to).String(), nil
+}
+
+// Presigning a PUT of the object under key so a client can upload it to the bucket
+// directly. headers, e.g. Content-Type and Content-Length, are signed and the client
+// must send them as given.
+func (sfs *S3FileSystem) PresignPut(key string, headers map[string]string, expires time.Duration) (string, error) {
+	req, err := sfs.newRequest(context.Background(), http.MethodPut, key, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	sfs.signer.Presign(req, headers, expires, time.Now())
+	return req.URL.String(), nil
+}
+
+// Copies and completed uploads can fail after S3 answered 200, the error is then
+// in the body
+func checkResultBody(resp *http.Response) error {
+	defer resp.Body.Close()
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&result); err != nil && err != io.EOF {
+		return fmt.Errorf("error parsing s3 response - %w", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 %s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, result.Code, result.Message)
+	}
+	return nil
+}
+
+func setMetadata(req *http.Request, metadata map[string]string) {
+	for name, value := range metadata {
+		if strings.EqualFold(name, "Content-Type") {
+			req.Header.Set("Content-Type", value)
+			continue
+		}
+		req.Header.Set("x-amz-meta-"+strings.ToLower(name), value)
+	}
+}
+
+// Getting the size and last modified time of an object
+func (sfs *S3FileSystem) Stat(key string) (fs.FileInfo, error) {
+	req, err := sfs.newRequest(context.Background(), http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sfs.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file info in s3 - %w", err)
+	}
+	resp.Body.Close()
+
+	info := objectInfo{
+		name: path.Base(key),
+		size: resp.ContentLength,
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.modTime = modTime
+	}
+	return info, nil
+}
+
+// Deleting an object, S3 reports success for objects that do not exist
+func (sfs *S3FileSystem) Delete(key string) error {
+	req, err := sfs.newRequest(context.Background(), http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := sfs.do(req, emptyPayloadHash)
+	if err != nil {
+		return fmt.Errorf("error deleting the file in s3 - %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Listing the keys of all objects starting with prefix, following continuation tokens
+func (sfs *S3FileSystem) List(prefix string) ([]string, error) {
+	var keys []string
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		req, err := sfs.newRequest(context.Background(), http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := sfs.do(req, emptyPayloadHash)
+		if err != nil {
+			return nil, fmt.Errorf("error listing files in s3 - %w", err)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing s3 listing - %w", err)
+		}
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// Opening an object for reading. The returned reader fetches byte ranges lazily
+// so seeking does not download the skipped part of the object.
+func (sfs *S3FileSystem) Open(key string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	info, err := sfs.Stat(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening the file in s3 - %w", err)
+	}
+	return &object{fileSystem: sfs, key: key, size: info.Size()}, info, nil
+}
+
+// Object url of key, an empty key addresses the bucket itself
+func (sfs *S3FileSystem) objectURL(key string) *url.URL {
+	u := *sfs.Endpoint
+	escapedKey := escapeKey(key)
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if sfs.PathStyle {
+		u.Path = basePath + "/" + sfs.Bucket + "/" + strings.TrimPrefix(key, "/")
+		u.RawPath = basePath + "/" + uriEncode(sfs.Bucket) + "/" + escapedKey
+	} else {
+		u.Host = sfs.Bucket + "." + u.Host
+		u.Path = basePath + "/" + strings.TrimPrefix(key, "/")
+		u.RawPath = basePath + "/" + escapedKey
+	}
+	return &u
+}
+
+// Each segment of key uri encoded
+func escapeKey(key string) string {
+	segments := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (sfs *S3FileSystem) newRequest(ctx context.Context, method string, key string, query url.Values, body io.ReadCloser) (*http.Request, error) {
+	u := sfs.objectURL(key)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating s3 request - %w", err)
+	}
+	if body != nil {
+		req.Body = body
+	}
+	return req, nil
+}
+
+// Sign and send a request, turning non 2xx responses into errors. A missing
+// object or bucket is reported as fs.ErrNotExist.
+func (sfs *S3FileSystem) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	sfs.signer.Sign(req, payloadHash, time.Now())
+	resp, err := sfs.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var s3Error struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&s3Error)
+	if s3Error.Code == "" {
+		s3Error.Code = resp.Status
+	}
+	err = fmt.Errorf("s3 %s %s: %s %s", req.Method, req.URL.Path, s3Error.Code, s3Error.Message)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s - %w", err.Error(), fs.ErrNotExist)
+	}
+	return nil, err
+}
+
+// object is a seekable reader over an s3 object backed by ranged GET requests
+type object struct {
+	fileSystem *S3FileSystem
+	key        string
+	size       int64
+	offset     int64
+	body       io.ReadCloser
+}
+
+func (o *object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := o.fileSystem.newRequest(context.Background(), http.MethodGet, o.key, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+		resp, err := o.fileSystem.do(req, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *object) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = o.offset + offset
+	case io.SeekEnd:
+		target = o.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if target < 0 {
+		return 0, errors.New("negative position")
+	}
+	if target != o.offset && o.body != nil {
+		// The open response streams from the old offset, a new range is needed
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = target
+	return target, nil
+}
+
+func (o *object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// objectInfo describes an s3 object as a fs.FileInfo
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (oi objectInfo) Name() string       { return oi.name }
+func (oi objectInfo) Size() int64        { return oi.size }
+func (oi objectInfo) Mode() fs.FileMode  { return 0444 }
+func (oi objectInfo) ModTime() time.Time { return oi.modTime }
+func (oi objectInfo) IsDir() bool        { return false }
+func (oi objectInfo) Sys() interface{}   { return nil }
+
+// readerSize returns the number of bytes left in reader, known is false for readers
+// that can't tell without being read
+func readerSize(reader io.Reader) (int64, bool, error) {
+	switch r := reader.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true, nil
+	case io.Seeker:
+		current, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false, err
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false, err
+		}
+		if _, err := r.Seek(current, io.SeekStart); err != nil {
+			return 0, false, err
+		}
+		return end - current, true, nil
+	}
+	return 0, false, nil
+}
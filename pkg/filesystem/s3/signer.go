@@ -0,0 +1,176 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+	amzShortFormat   = "20060102"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// signer implements AWS Signature Version 4 for the s3 service.
+type signer struct {
+	accessKeyID     string
+	secretAccessKey string
+	region          string
+}
+
+// Sign adds the x-amz-date, x-amz-content-sha256 and Authorization headers to
+// the request. payloadHash is the hex sha256 of the body or UNSIGNED-PAYLOAD.
+func (s signer) Sign(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("x-amz-date", now.UTC().Format(amzDateFormat))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	canonicalHeaders, signedHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	signature := s.signature(canonicalRequest, now)
+
+	req.Header.Set("Authorization", signingAlgorithm+
+		" Credential="+s.accessKeyID+"/"+s.scope(now)+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+// Presign adds the query parameters authorizing the request to its url, which then
+// works for anyone holding it until expires. headers are signed along with the host,
+// the request sent with the url must carry them as given. The payload isn't signed.
+func (s signer) Presign(req *http.Request, headers map[string]string, expires time.Duration, now time.Time) {
+	signed := map[string]string{"host": requestHost(req)}
+	for name, value := range headers {
+		signed[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	canonicalHeaders, signedHeaders := formatHeaders(signed)
+
+	query := req.URL.Query()
+	query.Set("X-Amz-Algorithm", signingAlgorithm)
+	query.Set("X-Amz-Credential", s.accessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.UTC().Format(amzDateFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", signedHeaders)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(canonicalRequest, now))
+	req.URL.RawQuery = canonicalQuery(query)
+}
+
+func (s signer) scope(now time.Time) string {
+	return now.UTC().Format(amzShortFormat) + "/" + s.region + "/s3/aws4_request"
+}
+
+// Hex signature of a canonical request made at now
+func (s signer) signature(canonicalRequest string, now time.Time) string {
+	stringToSign := strings.Join([]string{
+		signingAlgorithm,
+		now.UTC().Format(amzDateFormat),
+		s.scope(now),
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), now.UTC().Format(amzShortFormat))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// Host and every x-amz-*, range and content-type header take part in the signature
+func canonicalHeaders(req *http.Request) (string, string) {
+	headers := map[string]string{"host": requestHost(req)}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	return formatHeaders(headers)
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host == "" {
+		return req.URL.Host
+	}
+	return req.Host
+}
+
+// Canonical headers and the list of their names, by lower case name
+func formatHeaders(headers map[string]string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return canonical.String(), strings.Join(names, ";")
+}
+
+// S3 signs the path exactly as sent, each segment uri encoded once
+func canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes everything except the unreserved characters of RFC 3986
+func uriEncode(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -2,12 +2,14 @@ package httputils
 
 import (
 	"net/http"
+	"time"
 )
 
 type Error struct {
 	StatusCode int
 	Err        error
 	Message    string
+	RetryAfter time.Duration // sent as the Retry-After header when set
 }
 
 func NewBadRequestError(err error, msg string) Error {
@@ -33,3 +35,79 @@ func NewNotFoundError(err error, msg string) Error {
 		Message:    msg,
 	}
 }
+
+func NewUnauthorizedError(err error, msg string) Error {
+	return Error{
+		StatusCode: http.StatusUnauthorized,
+		Err:        err,
+		Message:    msg,
+	}
+}
+
+func NewForbiddenError(err error, msg string) Error {
+	return Error{
+		StatusCode: http.StatusForbidden,
+		Err:        err,
+		Message:    msg,
+	}
+}
+
+func NewUnsupportedMediaTypeError(err error, msg string) Error {
+	return Error{
+		StatusCode: http.StatusUnsupportedMediaType,
+		Err:        err,
+		Message:    msg,
+	}
+}
+
+func NewRequestEntityTooLargeError(err error, msg string) Error {
+	return Error{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Err:        err,
+		Message:    msg,
+	}
+}
+
+func NewConflictError(err error, msg string) Error {
+	return Error{
+		StatusCode: http.StatusConflict,
+		Err:        err,
+		Message:    msg,
+	}
+}
+
+func NewUnprocessableEntityError(err error, msg string) Error {
+	return Error{
+		StatusCode: http.StatusUnprocessableEntity,
+		Err:        err,
+		Message:    msg,
+	}
+}
+
+func NewPreconditionFailedError(err error, msg string) Error {
+	return Error{
+		StatusCode: http.StatusPreconditionFailed,
+		Err:        err,
+		Message:    msg,
+	}
+}
+
+func NewServiceUnavailableError(err error, msg string, retryAfter time.Duration) Error {
+	return Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Err:        err,
+		Message:    msg,
+		RetryAfter: retryAfter,
+	}
+}
+
+// StatusChecksumMismatch is the status resumable uploads answer a chunk failing its checksum with
+const StatusChecksumMismatch = 460
+
+func NewChecksumMismatchError(err error, msg string) Error {
+	return Error{
+		StatusCode: StatusChecksumMismatch,
+		Err:        err,
+		Message:    msg,
+	}
+}
@@ -3,8 +3,10 @@ package httputils
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
@@ -25,6 +27,9 @@ func WriteErrorResponse(w http.ResponseWriter, err Error) {
 		"message": err.Message,
 		"error":   err.Err.Error(),
 	}
+	if err.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(err.RetryAfter.Seconds())))
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(err.StatusCode)
 	json.NewEncoder(w).Encode(errorTrace)
@@ -38,3 +43,33 @@ func GetUrlParam(r *http.Request, paramName string) (string, error) {
 	}
 	return param, nil
 }
+
+// LimitedBody caps a request body with http.MaxBytesReader and remembers whether
+// reading failed because the body is over the cap
+type LimitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+// LimitBody replaces the body of r with one failing past limit bytes
+func LimitBody(w http.ResponseWriter, r *http.Request, limit int64) *LimitedBody {
+	body := &LimitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), limit: limit}
+	r.Body = body
+	return body
+}
+
+func (lb *LimitedBody) Read(p []byte) (int, error) {
+	n, err := lb.ReadCloser.Read(p)
+	lb.read += int64(n)
+	if err != nil && err != io.EOF && lb.read >= lb.limit {
+		lb.exceeded = true
+	}
+	return n, err
+}
+
+// Exceeded tells whether the body turned out larger than the limit
+func (lb *LimitedBody) Exceeded() bool {
+	return lb.exceeded
+}
@@ -1,145 +1,346 @@
 package converter
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"image/jpeg"
-	"os"
-	"path/filepath"
+	"image"
+	"io"
+	"path"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/filesystem"
 	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
+	"github.com/ksindhwani/imagegram/pkg/internal/encoder"
+	"github.com/ksindhwani/imagegram/pkg/internal/placeholder"
 	"github.com/ksindhwani/imagegram/pkg/internal/tables"
-	"github.com/nfnt/resize"
+	"github.com/ksindhwani/imagegram/pkg/worker"
 )
 
 const CONVERTED_IMAGE_SUBDIRECTORY = "converted"
 
-type ImageConversionResponse struct {
-	ImageId                int64
-	ImageName              string
-	ImageLocation          string
-	ConvertedImageName     string
-	ConvertedImageLocation string
-	ConversionStatus       bool
-	Error                  error
+// Memory reserved per decoded byte, for the upright and resized copies made from it
+const decodeMemoryFactor = 2
+
+// DecodeOptions decides which images are decoded and bounds what decoding them may take
+type DecodeOptions struct {
+	decoder.Pipeline
+	// Slots bounds the images decoded at once, shared by everything decoding in the
+	// process like Memory, nil for no bound
+	Slots *worker.Semaphore
+	// Memory is shared by everything decoding in the process, nil for no bound
+	Memory *worker.WeightedSemaphore
+	// Wait is the longest decoding waits for a slot and memory before failing with
+	// ErrDecodeBusy, 0 waits as long as the context lasts
+	Wait time.Duration
 }
 
-func ConvertImagesIntoJpgAndSize(
-	images []tables.ImageTable,
-	config *config.Config,
-	length int,
-	width int,
-) ([]ImageConversionResponse, []ImageConversionResponse, error) {
+// Wait until a slot and the memory to decode the image are available, at most Wait
+func (o DecodeOptions) reserve(ctx context.Context, header decoder.Header) (func(), error) {
+	if o.Wait <= 0 {
+		return o.acquire(ctx, header)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, o.Wait)
+	defer cancel()
+	release, err := o.acquire(waitCtx, header)
+	if err != nil && ctx.Err() == nil {
+		return nil, ErrDecodeBusy
+	}
+	return release, err
+}
 
-	destinationDirectory, err := createDestinationDirectory(config.HostImageDirectory)
+func (o DecodeOptions) acquire(ctx context.Context, header decoder.Header) (func(), error) {
+	if o.Slots != nil {
+		if err := o.Slots.Acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	releaseSlot := func() {
+		if o.Slots != nil {
+			o.Slots.Release()
+		}
+	}
+	if o.Memory == nil {
+		return releaseSlot, nil
+	}
+	weight, err := o.Memory.Acquire(ctx, decoder.DecodedSize(header.Config)*decodeMemoryFactor+o.FramesSize(header))
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to create subdirectory for images - %w", err)
+		releaseSlot()
+		return nil, err
 	}
+	return func() {
+		o.Memory.Release(weight)
+		releaseSlot()
+	}, nil
+}
+
+// ErrDecodeBusy is returned when no decode slot or memory frees up within the wait,
+// decoding may be tried again later
+var ErrDecodeBusy = errors.New("too many images are being decoded")
 
-	return convertImages(images, config.HostImageDirectory, destinationDirectory, length, width)
+// Decode an image from reader within the bounds of the options, waiting at most wait
+// for a slot and the memory it takes. release hands them back once the image is no
+// longer used.
+func (o DecodeOptions) DecodeWithin(ctx context.Context, reader io.Reader, wait time.Duration) (img image.Image, release func(), err error) {
+	header, rest, err := o.ReadHeader(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	o.Wait = wait
+	release, err = o.reserve(ctx, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err = o.DecodeWithHeader(header, rest)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return img, release, nil
 }
 
-func convertImages(
-	files []tables.ImageTable,
-	sourceDir string,
-	destinationDir string,
-	length int,
-	width int,
+type ImageConversionResponse struct {
+	ImageId          int64
+	ImageName        string
+	ImageLocation    string
+	Renditions       []RenditionResult
+	Metadata         ImageMetadata
+	ConversionStatus bool
+	Rejected         bool // the image can never be converted, e.g. it is too large
+	Error            error
+}
+
+// ImageMetadata is what we keep from an original, read from its EXIF data when present
+type ImageMetadata struct {
+	Width       int // upright size of the original
+	Height      int
+	Orientation int // EXIF orientation applied before resizing
+	CapturedAt  time.Time
+	CameraMake  string
+	CameraModel string
+	BlurHash    string // placeholder shown while a rendition loads
+	Color       string // dominant #rrggbb color
+	// PerceptualHash finds copies of the image, see PerceptualHash
+	PerceptualHash uint64
+}
+
+// RenditionResult describes one converted JPEG of an image
+type RenditionResult struct {
+	Name       string
+	Mode       string // resize mode, see config.Rendition.ResizeMode
+	Width      int
+	Height     int
+	StorageKey string
+	Location   string
+	Size       int64
+	Encoding   encoder.Options // quality, progressive and chroma the JPEG was written with
+}
+
+// RenditionKey is the file system key of an image's rendition
+func RenditionKey(imageId int64, name string) string {
+	return path.Join(CONVERTED_IMAGE_SUBDIRECTORY, strconv.FormatInt(imageId, 10), name+".jpg")
+}
+
+// Convert every image into each of the renditions. Each image is decoded once and
+// all its renditions are produced from the decoded image.
+func ConvertImagesIntoRenditions(
+	ctx context.Context,
+	images []tables.ImageTable,
+	fileSystem filesystem.FileSystem,
+	renditions config.Renditions,
+	options DecodeOptions,
 ) ([]ImageConversionResponse, []ImageConversionResponse, error) {
 
 	var successfullConversions []ImageConversionResponse
 	var failedConversions []ImageConversionResponse
 
-	// Process each file in the source directory
-	for _, file := range files {
-		imageFilePath := filepath.Join(sourceDir, file.ImageFileName)
-
-		// Check if the file is an image
-		if isImage(imageFilePath) {
-
-			// Open the image file
-			imageFile, err := os.Open(imageFilePath)
-			if err != nil {
-				failedConversions = addToFailedConversion(failedConversions, file, fmt.Errorf("error opening image: %w", err))
-				continue
-			}
-			defer imageFile.Close()
-
-			// Decode the image
-			imageExtension := strings.ToLower(filepath.Ext(imageFilePath))
-			fileWithoutExt := file.ImageFileName[:len(file.ImageFileName)-len(imageExtension)]
-			img, err := decoder.New(imageExtension).Decode(imageFile)
-			if err != nil {
-				failedConversions = addToFailedConversion(failedConversions, file, fmt.Errorf("error decoding image: %w", err))
-				continue
-			}
-
-			// Resize the image to length * width pixels
-			resizedImg := resize.Resize(uint(length), uint(width), img, resize.Lanczos3)
-			convertedFileName := strconv.FormatInt(file.ImageId, 10) + "converted" + fileWithoutExt + ".jpg"
-
-			// Create the destination file path
-			destinationFilePath := filepath.Join(destinationDir, convertedFileName)
-
-			// Create the destination file
-			destinationFile, err := createConvertedFile(destinationFilePath)
-			if err != nil {
-				failedConversions = addToFailedConversion(failedConversions, file, fmt.Errorf("error creating destination file: %w", err))
-				continue
-			}
-			defer destinationFile.Close()
-
-			// Encode the resized image as JPEG and save it to the destination file
-			err = jpeg.Encode(destinationFile, resizedImg, nil)
-			if err != nil {
-				failedConversions = addToFailedConversion(failedConversions, file, fmt.Errorf("error encoding image: %w", err))
-				continue
-			}
-
-			successfullConversions = addToSuccessfulConversion(successfullConversions, file, convertedFileName, destinationFilePath)
+	// Process each image, reading the original and writing the result through the file system
+	for _, file := range images {
+		if err := ctx.Err(); err != nil {
+			return successfullConversions, failedConversions, err
+		}
+
+		results, metadata, err := convertImage(ctx, fileSystem, file, renditions, options)
+		if err != nil {
+			failedConversions = addToFailedConversion(failedConversions, file, err)
+			continue
 		}
+		successfullConversions = addToSuccessfulConversion(successfullConversions, file, results, metadata)
 	}
 
 	return successfullConversions, failedConversions, nil
 }
 
-func createConvertedFile(filePath string) (*os.File, error) {
-	// Check if the file already exists
-	_, err := os.Stat(filePath)
-	if err == nil {
-		// File exists, remove it
-		err := os.Remove(filePath)
+// Decode one image, compute its placeholder and perceptual hash and save each
+// rendition of it
+func convertImage(
+	ctx context.Context,
+	fileSystem filesystem.FileSystem,
+	file tables.ImageTable,
+	renditions config.Renditions,
+	options DecodeOptions,
+) ([]RenditionResult, ImageMetadata, error) {
+	img, metadata, release, err := decodeImage(ctx, fileSystem, file, options)
+	if err != nil {
+		return nil, ImageMetadata{}, err
+	}
+	defer release()
+
+	preview, err := placeholder.New(img)
+	if err != nil {
+		return nil, ImageMetadata{}, err
+	}
+	metadata.BlurHash = preview.BlurHash
+	metadata.Color = preview.DominantColor
+	metadata.PerceptualHash = PerceptualHash(img)
+
+	results := make([]RenditionResult, 0, len(renditions))
+	for _, rendition := range renditions {
+		result, err := saveRendition(ctx, fileSystem, img, rendition, RenditionKey(file.ImageId, rendition.Name))
 		if err != nil {
-			return nil, fmt.Errorf("error removing existing file: %w", err)
+			return nil, ImageMetadata{}, err
 		}
-	} else if !os.IsNotExist(err) {
-		// Error occurred while checking file existence
-		return nil, fmt.Errorf("error checking file existence: %w", err)
+		results = append(results, result)
 	}
-	// Create the new file
-	file, err := os.Create(filePath)
+	return results, metadata, nil
+}
+
+// Decode an image turned upright as its EXIF orientation says. The header is checked
+// against the limits first, release hands back the memory the image takes.
+func decodeImage(
+	ctx context.Context,
+	fileSystem filesystem.FileSystem,
+	file tables.ImageTable,
+	options DecodeOptions,
+) (img image.Image, metadata ImageMetadata, release func(), err error) {
+	// Open the image file
+	imageFile, _, err := fileSystem.Open(file.StorageKey)
+	if err != nil {
+		return nil, ImageMetadata{}, nil, fmt.Errorf("error opening image: %w", err)
+	}
+	defer imageFile.Close()
+
+	// The format is sniffed from the content, the file name may lie about it
+	header, rest, err := options.ReadHeader(imageFile)
+	if err != nil {
+		return nil, ImageMetadata{}, nil, err
+	}
+	release, err = options.reserve(ctx, header)
+	if err != nil {
+		return nil, ImageMetadata{}, nil, err
+	}
+	img, err = options.DecodeWithHeader(header, rest)
+	if err != nil {
+		release()
+		return nil, ImageMetadata{}, nil, err
+	}
+
+	bounds := img.Bounds()
+	return img, ImageMetadata{
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Orientation: header.Exif.Orientation,
+		CapturedAt:  header.Exif.CaptureTime,
+		CameraMake:  header.Exif.Make,
+		CameraModel: header.Exif.Model,
+	}, release, nil
+}
+
+// Saver stores encoded renditions, a filesystem.FileSystem or a filesystem.Cache
+type Saver interface {
+	Save(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error)
+}
+
+// Produce one rendition of an image and store it under storageKey through saver,
+// used for sizes asked for on demand rather than configured
+func ConvertImageIntoDerivative(
+	ctx context.Context,
+	file tables.ImageTable,
+	fileSystem filesystem.FileSystem,
+	saver Saver,
+	rendition config.Rendition,
+	storageKey string,
+	options DecodeOptions,
+) (RenditionResult, error) {
+	img, _, release, err := decodeImage(ctx, fileSystem, file, options)
+	if err != nil {
+		return RenditionResult{}, err
+	}
+	defer release()
+	return saveRendition(ctx, saver, img, rendition, storageKey)
+}
+
+func saveRendition(
+	ctx context.Context,
+	saver Saver,
+	img image.Image,
+	rendition config.Rendition,
+	storageKey string,
+) (RenditionResult, error) {
+	// Resize the image into the rendition's box
+	resizedImg := resizeImage(img, rendition)
+
+	// Encode the resized image as JPEG and save it through the file system
+	encoded, encoding, err := encodeRendition(resizedImg, rendition)
+	if err != nil {
+		return RenditionResult{}, fmt.Errorf("error encoding %s rendition: %w", rendition.Name, err)
+	}
+	// Renditions are served publicly, they must never carry EXIF data such as GPS positions
+	if decoder.HasMetadata(encoded) {
+		return RenditionResult{}, fmt.Errorf("%s rendition carries metadata", rendition.Name)
+	}
+	size := int64(len(encoded))
+	location, err := saver.Save(ctx, storageKey, bytes.NewReader(encoded), map[string]string{
+		"Content-Type": "image/jpeg",
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error creating file: %w", err)
+		return RenditionResult{}, fmt.Errorf("error saving %s rendition: %w", rendition.Name, err)
 	}
-	return file, nil
+	bounds := resizedImg.Bounds()
+	return RenditionResult{
+		Name:       rendition.Name,
+		Mode:       rendition.ResizeMode(),
+		Width:      bounds.Dx(),
+		Height:     bounds.Dy(),
+		StorageKey: storageKey,
+		Location:   location,
+		Size:       size,
+		Encoding:   encoding,
+	}, nil
+}
+
+// Encode a rendition with its JPEG settings, lowering the quality to fit MaxBytes
+func encodeRendition(img image.Image, rendition config.Rendition) ([]byte, encoder.Options, error) {
+	options := encoder.Options{
+		Quality:     rendition.Quality,
+		Progressive: rendition.Progressive,
+		Chroma:      rendition.Chroma,
+	}
+	if rendition.MaxBytes > 0 {
+		return encoder.EncodeWithinBudget(img, options, rendition.MaxBytes)
+	}
+	var encoded bytes.Buffer
+	used, err := encoder.Encode(&encoded, img, options)
+	return encoded.Bytes(), used, err
 }
 
 func addToSuccessfulConversion(
 	successfullConversions []ImageConversionResponse,
 	file tables.ImageTable,
-	convertedFileName,
-	destinationFilePath string,
+	renditions []RenditionResult,
+	metadata ImageMetadata,
 ) []ImageConversionResponse {
 	response := ImageConversionResponse{
-		ImageId:                file.ImageId,
-		ImageName:              file.ImageFileName,
-		ImageLocation:          file.Location,
-		ConvertedImageName:     convertedFileName,
-		ConvertedImageLocation: destinationFilePath,
-		ConversionStatus:       true,
-		Error:                  nil,
+		ImageId:          file.ImageId,
+		ImageName:        file.ImageFileName,
+		ImageLocation:    file.Location,
+		Renditions:       renditions,
+		Metadata:         metadata,
+		ConversionStatus: true,
+		Error:            nil,
 	}
 	successfullConversions = append(successfullConversions, response)
 	return successfullConversions
@@ -151,39 +352,21 @@ func addToFailedConversion(failedConversions []ImageConversionResponse, file tab
 		ImageName:        file.ImageFileName,
 		ImageLocation:    file.Location,
 		ConversionStatus: false,
+		Rejected:         IsRejected(err),
 		Error:            err,
 	}
 	failedConversions = append(failedConversions, response)
 	return failedConversions
 }
 
-func createDestinationDirectory(hostDirectory string) (string, error) {
-	// Create the full path to the subdirectory
-	subDirPath := filepath.Join(hostDirectory, CONVERTED_IMAGE_SUBDIRECTORY)
-
-	// Check if the subdirectory already exists
-	if _, err := os.Stat(subDirPath); os.IsNotExist(err) {
-		// Create the subdirectory and its parent directories
-		err := os.MkdirAll(subDirPath, 0755) // 0755 sets the directory's permission
-		if err != nil {
-			return "", err
-		}
-	}
-	return subDirPath, nil
+// IsRejected reports whether a conversion error is down to the image itself, an
+// unsupported format or a size over the limits, so retrying is pointless
+func IsRejected(err error) bool {
+	var unsupported *decoder.UnsupportedFormatError
+	var tooLarge *decoder.TooLargeError
+	return errors.As(err, &unsupported) || errors.As(err, &tooLarge)
 }
 
 func (icr ImageConversionResponse) ToString() string {
 	return fmt.Sprintf("%s: %s", icr.ImageLocation, icr.Error.Error())
 }
-
-// Helper function to check if a file has an image extension
-func isImage(filename string) bool {
-	extensions := []string{".jpg", ".jpeg", ".png", ".bmp", ".gif"}
-	ext := strings.ToLower(filepath.Ext(filename))
-	for _, e := range extensions {
-		if ext == e {
-			return true
-		}
-	}
-	return false
-}
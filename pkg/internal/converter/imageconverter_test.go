@@ -0,0 +1,218 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
+	"github.com/ksindhwani/imagegram/pkg/internal/encoder"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/worker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertImagesIntoRenditions(t *testing.T) {
+	fileSystem := local.New("test host directory", t.TempDir())
+
+	source := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	source.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, source))
+	_, err := fileSystem.Save(context.Background(), "photo.png", bytes.NewReader(encoded.Bytes()), nil)
+	assert.Nil(t, err)
+	_, err = fileSystem.Save(context.Background(), "broken.png", bytes.NewReader(encoded.Bytes()[:40]), nil)
+	assert.Nil(t, err)
+	_, err = fileSystem.Save(context.Background(), "notes.png", bytes.NewReader([]byte("not an image")), nil)
+	assert.Nil(t, err)
+
+	images := []tables.ImageTable{
+		{ImageId: 1, ImageFileName: "my photo.png", StorageKey: "photo.png", Location: "photo location"},
+		{ImageId: 2, ImageFileName: "broken.png", StorageKey: "broken.png", Location: "broken location"},
+		{ImageId: 3, ImageFileName: "missing.png", StorageKey: "missing.png", Location: "missing location"},
+		{ImageId: 4, ImageFileName: "notes.png", StorageKey: "notes.png", Location: "notes location"},
+	}
+	renditions := config.Renditions{
+		{Name: "thumb", Width: 10, Height: 10, Mode: config.RESIZE_FILL, Crop: config.CROP_CENTER},
+		{Name: "feed", Width: 30, Height: 20, Mode: config.RESIZE_FIT},
+	}
+	successful, failed, err := ConvertImagesIntoRenditions(context.Background(), images, fileSystem, renditions, DecodeOptions{})
+	assert.Nil(t, err)
+
+	assert.Len(t, successful, 1)
+	assert.Equal(t, int64(1), successful[0].ImageId)
+	assert.Len(t, successful[0].Renditions, 2)
+	assert.Equal(t, "thumb", successful[0].Renditions[0].Name)
+	assert.Equal(t, "converted/1/thumb.jpg", successful[0].Renditions[0].StorageKey)
+	assert.Equal(t, "converted/1/feed.jpg", successful[0].Renditions[1].StorageKey)
+	assert.Equal(t, "fill:center", successful[0].Renditions[0].Mode)
+	assert.Equal(t, 10, successful[0].Renditions[0].Width)
+	assert.Equal(t, 10, successful[0].Renditions[0].Height)
+	assert.Equal(t, "fit", successful[0].Renditions[1].Mode)
+	assert.Equal(t, 30, successful[0].Renditions[1].Width)
+	assert.Equal(t, 15, successful[0].Renditions[1].Height)
+
+	assert.Len(t, failed, 3)
+	assert.Equal(t, int64(2), failed[0].ImageId)
+	assert.Equal(t, int64(3), failed[1].ImageId)
+	assert.Equal(t, int64(4), failed[2].ImageId)
+	var unsupported *decoder.UnsupportedFormatError
+	assert.ErrorAs(t, failed[2].Error, &unsupported)
+	assert.False(t, failed[0].Rejected)
+	assert.False(t, failed[1].Rejected)
+	assert.True(t, failed[2].Rejected)
+
+	for _, rendition := range successful[0].Renditions {
+		converted, info, err := fileSystem.Open(rendition.StorageKey)
+		assert.Nil(t, err)
+		imageConfig, err := jpeg.DecodeConfig(converted)
+		converted.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, rendition.Width, imageConfig.Width)
+		assert.Equal(t, rendition.Height, imageConfig.Height)
+		assert.Equal(t, rendition.Size, info.Size())
+	}
+}
+
+func TestConvertImageAppliesOrientationAndStripsExif(t *testing.T) {
+	fileSystem := local.New("test host directory", t.TempDir())
+
+	// A landscape JPEG whose EXIF block says it must be rotated 90 degrees to be upright
+	var encoded bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 40, 20)), nil))
+	tiff := []byte{
+		'I', 'I', 42, 0, 8, 0, 0, 0,
+		1, 0, // one entry, orientation SHORT 6
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0,
+		0, 0, 0, 0,
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xFF, 0xE1, 0, byte(len(payload) + 2)}, payload...)
+	original := append(append([]byte{0xFF, 0xD8}, app1...), encoded.Bytes()[2:]...)
+	_, err := fileSystem.Save(context.Background(), "photo.jpg", bytes.NewReader(original), nil)
+	assert.Nil(t, err)
+
+	images := []tables.ImageTable{{ImageId: 1, ImageFileName: "photo.jpg", StorageKey: "photo.jpg"}}
+	renditions := config.Renditions{{Name: "feed", Width: 100, Height: 100, Mode: config.RESIZE_FIT}}
+	successful, failed, err := ConvertImagesIntoRenditions(context.Background(), images, fileSystem, renditions, DecodeOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, failed)
+	assert.Len(t, successful, 1)
+	// The placeholder is of the upright, portrait image
+	assert.Equal(t, ImageMetadata{
+		Width:       20,
+		Height:      40,
+		Orientation: decoder.ORIENTATION_ROTATE_90,
+		BlurHash:    "T00000fQfQfQfQfQfQfQfQfQfQfQ",
+		Color:       "#000000",
+	}, successful[0].Metadata)
+
+	converted, _, err := fileSystem.Open(successful[0].Renditions[0].StorageKey)
+	assert.Nil(t, err)
+	defer converted.Close()
+	data, err := io.ReadAll(converted)
+	assert.Nil(t, err)
+	assert.False(t, decoder.HasMetadata(data))
+	assert.False(t, bytes.Contains(data, []byte("Exif\x00\x00")))
+	imageConfig, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 20, imageConfig.Width)
+	assert.Equal(t, 40, imageConfig.Height)
+}
+
+func TestConvertImagesIntoRenditionsRejectsTooLargeImages(t *testing.T) {
+	fileSystem := local.New("test host directory", t.TempDir())
+	for key, size := range map[string]image.Rectangle{
+		"small.png": image.Rect(0, 0, 40, 20),
+		"wide.png":  image.Rect(0, 0, 120, 10),
+		"large.png": image.Rect(0, 0, 90, 90),
+	} {
+		var encoded bytes.Buffer
+		assert.Nil(t, png.Encode(&encoded, image.NewRGBA(size)))
+		_, err := fileSystem.Save(context.Background(), key, &encoded, nil)
+		assert.Nil(t, err)
+	}
+
+	images := []tables.ImageTable{
+		{ImageId: 1, StorageKey: "small.png"},
+		{ImageId: 2, StorageKey: "wide.png"},
+		{ImageId: 3, StorageKey: "large.png"},
+	}
+	renditions := config.Renditions{{Name: "feed", Width: 30, Height: 30, Mode: config.RESIZE_FIT}}
+	slots := worker.NewSemaphore(1)
+	memory := worker.NewWeightedSemaphore(1 << 20)
+	options := DecodeOptions{
+		Pipeline: decoder.Pipeline{Limits: decoder.Limits{MaxWidth: 100, MaxHeight: 100, MaxPixels: 5000}},
+		Slots:    slots,
+		Memory:   memory,
+	}
+	successful, failed, err := ConvertImagesIntoRenditions(context.Background(), images, fileSystem, renditions, options)
+	assert.Nil(t, err)
+	assert.Len(t, successful, 1)
+	assert.Equal(t, int64(1), successful[0].ImageId)
+
+	assert.Len(t, failed, 2)
+	var tooLarge *decoder.TooLargeError
+	for _, conversion := range failed {
+		assert.True(t, conversion.Rejected)
+		assert.ErrorAs(t, conversion.Error, &tooLarge)
+	}
+	assert.Equal(t, 90, tooLarge.Width)
+
+	// All reserved memory and the decode slot were handed back
+	weight, err := memory.Acquire(context.Background(), 1<<20)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1<<20), weight)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, slots.Acquire(ctx))
+}
+
+func TestConvertImagesIntoRenditionsEncodingSettings(t *testing.T) {
+	fileSystem := local.New("test host directory", t.TempDir())
+	source := image.NewRGBA(image.Rect(0, 0, 120, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 120; x++ {
+			source.Set(x, y, color.RGBA{R: uint8(x * 2), G: uint8(y * 3), B: uint8(x * y), A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, source))
+	_, err := fileSystem.Save(context.Background(), "photo.png", &encoded, nil)
+	assert.Nil(t, err)
+
+	images := []tables.ImageTable{{ImageId: 1, StorageKey: "photo.png"}}
+	renditions := config.Renditions{
+		{Name: "thumb", Width: 60, Height: 40, Mode: config.RESIZE_FIT},
+		{Name: "feed", Width: 120, Height: 80, Mode: config.RESIZE_FIT, Quality: 95, Progressive: true, MaxBytes: 3000},
+		{Name: "large", Width: 120, Height: 80, Mode: config.RESIZE_FIT, Quality: 90, Chroma: config.CHROMA_444},
+	}
+	successful, failed, err := ConvertImagesIntoRenditions(context.Background(), images, fileSystem, renditions, DecodeOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, failed)
+	assert.Len(t, successful, 1)
+
+	results := successful[0].Renditions
+	assert.Equal(t, encoder.Options{Quality: jpeg.DefaultQuality, Chroma: encoder.CHROMA_420}, results[0].Encoding)
+	assert.True(t, results[1].Encoding.Progressive)
+	assert.Equal(t, encoder.CHROMA_444, results[1].Encoding.Chroma)
+	assert.Less(t, results[1].Encoding.Quality, 95)
+	assert.LessOrEqual(t, results[1].Size, int64(3000))
+	assert.Equal(t, encoder.Options{Quality: 90, Chroma: encoder.CHROMA_444}, results[2].Encoding)
+
+	for _, rendition := range results {
+		converted, _, err := fileSystem.Open(rendition.StorageKey)
+		assert.Nil(t, err)
+		_, err = jpeg.Decode(converted)
+		converted.Close()
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,40 @@
+package converter
+
+import (
+	"image"
+	"math/bits"
+
+	"github.com/nfnt/resize"
+)
+
+// PerceptualHash is the 64 bit difference hash (dHash) of an image. The image is
+// shrunk to 9x8 grey pixels and each bit tells whether a pixel is brighter than its
+// right neighbour, so resized, recompressed or slightly edited copies of an image
+// get hashes only a few bits apart.
+func PerceptualHash(img image.Image) uint64 {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	bounds := small.Bounds()
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		left := luminance(small, bounds.Min.X, bounds.Min.Y+y)
+		for x := 1; x < 9; x++ {
+			right := luminance(small, bounds.Min.X+x, bounds.Min.Y+y)
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+			left = right
+		}
+	}
+	return hash
+}
+
+// HammingDistance is the number of bits two perceptual hashes differ by
+func HammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func luminance(img image.Image, x int, y int) uint32 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (299*r + 587*g + 114*b) / 1000
+}
@@ -0,0 +1,45 @@
+package converter
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPerceptualHash(t *testing.T) {
+	// Bright left half, detail on the right
+	original := image.NewRGBA(image.Rect(0, 0, 360, 240))
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 360; x++ {
+			value := uint8(255 - x*255/360)
+			if x > 180 && (x/20+y/20)%2 == 0 {
+				value = 40
+			}
+			original.Set(x, y, color.RGBA{R: value, G: value, B: value, A: 255})
+		}
+	}
+
+	// A resized and recompressed copy is close, a flipped one is not
+	resized := resizeImage(original, config.Rendition{Width: 120, Height: 120, Mode: config.RESIZE_FIT})
+	var encoded bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&encoded, resized, &jpeg.Options{Quality: 40}))
+	recompressed, err := jpeg.Decode(&encoded)
+	assert.Nil(t, err)
+	flipped := image.NewRGBA(original.Bounds())
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 360; x++ {
+			flipped.Set(359-x, y, original.At(x, y))
+		}
+	}
+
+	hash := PerceptualHash(original)
+	assert.LessOrEqual(t, HammingDistance(hash, PerceptualHash(recompressed)), 4)
+	assert.Greater(t, HammingDistance(hash, PerceptualHash(flipped)), 20)
+	assert.Equal(t, 0, HammingDistance(hash, hash))
+	assert.Equal(t, 64, HammingDistance(0, ^uint64(0)))
+}
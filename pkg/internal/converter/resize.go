@@ -0,0 +1,127 @@
+package converter
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/nfnt/resize"
+)
+
+// Candidate crop positions tried along the overflowing side by the entropy crop
+const entropyCropSteps = 16
+
+// Resize an image into the box of a rendition according to its mode
+func resizeImage(img image.Image, rendition config.Rendition) image.Image {
+	switch rendition.Mode {
+	case config.RESIZE_FILL:
+		return fill(img, rendition.Width, rendition.Height, rendition.Crop)
+	case config.RESIZE_PAD:
+		return pad(img, rendition.Width, rendition.Height, rendition.Background)
+	}
+	return fit(img, rendition.Width, rendition.Height)
+}
+
+// Scale down to fit within width x height keeping the aspect ratio. Smaller images
+// are left as they are.
+func fit(img image.Image, width int, height int) image.Image {
+	bounds := img.Bounds()
+	fitWidth, fitHeight := fitSize(bounds.Dx(), bounds.Dy(), width, height)
+	if fitWidth == bounds.Dx() && fitHeight == bounds.Dy() {
+		return img
+	}
+	return resize.Resize(uint(fitWidth), uint(fitHeight), img, resize.Lanczos3)
+}
+
+// Scale to cover width x height keeping the aspect ratio and crop the overflow
+func fill(img image.Image, width int, height int, crop string) image.Image {
+	bounds := img.Bounds()
+	scale := math.Max(float64(width)/float64(bounds.Dx()), float64(height)/float64(bounds.Dy()))
+	coverWidth := maxInt(width, int(math.Round(float64(bounds.Dx())*scale)))
+	coverHeight := maxInt(height, int(math.Round(float64(bounds.Dy())*scale)))
+	covered := resize.Resize(uint(coverWidth), uint(coverHeight), img, resize.Lanczos3)
+
+	offset := image.Point{X: (coverWidth - width) / 2, Y: (coverHeight - height) / 2}
+	if crop == config.CROP_ENTROPY {
+		offset = entropyCropOffset(covered, width, height)
+	}
+	cropped := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(cropped, cropped.Bounds(), covered, covered.Bounds().Min.Add(offset), draw.Src)
+	return cropped
+}
+
+// Fit within width x height and center the result on a background of exactly that size
+func pad(img image.Image, width int, height int, background color.RGBA) image.Image {
+	fitted := fit(img, width, height)
+	fittedBounds := fitted.Bounds()
+
+	padded := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(padded, padded.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+	offset := image.Point{X: (width - fittedBounds.Dx()) / 2, Y: (height - fittedBounds.Dy()) / 2}
+	draw.Draw(padded, fittedBounds.Sub(fittedBounds.Min).Add(offset), fitted, fittedBounds.Min, draw.Over)
+	return padded
+}
+
+// Size of a srcWidth x srcHeight image scaled down to fit within width x height
+func fitSize(srcWidth int, srcHeight int, width int, height int) (int, int) {
+	if srcWidth <= width && srcHeight <= height {
+		return srcWidth, srcHeight
+	}
+	scale := math.Min(float64(width)/float64(srcWidth), float64(height)/float64(srcHeight))
+	return maxInt(1, int(math.Round(float64(srcWidth)*scale))), maxInt(1, int(math.Round(float64(srcHeight)*scale)))
+}
+
+// Find the width x height window with the most detail, measured as the entropy of
+// its luminance histogram. Only the overflowing side is searched since the image
+// already covers the window on the other side.
+func entropyCropOffset(img image.Image, width int, height int) image.Point {
+	bounds := img.Bounds()
+	luminance := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(luminance, luminance.Bounds(), img, bounds.Min, draw.Src)
+
+	overflowX := bounds.Dx() - width
+	overflowY := bounds.Dy() - height
+	best := image.Point{}
+	bestEntropy := -1.0
+	for step := 0; step <= entropyCropSteps; step++ {
+		candidate := image.Point{
+			X: overflowX * step / entropyCropSteps,
+			Y: overflowY * step / entropyCropSteps,
+		}
+		entropy := windowEntropy(luminance, image.Rect(candidate.X, candidate.Y, candidate.X+width, candidate.Y+height))
+		if entropy > bestEntropy {
+			best = candidate
+			bestEntropy = entropy
+		}
+	}
+	return best
+}
+
+func windowEntropy(luminance *image.Gray, window image.Rectangle) float64 {
+	var histogram [256]int
+	for y := window.Min.Y; y < window.Max.Y; y++ {
+		row := luminance.Pix[y*luminance.Stride : y*luminance.Stride+luminance.Rect.Dx()]
+		for _, value := range row[window.Min.X:window.Max.X] {
+			histogram[value]++
+		}
+	}
+	total := float64(window.Dx() * window.Dy())
+	entropy := 0.0
+	for _, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+package converter
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResizeImage(t *testing.T) {
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	tests := []struct {
+		Name           string
+		Source         image.Rectangle
+		Rendition      config.Rendition
+		ExpectedWidth  int
+		ExpectedHeight int
+	}{
+		{
+			Name:           "Test fit keeps the aspect ratio",
+			Source:         image.Rect(0, 0, 400, 200),
+			Rendition:      config.Rendition{Width: 100, Height: 100, Mode: config.RESIZE_FIT},
+			ExpectedWidth:  100,
+			ExpectedHeight: 50,
+		},
+		{
+			Name:           "Test fit does not upscale",
+			Source:         image.Rect(0, 0, 40, 20),
+			Rendition:      config.Rendition{Width: 100, Height: 100, Mode: config.RESIZE_FIT},
+			ExpectedWidth:  40,
+			ExpectedHeight: 20,
+		},
+		{
+			Name:           "Test fill covers the box",
+			Source:         image.Rect(0, 0, 400, 200),
+			Rendition:      config.Rendition{Width: 100, Height: 100, Mode: config.RESIZE_FILL, Crop: config.CROP_CENTER},
+			ExpectedWidth:  100,
+			ExpectedHeight: 100,
+		},
+		{
+			Name:           "Test fill upscales small images",
+			Source:         image.Rect(0, 0, 20, 40),
+			Rendition:      config.Rendition{Width: 100, Height: 50, Mode: config.RESIZE_FILL, Crop: config.CROP_ENTROPY},
+			ExpectedWidth:  100,
+			ExpectedHeight: 50,
+		},
+		{
+			Name:           "Test pad fills the box",
+			Source:         image.Rect(0, 0, 400, 200),
+			Rendition:      config.Rendition{Width: 100, Height: 100, Mode: config.RESIZE_PAD, Background: white},
+			ExpectedWidth:  100,
+			ExpectedHeight: 100,
+		},
+	}
+	for _, test := range tests {
+		resized := resizeImage(image.NewRGBA(test.Source), test.Rendition)
+		assert.Equal(t, test.ExpectedWidth, resized.Bounds().Dx(), test.Name)
+		assert.Equal(t, test.ExpectedHeight, resized.Bounds().Dy(), test.Name)
+	}
+}
+
+func TestPadCentersOnBackground(t *testing.T) {
+	black := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(black, black.Bounds(), &image.Uniform{C: color.Black}, image.Point{}, draw.Src)
+	background := color.RGBA{R: 255, A: 255}
+
+	padded := pad(black, 40, 40, background)
+	assert.Equal(t, background, padded.At(20, 5))
+	assert.Equal(t, background, padded.At(20, 35))
+	r, g, b, _ := padded.At(20, 20).RGBA()
+	assert.Equal(t, []uint32{0, 0, 0}, []uint32{r, g, b})
+}
+
+func TestEntropyCropFindsDetail(t *testing.T) {
+	// A flat image with a noisy band on the right, the crop should move onto the band
+	source := image.NewGray(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 200; x < 300; x++ {
+			source.SetGray(x, y, color.Gray{Y: uint8((x*31 + y*17) % 256)})
+		}
+	}
+	offset := entropyCropOffset(source, 100, 100)
+	assert.Equal(t, image.Point{X: 200, Y: 0}, offset)
+
+	centered := fill(source, 100, 100, config.CROP_CENTER)
+	cropped := fill(source, 100, 100, config.CROP_ENTROPY)
+	assert.NotEqual(t, centered, cropped)
+}
@@ -2,7 +2,7 @@ package decoder
 
 import (
 	"image"
-	"os"
+	"io"
 
 	"golang.org/x/image/bmp"
 )
@@ -13,18 +13,13 @@ func NewBMPImageDecoder() *BmpImageDecoder {
 	return &BmpImageDecoder{}
 }
 
-func (jpg *BmpImageDecoder) Decode(file *os.File) (image.Image, error) {
-	img, err := bmp.Decode(file)
-	if err != nil {
-		return nil, err
-	}
-
-	rgba := image.NewRGBA(img.Bounds())
-	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
-		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
-			rgba.Set(x, y, img.At(x, y))
-		}
-	}
+// The decoded image is returned as is, bmp already produces RGBA, NRGBA or paletted
+// images that the resizer reads directly
+func (jpg *BmpImageDecoder) Decode(reader io.Reader) (image.Image, string, error) {
+	img, err := bmp.Decode(reader)
+	return img, "bmp", err
+}
 
-	return rgba, nil
+func (jpg *BmpImageDecoder) DecodeConfig(reader io.Reader) (image.Config, error) {
+	return bmp.DecodeConfig(reader)
 }
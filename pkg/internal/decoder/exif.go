@@ -0,0 +1,314 @@
+package decoder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"strings"
+	"time"
+)
+
+// EXIF orientations, how the stored pixels must be transformed to be upright
+const (
+	ORIENTATION_NORMAL      = 1
+	ORIENTATION_FLIP_H      = 2
+	ORIENTATION_ROTATE_180  = 3
+	ORIENTATION_FLIP_V      = 4
+	ORIENTATION_TRANSPOSE   = 5
+	ORIENTATION_ROTATE_90   = 6
+	ORIENTATION_TRANSVERSE  = 7
+	ORIENTATION_ROTATE_270  = 8
+	exifDateTimeLayout      = "2006:01:02 15:04:05"
+	maxExifIFDEntries       = 512
+	jpegMarkerStartOfImage  = 0xD8
+	jpegMarkerEndOfImage    = 0xD9
+	jpegMarkerStartOfScan   = 0xDA
+	jpegMarkerApp1          = 0xE1
+	tagMake                 = 0x010F
+	tagModel                = 0x0110
+	tagOrientation          = 0x0112
+	tagExifIFD              = 0x8769
+	tagGPSIFD               = 0x8825
+	tagDateTimeOriginal     = 0x9003
+	tagPixelXDimension      = 0xA002
+	tagPixelYDimension      = 0xA003
+	tiffTypeASCII           = 2
+	tiffTypeShort           = 3
+	tiffTypeLong            = 4
+	exifHeader              = "Exif\x00\x00"
+	maxMetadataSegmentBytes = 1 << 16
+)
+
+var (
+	ErrNoExif      = errors.New("no exif data")
+	ErrInvalidExif = errors.New("invalid exif data")
+)
+
+// Exif holds the EXIF fields we keep from an original
+type Exif struct {
+	Orientation int
+	CaptureTime time.Time // zero when unknown, EXIF has no time zone
+	Make        string
+	Model       string
+	Width       int // pixel dimensions recorded by the camera, 0 when unknown
+	Height      int
+	HasGPS      bool
+}
+
+// Read the EXIF segment of a JPEG. Only the segments before the image data are read.
+// ErrNoExif is returned for other formats and JPEGs without EXIF.
+func ParseExif(reader io.Reader) (Exif, error) {
+	segment, err := findExifSegment(bufio.NewReader(reader))
+	if err != nil {
+		return Exif{}, err
+	}
+	return parseTiff(segment)
+}
+
+func findExifSegment(reader *bufio.Reader) ([]byte, error) {
+	var start [2]byte
+	if _, err := io.ReadFull(reader, start[:]); err != nil || start[0] != 0xFF || start[1] != jpegMarkerStartOfImage {
+		return nil, ErrNoExif
+	}
+	for {
+		marker, err := readMarker(reader)
+		if err != nil {
+			return nil, err
+		}
+		if marker == jpegMarkerStartOfScan || marker == jpegMarkerEndOfImage {
+			return nil, ErrNoExif
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// Markers without a payload
+			continue
+		}
+		var lengthBytes [2]byte
+		if _, err := io.ReadFull(reader, lengthBytes[:]); err != nil {
+			return nil, ErrInvalidExif
+		}
+		length := int(binary.BigEndian.Uint16(lengthBytes[:])) - 2
+		if length < 0 {
+			return nil, ErrInvalidExif
+		}
+		if marker != jpegMarkerApp1 {
+			if _, err := reader.Discard(length); err != nil {
+				return nil, ErrInvalidExif
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			return nil, ErrInvalidExif
+		}
+		// APP1 also carries XMP, keep looking when it isn't EXIF
+		if bytes.HasPrefix(segment, []byte(exifHeader)) {
+			return segment[len(exifHeader):], nil
+		}
+	}
+}
+
+// Read the next marker, skipping fill bytes
+func readMarker(reader *bufio.Reader) (byte, error) {
+	value, err := reader.ReadByte()
+	if err != nil || value != 0xFF {
+		return 0, ErrInvalidExif
+	}
+	for value == 0xFF {
+		if value, err = reader.ReadByte(); err != nil {
+			return 0, ErrInvalidExif
+		}
+	}
+	return value, nil
+}
+
+type tiffBlock struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // the 4 byte value or offset field
+}
+
+func parseTiff(data []byte) (Exif, error) {
+	if len(data) < 8 {
+		return Exif{}, ErrInvalidExif
+	}
+	t := tiffBlock{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return Exif{}, ErrInvalidExif
+	}
+	if t.order.Uint16(data[2:4]) != 42 {
+		return Exif{}, ErrInvalidExif
+	}
+
+	ifd0, err := t.ifd(t.order.Uint32(data[4:8]))
+	if err != nil {
+		return Exif{}, err
+	}
+	exif := Exif{
+		Orientation: ORIENTATION_NORMAL,
+		Make:        t.ascii(ifd0[tagMake]),
+		Model:       t.ascii(ifd0[tagModel]),
+	}
+	if orientation, ok := t.uint(ifd0[tagOrientation]); ok && orientation >= ORIENTATION_NORMAL && orientation <= ORIENTATION_ROTATE_270 {
+		exif.Orientation = int(orientation)
+	}
+	_, exif.HasGPS = ifd0[tagGPSIFD]
+
+	if offset, ok := t.uint(ifd0[tagExifIFD]); ok {
+		exifIFD, err := t.ifd(offset)
+		if err != nil {
+			return exif, nil
+		}
+		if captureTime, err := time.Parse(exifDateTimeLayout, t.ascii(exifIFD[tagDateTimeOriginal])); err == nil {
+			exif.CaptureTime = captureTime
+		}
+		if width, ok := t.uint(exifIFD[tagPixelXDimension]); ok {
+			exif.Width = int(width)
+		}
+		if height, ok := t.uint(exifIFD[tagPixelYDimension]); ok {
+			exif.Height = int(height)
+		}
+	}
+	return exif, nil
+}
+
+func (t tiffBlock) ifd(offset uint32) (map[uint16]ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, ErrInvalidExif
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	if count > maxExifIFDEntries || int(offset)+2+count*12 > len(t.data) {
+		return nil, ErrInvalidExif
+	}
+	entries := make(map[uint16]ifdEntry, count)
+	for i := 0; i < count; i++ {
+		raw := t.data[int(offset)+2+i*12:]
+		entry := ifdEntry{
+			tag:   t.order.Uint16(raw[0:2]),
+			typ:   t.order.Uint16(raw[2:4]),
+			count: t.order.Uint32(raw[4:8]),
+			value: raw[8:12],
+		}
+		entries[entry.tag] = entry
+	}
+	return entries, nil
+}
+
+// Value of an ASCII entry, empty when missing or malformed
+func (t tiffBlock) ascii(entry ifdEntry) string {
+	if entry.typ != tiffTypeASCII || entry.count == 0 {
+		return ""
+	}
+	value := entry.value
+	if entry.count > 4 {
+		offset := t.order.Uint32(entry.value)
+		if uint64(offset)+uint64(entry.count) > uint64(len(t.data)) {
+			return ""
+		}
+		value = t.data[offset : offset+entry.count]
+	} else {
+		value = value[:entry.count]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+}
+
+// First value of a SHORT or LONG entry
+func (t tiffBlock) uint(entry ifdEntry) (uint32, bool) {
+	if entry.count == 0 {
+		return 0, false
+	}
+	switch entry.typ {
+	case tiffTypeShort:
+		return uint32(t.order.Uint16(entry.value)), true
+	case tiffTypeLong:
+		return t.order.Uint32(entry.value), true
+	}
+	return 0, false
+}
+
+// Transform an image as its EXIF orientation says so it is upright
+func ApplyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= ORIENTATION_NORMAL || orientation > ORIENTATION_ROTATE_270 {
+		return img
+	}
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= ORIENTATION_TRANSPOSE {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var srcX, srcY int
+			switch orientation {
+			case ORIENTATION_FLIP_H:
+				srcX, srcY = width-1-x, y
+			case ORIENTATION_ROTATE_180:
+				srcX, srcY = width-1-x, height-1-y
+			case ORIENTATION_FLIP_V:
+				srcX, srcY = x, height-1-y
+			case ORIENTATION_TRANSPOSE:
+				srcX, srcY = y, x
+			case ORIENTATION_ROTATE_90:
+				srcX, srcY = y, height-1-x
+			case ORIENTATION_TRANSVERSE:
+				srcX, srcY = width-1-y, height-1-x
+			case ORIENTATION_ROTATE_270:
+				srcX, srcY = width-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(srcX, srcY):src.PixOffset(srcX, srcY)+4])
+		}
+	}
+	return dst
+}
+
+// Report whether a JPEG carries metadata segments, EXIF or XMP in APP1 or comments,
+// before its image data
+func HasMetadata(data []byte) bool {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	var start [2]byte
+	if _, err := io.ReadFull(reader, start[:]); err != nil || start[0] != 0xFF || start[1] != jpegMarkerStartOfImage {
+		return false
+	}
+	for {
+		marker, err := readMarker(reader)
+		if err != nil || marker == jpegMarkerStartOfScan || marker == jpegMarkerEndOfImage {
+			return false
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+		if marker == jpegMarkerApp1 || marker == 0xFE {
+			return true
+		}
+		var lengthBytes [2]byte
+		if _, err := io.ReadFull(reader, lengthBytes[:]); err != nil {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(lengthBytes[:])) - 2
+		if length < 0 || length > maxMetadataSegmentBytes {
+			return false
+		}
+		if _, err := reader.Discard(length); err != nil {
+			return false
+		}
+	}
+}
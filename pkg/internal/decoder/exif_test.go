@@ -0,0 +1,178 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testIFDEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte // stored inline when it fits in 4 bytes
+}
+
+// Build a little endian TIFF block with IFD0 and an EXIF IFD
+func buildTiff(ifd0 []testIFDEntry, exifIFD []testIFDEntry) []byte {
+	order := binary.LittleEndian
+	ifdSize := func(entries []testIFDEntry) int { return 2 + len(entries)*12 + 4 }
+	ifd0Offset := 8
+	if len(exifIFD) > 0 {
+		// The EXIF IFD follows IFD0, which grows by this entry
+		exifOffset := ifd0Offset + ifdSize(ifd0) + 12
+		ifd0 = append(ifd0, testIFDEntry{tag: tagExifIFD, typ: tiffTypeLong, count: 1, data: order.AppendUint32(nil, uint32(exifOffset))})
+	}
+	dataOffset := ifd0Offset + ifdSize(ifd0) + ifdSize(exifIFD)
+
+	var data []byte
+	writeIFD := func(out []byte, entries []testIFDEntry) []byte {
+		out = order.AppendUint16(out, uint16(len(entries)))
+		for _, entry := range entries {
+			out = order.AppendUint16(out, entry.tag)
+			out = order.AppendUint16(out, entry.typ)
+			out = order.AppendUint32(out, entry.count)
+			if len(entry.data) <= 4 {
+				value := make([]byte, 4)
+				copy(value, entry.data)
+				out = append(out, value...)
+				continue
+			}
+			out = order.AppendUint32(out, uint32(dataOffset+len(data)))
+			data = append(data, entry.data...)
+		}
+		return order.AppendUint32(out, 0)
+	}
+
+	out := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	out = writeIFD(out, ifd0)
+	out = writeIFD(out, exifIFD)
+	return append(out, data...)
+}
+
+// Encode a JPEG and insert an APP1 segment after its start of image marker
+func jpegWithApp1(t *testing.T, img image.Image, payload []byte) []byte {
+	var encoded bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&encoded, img, nil))
+	segment := []byte{0xFF, jpegMarkerApp1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	data := encoded.Bytes()
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func ascii(value string) []byte {
+	return append([]byte(value), 0)
+}
+
+func TestParseExif(t *testing.T) {
+	order := binary.LittleEndian
+	img := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	exifBlock := buildTiff(
+		[]testIFDEntry{
+			{tag: tagMake, typ: tiffTypeASCII, count: 6, data: ascii("Canon")},
+			{tag: tagModel, typ: tiffTypeASCII, count: 4, data: ascii("EOS")},
+			{tag: tagOrientation, typ: tiffTypeShort, count: 1, data: order.AppendUint16(nil, ORIENTATION_ROTATE_90)},
+			{tag: tagGPSIFD, typ: tiffTypeLong, count: 1, data: order.AppendUint32(nil, 0)},
+		},
+		[]testIFDEntry{
+			{tag: tagDateTimeOriginal, typ: tiffTypeASCII, count: 20, data: ascii("2023:05:17 10:20:30")},
+			{tag: tagPixelXDimension, typ: tiffTypeLong, count: 1, data: order.AppendUint32(nil, 4000)},
+			{tag: tagPixelYDimension, typ: tiffTypeShort, count: 1, data: order.AppendUint16(nil, 3000)},
+		},
+	)
+
+	tests := []struct {
+		Name          string
+		Input         []byte
+		ExpectedExif  Exif
+		ExpectedError error
+	}{
+		{
+			Name:  "Test exif fields are read",
+			Input: jpegWithApp1(t, img, append([]byte(exifHeader), exifBlock...)),
+			ExpectedExif: Exif{
+				Orientation: ORIENTATION_ROTATE_90,
+				CaptureTime: time.Date(2023, 5, 17, 10, 20, 30, 0, time.UTC),
+				Make:        "Canon",
+				Model:       "EOS",
+				Width:       4000,
+				Height:      3000,
+				HasGPS:      true,
+			},
+		},
+		{
+			Name:          "Test xmp segment is not exif",
+			Input:         jpegWithApp1(t, img, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")),
+			ExpectedError: ErrNoExif,
+		},
+		{
+			Name:          "Test jpeg without exif",
+			Input:         jpegWithApp1(t, img, []byte("other")),
+			ExpectedError: ErrNoExif,
+		},
+		{
+			Name:          "Test not a jpeg",
+			Input:         []byte("\x89PNG\r\n\x1a\n"),
+			ExpectedError: ErrNoExif,
+		},
+		{
+			Name:          "Test truncated tiff block",
+			Input:         jpegWithApp1(t, img, append([]byte(exifHeader), exifBlock[:20]...)),
+			ExpectedError: ErrInvalidExif,
+		},
+	}
+	for _, test := range tests {
+		exif, err := ParseExif(bytes.NewReader(test.Input))
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+		assert.Equal(t, test.ExpectedExif, exif, test.Name)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 3x2 image with a marked top left pixel
+	marked := color.RGBA{R: 255, A: 255}
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, marked)
+
+	tests := []struct {
+		Name           string
+		Orientation    int
+		ExpectedWidth  int
+		ExpectedHeight int
+		ExpectedMarked image.Point
+	}{
+		{Name: "Test normal", Orientation: ORIENTATION_NORMAL, ExpectedWidth: 3, ExpectedHeight: 2, ExpectedMarked: image.Pt(0, 0)},
+		{Name: "Test unknown orientation", Orientation: 9, ExpectedWidth: 3, ExpectedHeight: 2, ExpectedMarked: image.Pt(0, 0)},
+		{Name: "Test flip horizontal", Orientation: ORIENTATION_FLIP_H, ExpectedWidth: 3, ExpectedHeight: 2, ExpectedMarked: image.Pt(2, 0)},
+		{Name: "Test rotate 180", Orientation: ORIENTATION_ROTATE_180, ExpectedWidth: 3, ExpectedHeight: 2, ExpectedMarked: image.Pt(2, 1)},
+		{Name: "Test flip vertical", Orientation: ORIENTATION_FLIP_V, ExpectedWidth: 3, ExpectedHeight: 2, ExpectedMarked: image.Pt(0, 1)},
+		{Name: "Test transpose", Orientation: ORIENTATION_TRANSPOSE, ExpectedWidth: 2, ExpectedHeight: 3, ExpectedMarked: image.Pt(0, 0)},
+		{Name: "Test rotate 90", Orientation: ORIENTATION_ROTATE_90, ExpectedWidth: 2, ExpectedHeight: 3, ExpectedMarked: image.Pt(1, 0)},
+		{Name: "Test transverse", Orientation: ORIENTATION_TRANSVERSE, ExpectedWidth: 2, ExpectedHeight: 3, ExpectedMarked: image.Pt(1, 2)},
+		{Name: "Test rotate 270", Orientation: ORIENTATION_ROTATE_270, ExpectedWidth: 2, ExpectedHeight: 3, ExpectedMarked: image.Pt(0, 2)},
+	}
+	for _, test := range tests {
+		oriented := ApplyOrientation(img, test.Orientation)
+		bounds := oriented.Bounds()
+		assert.Equal(t, test.ExpectedWidth, bounds.Dx(), test.Name)
+		assert.Equal(t, test.ExpectedHeight, bounds.Dy(), test.Name)
+		assert.Equal(t, marked, color.RGBAModel.Convert(oriented.At(test.ExpectedMarked.X, test.ExpectedMarked.Y)), test.Name)
+	}
+}
+
+func TestHasMetadata(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	var plain bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&plain, img, nil))
+
+	assert.False(t, HasMetadata(plain.Bytes()), "Test encoder output has no metadata")
+	assert.True(t, HasMetadata(jpegWithApp1(t, img, []byte(exifHeader))), "Test exif segment is found")
+	assert.False(t, HasMetadata([]byte("not a jpeg")), "Test not a jpeg")
+}
@@ -0,0 +1,179 @@
+package decoder
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// Blocks of a GIF stream
+const (
+	gifExtension       = 0x21
+	gifImageDescriptor = 0x2c
+	gifTrailer         = 0x3b
+)
+
+// GifImageDecoder decodes the poster frame of a GIF, the first frame by default
+type GifImageDecoder struct {
+	PosterFrame int
+}
+
+func NewGifImageDecoder(posterFrame int) *GifImageDecoder {
+	return &GifImageDecoder{
+		PosterFrame: posterFrame,
+	}
+}
+
+func (g *GifImageDecoder) Decode(reader io.Reader) (image.Image, string, error) {
+	if g.PosterFrame <= 0 {
+		img, err := gif.Decode(reader)
+		return img, "gif", err
+	}
+	// Later frames only hold what changed, so every frame up to the poster is needed,
+	// the frames after it are never decoded
+	frames, err := truncateAnimation(reader, g.PosterFrame)
+	if err != nil {
+		return nil, "gif", err
+	}
+	animation, err := gif.DecodeAll(frames)
+	if err != nil {
+		return nil, "gif", err
+	}
+	return composeFrame(animation, g.PosterFrame), "gif", nil
+}
+
+func (g *GifImageDecoder) DecodeConfig(reader io.Reader) (image.Config, error) {
+	return gif.DecodeConfig(reader)
+}
+
+// Draw the frames of an animation up to frame, the last one when it has fewer,
+// disposing of each frame as the animation says
+func composeFrame(animation *gif.GIF, frame int) image.Image {
+	if frame >= len(animation.Image) {
+		frame = len(animation.Image) - 1
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, animation.Config.Width, animation.Config.Height))
+	var previous []byte
+	for i := 0; i <= frame; i++ {
+		img := animation.Image[i]
+		var disposal byte
+		if i < len(animation.Disposal) {
+			disposal = animation.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = append(previous[:0], canvas.Pix...)
+		}
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+		if i == frame {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return canvas
+}
+
+// Copy an animation up to the end of its frame-th image and end it there. Only the
+// compressed frames up to it are kept.
+func truncateAnimation(reader io.Reader, frame int) (io.Reader, error) {
+	source := bufio.NewReader(reader)
+	var truncated bytes.Buffer
+	// Header and logical screen descriptor, then the global color table
+	screen := make([]byte, 13)
+	if _, err := io.ReadFull(source, screen); err != nil {
+		return nil, err
+	}
+	truncated.Write(screen)
+	if err := copyColorTable(&truncated, source, screen[10]); err != nil {
+		return nil, err
+	}
+
+	images := 0
+	for {
+		block, err := source.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		truncated.WriteByte(block)
+		switch block {
+		case gifExtension:
+			label, err := source.ReadByte()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			truncated.WriteByte(label)
+		case gifImageDescriptor:
+			// Position, size and flags, then the local color table and the LZW code size
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(source, descriptor); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			truncated.Write(descriptor)
+			if err := copyColorTable(&truncated, source, descriptor[8]); err != nil {
+				return nil, err
+			}
+			codeSize, err := source.ReadByte()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			truncated.WriteByte(codeSize)
+		case gifTrailer:
+			return &truncated, nil
+		default:
+			return nil, fmt.Errorf("gif: unknown block type %#x", block)
+		}
+		if err := copySubBlocks(&truncated, source); err != nil {
+			return nil, err
+		}
+		if block == gifImageDescriptor {
+			images++
+			if images > frame {
+				truncated.WriteByte(gifTrailer)
+				return &truncated, nil
+			}
+		}
+	}
+}
+
+// Copy the color table a block's flags announce, if any
+func copyColorTable(truncated *bytes.Buffer, source io.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	size := int64(3 * (1 << (flags&0x07 + 1)))
+	_, err := io.CopyN(truncated, source, size)
+	return unexpectedEOF(err)
+}
+
+// Copy data sub-blocks up to the empty one ending them
+func copySubBlocks(truncated *bytes.Buffer, source *bufio.Reader) error {
+	for {
+		size, err := source.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		truncated.WriteByte(size)
+		if size == 0 {
+			return nil
+		}
+		if _, err := io.CopyN(truncated, source, int64(size)); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -1,21 +1,150 @@
 package decoder
 
 import (
+	"errors"
+	"fmt"
 	"image"
-	"os"
+	"io"
+	"strings"
 )
 
-var typeDecoderMap = map[string]ImageDecoder{
-	".jpg":  NewJpgImageDecoder(),
-	".jpeg": NewJpgImageDecoder(),
-	".png":  NewPngImageDecoder(),
-	".bmp":  NewBMPImageDecoder(),
+// Bytes needed to recognise any registered format
+const SNIFF_LENGTH = 16
+
+var ErrInvalidImage = errors.New("invalid image")
+
+// UnsupportedFormatError is returned for content no registered decoder reads.
+// Format is the recognised format, empty when the content isn't recognised at all.
+type UnsupportedFormatError struct {
+	Format string
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	if e.Format == "" {
+		return "unsupported image format"
+	}
+	return fmt.Sprintf("unsupported image format %s", e.Format)
+}
+
+// FormatMismatchError is returned when the content isn't what the file name says it is
+type FormatMismatchError struct {
+	Extension string
+	Format    string
+}
+
+func (e *FormatMismatchError) Error() string {
+	return fmt.Sprintf("file with extension %q contains %s data", e.Extension, e.Format)
 }
 
+// ImageDecoder decodes an image from a stream. Decode returns the name of the format
+// it read, as Sniff names it.
 type ImageDecoder interface {
-	Decode(file *os.File) (image.Image, error)
+	Decode(reader io.Reader) (image.Image, string, error)
+	// Read the dimensions from the header without decoding the image
+	DecodeConfig(reader io.Reader) (image.Config, error)
+}
+
+// Format is an image format we recognise by its magic bytes. Formats without a
+// Decoder are recognised so they can be reported but are not supported.
+type Format struct {
+	Name       string
+	Extensions []string
+	Magic      []string // prefixes of the content, '?' matches any byte
+	Decoder    ImageDecoder
+}
+
+var registry []Format
+
+func init() {
+	Register(Format{Name: "jpeg", Extensions: []string{".jpg", ".jpeg"}, Magic: []string{"\xff\xd8\xff"}, Decoder: NewJpgImageDecoder()})
+	Register(Format{Name: "png", Extensions: []string{".png"}, Magic: []string{"\x89PNG\r\n\x1a\n"}, Decoder: NewPngImageDecoder()})
+	Register(Format{Name: "bmp", Extensions: []string{".bmp"}, Magic: []string{"BM"}, Decoder: NewBMPImageDecoder()})
+	Register(Format{Name: "gif", Extensions: []string{".gif"}, Magic: []string{"GIF87a", "GIF89a"}, Decoder: NewGifImageDecoder(0)})
+	Register(Format{Name: "webp", Extensions: []string{".webp"}, Magic: []string{"RIFF????WEBP"}, Decoder: NewWebpImageDecoder()})
+	Register(Format{Name: "tiff", Extensions: []string{".tif", ".tiff"}, Magic: []string{"II*\x00", "MM\x00*"}, Decoder: NewTiffImageDecoder()})
+}
+
+// Register a format, replacing a registered one with the same name
+func Register(format Format) {
+	for i, registered := range registry {
+		if registered.Name == format.Name {
+			registry[i] = format
+			return
+		}
+	}
+	registry = append(registry, format)
+}
+
+// Decoder for a file extension
+func New(imageExtension string) (ImageDecoder, error) {
+	format, ok := formatForExtension(imageExtension)
+	if !ok {
+		return nil, &UnsupportedFormatError{}
+	}
+	return ForFormat(format.Name)
+}
+
+// Decoder for a format name as returned by Sniff
+func ForFormat(name string) (ImageDecoder, error) {
+	for _, format := range registry {
+		if format.Name == name && format.Decoder != nil {
+			return format.Decoder, nil
+		}
+	}
+	return nil, &UnsupportedFormatError{Format: name}
+}
+
+// Name of the format a file extension stands for, as Sniff names it
+func ExtensionFormat(extension string) (string, bool) {
+	format, ok := formatForExtension(extension)
+	return format.Name, ok
+}
+
+// Report whether a format is in the allowed list, an empty list allows every format
+func Allowed(name string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, format := range allowed {
+		if format == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Name of the format the content starts with, empty when it isn't recognised
+func Sniff(header []byte) string {
+	for _, format := range registry {
+		for _, magic := range format.Magic {
+			if matchMagic(header, magic) {
+				return format.Name
+			}
+		}
+	}
+	return ""
+}
+
+func formatForExtension(extension string) (Format, bool) {
+	extension = strings.ToLower(extension)
+	for _, format := range registry {
+		for _, registered := range format.Extensions {
+			if registered == extension {
+				return format, true
+			}
+		}
+	}
+	return Format{}, false
 }
 
-func New(imageExtension string) ImageDecoder {
-	return typeDecoderMap[imageExtension]
+func matchMagic(header []byte, magic string) bool {
+	if len(header) < len(magic) {
+		return false
+	}
+	for i := 0; i < len(magic); i++ {
+		if magic[i] != '?' && magic[i] != header[i] {
+			return false
+		}
+	}
+	return true
 }
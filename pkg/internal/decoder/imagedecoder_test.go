@@ -0,0 +1,283 @@
+package decoder
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/tiff"
+)
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Input          []byte
+		ExpectedFormat string
+	}{
+		{Name: "Test jpeg", Input: []byte("\xff\xd8\xff\xe0rest"), ExpectedFormat: "jpeg"},
+		{Name: "Test png", Input: []byte("\x89PNG\r\n\x1a\nrest"), ExpectedFormat: "png"},
+		{Name: "Test bmp", Input: []byte("BM rest"), ExpectedFormat: "bmp"},
+		{Name: "Test gif", Input: []byte("GIF89a rest"), ExpectedFormat: "gif"},
+		{Name: "Test webp", Input: []byte("RIFF\x10\x00\x00\x00WEBPVP8 "), ExpectedFormat: "webp"},
+		{Name: "Test riff that isn't webp", Input: []byte("RIFF\x10\x00\x00\x00WAVEfmt "), ExpectedFormat: ""},
+		{Name: "Test text", Input: []byte("hello"), ExpectedFormat: ""},
+		{Name: "Test empty", Input: nil, ExpectedFormat: ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.ExpectedFormat, Sniff(test.Input), test.Name)
+	}
+}
+
+func TestNew(t *testing.T) {
+	imageDecoder, err := New(".JPG")
+	assert.Nil(t, err)
+	assert.NotNil(t, imageDecoder)
+
+	imageDecoder, err = New(".tif")
+	assert.Nil(t, err)
+	assert.NotNil(t, imageDecoder)
+
+	var unsupported *UnsupportedFormatError
+	_, err = New(".txt")
+	assert.ErrorAs(t, err, &unsupported)
+	assert.Equal(t, "", unsupported.Format)
+}
+
+func TestPipelineValidate(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 30, 20))
+	var encodedPng bytes.Buffer
+	assert.Nil(t, png.Encode(&encodedPng, img))
+	var encodedJpeg bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&encodedJpeg, img, nil))
+
+	tests := []struct {
+		Name           string
+		Input          []byte
+		FileName       string
+		Allowed        []string
+		Limits         Limits
+		ExpectedFormat string
+		ExpectedWidth  int
+		ExpectedHeight int
+		ExpectedError  error
+	}{
+		{
+			Name:           "Test valid png",
+			Input:          encodedPng.Bytes(),
+			FileName:       "photo.png",
+			ExpectedFormat: "png",
+			ExpectedWidth:  30,
+			ExpectedHeight: 20,
+		},
+		{
+			Name:           "Test upper case extension",
+			Input:          encodedJpeg.Bytes(),
+			FileName:       "photo.JPEG",
+			ExpectedFormat: "jpeg",
+			ExpectedWidth:  30,
+			ExpectedHeight: 20,
+		},
+		{
+			Name:           "Test png named jpg",
+			Input:          encodedPng.Bytes(),
+			FileName:       "photo.jpg",
+			ExpectedFormat: "png",
+			ExpectedError:  &FormatMismatchError{Extension: ".jpg", Format: "png"},
+		},
+		{
+			Name:           "Test missing extension",
+			Input:          encodedPng.Bytes(),
+			FileName:       "photo",
+			ExpectedFormat: "png",
+			ExpectedError:  &FormatMismatchError{Extension: "", Format: "png"},
+		},
+		{
+			Name:           "Test format that isn't allowed",
+			Input:          encodedPng.Bytes(),
+			FileName:       "photo.png",
+			Allowed:        []string{"jpeg", "gif"},
+			ExpectedFormat: "png",
+			ExpectedError:  &UnsupportedFormatError{Format: "png"},
+		},
+		{
+			Name:           "Test allowed format",
+			Input:          encodedJpeg.Bytes(),
+			FileName:       "photo.jpg",
+			Allowed:        []string{"jpeg", "gif"},
+			ExpectedFormat: "jpeg",
+			ExpectedWidth:  30,
+			ExpectedHeight: 20,
+		},
+		{
+			Name:          "Test text named png",
+			Input:         []byte("not an image"),
+			FileName:      "notes.png",
+			ExpectedError: &UnsupportedFormatError{},
+		},
+		{
+			Name:           "Test truncated header",
+			Input:          encodedPng.Bytes()[:12],
+			FileName:       "photo.png",
+			ExpectedFormat: "png",
+			ExpectedError:  ErrInvalidImage,
+		},
+		{
+			Name:           "Test image over the limits",
+			Input:          encodedPng.Bytes(),
+			FileName:       "photo.png",
+			Limits:         Limits{MaxWidth: 20},
+			ExpectedFormat: "png",
+			ExpectedError:  &TooLargeError{Width: 30, Height: 20, Limits: Limits{MaxWidth: 20}},
+		},
+	}
+	for _, test := range tests {
+		pipeline := Pipeline{Formats: test.Allowed, Limits: test.Limits}
+		reader := bytes.NewReader(test.Input)
+		header, rest, err := pipeline.Validate(reader, test.FileName)
+		assert.Equal(t, test.ExpectedFormat, header.Format, test.Name)
+		if test.ExpectedError == nil {
+			assert.Nil(t, err, test.Name)
+			assert.Equal(t, test.ExpectedWidth, header.Config.Width, test.Name)
+			assert.Equal(t, test.ExpectedHeight, header.Config.Height, test.Name)
+			// The reader is rewound for the upload
+			assert.Equal(t, int64(len(test.Input)), int64(reader.Len()), test.Name)
+			assert.Equal(t, reader, rest, test.Name)
+			continue
+		}
+		if errors.Is(test.ExpectedError, ErrInvalidImage) {
+			assert.ErrorIs(t, err, ErrInvalidImage, test.Name)
+			continue
+		}
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+	}
+}
+
+func TestLimitsCheck(t *testing.T) {
+	limits := Limits{MaxWidth: 100, MaxHeight: 50, MaxPixels: 3000}
+	tests := []struct {
+		Name          string
+		Config        image.Config
+		ExpectedError error
+	}{
+		{Name: "Test within limits", Config: image.Config{Width: 60, Height: 50}},
+		{Name: "Test too wide", Config: image.Config{Width: 101, Height: 1}, ExpectedError: &TooLargeError{Width: 101, Height: 1, Limits: limits}},
+		{Name: "Test too high", Config: image.Config{Width: 1, Height: 51}, ExpectedError: &TooLargeError{Width: 1, Height: 51, Limits: limits}},
+		{Name: "Test too many pixels", Config: image.Config{Width: 100, Height: 31}, ExpectedError: &TooLargeError{Width: 100, Height: 31, Limits: limits}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.ExpectedError, limits.Check(test.Config), test.Name)
+	}
+	assert.Nil(t, Limits{}.Check(image.Config{Width: 50000, Height: 50000}), "Test zero limits are not checked")
+}
+
+func TestConfiguredFormatsHaveDecoders(t *testing.T) {
+	cfg, err := config.New()
+	assert.Nil(t, err)
+	for _, format := range cfg.ImageFormats {
+		_, err := ForFormat(format)
+		assert.Nil(t, err, format)
+	}
+}
+
+func TestDecodeTiff(t *testing.T) {
+	var encoded bytes.Buffer
+	assert.Nil(t, tiff.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 12, 7)), nil))
+	assert.Equal(t, "tiff", Sniff(encoded.Bytes()))
+
+	imageDecoder, err := ForFormat("tiff")
+	assert.Nil(t, err)
+	img, format, err := imageDecoder.Decode(bytes.NewReader(encoded.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, "tiff", format)
+	assert.Equal(t, image.Rect(0, 0, 12, 7), img.Bounds())
+}
+
+func TestDecodeGifPosterFrame(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	palette := color.Palette{color.Transparent, red, blue}
+	frame := func(rect image.Rectangle, c color.Color) *image.Paletted {
+		img := image.NewPaletted(rect, palette)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				img.Set(x, y, c)
+			}
+		}
+		return img
+	}
+	// A red 4x4 first frame, then a blue top left pixel drawn over it and disposed,
+	// then a blue bottom right pixel
+	animation := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 4, 4), red),
+			frame(image.Rect(0, 0, 1, 1), blue),
+			frame(image.Rect(3, 3, 4, 4), blue),
+		},
+		Delay:    []int{10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalNone},
+	}
+	var encoded bytes.Buffer
+	assert.Nil(t, gif.EncodeAll(&encoded, animation))
+
+	tests := []struct {
+		Name          string
+		PosterFrame   int
+		ExpectedPixel map[image.Point]color.RGBA
+	}{
+		{Name: "Test first frame", PosterFrame: 0, ExpectedPixel: map[image.Point]color.RGBA{{0, 0}: red, {3, 3}: red}},
+		{Name: "Test second frame", PosterFrame: 1, ExpectedPixel: map[image.Point]color.RGBA{{0, 0}: blue, {3, 3}: red}},
+		{Name: "Test disposed frame is restored", PosterFrame: 2, ExpectedPixel: map[image.Point]color.RGBA{{0, 0}: red, {3, 3}: blue}},
+		{Name: "Test frame after the last one", PosterFrame: 10, ExpectedPixel: map[image.Point]color.RGBA{{0, 0}: red, {3, 3}: blue}},
+	}
+	for _, test := range tests {
+		img, _, err := NewGifImageDecoder(test.PosterFrame).Decode(bytes.NewReader(encoded.Bytes()))
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, image.Rect(0, 0, 4, 4), img.Bounds(), test.Name)
+		for point, expected := range test.ExpectedPixel {
+			assert.Equal(t, expected, color.RGBAModel.Convert(img.At(point.X, point.Y)), test.Name)
+		}
+	}
+}
+
+func TestTruncateAnimation(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{Config: image.Config{Width: 4, Height: 4, ColorModel: palette}}
+	for i := 0; i < 5; i++ {
+		animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette))
+		animation.Delay = append(animation.Delay, 10)
+	}
+	var encoded bytes.Buffer
+	assert.Nil(t, gif.EncodeAll(&encoded, animation))
+	// A broken frame in place of the trailer, only decoded when reaching it
+	broken := append(encoded.Bytes()[:encoded.Len()-1:encoded.Len()-1], gifImageDescriptor, 0, 0)
+
+	for frame, expectedFrames := range map[int]int{0: 1, 2: 3, 4: 5} {
+		truncated, err := truncateAnimation(bytes.NewReader(broken), frame)
+		assert.Nil(t, err)
+		decoded, err := gif.DecodeAll(truncated)
+		assert.Nil(t, err)
+		assert.Len(t, decoded.Image, expectedFrames)
+	}
+
+	// Past the last frame the whole animation is read
+	truncated, err := truncateAnimation(bytes.NewReader(encoded.Bytes()), 10)
+	assert.Nil(t, err)
+	decoded, err := gif.DecodeAll(truncated)
+	assert.Nil(t, err)
+	assert.Len(t, decoded.Image, 5)
+	_, err = truncateAnimation(bytes.NewReader(broken), 10)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Memory is reserved for every frame up to the poster
+	header := Header{Format: "gif", Config: image.Config{Width: 4, Height: 4}}
+	assert.Equal(t, int64(0), Pipeline{}.FramesSize(header))
+	assert.Equal(t, int64(3*16), Pipeline{GifPosterFrame: 2}.FramesSize(header))
+}
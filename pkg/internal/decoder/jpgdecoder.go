@@ -3,7 +3,7 @@ package decoder
 import (
 	"image"
 	"image/jpeg"
-	"os"
+	"io"
 )
 
 type JpgImageDecoder struct{}
@@ -12,6 +12,11 @@ func NewJpgImageDecoder() *JpgImageDecoder {
 	return &JpgImageDecoder{}
 }
 
-func (jpg *JpgImageDecoder) Decode(file *os.File) (image.Image, error) {
-	return jpeg.Decode(file)
+func (jpg *JpgImageDecoder) Decode(reader io.Reader) (image.Image, string, error) {
+	img, err := jpeg.Decode(reader)
+	return img, "jpeg", err
+}
+
+func (jpg *JpgImageDecoder) DecodeConfig(reader io.Reader) (image.Config, error) {
+	return jpeg.DecodeConfig(reader)
 }
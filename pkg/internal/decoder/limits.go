@@ -0,0 +1,41 @@
+package decoder
+
+import (
+	"fmt"
+	"image"
+)
+
+// Limits on the size of images we decode, a zero field is not checked. They are
+// checked against the header so a small file declaring a huge image is never decoded.
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+}
+
+// TooLargeError is returned for an image whose header exceeds the limits
+type TooLargeError struct {
+	Width  int
+	Height int
+	Limits Limits
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("image of %dx%d pixels exceeds the limit of %dx%d and %d pixels",
+		e.Width, e.Height, e.Limits.MaxWidth, e.Limits.MaxHeight, e.Limits.MaxPixels)
+}
+
+func (l Limits) Check(config image.Config) error {
+	pixels := int64(config.Width) * int64(config.Height)
+	if (l.MaxWidth > 0 && config.Width > l.MaxWidth) ||
+		(l.MaxHeight > 0 && config.Height > l.MaxHeight) ||
+		(l.MaxPixels > 0 && pixels > l.MaxPixels) {
+		return &TooLargeError{Width: config.Width, Height: config.Height, Limits: l}
+	}
+	return nil
+}
+
+// Bytes an image of this size takes once decoded into RGBA
+func DecodedSize(config image.Config) int64 {
+	return int64(config.Width) * int64(config.Height) * 4
+}
@@ -0,0 +1,224 @@
+package decoder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"path"
+	"strings"
+)
+
+// Most bytes of a stream that can't seek kept while its header is read
+const MAX_REPLAY_BYTES = 1 << 20
+
+// ErrHeaderTooLarge is returned when the header of a stream that can't seek takes
+// more than MAX_REPLAY_BYTES to read, e.g. a TIFF whose directory is at its end
+var ErrHeaderTooLarge = fmt.Errorf("image header takes over %d bytes to read", MAX_REPLAY_BYTES)
+
+// Pipeline decodes images from any stream, a local file, an S3 object, a request
+// body or a buffer. It sniffs the format, checks it is allowed and that the header
+// is within the limits, reads the EXIF data and only then decodes the image, once.
+type Pipeline struct {
+	Formats        []string // allowed formats, empty for every registered one
+	Limits         Limits
+	GifPosterFrame int // frame of an animated GIF that is decoded, 0 for the first
+}
+
+// Header is what the pipeline learns about an image before decoding it
+type Header struct {
+	Format string
+	Config image.Config
+	Exif   Exif
+}
+
+// Decode an image turned upright as its EXIF orientation says
+func (p Pipeline) Decode(reader io.Reader) (image.Image, string, error) {
+	header, rest, err := p.ReadHeader(reader)
+	if err != nil {
+		return nil, header.Format, err
+	}
+	img, err := p.DecodeWithHeader(header, rest)
+	return img, header.Format, err
+}
+
+func (p Pipeline) DecodeConfig(reader io.Reader) (image.Config, error) {
+	header, _, err := p.ReadHeader(reader)
+	return header.Config, err
+}
+
+// Read and check the header of an image. The returned reader yields the whole image
+// again: seekable readers are rewound, the bytes read from others are replayed.
+// A seekable reader must be at its start. ErrHeaderTooLarge comes with the reader
+// too, to store the image somewhere seekable and read its header from there.
+func (p Pipeline) ReadHeader(reader io.Reader) (Header, io.Reader, error) {
+	source := newReplayReader(reader)
+	header, err := p.readHeader(source)
+	if errors.Is(err, ErrHeaderTooLarge) {
+		rest, replayErr := source.replay()
+		if replayErr != nil {
+			return header, nil, replayErr
+		}
+		return header, rest, err
+	}
+	if err != nil {
+		return header, nil, err
+	}
+	rest, err := source.replay()
+	if err != nil {
+		return header, nil, err
+	}
+	return header, rest, nil
+}
+
+// Read and check the header of an uploaded image like ReadHeader, and that the file
+// name's extension matches the content
+func (p Pipeline) Validate(reader io.Reader, fileName string) (Header, io.Reader, error) {
+	header, rest, err := p.ReadHeader(reader)
+	if err != nil {
+		// rest is only returned with ErrHeaderTooLarge
+		return header, rest, err
+	}
+	extension := strings.ToLower(path.Ext(fileName))
+	if format, ok := formatForExtension(extension); !ok || format.Name != header.Format {
+		return header, nil, &FormatMismatchError{Extension: extension, Format: header.Format}
+	}
+	return header, rest, nil
+}
+
+// Decode an image whose header was read by ReadHeader from the reader it returned
+func (p Pipeline) DecodeWithHeader(header Header, reader io.Reader) (image.Image, error) {
+	imageDecoder, err := p.decoder(header.Format)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := imageDecoder.Decode(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	return ApplyOrientation(img, header.Exif.Orientation), nil
+}
+
+// Bytes the frames of an animated GIF up to its poster frame take while they are
+// decoded, on top of the decoded image. At most a byte per pixel of the image each.
+func (p Pipeline) FramesSize(header Header) int64 {
+	if header.Format != "gif" || p.GifPosterFrame <= 0 {
+		return 0
+	}
+	return int64(p.GifPosterFrame+1) * int64(header.Config.Width) * int64(header.Config.Height)
+}
+
+func (p Pipeline) readHeader(source *replayReader) (Header, error) {
+	header := Header{Exif: Exif{Orientation: ORIENTATION_NORMAL}}
+	sniffed := make([]byte, SNIFF_LENGTH)
+	n, err := io.ReadFull(source, sniffed)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return header, err
+	}
+	header.Format = Sniff(sniffed[:n])
+	imageDecoder, err := p.decoder(header.Format)
+	if err != nil {
+		return header, err
+	}
+
+	// Only the segments before the image data are read, a missing or broken EXIF
+	// block is ignored
+	if header.Format == "jpeg" {
+		if err := source.rewind(); err != nil {
+			return header, err
+		}
+		if exif, err := ParseExif(source); err == nil {
+			header.Exif = exif
+		}
+	}
+
+	if err := source.rewind(); err != nil {
+		return header, err
+	}
+	header.Config, err = imageDecoder.DecodeConfig(source)
+	if source.exceeded {
+		// Whatever the decoder made of the stream cut short
+		return header, ErrHeaderTooLarge
+	}
+	if err != nil {
+		return header, fmt.Errorf("%w - %s", ErrInvalidImage, err)
+	}
+	if header.Config.Width <= 0 || header.Config.Height <= 0 {
+		return header, fmt.Errorf("%w - empty image", ErrInvalidImage)
+	}
+	return header, p.Limits.Check(header.Config)
+}
+
+func (p Pipeline) decoder(format string) (ImageDecoder, error) {
+	if !Allowed(format, p.Formats) {
+		return nil, &UnsupportedFormatError{Format: format}
+	}
+	if format == "gif" && p.GifPosterFrame > 0 {
+		return NewGifImageDecoder(p.GifPosterFrame), nil
+	}
+	return ForFormat(format)
+}
+
+// replayReader lets the start of a stream be read more than once. Seekable readers
+// are rewound, what is read from others is kept to be read again, up to limit bytes.
+type replayReader struct {
+	reader   io.Reader
+	seeker   io.Seeker
+	recorded []byte
+	offset   int
+	limit    int
+	exceeded bool // more than limit bytes were asked for
+}
+
+func newReplayReader(reader io.Reader) *replayReader {
+	seeker, _ := reader.(io.Seeker)
+	return &replayReader{
+		reader: reader,
+		seeker: seeker,
+		limit:  MAX_REPLAY_BYTES,
+	}
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if r.seeker == nil && r.offset < len(r.recorded) {
+		n := copy(p, r.recorded[r.offset:])
+		r.offset += n
+		return n, nil
+	}
+	if r.seeker == nil {
+		if len(r.recorded) >= r.limit {
+			r.exceeded = true
+			return 0, ErrHeaderTooLarge
+		}
+		if len(p) > r.limit-len(r.recorded) {
+			p = p[:r.limit-len(r.recorded)]
+		}
+	}
+	n, err := r.reader.Read(p)
+	if r.seeker == nil {
+		r.recorded = append(r.recorded, p[:n]...)
+		r.offset += n
+	}
+	return n, err
+}
+
+func (r *replayReader) rewind() error {
+	if r.seeker != nil {
+		_, err := r.seeker.Seek(0, io.SeekStart)
+		return err
+	}
+	r.offset = 0
+	return nil
+}
+
+// The whole stream from its start, no longer kept
+func (r *replayReader) replay() (io.Reader, error) {
+	if err := r.rewind(); err != nil {
+		return nil, err
+	}
+	if r.seeker != nil {
+		return r.reader, nil
+	}
+	return io.MultiReader(bytes.NewReader(r.recorded), r.reader), nil
+}
@@ -0,0 +1,100 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/tiff"
+)
+
+// A reader that can't seek, like a request body or an S3 stream
+type streamReader struct {
+	reader io.Reader
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	// Short reads, as networks do
+	if len(p) > 7 {
+		p = p[:7]
+	}
+	return s.reader.Read(p)
+}
+
+func TestPipelineDecodesStreams(t *testing.T) {
+	order := binary.LittleEndian
+	source := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	source.Set(0, 0, color.RGBA{R: 255, A: 255})
+	var encodedPng bytes.Buffer
+	assert.Nil(t, png.Encode(&encodedPng, source))
+	exifBlock := buildTiff(
+		[]testIFDEntry{{tag: tagOrientation, typ: tiffTypeShort, count: 1, data: order.AppendUint16(nil, ORIENTATION_ROTATE_90)}},
+		nil,
+	)
+	orientedJpeg := jpegWithApp1(t, source, append([]byte(exifHeader), exifBlock...))
+
+	tests := []struct {
+		Name                string
+		Input               []byte
+		ExpectedFormat      string
+		ExpectedBounds      image.Rectangle
+		ExpectedOrientation int
+	}{
+		{Name: "Test png stream", Input: encodedPng.Bytes(), ExpectedFormat: "png", ExpectedBounds: image.Rect(0, 0, 8, 4), ExpectedOrientation: ORIENTATION_NORMAL},
+		{Name: "Test rotated jpeg stream", Input: orientedJpeg, ExpectedFormat: "jpeg", ExpectedBounds: image.Rect(0, 0, 4, 8), ExpectedOrientation: ORIENTATION_ROTATE_90},
+	}
+	for _, test := range tests {
+		pipeline := Pipeline{}
+		header, rest, err := pipeline.ReadHeader(&streamReader{reader: bytes.NewReader(test.Input)})
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedFormat, header.Format, test.Name)
+		assert.Equal(t, test.ExpectedOrientation, header.Exif.Orientation, test.Name)
+		assert.Equal(t, 8, header.Config.Width, test.Name)
+
+		// The header bytes are replayed, the whole image is read again
+		replayed, err := io.ReadAll(rest)
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.Input, replayed, test.Name)
+
+		img, format, err := pipeline.Decode(&streamReader{reader: bytes.NewReader(test.Input)})
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedFormat, format, test.Name)
+		assert.Equal(t, test.ExpectedBounds, img.Bounds(), test.Name)
+	}
+}
+
+func TestPipelineStopsRecordingLargeHeaders(t *testing.T) {
+	// The directory of a TIFF is written after the pixels, reading the header of a
+	// stream means reading all of it
+	var encodedTiff bytes.Buffer
+	assert.Nil(t, tiff.Encode(&encodedTiff, image.NewRGBA(image.Rect(0, 0, 600, 600)), nil))
+	assert.Greater(t, encodedTiff.Len(), MAX_REPLAY_BYTES)
+
+	pipeline := Pipeline{}
+	_, rest, err := pipeline.Validate(&streamReader{reader: bytes.NewReader(encodedTiff.Bytes())}, "large.tiff")
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+	// Nothing read is lost, the whole stream can be stored and read again
+	replayed, err := io.ReadAll(rest)
+	assert.Nil(t, err)
+	assert.Equal(t, encodedTiff.Bytes(), replayed)
+
+	header, _, err := pipeline.Validate(bytes.NewReader(encodedTiff.Bytes()), "large.tiff")
+	assert.Nil(t, err)
+	assert.Equal(t, "tiff", header.Format)
+	assert.Equal(t, 600, header.Config.Width)
+}
+
+func TestPipelineRejectsFormatsNotAllowed(t *testing.T) {
+	var encodedPng bytes.Buffer
+	assert.Nil(t, png.Encode(&encodedPng, image.NewRGBA(image.Rect(0, 0, 2, 2))))
+
+	pipeline := Pipeline{Formats: []string{"jpeg"}}
+	_, format, err := pipeline.Decode(bytes.NewReader(encodedPng.Bytes()))
+	assert.Equal(t, "png", format)
+	assert.Equal(t, &UnsupportedFormatError{Format: "png"}, err)
+}
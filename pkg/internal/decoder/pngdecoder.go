@@ -3,7 +3,7 @@ package decoder
 import (
 	"image"
 	"image/png"
-	"os"
+	"io"
 )
 
 type PngImageDecoder struct{}
@@ -12,6 +12,11 @@ func NewPngImageDecoder() *PngImageDecoder {
 	return &PngImageDecoder{}
 }
 
-func (jpg *PngImageDecoder) Decode(file *os.File) (image.Image, error) {
-	return png.Decode(file)
+func (jpg *PngImageDecoder) Decode(reader io.Reader) (image.Image, string, error) {
+	img, err := png.Decode(reader)
+	return img, "png", err
+}
+
+func (jpg *PngImageDecoder) DecodeConfig(reader io.Reader) (image.Config, error) {
+	return png.DecodeConfig(reader)
 }
@@ -0,0 +1,23 @@
+package decoder
+
+import (
+	"image"
+	"io"
+
+	"golang.org/x/image/tiff"
+)
+
+type TiffImageDecoder struct{}
+
+func NewTiffImageDecoder() *TiffImageDecoder {
+	return &TiffImageDecoder{}
+}
+
+func (t *TiffImageDecoder) Decode(reader io.Reader) (image.Image, string, error) {
+	img, err := tiff.Decode(reader)
+	return img, "tiff", err
+}
+
+func (t *TiffImageDecoder) DecodeConfig(reader io.Reader) (image.Config, error) {
+	return tiff.DecodeConfig(reader)
+}
@@ -0,0 +1,23 @@
+package decoder
+
+import (
+	"image"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+type WebpImageDecoder struct{}
+
+func NewWebpImageDecoder() *WebpImageDecoder {
+	return &WebpImageDecoder{}
+}
+
+func (w *WebpImageDecoder) Decode(reader io.Reader) (image.Image, string, error) {
+	img, err := webp.Decode(reader)
+	return img, "webp", err
+}
+
+func (w *WebpImageDecoder) DecodeConfig(reader io.Reader) (image.Config, error) {
+	return webp.DecodeConfig(reader)
+}
@@ -0,0 +1,431 @@
+package encoder
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+)
+
+// Chroma subsampling of the output
+const (
+	CHROMA_420 = "4:2:0" // chroma at half resolution, smaller files
+	CHROMA_444 = "4:4:4" // full resolution chroma, sharper colour edges
+)
+
+// Lowest quality a byte budget search goes down to
+const MIN_BUDGET_QUALITY = 30
+
+// Options of a JPEG encoding
+type Options struct {
+	Quality     int // 1 to 100, 0 for jpeg.DefaultQuality
+	Progressive bool
+	Chroma      string // CHROMA_420 or CHROMA_444, progressive output is always 4:4:4
+}
+
+// Settings the image is encoded with once defaults are applied
+func (o Options) resolved() Options {
+	if o.Quality <= 0 {
+		o.Quality = jpeg.DefaultQuality
+	}
+	if o.Quality > 100 {
+		o.Quality = 100
+	}
+	if o.Progressive || o.Chroma != CHROMA_444 && o.Chroma != CHROMA_420 {
+		o.Chroma = CHROMA_420
+	}
+	if o.Progressive {
+		o.Chroma = CHROMA_444
+	}
+	return o
+}
+
+// Encode an image as a JPEG without metadata segments. Baseline 4:2:0 output comes
+// from image/jpeg, which writes neither 4:4:4 nor progressive JPEGs, the others from
+// our own encoder. Returns the settings used.
+func Encode(w io.Writer, img image.Image, options Options) (Options, error) {
+	options = options.resolved()
+	if options.Chroma == CHROMA_420 {
+		return options, jpeg.Encode(w, img, &jpeg.Options{Quality: options.Quality})
+	}
+	return options, encodeFullChroma(w, img, options)
+}
+
+// Encode an image at the highest quality up to options.Quality that stays within
+// maxBytes, searching down to MIN_BUDGET_QUALITY. When even that is too large the
+// result at MIN_BUDGET_QUALITY is returned.
+func EncodeWithinBudget(img image.Image, options Options, maxBytes int64) ([]byte, Options, error) {
+	options = options.resolved()
+	encode := func(quality int) ([]byte, Options, error) {
+		attempt := options
+		attempt.Quality = quality
+		var encoded bytes.Buffer
+		used, err := Encode(&encoded, img, attempt)
+		return encoded.Bytes(), used, err
+	}
+
+	encoded, used, err := encode(options.Quality)
+	if err != nil || int64(len(encoded)) <= maxBytes || options.Quality <= MIN_BUDGET_QUALITY {
+		return encoded, used, err
+	}
+	// Size grows with quality, look for the highest quality within the budget
+	low, high := MIN_BUDGET_QUALITY, options.Quality-1
+	var best []byte
+	var bestUsed Options
+	for low <= high {
+		quality := (low + high) / 2
+		attempt, attemptUsed, err := encode(quality)
+		if err != nil {
+			return nil, Options{}, err
+		}
+		if int64(len(attempt)) <= maxBytes {
+			best, bestUsed = attempt, attemptUsed
+			low = quality + 1
+		} else {
+			high = quality - 1
+		}
+	}
+	if best == nil {
+		return encode(MIN_BUDGET_QUALITY)
+	}
+	return best, bestUsed, nil
+}
+
+// A scan of a progressive JPEG, a band of coefficients of some components
+type scan struct {
+	components []int
+	start, end int // zigzag positions
+}
+
+// DC of every component first, then the low luma frequencies, the chroma and the rest
+// of the luma, so an early coarse preview is followed by the details
+var progressiveScans = []scan{
+	{components: []int{0, 1, 2}, start: 0, end: 0},
+	{components: []int{0}, start: 1, end: 5},
+	{components: []int{1}, start: 1, end: 63},
+	{components: []int{2}, start: 1, end: 63},
+	{components: []int{0}, start: 6, end: 63},
+}
+
+var baselineScans = []scan{
+	{components: []int{0, 1, 2}, start: 0, end: 63},
+}
+
+type fullChromaEncoder struct {
+	w              *bufio.Writer
+	err            error
+	quantization   [2][64]int
+	codes          [4]huffmanCode
+	blocksWide     int
+	blocksHigh     int
+	coefficients   [3][]int32 // quantized coefficients of each component, 64 per block in zigzag order
+	bits           uint32
+	bitCount       uint
+	previousDC     [3]int32
+	componentTable [3]int // quantization and Huffman tables of each component
+}
+
+// Encode without chroma subsampling, every component has one 8x8 block per MCU
+func encodeFullChroma(w io.Writer, img image.Image, options Options) error {
+	bounds := img.Bounds()
+	if bounds.Dx() <= 0 || bounds.Dy() <= 0 || bounds.Dx() >= 1<<16 || bounds.Dy() >= 1<<16 {
+		return fmt.Errorf("jpeg: image of %dx%d pixels can't be encoded", bounds.Dx(), bounds.Dy())
+	}
+	e := &fullChromaEncoder{
+		w:              bufio.NewWriter(w),
+		blocksWide:     (bounds.Dx() + 7) / 8,
+		blocksHigh:     (bounds.Dy() + 7) / 8,
+		componentTable: [3]int{0, 1, 1},
+	}
+	for table := range e.quantization {
+		e.quantization[table] = scaledQuantization(table, options.Quality)
+	}
+	for i := range e.codes {
+		e.codes[i] = huffmanSpecs[i].codes()
+	}
+	e.transform(img)
+
+	scans := baselineScans
+	startOfFrame := byte(0xC0)
+	if options.Progressive {
+		scans = progressiveScans
+		startOfFrame = 0xC2
+	}
+	e.write([]byte{0xFF, 0xD8})
+	e.writeQuantization()
+	e.writeStartOfFrame(startOfFrame, bounds.Dx(), bounds.Dy())
+	e.writeHuffman()
+	for _, s := range scans {
+		e.writeScan(s)
+	}
+	e.write([]byte{0xFF, 0xD9})
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+func scaledQuantization(table int, quality int) [64]int {
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var scaled [64]int
+	for i, base := range baseQuantization[table] {
+		value := (base*scale + 50) / 100
+		if value < 1 {
+			value = 1
+		}
+		if value > 255 {
+			value = 255
+		}
+		scaled[i] = value
+	}
+	return scaled
+}
+
+// Convert the image to YCbCr and store the quantized DCT coefficients of every block.
+// Blocks past the edges repeat the last row and column.
+func (e *fullChromaEncoder) transform(img image.Image) {
+	bounds := img.Bounds()
+	rgba, ok := img.(*image.RGBA)
+	if !ok || rgba.Bounds().Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	planes := [3][]uint8{make([]uint8, width*height), make([]uint8, width*height), make([]uint8, width*height)}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			offset := rgba.PixOffset(x, y)
+			// Alpha is dropped, the pixels are already premultiplied
+			yy, cb, cr := color.RGBToYCbCr(rgba.Pix[offset], rgba.Pix[offset+1], rgba.Pix[offset+2])
+			planes[0][y*width+x], planes[1][y*width+x], planes[2][y*width+x] = yy, cb, cr
+		}
+	}
+
+	blocks := e.blocksWide * e.blocksHigh
+	var samples [64]float64
+	for component := range planes {
+		e.coefficients[component] = make([]int32, blocks*64)
+		quantization := e.quantization[e.componentTable[component]]
+		for by := 0; by < e.blocksHigh; by++ {
+			for bx := 0; bx < e.blocksWide; bx++ {
+				for y := 0; y < 8; y++ {
+					sy := minInt(by*8+y, height-1)
+					for x := 0; x < 8; x++ {
+						sx := minInt(bx*8+x, width-1)
+						samples[y*8+x] = float64(planes[component][sy*width+sx]) - 128
+					}
+				}
+				coefficients := forwardDCT(samples)
+				block := e.coefficients[component][(by*e.blocksWide+bx)*64:]
+				for k := 0; k < 64; k++ {
+					natural := zigzag[k]
+					block[k] = int32(math.Round(coefficients[natural] / float64(quantization[natural])))
+				}
+			}
+		}
+	}
+}
+
+// cosines[u][x] = C(u)/2 * cos((2x+1)uπ/16)
+var cosines = func() [8][8]float64 {
+	var table [8][8]float64
+	for u := 0; u < 8; u++ {
+		scale := 0.5
+		if u == 0 {
+			scale = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			table[u][x] = scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return table
+}()
+
+// Separable 8x8 DCT-II, the result is in natural order indexed [v*8+u]
+func forwardDCT(samples [64]float64) [64]float64 {
+	var rows, result [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += cosines[u][x] * samples[y*8+x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			sum := 0.0
+			for y := 0; y < 8; y++ {
+				sum += cosines[v][y] * rows[y*8+u]
+			}
+			result[v*8+u] = sum
+		}
+	}
+	return result
+}
+
+func (e *fullChromaEncoder) write(data []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(data)
+}
+
+func (e *fullChromaEncoder) writeMarker(marker byte, length int) {
+	e.write([]byte{0xFF, marker, byte(length >> 8), byte(length)})
+}
+
+func (e *fullChromaEncoder) writeQuantization() {
+	e.writeMarker(0xDB, 2+2*65)
+	for table, values := range e.quantization {
+		data := make([]byte, 65)
+		data[0] = byte(table)
+		for k := 0; k < 64; k++ {
+			data[k+1] = byte(values[zigzag[k]])
+		}
+		e.write(data)
+	}
+}
+
+func (e *fullChromaEncoder) writeStartOfFrame(marker byte, width, height int) {
+	e.writeMarker(marker, 8+3*3)
+	e.write([]byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3})
+	for component := 0; component < 3; component++ {
+		e.write([]byte{byte(component + 1), 0x11, byte(e.componentTable[component])})
+	}
+}
+
+func (e *fullChromaEncoder) writeHuffman() {
+	length := 2
+	for _, spec := range huffmanSpecs {
+		length += 17 + len(spec.values)
+	}
+	e.writeMarker(0xC4, length)
+	// Class 0 is DC and 1 is AC, table 0 is luminance and 1 chrominance
+	classAndTable := [4]byte{0x00, 0x10, 0x01, 0x11}
+	for i, spec := range huffmanSpecs {
+		e.write([]byte{classAndTable[i]})
+		e.write(spec.counts[:])
+		e.write(spec.values)
+	}
+}
+
+func (e *fullChromaEncoder) writeScan(s scan) {
+	e.writeMarker(0xDA, 6+2*len(s.components))
+	e.write([]byte{byte(len(s.components))})
+	for _, component := range s.components {
+		table := byte(e.componentTable[component])
+		e.write([]byte{byte(component + 1), table<<4 | table})
+	}
+	e.write([]byte{byte(s.start), byte(s.end), 0})
+
+	e.previousDC = [3]int32{}
+	// With one 8x8 block per component in an MCU, interleaved and single component
+	// scans both visit the blocks in raster order
+	for block := 0; block < e.blocksWide*e.blocksHigh; block++ {
+		for _, component := range s.components {
+			e.writeBlock(component, e.coefficients[component][block*64:block*64+64], s.start, s.end)
+		}
+	}
+	// Pad the last byte with ones
+	if e.bitCount > 0 {
+		e.emit(0xFF, 8-e.bitCount)
+	}
+}
+
+// Write the coefficients start to end of a block
+func (e *fullChromaEncoder) writeBlock(component int, block []int32, start, end int) {
+	table := e.componentTable[component]
+	if start == 0 {
+		dc := &e.codes[huffmanDCLuminance+2*table]
+		diff := block[0] - e.previousDC[component]
+		e.previousDC[component] = block[0]
+		size := bitSize(diff)
+		e.emitCode(dc, byte(size))
+		e.emitValue(diff, size)
+		start = 1
+	}
+	if end < start {
+		return
+	}
+
+	ac := &e.codes[huffmanACLuminance+2*table]
+	run := 0
+	for k := start; k <= end; k++ {
+		if block[k] == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			e.emitCode(ac, 0xF0)
+			run -= 16
+		}
+		size := bitSize(block[k])
+		e.emitCode(ac, byte(run<<4|size))
+		e.emitValue(block[k], size)
+		run = 0
+	}
+	if run > 0 {
+		// End of block, a run of one block in progressive scans
+		e.emitCode(ac, 0x00)
+	}
+}
+
+func (e *fullChromaEncoder) emitCode(codes *huffmanCode, value byte) {
+	e.emit(codes.code[value], uint(codes.length[value]))
+}
+
+// Write the low size bits of a coefficient, negative values as their ones' complement
+func (e *fullChromaEncoder) emitValue(value int32, size int) {
+	if size == 0 {
+		return
+	}
+	if value < 0 {
+		value += 1<<size - 1
+	}
+	e.emit(uint32(value), uint(size))
+}
+
+// Write bits most significant first, stuffing a zero byte after every 0xFF
+func (e *fullChromaEncoder) emit(bits uint32, count uint) {
+	e.bits = e.bits<<count | bits&(1<<count-1)
+	e.bitCount += count
+	for e.bitCount >= 8 {
+		b := byte(e.bits >> (e.bitCount - 8))
+		e.write([]byte{b})
+		if b == 0xFF {
+			e.write([]byte{0})
+		}
+		e.bitCount -= 8
+	}
+	e.bits &= 1<<e.bitCount - 1
+}
+
+// Number of bits of the magnitude of a coefficient
+func bitSize(value int32) int {
+	if value < 0 {
+		value = -value
+	}
+	size := 0
+	for value > 0 {
+		size++
+		value >>= 1
+	}
+	return size
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,116 @@
+package encoder
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
+	"github.com/stretchr/testify/assert"
+)
+
+func gradient(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: uint8((x + y) % 256), A: 255})
+		}
+	}
+	return img
+}
+
+func TestEncode(t *testing.T) {
+	source := gradient(37, 21)
+	tests := []struct {
+		Name            string
+		Options         Options
+		ExpectedOptions Options
+		ExpectedMarker  byte
+	}{
+		{
+			Name:            "baseline 4:2:0",
+			Options:         Options{Quality: 80},
+			ExpectedOptions: Options{Quality: 80, Chroma: CHROMA_420},
+			ExpectedMarker:  0xC0,
+		},
+		{
+			Name:            "baseline 4:4:4",
+			Options:         Options{Quality: 90, Chroma: CHROMA_444},
+			ExpectedOptions: Options{Quality: 90, Chroma: CHROMA_444},
+			ExpectedMarker:  0xC0,
+		},
+		{
+			Name:            "progressive",
+			Options:         Options{Progressive: true},
+			ExpectedOptions: Options{Quality: jpeg.DefaultQuality, Progressive: true, Chroma: CHROMA_444},
+			ExpectedMarker:  0xC2,
+		},
+		{
+			Name:            "low quality progressive",
+			Options:         Options{Quality: 10, Progressive: true},
+			ExpectedOptions: Options{Quality: 10, Progressive: true, Chroma: CHROMA_444},
+			ExpectedMarker:  0xC2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var encoded bytes.Buffer
+			used, err := Encode(&encoded, source, test.Options)
+			assert.Nil(t, err)
+			assert.Equal(t, test.ExpectedOptions, used)
+			assert.False(t, decoder.HasMetadata(encoded.Bytes()))
+			assert.True(t, bytes.Contains(encoded.Bytes(), []byte{0xFF, test.ExpectedMarker}))
+
+			decoded, err := jpeg.Decode(bytes.NewReader(encoded.Bytes()))
+			assert.Nil(t, err)
+			assert.Equal(t, source.Bounds(), decoded.Bounds())
+			if test.ExpectedOptions.Quality < 50 {
+				return
+			}
+			// Lossy but close to the source
+			for _, point := range []image.Point{{0, 0}, {18, 10}, {36, 20}} {
+				expected := source.RGBAAt(point.X, point.Y)
+				r, g, b, _ := decoded.At(point.X, point.Y).RGBA()
+				assert.InDelta(t, expected.R, r>>8, 24)
+				assert.InDelta(t, expected.G, g>>8, 24)
+				assert.InDelta(t, expected.B, b>>8, 24)
+			}
+		})
+	}
+}
+
+func TestEncodeWithinBudget(t *testing.T) {
+	source := gradient(200, 200)
+	full, used, err := EncodeWithinBudget(source, Options{Quality: 95}, 1<<30)
+	assert.Nil(t, err)
+	assert.Equal(t, 95, used.Quality)
+
+	budget := int64(len(full)) / 2
+	encoded, used, err := EncodeWithinBudget(source, Options{Quality: 95, Progressive: true}, budget)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, int64(len(encoded)), budget)
+	assert.Less(t, used.Quality, 95)
+	assert.GreaterOrEqual(t, used.Quality, MIN_BUDGET_QUALITY)
+	assert.True(t, used.Progressive)
+	_, err = jpeg.Decode(bytes.NewReader(encoded))
+	assert.Nil(t, err)
+
+	// An unreachable budget settles for the lowest quality
+	encoded, used, err = EncodeWithinBudget(source, Options{Quality: 95}, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, MIN_BUDGET_QUALITY, used.Quality)
+	assert.NotEmpty(t, encoded)
+}
+
+func TestHuffmanSpecs(t *testing.T) {
+	for i, expected := range []int{12, 162, 12, 162} {
+		total := 0
+		for _, count := range huffmanSpecs[i].counts {
+			total += int(count)
+		}
+		assert.Equal(t, expected, total)
+		assert.Len(t, huffmanSpecs[i].values, expected)
+	}
+}
@@ -0,0 +1,114 @@
+package placeholder
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+const base83Characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash encodes an image as https://blurha.sh does, with xComponents by
+// yComponents cosine components from 1 to 9 each
+func BlurHash(img *image.RGBA, xComponents int, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("blurhash components should be from 1 to 9, got %dx%d", xComponents, yComponents)
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return "", fmt.Errorf("blurhash of an empty image")
+	}
+
+	// Linear colour of every pixel
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixel := img.RGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			linear[y*width+x] = [3]float64{sRGBToLinear(pixel.R), sRGBToLinear(pixel.G), sRGBToLinear(pixel.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				cosY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * cosY
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * linear[y*width+x][c]
+					}
+				}
+			}
+			scale := normalisation / float64(width*height)
+			for c := range factor {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	var hash strings.Builder
+	encodeBase83(&hash, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximum := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, factor := range ac {
+			for _, value := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(value))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximum = float64(quantisedMaximum+1) / 166
+		encodeBase83(&hash, quantisedMaximum, 1)
+	} else {
+		encodeBase83(&hash, 0, 1)
+	}
+
+	encodeBase83(&hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, factor := range ac {
+		quantised := 0
+		for _, value := range factor {
+			level := int(math.Max(0, math.Min(18, math.Floor(signPow(value/maximum, 0.5)*9+9.5))))
+			quantised = quantised*19 + level
+		}
+		encodeBase83(&hash, quantised, 2)
+	}
+	return hash.String(), nil
+}
+
+func encodeBase83(hash *strings.Builder, value int, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		hash.WriteByte(base83Characters[digit])
+	}
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value float64, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
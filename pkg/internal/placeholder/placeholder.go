@@ -0,0 +1,98 @@
+package placeholder
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/nfnt/resize"
+)
+
+// Side of the thumbnail placeholders are computed from, more detail than a BlurHash
+// of a few components can show is wasted time
+const SAMPLE_SIZE = 32
+
+// Placeholder is what a client shows while an image loads
+type Placeholder struct {
+	BlurHash      string
+	DominantColor string // #rrggbb
+	Width         int    // size of the upright image
+	Height        int
+}
+
+// New computes the placeholder of an image, the BlurHash has 4 components along the
+// longer side and 3 along the shorter one
+func New(img image.Image) (Placeholder, error) {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return Placeholder{}, fmt.Errorf("placeholder of an empty image")
+	}
+	sample := downscale(img)
+	xComponents, yComponents := 4, 3
+	if bounds.Dy() > bounds.Dx() {
+		xComponents, yComponents = 3, 4
+	}
+	hash, err := BlurHash(sample, xComponents, yComponents)
+	if err != nil {
+		return Placeholder{}, err
+	}
+	dominant := DominantColor(sample)
+	return Placeholder{
+		BlurHash:      hash,
+		DominantColor: fmt.Sprintf("#%02x%02x%02x", dominant.R, dominant.G, dominant.B),
+		Width:         bounds.Dx(),
+		Height:        bounds.Dy(),
+	}, nil
+}
+
+// Scale the image down to fit SAMPLE_SIZE, keeping its aspect ratio
+func downscale(img image.Image) *image.RGBA {
+	small := resize.Thumbnail(SAMPLE_SIZE, SAMPLE_SIZE, img, resize.Bilinear)
+	bounds := small.Bounds()
+	sample := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(sample, sample.Bounds(), small, bounds.Min, draw.Src)
+	return sample
+}
+
+// DominantColor is the mean of the most common colour, colours are grouped into
+// buckets of 16 levels per channel. Transparent pixels are left out.
+func DominantColor(img *image.RGBA) color.RGBA {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	var dominant *bucket
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := img.RGBAAt(x, y)
+			if pixel.A < 128 {
+				continue
+			}
+			key := int(pixel.R>>4)<<8 | int(pixel.G>>4)<<4 | int(pixel.B>>4)
+			b, ok := buckets[key]
+			if !ok {
+				b = &bucket{}
+				buckets[key] = b
+			}
+			b.count++
+			b.r += int(pixel.R)
+			b.g += int(pixel.G)
+			b.b += int(pixel.B)
+			if dominant == nil || b.count > dominant.count {
+				dominant = b
+			}
+		}
+	}
+	if dominant == nil {
+		return color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	}
+	return color.RGBA{
+		R: uint8(dominant.r / dominant.count),
+		G: uint8(dominant.g / dominant.count),
+		B: uint8(dominant.b / dominant.count),
+		A: 255,
+	}
+}
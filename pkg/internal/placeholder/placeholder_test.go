@@ -0,0 +1,77 @@
+package placeholder
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func filled(width, height int, fill color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: fill}, image.Point{}, draw.Src)
+	return img
+}
+
+func gradient(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 30), G: uint8(y * 40), B: uint8((x + y) * 10), A: 255})
+		}
+	}
+	return img
+}
+
+func TestBlurHash(t *testing.T) {
+	white := filled(8, 6, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	tests := []struct {
+		Name          string
+		Image         *image.RGBA
+		XComponents   int
+		YComponents   int
+		Expected      string
+		ExpectedError bool
+	}{
+		{Name: "Test single component", Image: white, XComponents: 1, YComponents: 1, Expected: "00TSUA"},
+		{Name: "Test flat image", Image: white, XComponents: 4, YComponents: 3, Expected: "LsTSUA_3fQ_3~qt7fQt7fQfQfQfQ"},
+		{Name: "Test gradient", Image: gradient(8, 6), XComponents: 4, YComponents: 3, Expected: "LcE.,Z34a_%0zHNJfRnQeof8fRf6"},
+		{Name: "Test black", Image: filled(4, 4, color.RGBA{A: 255}), XComponents: 1, YComponents: 1, Expected: "000000"},
+		{Name: "Test too many components", Image: white, XComponents: 10, YComponents: 1, ExpectedError: true},
+		{Name: "Test empty image", Image: image.NewRGBA(image.Rect(0, 0, 0, 0)), XComponents: 1, YComponents: 1, ExpectedError: true},
+	}
+	for _, test := range tests {
+		hash, err := BlurHash(test.Image, test.XComponents, test.YComponents)
+		assert.Equal(t, test.ExpectedError, err != nil, test.Name)
+		assert.Equal(t, test.Expected, hash, test.Name)
+	}
+}
+
+func TestNew(t *testing.T) {
+	// A red portrait with a blue band across the top
+	img := filled(300, 400, color.RGBA{R: 255, A: 255})
+	draw.Draw(img, image.Rect(0, 0, 300, 100), &image.Uniform{C: color.RGBA{B: 255, A: 255}}, image.Point{}, draw.Src)
+
+	placeholder, err := New(img)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, placeholder.Width)
+	assert.Equal(t, 400, placeholder.Height)
+	assert.Equal(t, "#ff0000", placeholder.DominantColor)
+	// 3x4 components, the size flag is (3-1) + (4-1)*9
+	assert.Equal(t, byte('T'), placeholder.BlurHash[0])
+	assert.Len(t, placeholder.BlurHash, 6+2*11)
+
+	landscape, err := New(filled(400, 300, color.RGBA{G: 255, A: 255}))
+	assert.Nil(t, err)
+	assert.Equal(t, byte('L'), landscape.BlurHash[0])
+	assert.Equal(t, "#00ff00", landscape.DominantColor)
+}
+
+func TestDominantColorSkipsTransparentPixels(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(img, image.Rect(0, 0, 3, 3), &image.Uniform{C: color.RGBA{R: 10, G: 20, B: 30, A: 255}}, image.Point{}, draw.Src)
+	assert.Equal(t, color.RGBA{R: 10, G: 20, B: 30, A: 255}, DominantColor(img))
+	assert.Equal(t, color.RGBA{R: 255, G: 255, B: 255, A: 255}, DominantColor(image.NewRGBA(image.Rect(0, 0, 2, 2))))
+}
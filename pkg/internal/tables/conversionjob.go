@@ -0,0 +1,27 @@
+package tables
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	CONVERSION_JOB_PENDING  = "pending"
+	CONVERSION_JOB_RUNNING  = "running"
+	CONVERSION_JOB_DONE     = "done"
+	CONVERSION_JOB_DEAD     = "dead"     // gave up after too many attempts
+	CONVERSION_JOB_REJECTED = "rejected" // the image can't be converted, e.g. too large
+)
+
+type ConversionJobTable struct {
+	JobId          int64
+	ImageId        int64
+	Status         string
+	Attempts       int
+	LastError      string
+	NextAttemptAt  time.Time
+	LeaseOwner     string // worker currently holding the job
+	LeaseExpiresAt sql.NullTime
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
@@ -1,13 +1,25 @@
 package tables
 
-import "time"
+import (
+	"database/sql"
+	"time"
+)
 
 type ImageTable struct {
-	ImageId                int64
-	PostId                 int64
-	ImageFileName          string
-	Location               string
-	ConvertedImageName     string
-	ConvertedImageLocation string
-	UploadedAt             time.Time
+	ImageId       int64
+	PostId        int64
+	ImageFileName string // original file name sent by the client
+	StorageKey    string // key of the original in the file system
+	ContentHash   string // hex sha256 of the original
+	Location      string
+	Width         int // upright size, 0 until the image is converted
+	Height        int
+	BlurHash      string // placeholder, empty until the image is converted
+	DominantColor string // #rrggbb
+	// PerceptualHash holds the bits of the 64 bit dHash, null until the image is converted
+	PerceptualHash sql.NullInt64
+	DuplicateOf    int64 // image this one was flagged as a near duplicate of, 0 for none
+	// QuarantinedAt is set once the image matched the blocklist, its post is hidden
+	QuarantinedAt sql.NullTime
+	UploadedAt    time.Time
 }
@@ -0,0 +1,19 @@
+package tables
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ImageMetadataTable holds what we keep from an original's EXIF data. GPS positions
+// are never stored.
+type ImageMetadataTable struct {
+	ImageId     int64
+	Width       int // upright size of the original
+	Height      int
+	Orientation int
+	CapturedAt  sql.NullTime
+	CameraMake  string
+	CameraModel string
+	CreatedAt   time.Time
+}
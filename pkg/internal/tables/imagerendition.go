@@ -0,0 +1,18 @@
+package tables
+
+import "time"
+
+type ImageRenditionTable struct {
+	ImageId     int64
+	Name        string
+	Mode        string // resize mode the rendition was produced with, e.g. fill:entropy
+	StorageKey  string
+	Location    string
+	Width       int // output size
+	Height      int
+	SizeBytes   int64
+	Quality     int // JPEG encoding the rendition was written with
+	Progressive bool
+	Chroma      string // chroma subsampling, e.g. 4:4:4
+	CreatedAt   time.Time
+}
@@ -0,0 +1,37 @@
+package tables
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	MODERATION_ACTION_REJECTED    = "rejected"    // an upload matching the blocklist was refused
+	MODERATION_ACTION_QUARANTINED = "quarantined" // a posted image matching the blocklist was hidden
+)
+
+// Where a blocklist match was found
+const (
+	MODERATION_SOURCE_UPLOAD    = "upload"
+	MODERATION_SOURCE_CONVERTER = "converter"
+	MODERATION_SOURCE_BLOCKLIST = "blocklist" // a hash added to the blocklist matched images already posted
+)
+
+type BlockedHashTable struct {
+	BlockedHashId  int64
+	PerceptualHash uint64
+	Reason         string
+	CreatedAt      time.Time
+}
+
+type ModerationEventTable struct {
+	EventId       int64
+	Action        string
+	Source        string
+	BlockedHashId int64
+	Distance      int // bits the image's perceptual hash differs from the blocked hash by
+	ImageId       sql.NullInt64
+	PostId        sql.NullInt64
+	UserId        sql.NullInt64 // uploader of a refused image, which has no post
+	CreatedAt     time.Time
+}
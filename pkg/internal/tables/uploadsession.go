@@ -0,0 +1,38 @@
+package tables
+
+import (
+	"database/sql"
+	"time"
+)
+
+type UploadSessionTable struct {
+	UploadId    string
+	UserId      int64
+	Caption     string
+	FileName    string
+	Length      int64        // size of the whole file, declared when the upload is created
+	Offset      int64        // bytes received so far
+	PostId      int64        // post the upload was finalized into, 0 until then
+	FinalizedAt sql.NullTime // set while the upload is being turned into a post
+	ExpiresAt   time.Time
+	CreatedAt   time.Time
+}
+
+type UploadPartTable struct {
+	UploadId   string
+	Offset     int64 // offset of the part's first byte in the file
+	Size       int64
+	StorageKey string
+}
+
+type DirectUploadTable struct {
+	UploadId    string
+	UserId      int64
+	FileName    string
+	ContentType string
+	Length      int64        // size the client declared, the stored file must match it
+	PostId      int64        // post the upload was turned into, 0 until then
+	ClaimedAt   sql.NullTime // set while the upload is being turned into a post
+	ExpiresAt   time.Time
+	CreatedAt   time.Time
+}
@@ -1,16 +1,17 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: /Users/kunalsindhwani/InterviewCoding/bandlabs/imagegram/pkg/database/dboperation.go
+// Source: pkg/database/dboperation.go
 
-// Package mock_database is a generated GoMock package.
+// Package mocks is a generated GoMock package.
 package mocks
 
 import (
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	database "github.com/ksindhwani/imagegram/pkg/database"
-	converter "github.com/ksindhwani/imagegram/pkg/internal/converter"
 	tables "github.com/ksindhwani/imagegram/pkg/internal/tables"
+	pagination "github.com/ksindhwani/imagegram/pkg/pagination"
 )
 
 // MockDatabase is a mock of Database interface.
@@ -36,6 +37,120 @@ func (m *MockDatabase) EXPECT() *MockDatabaseMockRecorder {
 	return m.recorder
 }
 
+// ClaimConversionJobs mocks base method.
+func (m *MockDatabase) ClaimConversionJobs(owner string, limit int, lease time.Duration, maxAttempts int) ([]tables.ConversionJobTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimConversionJobs", owner, limit, lease, maxAttempts)
+	ret0, _ := ret[0].([]tables.ConversionJobTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimConversionJobs indicates an expected call of ClaimConversionJobs.
+func (mr *MockDatabaseMockRecorder) ClaimConversionJobs(owner, limit, lease, maxAttempts interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimConversionJobs", reflect.TypeOf((*MockDatabase)(nil).ClaimConversionJobs), owner, limit, lease, maxAttempts)
+}
+
+// ClaimDirectUpload mocks base method.
+func (m *MockDatabase) ClaimDirectUpload(uploadId string, timeout time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimDirectUpload", uploadId, timeout)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ClaimDirectUpload indicates an expected call of ClaimDirectUpload.
+func (mr *MockDatabaseMockRecorder) ClaimDirectUpload(uploadId, timeout interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimDirectUpload", reflect.TypeOf((*MockDatabase)(nil).ClaimDirectUpload), uploadId, timeout)
+}
+
+// ClaimPostConversionJob mocks base method.
+func (m *MockDatabase) ClaimPostConversionJob(owner string, postId int64, lease time.Duration, maxAttempts int) (tables.ConversionJobTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimPostConversionJob", owner, postId, lease, maxAttempts)
+	ret0, _ := ret[0].(tables.ConversionJobTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimPostConversionJob indicates an expected call of ClaimPostConversionJob.
+func (mr *MockDatabaseMockRecorder) ClaimPostConversionJob(owner, postId, lease, maxAttempts interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimPostConversionJob", reflect.TypeOf((*MockDatabase)(nil).ClaimPostConversionJob), owner, postId, lease, maxAttempts)
+}
+
+// ClaimUploadSession mocks base method.
+func (m *MockDatabase) ClaimUploadSession(uploadId string, timeout time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimUploadSession", uploadId, timeout)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ClaimUploadSession indicates an expected call of ClaimUploadSession.
+func (mr *MockDatabaseMockRecorder) ClaimUploadSession(uploadId, timeout interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimUploadSession", reflect.TypeOf((*MockDatabase)(nil).ClaimUploadSession), uploadId, timeout)
+}
+
+// CompleteConversionJob mocks base method.
+func (m *MockDatabase) CompleteConversionJob(job tables.ConversionJobTable) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompleteConversionJob", job)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CompleteConversionJob indicates an expected call of CompleteConversionJob.
+func (mr *MockDatabaseMockRecorder) CompleteConversionJob(job interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteConversionJob", reflect.TypeOf((*MockDatabase)(nil).CompleteConversionJob), job)
+}
+
+// CreateDirectUpload mocks base method.
+func (m *MockDatabase) CreateDirectUpload(upload tables.DirectUploadTable, ttl time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateDirectUpload", upload, ttl)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateDirectUpload indicates an expected call of CreateDirectUpload.
+func (mr *MockDatabaseMockRecorder) CreateDirectUpload(upload, ttl interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateDirectUpload", reflect.TypeOf((*MockDatabase)(nil).CreateDirectUpload), upload, ttl)
+}
+
+// CreateUploadSession mocks base method.
+func (m *MockDatabase) CreateUploadSession(session tables.UploadSessionTable, ttl time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUploadSession", session, ttl)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateUploadSession indicates an expected call of CreateUploadSession.
+func (mr *MockDatabaseMockRecorder) CreateUploadSession(session, ttl interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUploadSession", reflect.TypeOf((*MockDatabase)(nil).CreateUploadSession), session, ttl)
+}
+
+// DeleteBlockedHash mocks base method.
+func (m *MockDatabase) DeleteBlockedHash(blockedHashId int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteBlockedHash", blockedHashId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteBlockedHash indicates an expected call of DeleteBlockedHash.
+func (mr *MockDatabaseMockRecorder) DeleteBlockedHash(blockedHashId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteBlockedHash", reflect.TypeOf((*MockDatabase)(nil).DeleteBlockedHash), blockedHashId)
+}
+
 // DeleteComment mocks base method.
 func (m *MockDatabase) DeleteComment(commentId int64) error {
 	m.ctrl.T.Helper()
@@ -50,34 +165,389 @@ func (mr *MockDatabaseMockRecorder) DeleteComment(commentId interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteComment", reflect.TypeOf((*MockDatabase)(nil).DeleteComment), commentId)
 }
 
-// GetAllImages mocks base method.
-func (m *MockDatabase) GetAllImages() ([]tables.ImageTable, error) {
+// DeleteDirectUpload mocks base method.
+func (m *MockDatabase) DeleteDirectUpload(uploadId string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetAllImages")
-	ret0, _ := ret[0].([]tables.ImageTable)
+	ret := m.ctrl.Call(m, "DeleteDirectUpload", uploadId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteDirectUpload indicates an expected call of DeleteDirectUpload.
+func (mr *MockDatabaseMockRecorder) DeleteDirectUpload(uploadId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteDirectUpload", reflect.TypeOf((*MockDatabase)(nil).DeleteDirectUpload), uploadId)
+}
+
+// DeleteUploadSession mocks base method.
+func (m *MockDatabase) DeleteUploadSession(uploadId string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUploadSession", uploadId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUploadSession indicates an expected call of DeleteUploadSession.
+func (mr *MockDatabaseMockRecorder) DeleteUploadSession(uploadId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUploadSession", reflect.TypeOf((*MockDatabase)(nil).DeleteUploadSession), uploadId)
+}
+
+// EnqueueImagesMissingRenditions mocks base method.
+func (m *MockDatabase) EnqueueImagesMissingRenditions(names []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnqueueImagesMissingRenditions", names)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EnqueueImagesMissingRenditions indicates an expected call of EnqueueImagesMissingRenditions.
+func (mr *MockDatabaseMockRecorder) EnqueueImagesMissingRenditions(names interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnqueueImagesMissingRenditions", reflect.TypeOf((*MockDatabase)(nil).EnqueueImagesMissingRenditions), names)
+}
+
+// FailConversionJob mocks base method.
+func (m *MockDatabase) FailConversionJob(job tables.ConversionJobTable, retryAfter time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FailConversionJob", job, retryAfter)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FailConversionJob indicates an expected call of FailConversionJob.
+func (mr *MockDatabaseMockRecorder) FailConversionJob(job, retryAfter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FailConversionJob", reflect.TypeOf((*MockDatabase)(nil).FailConversionJob), job, retryAfter)
+}
+
+// FinishDirectUpload mocks base method.
+func (m *MockDatabase) FinishDirectUpload(uploadId string, postId int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FinishDirectUpload", uploadId, postId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FinishDirectUpload indicates an expected call of FinishDirectUpload.
+func (mr *MockDatabaseMockRecorder) FinishDirectUpload(uploadId, postId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinishDirectUpload", reflect.TypeOf((*MockDatabase)(nil).FinishDirectUpload), uploadId, postId)
+}
+
+// FinishUploadSession mocks base method.
+func (m *MockDatabase) FinishUploadSession(uploadId string, postId int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FinishUploadSession", uploadId, postId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FinishUploadSession indicates an expected call of FinishUploadSession.
+func (mr *MockDatabaseMockRecorder) FinishUploadSession(uploadId, postId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinishUploadSession", reflect.TypeOf((*MockDatabase)(nil).FinishUploadSession), uploadId, postId)
+}
+
+// GetBlockedHashMatch mocks base method.
+func (m *MockDatabase) GetBlockedHashMatch(hash uint64, maxDistance int) (tables.BlockedHashTable, int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBlockedHashMatch", hash, maxDistance)
+	ret0, _ := ret[0].(tables.BlockedHashTable)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetBlockedHashMatch indicates an expected call of GetBlockedHashMatch.
+func (mr *MockDatabaseMockRecorder) GetBlockedHashMatch(hash, maxDistance interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBlockedHashMatch", reflect.TypeOf((*MockDatabase)(nil).GetBlockedHashMatch), hash, maxDistance)
+}
+
+// GetBlockedHashes mocks base method.
+func (m *MockDatabase) GetBlockedHashes(cursor *pagination.Cursor, limit int) ([]tables.BlockedHashTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBlockedHashes", cursor, limit)
+	ret0, _ := ret[0].([]tables.BlockedHashTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBlockedHashes indicates an expected call of GetBlockedHashes.
+func (mr *MockDatabaseMockRecorder) GetBlockedHashes(cursor, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBlockedHashes", reflect.TypeOf((*MockDatabase)(nil).GetBlockedHashes), cursor, limit)
+}
+
+// GetCommentsForPost mocks base method.
+func (m *MockDatabase) GetCommentsForPost(postId int64, cursor *pagination.Cursor, limit int) ([]tables.CommentTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCommentsForPost", postId, cursor, limit)
+	ret0, _ := ret[0].([]tables.CommentTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCommentsForPost indicates an expected call of GetCommentsForPost.
+func (mr *MockDatabaseMockRecorder) GetCommentsForPost(postId, cursor, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCommentsForPost", reflect.TypeOf((*MockDatabase)(nil).GetCommentsForPost), postId, cursor, limit)
+}
+
+// GetConversionJobs mocks base method.
+func (m *MockDatabase) GetConversionJobs(status string, cursor *pagination.Cursor, limit int) ([]tables.ConversionJobTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetConversionJobs", status, cursor, limit)
+	ret0, _ := ret[0].([]tables.ConversionJobTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetConversionJobs indicates an expected call of GetConversionJobs.
+func (mr *MockDatabaseMockRecorder) GetConversionJobs(status, cursor, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetConversionJobs", reflect.TypeOf((*MockDatabase)(nil).GetConversionJobs), status, cursor, limit)
+}
+
+// GetDirectUpload mocks base method.
+func (m *MockDatabase) GetDirectUpload(uploadId string) (tables.DirectUploadTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDirectUpload", uploadId)
+	ret0, _ := ret[0].(tables.DirectUploadTable)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetAllImages indicates an expected call of GetAllImages.
-func (mr *MockDatabaseMockRecorder) GetAllImages() *gomock.Call {
+// GetDirectUpload indicates an expected call of GetDirectUpload.
+func (mr *MockDatabaseMockRecorder) GetDirectUpload(uploadId interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllImages", reflect.TypeOf((*MockDatabase)(nil).GetAllImages))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDirectUpload", reflect.TypeOf((*MockDatabase)(nil).GetDirectUpload), uploadId)
 }
 
-// GetAllPostWithLast2Comments mocks base method.
-func (m *MockDatabase) GetAllPostWithLast2Comments(cursor, pageSize int) ([]database.AllPostsJoinQueryResult, error) {
+// GetExpiredDirectUploads mocks base method.
+func (m *MockDatabase) GetExpiredDirectUploads(limit int) ([]string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetAllPostWithLast2Comments", cursor, pageSize)
-	ret0, _ := ret[0].([]database.AllPostsJoinQueryResult)
+	ret := m.ctrl.Call(m, "GetExpiredDirectUploads", limit)
+	ret0, _ := ret[0].([]string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetAllPostWithLast2Comments indicates an expected call of GetAllPostWithLast2Comments.
-func (mr *MockDatabaseMockRecorder) GetAllPostWithLast2Comments(cursor, pageSize interface{}) *gomock.Call {
+// GetExpiredDirectUploads indicates an expected call of GetExpiredDirectUploads.
+func (mr *MockDatabaseMockRecorder) GetExpiredDirectUploads(limit interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllPostWithLast2Comments", reflect.TypeOf((*MockDatabase)(nil).GetAllPostWithLast2Comments), cursor, pageSize)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpiredDirectUploads", reflect.TypeOf((*MockDatabase)(nil).GetExpiredDirectUploads), limit)
+}
+
+// GetExpiredUploadSessions mocks base method.
+func (m *MockDatabase) GetExpiredUploadSessions(limit int) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExpiredUploadSessions", limit)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExpiredUploadSessions indicates an expected call of GetExpiredUploadSessions.
+func (mr *MockDatabaseMockRecorder) GetExpiredUploadSessions(limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpiredUploadSessions", reflect.TypeOf((*MockDatabase)(nil).GetExpiredUploadSessions), limit)
+}
+
+// GetImage mocks base method.
+func (m *MockDatabase) GetImage(imageId int64) (tables.ImageTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetImage", imageId)
+	ret0, _ := ret[0].(tables.ImageTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetImage indicates an expected call of GetImage.
+func (mr *MockDatabaseMockRecorder) GetImage(imageId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetImage", reflect.TypeOf((*MockDatabase)(nil).GetImage), imageId)
+}
+
+// GetImageByContentHash mocks base method.
+func (m *MockDatabase) GetImageByContentHash(contentHash string) (tables.ImageTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetImageByContentHash", contentHash)
+	ret0, _ := ret[0].(tables.ImageTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetImageByContentHash indicates an expected call of GetImageByContentHash.
+func (mr *MockDatabaseMockRecorder) GetImageByContentHash(contentHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetImageByContentHash", reflect.TypeOf((*MockDatabase)(nil).GetImageByContentHash), contentHash)
+}
+
+// GetImageByStorageKey mocks base method.
+func (m *MockDatabase) GetImageByStorageKey(storageKey string) (tables.ImageTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetImageByStorageKey", storageKey)
+	ret0, _ := ret[0].(tables.ImageTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetImageByStorageKey indicates an expected call of GetImageByStorageKey.
+func (mr *MockDatabaseMockRecorder) GetImageByStorageKey(storageKey interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetImageByStorageKey", reflect.TypeOf((*MockDatabase)(nil).GetImageByStorageKey), storageKey)
+}
+
+// GetImageForPost mocks base method.
+func (m *MockDatabase) GetImageForPost(postId int64) (tables.ImageTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetImageForPost", postId)
+	ret0, _ := ret[0].(tables.ImageTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetImageForPost indicates an expected call of GetImageForPost.
+func (mr *MockDatabaseMockRecorder) GetImageForPost(postId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetImageForPost", reflect.TypeOf((*MockDatabase)(nil).GetImageForPost), postId)
+}
+
+// GetImageRendition mocks base method.
+func (m *MockDatabase) GetImageRendition(imageId int64, name string) (tables.ImageRenditionTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetImageRendition", imageId, name)
+	ret0, _ := ret[0].(tables.ImageRenditionTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetImageRendition indicates an expected call of GetImageRendition.
+func (mr *MockDatabaseMockRecorder) GetImageRendition(imageId, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetImageRendition", reflect.TypeOf((*MockDatabase)(nil).GetImageRendition), imageId, name)
+}
+
+// GetImageRenditions mocks base method.
+func (m *MockDatabase) GetImageRenditions(imageId int64) ([]tables.ImageRenditionTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetImageRenditions", imageId)
+	ret0, _ := ret[0].([]tables.ImageRenditionTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetImageRenditions indicates an expected call of GetImageRenditions.
+func (mr *MockDatabaseMockRecorder) GetImageRenditions(imageId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetImageRenditions", reflect.TypeOf((*MockDatabase)(nil).GetImageRenditions), imageId)
+}
+
+// GetLastCommentsForPosts mocks base method.
+func (m *MockDatabase) GetLastCommentsForPosts(postIds []int64, commentsPerPost int) ([]tables.CommentTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLastCommentsForPosts", postIds, commentsPerPost)
+	ret0, _ := ret[0].([]tables.CommentTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLastCommentsForPosts indicates an expected call of GetLastCommentsForPosts.
+func (mr *MockDatabaseMockRecorder) GetLastCommentsForPosts(postIds, commentsPerPost interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLastCommentsForPosts", reflect.TypeOf((*MockDatabase)(nil).GetLastCommentsForPosts), postIds, commentsPerPost)
+}
+
+// GetModerationEvents mocks base method.
+func (m *MockDatabase) GetModerationEvents(cursor *pagination.Cursor, limit int) ([]tables.ModerationEventTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetModerationEvents", cursor, limit)
+	ret0, _ := ret[0].([]tables.ModerationEventTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetModerationEvents indicates an expected call of GetModerationEvents.
+func (mr *MockDatabaseMockRecorder) GetModerationEvents(cursor, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetModerationEvents", reflect.TypeOf((*MockDatabase)(nil).GetModerationEvents), cursor, limit)
+}
+
+// GetPosts mocks base method.
+func (m *MockDatabase) GetPosts(cursor *pagination.Cursor, limit int) ([]database.PostQueryResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPosts", cursor, limit)
+	ret0, _ := ret[0].([]database.PostQueryResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPosts indicates an expected call of GetPosts.
+func (mr *MockDatabaseMockRecorder) GetPosts(cursor, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPosts", reflect.TypeOf((*MockDatabase)(nil).GetPosts), cursor, limit)
+}
+
+// GetSimilarImages mocks base method.
+func (m *MockDatabase) GetSimilarImages(hash uint64, maxDistance, limit int) ([]database.SimilarImageResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSimilarImages", hash, maxDistance, limit)
+	ret0, _ := ret[0].([]database.SimilarImageResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSimilarImages indicates an expected call of GetSimilarImages.
+func (mr *MockDatabaseMockRecorder) GetSimilarImages(hash, maxDistance, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSimilarImages", reflect.TypeOf((*MockDatabase)(nil).GetSimilarImages), hash, maxDistance, limit)
+}
+
+// GetUploadParts mocks base method.
+func (m *MockDatabase) GetUploadParts(uploadId string) ([]tables.UploadPartTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUploadParts", uploadId)
+	ret0, _ := ret[0].([]tables.UploadPartTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUploadParts indicates an expected call of GetUploadParts.
+func (mr *MockDatabaseMockRecorder) GetUploadParts(uploadId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUploadParts", reflect.TypeOf((*MockDatabase)(nil).GetUploadParts), uploadId)
+}
+
+// GetUploadSession mocks base method.
+func (m *MockDatabase) GetUploadSession(uploadId string) (tables.UploadSessionTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUploadSession", uploadId)
+	ret0, _ := ret[0].(tables.UploadSessionTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUploadSession indicates an expected call of GetUploadSession.
+func (mr *MockDatabaseMockRecorder) GetUploadSession(uploadId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUploadSession", reflect.TypeOf((*MockDatabase)(nil).GetUploadSession), uploadId)
+}
+
+// HasBlockedHashes mocks base method.
+func (m *MockDatabase) HasBlockedHashes() (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HasBlockedHashes")
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// HasBlockedHashes indicates an expected call of HasBlockedHashes.
+func (mr *MockDatabaseMockRecorder) HasBlockedHashes() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HasBlockedHashes", reflect.TypeOf((*MockDatabase)(nil).HasBlockedHashes))
 }
 
 // InsertNewPost mocks base method.
@@ -95,6 +565,93 @@ func (mr *MockDatabaseMockRecorder) InsertNewPost(postTableRow, imageTableRow in
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertNewPost", reflect.TypeOf((*MockDatabase)(nil).InsertNewPost), postTableRow, imageTableRow)
 }
 
+// QuarantineImages mocks base method.
+func (m *MockDatabase) QuarantineImages(storageKey, quarantineKey, location string, event tables.ModerationEventTable) ([]tables.ImageTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "QuarantineImages", storageKey, quarantineKey, location, event)
+	ret0, _ := ret[0].([]tables.ImageTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// QuarantineImages indicates an expected call of QuarantineImages.
+func (mr *MockDatabaseMockRecorder) QuarantineImages(storageKey, quarantineKey, location, event interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QuarantineImages", reflect.TypeOf((*MockDatabase)(nil).QuarantineImages), storageKey, quarantineKey, location, event)
+}
+
+// ReleaseDirectUpload mocks base method.
+func (m *MockDatabase) ReleaseDirectUpload(uploadId string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseDirectUpload", uploadId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseDirectUpload indicates an expected call of ReleaseDirectUpload.
+func (mr *MockDatabaseMockRecorder) ReleaseDirectUpload(uploadId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseDirectUpload", reflect.TypeOf((*MockDatabase)(nil).ReleaseDirectUpload), uploadId)
+}
+
+// ReleaseUploadSession mocks base method.
+func (m *MockDatabase) ReleaseUploadSession(uploadId string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseUploadSession", uploadId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseUploadSession indicates an expected call of ReleaseUploadSession.
+func (mr *MockDatabaseMockRecorder) ReleaseUploadSession(uploadId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseUploadSession", reflect.TypeOf((*MockDatabase)(nil).ReleaseUploadSession), uploadId)
+}
+
+// RequeueConversionJob mocks base method.
+func (m *MockDatabase) RequeueConversionJob(jobId int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequeueConversionJob", jobId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RequeueConversionJob indicates an expected call of RequeueConversionJob.
+func (mr *MockDatabaseMockRecorder) RequeueConversionJob(jobId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueConversionJob", reflect.TypeOf((*MockDatabase)(nil).RequeueConversionJob), jobId)
+}
+
+// RequeueDeadConversionJobs mocks base method.
+func (m *MockDatabase) RequeueDeadConversionJobs() (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequeueDeadConversionJobs")
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RequeueDeadConversionJobs indicates an expected call of RequeueDeadConversionJobs.
+func (mr *MockDatabaseMockRecorder) RequeueDeadConversionJobs() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueDeadConversionJobs", reflect.TypeOf((*MockDatabase)(nil).RequeueDeadConversionJobs))
+}
+
+// SaveBlockedHashes mocks base method.
+func (m *MockDatabase) SaveBlockedHashes(hashes []tables.BlockedHashTable) ([]tables.BlockedHashTable, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveBlockedHashes", hashes)
+	ret0, _ := ret[0].([]tables.BlockedHashTable)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SaveBlockedHashes indicates an expected call of SaveBlockedHashes.
+func (mr *MockDatabaseMockRecorder) SaveBlockedHashes(hashes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveBlockedHashes", reflect.TypeOf((*MockDatabase)(nil).SaveBlockedHashes), hashes)
+}
+
 // SaveComment mocks base method.
 func (m *MockDatabase) SaveComment(comment tables.CommentTable) (int64, error) {
 	m.ctrl.T.Helper()
@@ -110,16 +667,86 @@ func (mr *MockDatabaseMockRecorder) SaveComment(comment interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveComment", reflect.TypeOf((*MockDatabase)(nil).SaveComment), comment)
 }
 
-// UpdateImageConvertedData mocks base method.
-func (m *MockDatabase) UpdateImageConvertedData(image converter.ImageConversionResponse) error {
+// SaveImageHash mocks base method.
+func (m *MockDatabase) SaveImageHash(imageId int64, hash uint64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveImageHash", imageId, hash)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveImageHash indicates an expected call of SaveImageHash.
+func (mr *MockDatabaseMockRecorder) SaveImageHash(imageId, hash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveImageHash", reflect.TypeOf((*MockDatabase)(nil).SaveImageHash), imageId, hash)
+}
+
+// SaveImageMetadata mocks base method.
+func (m *MockDatabase) SaveImageMetadata(metadata tables.ImageMetadataTable) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveImageMetadata", metadata)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveImageMetadata indicates an expected call of SaveImageMetadata.
+func (mr *MockDatabaseMockRecorder) SaveImageMetadata(metadata interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveImageMetadata", reflect.TypeOf((*MockDatabase)(nil).SaveImageMetadata), metadata)
+}
+
+// SaveImagePlaceholder mocks base method.
+func (m *MockDatabase) SaveImagePlaceholder(image tables.ImageTable) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveImagePlaceholder", image)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveImagePlaceholder indicates an expected call of SaveImagePlaceholder.
+func (mr *MockDatabaseMockRecorder) SaveImagePlaceholder(image interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveImagePlaceholder", reflect.TypeOf((*MockDatabase)(nil).SaveImagePlaceholder), image)
+}
+
+// SaveImageRenditions mocks base method.
+func (m *MockDatabase) SaveImageRenditions(renditions []tables.ImageRenditionTable) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveImageRenditions", renditions)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveImageRenditions indicates an expected call of SaveImageRenditions.
+func (mr *MockDatabaseMockRecorder) SaveImageRenditions(renditions interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveImageRenditions", reflect.TypeOf((*MockDatabase)(nil).SaveImageRenditions), renditions)
+}
+
+// SaveModerationEvent mocks base method.
+func (m *MockDatabase) SaveModerationEvent(event tables.ModerationEventTable) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveModerationEvent", event)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveModerationEvent indicates an expected call of SaveModerationEvent.
+func (mr *MockDatabaseMockRecorder) SaveModerationEvent(event interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveModerationEvent", reflect.TypeOf((*MockDatabase)(nil).SaveModerationEvent), event)
+}
+
+// SaveUploadPart mocks base method.
+func (m *MockDatabase) SaveUploadPart(part tables.UploadPartTable, ttl time.Duration) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateImageConvertedData", image)
+	ret := m.ctrl.Call(m, "SaveUploadPart", part, ttl)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// UpdateImageConvertedData indicates an expected call of UpdateImageConvertedData.
-func (mr *MockDatabaseMockRecorder) UpdateImageConvertedData(image interface{}) *gomock.Call {
+// SaveUploadPart indicates an expected call of SaveUploadPart.
+func (mr *MockDatabaseMockRecorder) SaveUploadPart(part, ttl interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateImageConvertedData", reflect.TypeOf((*MockDatabase)(nil).UpdateImageConvertedData), image)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveUploadPart", reflect.TypeOf((*MockDatabase)(nil).SaveUploadPart), part, ttl)
 }
@@ -1,12 +1,15 @@
 // Code generated by MockGen. DO NOT EDIT.
 // Source: pkg/filesystem/client.go
 
-// Package mock_filesystem is a generated GoMock package.
+// Package mocks is a generated GoMock package.
 package mocks
 
 import (
-	multipart "mime/multipart"
+	context "context"
+	io "io"
+	fs "io/fs"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -34,17 +37,130 @@ func (m *MockFileSystem) EXPECT() *MockFileSystemMockRecorder {
 	return m.recorder
 }
 
-// SaveFile mocks base method.
-func (m *MockFileSystem) SaveFile(fileName string, file multipart.File) (string, error) {
+// Delete mocks base method.
+func (m *MockFileSystem) Delete(key string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SaveFile", fileName, file)
+	ret := m.ctrl.Call(m, "Delete", key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockFileSystemMockRecorder) Delete(key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockFileSystem)(nil).Delete), key)
+}
+
+// List mocks base method.
+func (m *MockFileSystem) List(prefix string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", prefix)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockFileSystemMockRecorder) List(prefix interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockFileSystem)(nil).List), prefix)
+}
+
+// Move mocks base method.
+func (m *MockFileSystem) Move(ctx context.Context, from, to string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Move", ctx, from, to)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Move indicates an expected call of Move.
+func (mr *MockFileSystemMockRecorder) Move(ctx, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Move", reflect.TypeOf((*MockFileSystem)(nil).Move), ctx, from, to)
+}
+
+// Open mocks base method.
+func (m *MockFileSystem) Open(key string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Open", key)
+	ret0, _ := ret[0].(io.ReadSeekCloser)
+	ret1, _ := ret[1].(fs.FileInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Open indicates an expected call of Open.
+func (mr *MockFileSystemMockRecorder) Open(key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Open", reflect.TypeOf((*MockFileSystem)(nil).Open), key)
+}
+
+// Save mocks base method.
+func (m *MockFileSystem) Save(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Save", ctx, key, reader, metadata)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Save indicates an expected call of Save.
+func (mr *MockFileSystemMockRecorder) Save(ctx, key, reader, metadata interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockFileSystem)(nil).Save), ctx, key, reader, metadata)
+}
+
+// Stat mocks base method.
+func (m *MockFileSystem) Stat(key string) (fs.FileInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stat", key)
+	ret0, _ := ret[0].(fs.FileInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stat indicates an expected call of Stat.
+func (mr *MockFileSystemMockRecorder) Stat(key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stat", reflect.TypeOf((*MockFileSystem)(nil).Stat), key)
+}
+
+// MockPresigner is a mock of Presigner interface.
+type MockPresigner struct {
+	ctrl     *gomock.Controller
+	recorder *MockPresignerMockRecorder
+}
+
+// MockPresignerMockRecorder is the mock recorder for MockPresigner.
+type MockPresignerMockRecorder struct {
+	mock *MockPresigner
+}
+
+// NewMockPresigner creates a new mock instance.
+func NewMockPresigner(ctrl *gomock.Controller) *MockPresigner {
+	mock := &MockPresigner{ctrl: ctrl}
+	mock.recorder = &MockPresignerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockPresigner) EXPECT() *MockPresignerMockRecorder {
+	return m.recorder
+}
+
+// PresignPut mocks base method.
+func (m *MockPresigner) PresignPut(key string, headers map[string]string, expires time.Duration) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PresignPut", key, headers, expires)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// SaveFile indicates an expected call of SaveFile.
-func (mr *MockFileSystemMockRecorder) SaveFile(fileName, file interface{}) *gomock.Call {
+// PresignPut indicates an expected call of PresignPut.
+func (mr *MockPresignerMockRecorder) PresignPut(key, headers, expires interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveFile", reflect.TypeOf((*MockFileSystem)(nil).SaveFile), fileName, file)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PresignPut", reflect.TypeOf((*MockPresigner)(nil).PresignPut), key, headers, expires)
 }
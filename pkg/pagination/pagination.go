@@ -0,0 +1,161 @@
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	NEXT Direction = "next"
+	PREV Direction = "prev"
+
+	cursorQueryParam   = "cursor"
+	pageSizeQueryParam = "pageSize"
+)
+
+var (
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrInvalidPageSize = errors.New("invalid pagesize")
+)
+
+// Direction tells whether a cursor walks forward or backward from its position.
+type Direction string
+
+// Cursor is a keyset position in a listing. SortKey is the primary sort
+// column and Id the unique tiebreak column, listings that sort by id alone
+// use the same value for both.
+type Cursor struct {
+	SortKey   int64     `json:"k"`
+	Id        int64     `json:"i"`
+	Direction Direction `json:"d"`
+}
+
+// IsPrev reports whether the cursor asks for the page before its position.
+func (c *Cursor) IsPrev() bool {
+	return c != nil && c.Direction == PREV
+}
+
+// Page is the response envelope returned by every listing endpoint.
+type Page struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+	PrevCursor string      `json:"prevCursor,omitempty"`
+}
+
+// Paginator encodes and verifies opaque cursors and resolves page sizes.
+type Paginator struct {
+	secret          []byte
+	defaultPageSize int
+	maxPageSize     int
+}
+
+// New returns a paginator signing cursors with secret. The configuration
+// generates a random secret when none is set.
+func New(secret string, defaultPageSize int, maxPageSize int) *Paginator {
+	return &Paginator{
+		secret:          []byte(secret),
+		defaultPageSize: defaultPageSize,
+		maxPageSize:     maxPageSize,
+	}
+}
+
+// Encode turns a cursor into a base64 token carrying an HMAC of its payload.
+func (p *Paginator) Encode(cursor Cursor) string {
+	payload, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(p.sign(payload))
+}
+
+// Decode verifies and parses a token produced by Encode. An empty token means
+// the first page and is returned as nil.
+func (p *Paginator) Decode(token string) (*Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, p.sign(payload)) {
+		return nil, ErrInvalidCursor
+	}
+	var cursor Cursor
+	if err := json.Unmarshal(payload, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Direction != NEXT && cursor.Direction != PREV {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// PageSize parses a requested page size, falling back to the default when it
+// is empty and clamping it to the configured maximum.
+func (p *Paginator) PageSize(pageSize string) (int, error) {
+	if pageSize == "" {
+		return p.defaultPageSize, nil
+	}
+	size, err := strconv.Atoi(pageSize)
+	if err != nil || size <= 0 {
+		return 0, ErrInvalidPageSize
+	}
+	if size > p.maxPageSize {
+		size = p.maxPageSize
+	}
+	return size, nil
+}
+
+// FromQuery reads the cursor and pageSize query parameters of a listing request.
+func (p *Paginator) FromQuery(query url.Values) (*Cursor, int, error) {
+	cursor, err := p.Decode(query.Get(cursorQueryParam))
+	if err != nil {
+		return nil, 0, err
+	}
+	pageSize, err := p.PageSize(query.Get(pageSizeQueryParam))
+	if err != nil {
+		return nil, 0, err
+	}
+	return cursor, pageSize, nil
+}
+
+// NewPage wraps the items of one page, already in display order. first and last
+// are the positions of the first and last item (nil for an empty page) and
+// hasMore tells whether more items exist past the page in the requested direction.
+func (p *Paginator) NewPage(data interface{}, request *Cursor, first *Cursor, last *Cursor, hasMore bool) Page {
+	page := Page{Data: data}
+	if first == nil || last == nil {
+		return page
+	}
+	if request.IsPrev() {
+		// Walking backwards we always came from a later page
+		if hasMore {
+			page.PrevCursor = p.Encode(Cursor{SortKey: first.SortKey, Id: first.Id, Direction: PREV})
+		}
+		page.NextCursor = p.Encode(Cursor{SortKey: last.SortKey, Id: last.Id, Direction: NEXT})
+		return page
+	}
+	if hasMore {
+		page.NextCursor = p.Encode(Cursor{SortKey: last.SortKey, Id: last.Id, Direction: NEXT})
+	}
+	if request != nil {
+		page.PrevCursor = p.Encode(Cursor{SortKey: first.SortKey, Id: first.Id, Direction: PREV})
+	}
+	return page
+}
+
+func (p *Paginator) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,155 @@
+package pagination
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	paginator := New("test secret", 10, 50)
+	other := New("other secret", 10, 50)
+	valid := paginator.Encode(Cursor{SortKey: 3, Id: 11, Direction: NEXT})
+
+	tests := []struct {
+		Name          string
+		Input         string
+		Expected      *Cursor
+		ExpectedError error
+	}{
+		{
+			Name:     "Test empty cursor is first page",
+			Input:    "",
+			Expected: nil,
+		},
+		{
+			Name:     "Test valid cursor",
+			Input:    valid,
+			Expected: &Cursor{SortKey: 3, Id: 11, Direction: NEXT},
+		},
+		{
+			Name:          "Test raw integer cursor",
+			Input:         "11",
+			ExpectedError: ErrInvalidCursor,
+		},
+		{
+			Name:          "Test cursor signed with another secret",
+			Input:         other.Encode(Cursor{SortKey: 3, Id: 11, Direction: NEXT}),
+			ExpectedError: ErrInvalidCursor,
+		},
+		{
+			Name:          "Test tampered cursor payload",
+			Input:         "eyJrIjo5OSwiaSI6MTEsImQiOiJuZXh0In0" + valid[len(valid)-44:],
+			ExpectedError: ErrInvalidCursor,
+		},
+		{
+			Name:          "Test cursor without direction",
+			Input:         paginator.Encode(Cursor{SortKey: 3, Id: 11}),
+			ExpectedError: ErrInvalidCursor,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := paginator.Decode(test.Input)
+		assert.Equal(t, test.Expected, result, test.Name)
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Input         string
+		Expected      int
+		ExpectedError error
+	}{
+		{Name: "Test default page size", Input: "", Expected: 10},
+		{Name: "Test page size within limit", Input: "20", Expected: 20},
+		{Name: "Test page size clamped to max", Input: "500", Expected: 50},
+		{Name: "Test zero page size", Input: "0", ExpectedError: ErrInvalidPageSize},
+		{Name: "Test non integer page size", Input: "ten", ExpectedError: ErrInvalidPageSize},
+	}
+
+	paginator := New("test secret", 10, 50)
+	for _, test := range tests {
+		result, err := paginator.PageSize(test.Input)
+		assert.Equal(t, test.Expected, result, test.Name)
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+	}
+}
+
+func TestFromQuery(t *testing.T) {
+	paginator := New("test secret", 10, 50)
+	query := url.Values{}
+	query.Set("cursor", paginator.Encode(Cursor{SortKey: 1, Id: 2, Direction: PREV}))
+	query.Set("pageSize", "5")
+
+	cursor, pageSize, err := paginator.FromQuery(query)
+	assert.Nil(t, err)
+	assert.Equal(t, &Cursor{SortKey: 1, Id: 2, Direction: PREV}, cursor)
+	assert.Equal(t, 5, pageSize)
+}
+
+func TestNewPage(t *testing.T) {
+	paginator := New("test secret", 10, 50)
+	first := &Cursor{SortKey: 5, Id: 9}
+	last := &Cursor{SortKey: 2, Id: 4}
+	next := paginator.Encode(Cursor{SortKey: 2, Id: 4, Direction: NEXT})
+	prev := paginator.Encode(Cursor{SortKey: 5, Id: 9, Direction: PREV})
+
+	tests := []struct {
+		Name     string
+		Request  *Cursor
+		First    *Cursor
+		Last     *Cursor
+		HasMore  bool
+		Expected Page
+	}{
+		{
+			Name:     "Test first page with more items",
+			Request:  nil,
+			First:    first,
+			Last:     last,
+			HasMore:  true,
+			Expected: Page{Data: "data", NextCursor: next},
+		},
+		{
+			Name:     "Test middle page walking forward",
+			Request:  &Cursor{SortKey: 6, Id: 10, Direction: NEXT},
+			First:    first,
+			Last:     last,
+			HasMore:  true,
+			Expected: Page{Data: "data", NextCursor: next, PrevCursor: prev},
+		},
+		{
+			Name:     "Test last page walking forward",
+			Request:  &Cursor{SortKey: 6, Id: 10, Direction: NEXT},
+			First:    first,
+			Last:     last,
+			HasMore:  false,
+			Expected: Page{Data: "data", PrevCursor: prev},
+		},
+		{
+			Name:     "Test first page reached walking backward",
+			Request:  &Cursor{SortKey: 1, Id: 3, Direction: PREV},
+			First:    first,
+			Last:     last,
+			HasMore:  false,
+			Expected: Page{Data: "data", NextCursor: next},
+		},
+		{
+			Name:     "Test empty page",
+			Request:  &Cursor{SortKey: 1, Id: 3, Direction: NEXT},
+			First:    nil,
+			Last:     nil,
+			HasMore:  false,
+			Expected: Page{Data: "data"},
+		},
+	}
+
+	for _, test := range tests {
+		result := paginator.NewPage("data", test.Request, test.First, test.Last, test.HasMore)
+		assert.Equal(t, test.Expected, result, test.Name)
+	}
+}
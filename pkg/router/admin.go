@@ -0,0 +1,213 @@
+package router
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ksindhwani/imagegram/pkg/httputils"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/service"
+)
+
+type AdminHandler struct {
+	ConvertorService  *service.ImageConvertorService
+	ModerationService *service.ModerationService
+}
+
+func NewAdminHandler(convertorService *service.ImageConvertorService, moderationService *service.ModerationService) *AdminHandler {
+	return &AdminHandler{
+		ConvertorService:  convertorService,
+		ModerationService: moderationService,
+	}
+}
+
+// BlockRequest adds a hash to the blocklist, given directly or as the hash of an
+// image already posted
+type BlockRequest struct {
+	Hash    string `json:"hash"`
+	ImageId int64  `json:"imageId"`
+	Reason  string `json:"reason"`
+}
+
+// Only let requests carrying "Authorization: Bearer <token>" through. An empty token
+// disables the admin endpoints.
+func requireAdminToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			httputils.WriteErrorResponse(w, httputils.NewForbiddenError(errors.New("admin endpoints are disabled"), "set ADMIN_TOKEN to enable them"))
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			httputils.WriteErrorResponse(w, httputils.NewUnauthorizedError(errors.New("invalid admin token"), "unauthorized"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// List conversion jobs by status, dead jobs unless ?status= says otherwise
+func (ah *AdminHandler) GetConversionJobs(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = tables.CONVERSION_JOB_DEAD
+	case tables.CONVERSION_JOB_PENDING, tables.CONVERSION_JOB_RUNNING, tables.CONVERSION_JOB_DONE, tables.CONVERSION_JOB_DEAD, tables.CONVERSION_JOB_REJECTED:
+	default:
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("unknown status "+status), "status should be pending, running, done, dead or rejected"))
+		return
+	}
+	cursor, pageSize, err := ah.ConvertorService.Paginator.FromQuery(r.URL.Query())
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "invalid cursor or pagesize"))
+		return
+	}
+	response, err := ah.ConvertorService.GetConversionJobs(status, cursor, pageSize)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to get conversion jobs"))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusOK, response)
+}
+
+func (ah *AdminHandler) RequeueConversionJob(w http.ResponseWriter, r *http.Request) {
+	jobIdParam, err := httputils.GetUrlParam(r, "jobId")
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch jobId from url"))
+		return
+	}
+	jobId, err := strconv.Atoi(jobIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("jobId in url should be integer"), ""))
+		return
+	}
+	response, err := ah.ConvertorService.RequeueConversionJob(int64(jobId))
+	if errors.Is(err, service.ErrConversionJobNotFound) {
+		httputils.WriteErrorResponse(w, httputils.NewNotFoundError(err, "unable to requeue conversion job"))
+		return
+	}
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to requeue conversion job"))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusOK, response)
+}
+
+func (ah *AdminHandler) RequeueDeadConversionJobs(w http.ResponseWriter, r *http.Request) {
+	response, err := ah.ConvertorService.RequeueDeadConversionJobs()
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to requeue conversion jobs"))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusOK, response)
+}
+
+func (ah *AdminHandler) GetBlockedHashes(w http.ResponseWriter, r *http.Request) {
+	cursor, pageSize, err := ah.ModerationService.Paginator.FromQuery(r.URL.Query())
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "invalid cursor or pagesize"))
+		return
+	}
+	response, err := ah.ModerationService.GetBlockedHashes(cursor, pageSize)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to get blocked hashes"))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusOK, response)
+}
+
+func (ah *AdminHandler) BlockHash(w http.ResponseWriter, r *http.Request) {
+	var request BlockRequest
+	body, err := httputils.GetRequestBody(w, r)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "unable to parse request body"))
+		return
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "unable to marshal request body"))
+		return
+	}
+
+	var response service.BlocklistResponse
+	switch {
+	case request.Hash != "" && request.ImageId != 0:
+		err = fmt.Errorf("%w - give either a hash or an imageId", service.ErrInvalidBlocklistEntry)
+	case request.ImageId != 0:
+		response, err = ah.ModerationService.BlockImage(r.Context(), request.ImageId, request.Reason)
+	default:
+		response, err = ah.ModerationService.BlockHash(r.Context(), request.Hash, request.Reason)
+	}
+	ah.writeBlocklistResponse(w, response, err)
+}
+
+// Add every hash of a blocklist file sent as the request body, see service.ParseBlocklist
+func (ah *AdminHandler) ImportBlocklist(w http.ResponseWriter, r *http.Request) {
+	hashes, err := service.ParseBlocklist(r.Body)
+	if err != nil {
+		ah.writeBlocklistResponse(w, service.BlocklistResponse{}, err)
+		return
+	}
+	response, err := ah.ModerationService.BlockHashes(r.Context(), hashes)
+	ah.writeBlocklistResponse(w, response, err)
+}
+
+func (ah *AdminHandler) writeBlocklistResponse(w http.ResponseWriter, response service.BlocklistResponse, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidBlocklistEntry):
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "hashes should be 16 hex digits"))
+	case errors.Is(err, service.ErrImageNotConverted):
+		httputils.WriteErrorResponse(w, httputils.NewConflictError(err, "the image has no perceptual hash yet"))
+	case errors.Is(err, service.ErrImageNotFound):
+		httputils.WriteErrorResponse(w, httputils.NewNotFoundError(err, "no image found"))
+	case err != nil:
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to block hashes"))
+	case len(response.Added) > 0:
+		httputils.WriteResponse(w, http.StatusCreated, response)
+	default:
+		httputils.WriteResponse(w, http.StatusOK, response)
+	}
+}
+
+func (ah *AdminHandler) UnblockHash(w http.ResponseWriter, r *http.Request) {
+	blockedHashIdParam, err := httputils.GetUrlParam(r, "blockedHashId")
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch blockedHashId from url"))
+		return
+	}
+	blockedHashId, err := strconv.Atoi(blockedHashIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("blockedHashId in url should be integer"), ""))
+		return
+	}
+	err = ah.ModerationService.UnblockHash(int64(blockedHashId))
+	if errors.Is(err, service.ErrBlockedHashNotFound) {
+		httputils.WriteErrorResponse(w, httputils.NewNotFoundError(err, "unable to unblock hash"))
+		return
+	}
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to unblock hash"))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func (ah *AdminHandler) GetModerationEvents(w http.ResponseWriter, r *http.Request) {
+	cursor, pageSize, err := ah.ModerationService.Paginator.FromQuery(r.URL.Query())
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "invalid cursor or pagesize"))
+		return
+	}
+	response, err := ah.ModerationService.GetModerationEvents(cursor, pageSize)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to get moderation events"))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusOK, response)
+}
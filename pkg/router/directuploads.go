@@ -0,0 +1,65 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ksindhwani/imagegram/pkg/httputils"
+	"github.com/ksindhwani/imagegram/pkg/service"
+)
+
+const (
+	directUploadsPath       = "/uploads"
+	uploadExpiresQueryParam = "expires"
+	signatureQueryParam     = "signature"
+)
+
+type DirectUploadHandler struct {
+	Service *service.DirectUploadService
+}
+
+func NewDirectUploadHandler(service *service.DirectUploadService) *DirectUploadHandler {
+	return &DirectUploadHandler{
+		Service: service,
+	}
+}
+
+// Hand out a url the client uploads the image to, the post is then created with
+// POST /posts and the upload's id
+func (dh *DirectUploadHandler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	var request service.DirectUploadRequest
+	body, err := httputils.GetRequestBody(w, r)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "unable to parse request body"))
+		return
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "unable to marshal request body"))
+		return
+	}
+	upload, err := dh.Service.CreateUpload(request)
+	if err != nil {
+		httputils.WriteErrorResponse(w, uploadError(err))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusCreated, upload)
+}
+
+// Receive an upload sent to a url signed by this API, for file systems that can't presign
+func (dh *DirectUploadHandler) ReceiveUpload(w http.ResponseWriter, r *http.Request) {
+	uploadId, err := httputils.GetUrlParam(r, uploadIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch uploadId from url"))
+		return
+	}
+	query := r.URL.Query()
+	err = dh.Service.ReceiveUpload(r.Context(), uploadId, query.Get(uploadExpiresQueryParam), query.Get(signatureQueryParam),
+		r.Header.Get("Content-Type"), r.Body)
+	if err != nil {
+		httputils.WriteErrorResponse(w, uploadError(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,13 +1,20 @@
 package router
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/ksindhwani/imagegram/pkg/httputils"
+	"github.com/ksindhwani/imagegram/pkg/internal/converter"
+	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
 	"github.com/ksindhwani/imagegram/pkg/service"
 )
 
@@ -15,21 +22,47 @@ const (
 	htmlImageTagName   = "image"
 	htmlCaptionTagName = "caption"
 	htmlUserIdTag      = "userId"
-	defaultCursor      = "0"
-	defaultPageSize    = "10"
+
+	renditionQueryParam = "rendition"
+
+	derivativeWidthQueryParam   = "w"
+	derivativeHeightQueryParam  = "h"
+	derivativeFitQueryParam     = "fit"
+	derivativeQualityQueryParam = "q"
+
+	distanceQueryParam = "distance"
+
+	// Room for the multipart boundaries and the fields sent along with the image
+	multipartFormOverhead = 1 << 20
+	maxFormFieldBytes     = 64 << 10
+
+	// Uploads refused while decoding is busy are sent again after this
+	decodeBusyRetryAfter = 5 * time.Second
 )
 
 type PostHandler struct {
 	Service *service.PostService
+	Uploads *service.DirectUploadService
+}
+
+// UploadedPostRequest creates a post with an image uploaded with POST /uploads
+type UploadedPostRequest struct {
+	service.Post
+	UploadId string `json:"uploadId"`
 }
 
 type CommentHandler struct {
 	Service *service.CommentService
 }
 
-func NewPostHandler(service *service.PostService) *PostHandler {
+type ImageHandler struct {
+	Service *service.ImageService
+}
+
+func NewPostHandler(service *service.PostService, uploads *service.DirectUploadService) *PostHandler {
 	return &PostHandler{
 		Service: service,
+		Uploads: uploads,
 	}
 }
 
@@ -39,23 +72,84 @@ func NewCommentHandler(service *service.CommentService) *CommentHandler {
 	}
 }
 
+func NewImageHandler(service *service.ImageService) *ImageHandler {
+	return &ImageHandler{
+		Service: service,
+	}
+}
+
 func PingHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "pong\n")
 }
 
 func (ph *PostHandler) CreateNewPost(w http.ResponseWriter, r *http.Request) {
-	// Making sure image is not more than 100 Mb
-	r.ParseMultipartForm(100 << 20)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		ph.createUploadedPost(w, r)
+		return
+	}
 
-	// Retrieve the file and caption from the form data
-	file, handler, err := r.FormFile(htmlImageTagName)
+	// The form is streamed, the image goes to storage as it arrives instead of being
+	// buffered. Requests over the limit are cut off as soon as they cross it.
+	limit := ph.Service.Config.UploadMaxBytes + multipartFormOverhead
+	if r.ContentLength > limit {
+		httputils.WriteErrorResponse(w, httputils.NewRequestEntityTooLargeError(
+			fmt.Errorf("request of %d bytes is over the limit of %d", r.ContentLength, limit), "image is too large"))
+		return
+	}
+	body := httputils.LimitBody(w, r, limit)
+	reader, err := r.MultipartReader()
 	if err != nil {
-		httputils.NewBadRequestError(err, "error in image reterival")
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "request should be multipart/form-data"))
 		return
 	}
-	defer file.Close()
-	caption := r.FormValue(htmlCaptionTagName)
-	userIdParam := r.FormValue(htmlUserIdTag)
+
+	var upload *service.StagedUpload
+	defer func() {
+		if upload != nil {
+			upload.Close()
+		}
+	}()
+	// Fields may also be given in the query string, fields of the form win
+	caption := r.URL.Query().Get(htmlCaptionTagName)
+	userIdParam := r.URL.Query().Get(htmlUserIdTag)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			httputils.WriteErrorResponse(w, formReadError(body, err, "unable to read form"))
+			return
+		}
+		switch part.FormName() {
+		case htmlImageTagName:
+			if upload != nil {
+				part.Close()
+				httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("more than one image sent"), "a post has one image"))
+				return
+			}
+			upload, err = ph.stageImage(r.Context(), part)
+			if err != nil {
+				part.Close()
+				httputils.WriteErrorResponse(w, stageImageError(body, err))
+				return
+			}
+		case htmlCaptionTagName:
+			caption, err = readFormField(part)
+		case htmlUserIdTag:
+			userIdParam, err = readFormField(part)
+		}
+		part.Close()
+		if err != nil {
+			httputils.WriteErrorResponse(w, formReadError(body, err, "unable to read form field "+part.FormName()))
+			return
+		}
+	}
+	if upload == nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(http.ErrMissingFile, "error in image reterival"))
+		return
+	}
+
 	if userIdParam == "" {
 		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("error "), "no userId present in the request"))
 		return
@@ -71,9 +165,9 @@ func (ph *PostHandler) CreateNewPost(w http.ResponseWriter, r *http.Request) {
 		UserId:  int64(userId),
 	}
 
-	response, err := ph.Service.CreateNewPost(post, handler.Filename, file)
+	response, err := ph.Service.CreateStagedPost(r.Context(), post, upload)
 	if err != nil {
-		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to create post"))
+		httputils.WriteErrorResponse(w, createPostError(err))
 		return
 	}
 
@@ -81,6 +175,109 @@ func (ph *PostHandler) CreateNewPost(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Create a post with an image the client already uploaded, see POST /uploads
+func (ph *PostHandler) createUploadedPost(w http.ResponseWriter, r *http.Request) {
+	var request UploadedPostRequest
+	body, err := httputils.GetRequestBody(w, r)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "unable to parse request body"))
+		return
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "unable to marshal request body"))
+		return
+	}
+	if request.UploadId == "" {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("no uploadId present in the request"), "send the image as multipart/form-data or upload it first"))
+		return
+	}
+	if request.UserId <= 0 {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("error "), "no userId present in the request"))
+		return
+	}
+
+	response, err := ph.Uploads.CreatePost(r.Context(), request.Post, request.UploadId)
+	if err != nil {
+		httputils.WriteErrorResponse(w, uploadError(err))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusCreated, response)
+}
+
+// Check and stage the image part of the form
+func (ph *PostHandler) stageImage(ctx context.Context, part *multipart.Part) (*service.StagedUpload, error) {
+	if part.FileName() == "" {
+		return nil, http.ErrMissingFile
+	}
+	// Don't trust the file name, the content must be an allowed image of the format it
+	// claims and within the size limits. Its header is checked before anything is stored.
+	_, content, err := ph.Service.DecodeOptions.Validate(part, part.FileName())
+	if errors.Is(err, decoder.ErrHeaderTooLarge) {
+		return ph.Service.StageAndValidate(ctx, part.FileName(), content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ph.Service.StageUpload(ctx, part.FileName(), content)
+}
+
+func stageImageError(body *httputils.LimitedBody, err error) httputils.Error {
+	if body.Exceeded() || errors.Is(err, service.ErrUploadTooLarge) {
+		return httputils.NewRequestEntityTooLargeError(err, "image is too large")
+	}
+	if errors.Is(err, http.ErrMissingFile) {
+		return httputils.NewBadRequestError(err, "error in image reterival")
+	}
+	return rejectedImageError(err)
+}
+
+// Read a form field that isn't a file, they are short
+func readFormField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxFormFieldBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > maxFormFieldBytes {
+		return "", fmt.Errorf("form field %s is over %d bytes", part.FormName(), maxFormFieldBytes)
+	}
+	return string(value), nil
+}
+
+func formReadError(body *httputils.LimitedBody, err error, msg string) httputils.Error {
+	if body.Exceeded() {
+		return httputils.NewRequestEntityTooLargeError(err, "image is too large")
+	}
+	return httputils.NewBadRequestError(err, msg)
+}
+
+func createPostError(err error) httputils.Error {
+	var duplicate *service.DuplicateImageError
+	if errors.As(err, &duplicate) {
+		return httputils.NewConflictError(err, "image is a near duplicate of an existing post")
+	}
+	var blocked *service.BlockedImageError
+	if errors.As(err, &blocked) {
+		return httputils.NewUnprocessableEntityError(err, "image is not allowed")
+	}
+	if errors.Is(err, converter.ErrDecodeBusy) {
+		return httputils.NewServiceUnavailableError(err, "too many images are being processed, try again", decodeBusyRetryAfter)
+	}
+	return httputils.NewInternalServerError(err, "unable to create post")
+}
+
+func rejectedImageError(err error) httputils.Error {
+	var unsupported *decoder.UnsupportedFormatError
+	var mismatch *decoder.FormatMismatchError
+	var tooLarge *decoder.TooLargeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return httputils.NewRequestEntityTooLargeError(err, "image dimensions exceed the limits")
+	case errors.As(err, &unsupported), errors.As(err, &mismatch), errors.Is(err, decoder.ErrInvalidImage):
+		return httputils.NewUnsupportedMediaTypeError(err, "unsupported or invalid image")
+	}
+	return httputils.NewInternalServerError(err, "unable to read image")
+}
+
 func (ch *CommentHandler) CommentOnPost(w http.ResponseWriter, r *http.Request) {
 	var comment service.Comment
 	postIdParam, err := httputils.GetUrlParam(r, "postId")
@@ -114,6 +311,31 @@ func (ch *CommentHandler) CommentOnPost(w http.ResponseWriter, r *http.Request)
 	httputils.WriteResponse(w, http.StatusCreated, response)
 }
 
+func (ch *CommentHandler) GetCommentsOnPost(w http.ResponseWriter, r *http.Request) {
+	postIdParam, err := httputils.GetUrlParam(r, "postId")
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch postId from url"))
+		return
+	}
+	postId, err := strconv.Atoi(postIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("postId in url should be integer"), ""))
+		return
+	}
+	cursor, pageSize, err := ch.Service.Paginator.FromQuery(r.URL.Query())
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "invalid cursor or pagesize"))
+		return
+	}
+	response, err := ch.Service.GetCommentsOnPost(int64(postId), cursor, pageSize)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to get comments"))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusOK, response)
+}
+
 func (ch *CommentHandler) DeleteCommentOnPost(w http.ResponseWriter, r *http.Request) {
 	commentIdPAram, err := httputils.GetUrlParam(r, "commentId")
 	if err != nil {
@@ -135,7 +357,7 @@ func (ch *CommentHandler) DeleteCommentOnPost(w http.ResponseWriter, r *http.Req
 }
 
 func (ph *PostHandler) GetAllPosts(w http.ResponseWriter, r *http.Request) {
-	cursor, pageSize, err := getCursorAndPageSize(r)
+	cursor, pageSize, err := ph.Service.Paginator.FromQuery(r.URL.Query())
 	if err != nil {
 		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "invalid cursor or pagesize"))
 		return
@@ -148,27 +370,136 @@ func (ph *PostHandler) GetAllPosts(w http.ResponseWriter, r *http.Request) {
 	httputils.WriteResponse(w, http.StatusOK, response)
 }
 
-func getCursorAndPageSize(r *http.Request) (int, int, error) {
-	// Parse query parameters
-	cursor := r.URL.Query().Get("cursor")
-	pageSizeStr := r.URL.Query().Get("pageSize")
+func (ih *ImageHandler) GetImage(w http.ResponseWriter, r *http.Request) {
+	imageIdParam, err := httputils.GetUrlParam(r, "imageId")
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch imageId from url"))
+		return
+	}
+	imageId, err := strconv.Atoi(imageIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("imageId in url should be integer"), ""))
+		return
+	}
+	image, err := ih.Service.GetConvertedImage(int64(imageId), r.URL.Query().Get(renditionQueryParam))
+	ih.serveConvertedImage(w, r, image, err)
+}
 
-	// Set default values for cursor and pageSize
-	if cursor == "" {
-		cursor = defaultCursor
+func (ih *ImageHandler) GetPostImage(w http.ResponseWriter, r *http.Request) {
+	postIdParam, err := httputils.GetUrlParam(r, "postId")
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch postId from url"))
+		return
 	}
-	if pageSizeStr == "" {
-		pageSizeStr = defaultPageSize
+	postId, err := strconv.Atoi(postIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("postId in url should be integer"), ""))
+		return
 	}
-	// Convert cursor and pageSize to integers
-	cursorInt, err := strconv.Atoi(cursor)
+	image, err := ih.Service.GetConvertedImageForPost(int64(postId), r.URL.Query().Get(renditionQueryParam))
+	ih.serveConvertedImage(w, r, image, err)
+}
+
+func (ih *ImageHandler) GetImageDerivative(w http.ResponseWriter, r *http.Request) {
+	imageIdParam, err := httputils.GetUrlParam(r, "imageId")
 	if err != nil {
-		return -1, -1, errors.New("invalid cursor")
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch imageId from url"))
+		return
+	}
+	imageId, err := strconv.Atoi(imageIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("imageId in url should be integer"), ""))
+		return
+	}
+	query := r.URL.Query()
+	params := service.DerivativeParams{Fit: query.Get(derivativeFitQueryParam)}
+	for name, value := range map[string]*int{
+		derivativeWidthQueryParam:   &params.Width,
+		derivativeHeightQueryParam:  &params.Height,
+		derivativeQualityQueryParam: &params.Quality,
+	} {
+		if query.Get(name) == "" {
+			continue
+		}
+		*value, err = strconv.Atoi(query.Get(name))
+		if err != nil {
+			httputils.WriteErrorResponse(w, httputils.NewBadRequestError(fmt.Errorf("%s should be integer", name), ""))
+			return
+		}
+	}
+	image, err := ih.Service.GetDerivative(int64(imageId), params)
+	if errors.Is(err, service.ErrInvalidDerivative) {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "w, h, fit and q should be among the allowed values"))
+		return
+	}
+	if errors.Is(err, converter.ErrDecodeBusy) {
+		httputils.WriteErrorResponse(w, httputils.NewServiceUnavailableError(err, "too many images are being processed, try again", decodeBusyRetryAfter))
+		return
 	}
+	ih.serveConvertedImage(w, r, image, err)
+}
 
-	pageSize, err := strconv.Atoi(pageSizeStr)
+func (ih *ImageHandler) GetSimilarImages(w http.ResponseWriter, r *http.Request) {
+	imageIdParam, err := httputils.GetUrlParam(r, "imageId")
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch imageId from url"))
+		return
+	}
+	imageId, err := strconv.Atoi(imageIdParam)
 	if err != nil {
-		return -1, -1, errors.New("invalid pagesize")
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("imageId in url should be integer"), ""))
+		return
+	}
+	distance := ih.Service.Config.SimilarMaxDistance
+	if param := r.URL.Query().Get(distanceQueryParam); param != "" {
+		distance, err = strconv.Atoi(param)
+		if err != nil {
+			httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("distance should be integer"), ""))
+			return
+		}
+	}
+	response, err := ih.Service.GetSimilarImages(int64(imageId), distance)
+	switch {
+	case errors.Is(err, service.ErrInvalidDistance):
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "distance is out of range"))
+	case errors.Is(err, service.ErrImageNotConverted):
+		w.Header().Set("Retry-After", "5")
+		httputils.WriteResponse(w, http.StatusAccepted, map[string]string{"message": err.Error()})
+	case errors.Is(err, service.ErrImageNotFound):
+		httputils.WriteErrorResponse(w, httputils.NewNotFoundError(err, "no image found"))
+	case err != nil:
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to get similar images"))
+	default:
+		httputils.WriteResponse(w, http.StatusOK, response)
 	}
-	return cursorInt, pageSize, nil
+}
+
+// Stream a converted image with caching headers. http.ServeContent takes care of
+// Range, If-None-Match and If-Modified-Since once ETag and Last-Modified are known.
+func (ih *ImageHandler) serveConvertedImage(w http.ResponseWriter, r *http.Request, image service.ConvertedImage, err error) {
+	switch {
+	case errors.Is(err, service.ErrImageNotConverted):
+		w.Header().Set("Retry-After", "5")
+		httputils.WriteResponse(w, http.StatusAccepted, map[string]string{"message": err.Error()})
+		return
+	case errors.Is(err, service.ErrUnknownRendition):
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "rendition should be one of the configured renditions"))
+		return
+	case errors.Is(err, service.ErrImageNotFound):
+		httputils.WriteErrorResponse(w, httputils.NewNotFoundError(err, "no image found"))
+		return
+	case err != nil:
+		httputils.WriteErrorResponse(w, httputils.NewInternalServerError(err, "unable to get image"))
+		return
+	}
+	defer image.File.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%s-%x-%x"`, image.ImageId, image.Rendition, image.Info.ModTime().UnixNano(), image.Info.Size()))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ih.Service.Config.ImageCacheMaxAge.Seconds())))
+	http.ServeContent(w, r, image.Info.Name(), image.Info.ModTime(), image.File)
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/ksindhwani/imagegram/pkg/app"
 	"github.com/ksindhwani/imagegram/pkg/database"
+	"github.com/ksindhwani/imagegram/pkg/filesystem"
 	"github.com/ksindhwani/imagegram/pkg/service"
 )
 
@@ -14,14 +15,55 @@ func New(deps *app.Dependencies) (*mux.Router, error) {
 	r.HandleFunc("/ping", PingHandler).Methods(http.MethodGet)
 
 	database := database.New(deps.DB)
-	postService := service.NewPostService(deps.Config, database, deps.LocalFileSystem)
-	commmentService := service.NewCommentService(deps.Config, database, deps.LocalFileSystem)
-	postHandler := NewPostHandler(postService)
+	// Decoding is bounded for the whole process, every service decoding shares the bounds
+	decodeOptions := service.NewDecodeOptions(deps.Config)
+	imageConvertorService := service.NewImageConvertorService(deps.Config, database, deps.FileSystem, decodeOptions)
+	var conversionQueue service.ConversionQueue
+	if deps.ConversionPool != nil {
+		conversionQueue = service.NewConversionQueue(deps.ConversionPool, imageConvertorService)
+	}
+	postService := service.NewPostService(deps.Config, database, deps.FileSystem, conversionQueue, decodeOptions)
+	commmentService := service.NewCommentService(deps.Config, database, deps.FileSystem)
+	derivatives, err := filesystem.NewCache(deps.FileSystem, service.DERIVATIVE_SUBDIRECTORY+"/", int64(deps.Config.DerivativeCacheMB)<<20)
+	if err != nil {
+		return nil, err
+	}
+	imageService := service.NewImageService(deps.Config, database, deps.FileSystem, derivatives, decodeOptions)
+	uploadSessionService := service.NewUploadSessionService(deps.Config, database, deps.FileSystem, postService)
+	directUploadService := service.NewDirectUploadService(deps.Config, database, deps.FileSystem, postService)
+	postHandler := NewPostHandler(postService, directUploadService)
 	commentHandler := NewCommentHandler(commmentService)
+	imageHandler := NewImageHandler(imageService)
+	uploadHandler := NewUploadHandler(uploadSessionService)
+	directUploadHandler := NewDirectUploadHandler(directUploadService)
+	adminHandler := NewAdminHandler(imageConvertorService, service.NewModerationService(deps.Config, database, deps.FileSystem))
+	adminToken := deps.Config.AdminToken
 
 	r.HandleFunc("/posts", postHandler.CreateNewPost).Methods(http.MethodPost)
 	r.HandleFunc("/posts/{postId}/comments", commentHandler.CommentOnPost).Methods(http.MethodPost)
+	r.HandleFunc("/posts/{postId}/comments", commentHandler.GetCommentsOnPost).Methods(http.MethodGet)
 	r.HandleFunc("/posts/{postId}/comments/{commentId}", commentHandler.DeleteCommentOnPost).Methods(http.MethodDelete)
 	r.HandleFunc("/posts", postHandler.GetAllPosts).Methods(http.MethodGet)
+	r.HandleFunc("/posts/{postId}/image", imageHandler.GetPostImage).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/images/{imageId:[0-9]+}.jpg", imageHandler.GetImage).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/images/{imageId:[0-9]+}", imageHandler.GetImageDerivative).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/images/{imageId:[0-9]+}/similar", imageHandler.GetSimilarImages).Methods(http.MethodGet)
+	r.HandleFunc(directUploadsPath, directUploadHandler.CreateUpload).Methods(http.MethodPost)
+	r.HandleFunc(directUploadsPath+"/{"+uploadIdParam+":"+uploadIdRegexp+"}", directUploadHandler.ReceiveUpload).Methods(http.MethodPut)
+	uploadPath := resumableUploadsPath + "/{" + uploadIdParam + ":" + uploadIdRegexp + "}"
+	r.HandleFunc(resumableUploadsPath, uploadHandler.GetUploadOptions).Methods(http.MethodOptions)
+	r.HandleFunc(resumableUploadsPath, tusResumable(uploadHandler.CreateUpload)).Methods(http.MethodPost)
+	r.HandleFunc(uploadPath, tusResumable(uploadHandler.GetUploadOffset)).Methods(http.MethodHead)
+	r.HandleFunc(uploadPath, tusResumable(uploadHandler.WriteChunk)).Methods(http.MethodPatch)
+	r.HandleFunc(uploadPath, tusResumable(uploadHandler.DeleteUpload)).Methods(http.MethodDelete)
+	r.HandleFunc(uploadPath+"/finalize", tusResumable(uploadHandler.FinalizeUpload)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/conversion-jobs", requireAdminToken(adminToken, adminHandler.GetConversionJobs)).Methods(http.MethodGet)
+	r.HandleFunc("/admin/conversion-jobs/requeue", requireAdminToken(adminToken, adminHandler.RequeueDeadConversionJobs)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/conversion-jobs/{jobId:[0-9]+}/requeue", requireAdminToken(adminToken, adminHandler.RequeueConversionJob)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/blocklist", requireAdminToken(adminToken, adminHandler.GetBlockedHashes)).Methods(http.MethodGet)
+	r.HandleFunc("/admin/blocklist", requireAdminToken(adminToken, adminHandler.BlockHash)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/blocklist/import", requireAdminToken(adminToken, adminHandler.ImportBlocklist)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/blocklist/{blockedHashId:[0-9]+}", requireAdminToken(adminToken, adminHandler.UnblockHash)).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/moderation-events", requireAdminToken(adminToken, adminHandler.GetModerationEvents)).Methods(http.MethodGet)
 	return r, nil
 }
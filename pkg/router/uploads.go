@@ -0,0 +1,225 @@
+package router
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ksindhwani/imagegram/pkg/httputils"
+	"github.com/ksindhwani/imagegram/pkg/service"
+)
+
+// Resumable uploads follow the tus protocol, https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,checksum,expiration,termination"
+
+	tusResumableHeader     = "Tus-Resumable"
+	uploadLengthHeader     = "Upload-Length"
+	uploadOffsetHeader     = "Upload-Offset"
+	uploadMetadataHeader   = "Upload-Metadata"
+	uploadChecksumHeader   = "Upload-Checksum"
+	uploadExpiresHeader    = "Upload-Expires"
+	offsetOctetStreamType  = "application/offset+octet-stream"
+	uploadFileNameMetadata = "filename"
+	uploadCaptionMetadata  = "caption"
+	uploadUserIdMetadata   = "userId"
+	resumableUploadsPath   = "/resumable-uploads"
+	uploadIdParam          = "uploadId"
+	uploadIdRegexp         = "[0-9a-f]{32}"
+)
+
+type UploadHandler struct {
+	Service *service.UploadSessionService
+}
+
+func NewUploadHandler(service *service.UploadSessionService) *UploadHandler {
+	return &UploadHandler{
+		Service: service,
+	}
+}
+
+// Refuse requests for another version of the protocol and mark every response with
+// the version spoken. Requests without the header are let through, for plain HTTP clients.
+func tusResumable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(tusResumableHeader, tusVersion)
+		if version := r.Header.Get(tusResumableHeader); version != "" && version != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			httputils.WriteErrorResponse(w, httputils.NewPreconditionFailedError(
+				fmt.Errorf("unsupported protocol version %q", version), "only version "+tusVersion+" is supported"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Tell clients what the server supports
+func (uh *UploadHandler) GetUploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(tusResumableHeader, tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(uh.Service.Config.UploadMaxBytes, 10))
+	w.Header().Set("Tus-Checksum-Algorithm", strings.Join(service.ChecksumAlgorithms(), ","))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Start an upload. The file's size is given in Upload-Length, its file name and the
+// post's userId and caption in Upload-Metadata.
+func (uh *UploadHandler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get(uploadLengthHeader), 10, 64)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, uploadLengthHeader+" should be an integer"))
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get(uploadMetadataHeader))
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, "invalid "+uploadMetadataHeader))
+		return
+	}
+	userId, err := strconv.Atoi(metadata[uploadUserIdMetadata])
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(errors.New("userId in metadata should be integer"), ""))
+		return
+	}
+
+	post := service.Post{
+		UserId:  int64(userId),
+		Caption: metadata[uploadCaptionMetadata],
+	}
+	session, err := uh.Service.CreateUpload(post, metadata[uploadFileNameMetadata], length)
+	if err != nil {
+		httputils.WriteErrorResponse(w, uploadError(err))
+		return
+	}
+	w.Header().Set("Location", resumableUploadsPath+"/"+session.UploadId)
+	writeUploadHeaders(w, session)
+	httputils.WriteResponse(w, http.StatusCreated, session)
+}
+
+// Report how much of an upload was received
+func (uh *UploadHandler) GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	uploadId, err := httputils.GetUrlParam(r, uploadIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch uploadId from url"))
+		return
+	}
+	session, err := uh.Service.GetUpload(uploadId)
+	if err != nil {
+		httputils.WriteErrorResponse(w, uploadError(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeUploadHeaders(w, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Append the request body to an upload at the offset given in Upload-Offset
+func (uh *UploadHandler) WriteChunk(w http.ResponseWriter, r *http.Request) {
+	uploadId, err := httputils.GetUrlParam(r, uploadIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch uploadId from url"))
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != offsetOctetStreamType {
+		httputils.WriteErrorResponse(w, httputils.NewUnsupportedMediaTypeError(
+			fmt.Errorf("unsupported content type %q", contentType), "chunks should be sent as "+offsetOctetStreamType))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(err, uploadOffsetHeader+" should be an integer"))
+		return
+	}
+
+	session, err := uh.Service.WriteChunk(uploadId, offset, r.Header.Get(uploadChecksumHeader), r.Body)
+	if err != nil {
+		httputils.WriteErrorResponse(w, uploadError(err))
+		return
+	}
+	writeUploadHeaders(w, session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create the post with a complete upload
+func (uh *UploadHandler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	uploadId, err := httputils.GetUrlParam(r, uploadIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch uploadId from url"))
+		return
+	}
+	response, err := uh.Service.FinalizeUpload(r.Context(), uploadId)
+	if err != nil {
+		httputils.WriteErrorResponse(w, uploadError(err))
+		return
+	}
+	httputils.WriteResponse(w, http.StatusCreated, response)
+}
+
+// Stop an upload and delete what was received of it
+func (uh *UploadHandler) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	uploadId, err := httputils.GetUrlParam(r, uploadIdParam)
+	if err != nil {
+		httputils.WriteErrorResponse(w, httputils.NewBadRequestError(
+			fmt.Errorf("bad request - %w", err), "unable to fetch uploadId from url"))
+		return
+	}
+	if err := uh.Service.DeleteUpload(uploadId); err != nil {
+		httputils.WriteErrorResponse(w, uploadError(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeUploadHeaders(w http.ResponseWriter, session service.UploadSession) {
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(session.Offset, 10))
+	w.Header().Set(uploadLengthHeader, strconv.FormatInt(session.Length, 10))
+	w.Header().Set(uploadExpiresHeader, session.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+func uploadError(err error) httputils.Error {
+	switch {
+	case errors.Is(err, service.ErrUploadNotFound):
+		return httputils.NewNotFoundError(err, "upload not found")
+	case errors.Is(err, service.ErrInvalidUpload), errors.Is(err, service.ErrUnsupportedChecksum):
+		return httputils.NewBadRequestError(err, "invalid upload")
+	case errors.Is(err, service.ErrUploadTooLarge):
+		return httputils.NewRequestEntityTooLargeError(err, "upload is too large")
+	case errors.Is(err, service.ErrUploadOffsetMismatch):
+		return httputils.NewConflictError(err, "check the upload's offset and resume from there")
+	case errors.Is(err, service.ErrUploadIncomplete), errors.Is(err, service.ErrUploadFinalizing):
+		return httputils.NewConflictError(err, "upload can't be finalized now")
+	case errors.Is(err, service.ErrInvalidUploadSignature):
+		return httputils.NewForbiddenError(err, "ask for a new upload url")
+	case errors.Is(err, service.ErrChecksumMismatch):
+		return httputils.NewChecksumMismatchError(err, "chunk was dropped, send it again")
+	}
+	if rejected := rejectedImageError(err); rejected.StatusCode != http.StatusInternalServerError {
+		return rejected
+	}
+	return createPostError(err)
+}
+
+// Parse "key base64value,key base64value", values may be left out
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("value of %s should be base64 - %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
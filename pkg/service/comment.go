@@ -8,12 +8,14 @@ import (
 	"github.com/ksindhwani/imagegram/pkg/database"
 	"github.com/ksindhwani/imagegram/pkg/filesystem"
 	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/pagination"
 )
 
 type CommentService struct {
 	Config     config.Config
 	Database   database.Database
 	FileSystem filesystem.FileSystem
+	Paginator  *pagination.Paginator
 }
 
 func NewCommentService(
@@ -25,10 +27,12 @@ func NewCommentService(
 		Config:     *Config,
 		Database:   database,
 		FileSystem: fileSystem,
+		Paginator:  pagination.New(Config.CursorSecret, Config.DefaultPageSize, Config.MaxPageSize),
 	}
 }
 
 type Comment struct {
+	CommentId int64     `json:"commentId,omitempty"`
 	PostId    int64     `json:"postId"`
 	UserId    int64     `json:"userId"`
 	Content   string    `json:"content"`
@@ -66,3 +70,45 @@ func (cs *CommentService) DeleteComment(commentId int64) (CommentResponse, error
 		Success:   true,
 	}, nil
 }
+
+func (cs *CommentService) GetCommentsOnPost(postId int64, cursor *pagination.Cursor, pageSize int) (pagination.Page, error) {
+	// Fetch one extra row to know whether another page exists
+	rows, err := cs.Database.GetCommentsForPost(postId, cursor, pageSize+1)
+	if err != nil {
+		return pagination.Page{}, fmt.Errorf("error in fetching comments - %w", err)
+	}
+	hasMore := len(rows) > pageSize
+	if hasMore {
+		rows = rows[:pageSize]
+	}
+
+	comments := make([]Comment, len(rows))
+	for i, row := range rows {
+		index := i
+		if cursor.IsPrev() {
+			// Previous pages are read in ascending order
+			index = len(rows) - 1 - i
+		}
+		comments[index] = Comment{
+			CommentId: row.CommentId,
+			PostId:    row.PostId,
+			UserId:    row.UserId,
+			Content:   row.Comment,
+			CreatedAt: row.CreatedAt,
+		}
+	}
+
+	var first, last *pagination.Cursor
+	if len(comments) > 0 {
+		first = commentCursor(comments[0])
+		last = commentCursor(comments[len(comments)-1])
+	}
+	return cs.Paginator.NewPage(comments, cursor, first, last, hasMore), nil
+}
+
+func commentCursor(comment Comment) *pagination.Cursor {
+	return &pagination.Cursor{
+		SortKey: comment.CommentId,
+		Id:      comment.CommentId,
+	}
+}
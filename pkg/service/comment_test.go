@@ -8,7 +8,9 @@ import (
 
 	"github.com/golang/mock/gomock"
 	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
 	"github.com/ksindhwani/imagegram/pkg/mocks"
+	"github.com/ksindhwani/imagegram/pkg/pagination"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -168,3 +170,81 @@ func TestDeleteComment(t *testing.T) {
 		assert.Equal(t, test.ExpectedError, err, test.Name)
 	}
 }
+
+func TestGetCommentsOnPost(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	paginator := pagination.New("test cursor secret", 10, 50)
+	createdAt := time.Date(2023, 6, 26, 0, 0, 0, 1, &time.Location{})
+
+	tests := []struct {
+		Name                               string
+		Cursor                             *pagination.Cursor
+		PageSize                           int
+		ExpectedGetCommentsForPostResponse []tables.CommentTable
+		ExpectedGetCommentsForPostError    error
+		ExpectedResponse                   pagination.Page
+		ExpectedError                      error
+	}{
+		{
+			Name:     "Test first page with more comments",
+			Cursor:   nil,
+			PageSize: 2,
+			ExpectedGetCommentsForPostResponse: []tables.CommentTable{
+				{CommentId: 9, PostId: 1, UserId: 2, Comment: "ninth", CreatedAt: createdAt},
+				{CommentId: 7, PostId: 1, UserId: 3, Comment: "seventh", CreatedAt: createdAt},
+				{CommentId: 4, PostId: 1, UserId: 2, Comment: "fourth", CreatedAt: createdAt},
+			},
+			ExpectedResponse: pagination.Page{
+				Data: []Comment{
+					{CommentId: 9, PostId: 1, UserId: 2, Content: "ninth", CreatedAt: createdAt},
+					{CommentId: 7, PostId: 1, UserId: 3, Content: "seventh", CreatedAt: createdAt},
+				},
+				NextCursor: paginator.Encode(pagination.Cursor{SortKey: 7, Id: 7, Direction: pagination.NEXT}),
+			},
+		},
+		{
+			Name:     "Test previous page is returned newest first",
+			Cursor:   &pagination.Cursor{SortKey: 4, Id: 4, Direction: pagination.PREV},
+			PageSize: 2,
+			ExpectedGetCommentsForPostResponse: []tables.CommentTable{
+				{CommentId: 7, PostId: 1, UserId: 3, Comment: "seventh", CreatedAt: createdAt},
+				{CommentId: 9, PostId: 1, UserId: 2, Comment: "ninth", CreatedAt: createdAt},
+			},
+			ExpectedResponse: pagination.Page{
+				Data: []Comment{
+					{CommentId: 9, PostId: 1, UserId: 2, Content: "ninth", CreatedAt: createdAt},
+					{CommentId: 7, PostId: 1, UserId: 3, Content: "seventh", CreatedAt: createdAt},
+				},
+				NextCursor: paginator.Encode(pagination.Cursor{SortKey: 7, Id: 7, Direction: pagination.NEXT}),
+			},
+		},
+		{
+			Name:                            "Test error in db query execution",
+			Cursor:                          nil,
+			PageSize:                        2,
+			ExpectedGetCommentsForPostError: errors.New("error in query execution"),
+			ExpectedResponse:                pagination.Page{},
+			ExpectedError:                   fmt.Errorf("error in fetching comments - %w", errors.New("error in query execution")),
+		},
+	}
+
+	config := config.Config{
+		HostImageDirectory:  "test host directory",
+		LocalImageDirectory: "test local directory",
+		CursorSecret:        "test cursor secret",
+		DefaultPageSize:     10,
+		MaxPageSize:         50,
+	}
+	database := mocks.NewMockDatabase(ctrl)
+	commentService := NewCommentService(&config, database, nil)
+	for _, test := range tests {
+		database.EXPECT().GetCommentsForPost(int64(1), test.Cursor, test.PageSize+1).
+			Return(test.ExpectedGetCommentsForPostResponse, test.ExpectedGetCommentsForPostError).
+			Times(1)
+		result, err := commentService.GetCommentsOnPost(1, test.Cursor, test.PageSize)
+		assert.Equal(t, test.ExpectedResponse, result, test.Name)
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+	}
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"github.com/ksindhwani/imagegram/pkg/worker"
+)
+
+// ConversionQueue is told about posts whose image should be converted. The job itself
+// is stored with the post, Enqueue only wakes a worker to run it now. It returns false
+// when no worker could be woken, the job then waits for the converter command.
+type ConversionQueue interface {
+	Enqueue(postId int64) bool
+}
+
+type WorkerConversionQueue struct {
+	Pool      *worker.Pool
+	Convertor *ImageConvertorService
+}
+
+func NewConversionQueue(pool *worker.Pool, convertor *ImageConvertorService) *WorkerConversionQueue {
+	return &WorkerConversionQueue{
+		Pool:      pool,
+		Convertor: convertor,
+	}
+}
+
+func (q *WorkerConversionQueue) Enqueue(postId int64) bool {
+	return q.Pool.Submit(func(ctx context.Context) {
+		if _, err := q.Convertor.RunPostConversionJob(ctx, postId); err != nil {
+			log.Printf("unable to run conversion job of post %d: %s", postId, err.Error())
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image/color"
+	"io/fs"
+	"math"
+	"path"
+	"strconv"
+
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/internal/converter"
+)
+
+const DERIVATIVE_SUBDIRECTORY = "derivatives"
+
+var ErrInvalidDerivative = errors.New("invalid derivative parameters")
+
+// DerivativeParams is a size asked for on demand, zero values are left to defaults
+type DerivativeParams struct {
+	Width   int
+	Height  int
+	Fit     string // fit (the default), fill or pad
+	Quality int
+}
+
+// DerivativeKey is the file system key of an image's derivative
+func DerivativeKey(imageId int64, name string) string {
+	return path.Join(DERIVATIVE_SUBDIRECTORY, strconv.FormatInt(imageId, 10), name+CONVERTED_IMAGE_EXTENSION)
+}
+
+// Open a derivative of an image, rendering it from the original the first time it
+// is asked for. Identical requests arriving while it renders wait for that render.
+// ErrInvalidDerivative is returned for parameters that aren't allowed,
+// ErrImageNotFound when the image or its original does not exist or the image is
+// quarantined and converter.ErrDecodeBusy when it can't be decoded within DecodeWait.
+func (is *ImageService) GetDerivative(imageId int64, params DerivativeParams) (ConvertedImage, error) {
+	rendition, err := is.derivativeRendition(params)
+	if err != nil {
+		return ConvertedImage{}, err
+	}
+	key := DerivativeKey(imageId, rendition.Name)
+	derivative, err := is.openDerivative(imageId, rendition.Name, key)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return derivative, err
+	}
+
+	// Another request saving a derivative may evict this one before it is opened, it
+	// is rendered once more then
+	for retried := false; ; retried = true {
+		err = is.Rendering.Do(key, func() error {
+			// Rendered apart from the request, the callers waiting for it may outlive it
+			return is.renderDerivative(context.Background(), imageId, rendition, key)
+		})
+		if err != nil {
+			return ConvertedImage{}, err
+		}
+		derivative, err = is.openDerivative(imageId, rendition.Name, key)
+		if errors.Is(err, fs.ErrNotExist) && !retried {
+			continue
+		}
+		if err != nil {
+			return ConvertedImage{}, fmt.Errorf("unable to open rendered derivative - %w", err)
+		}
+		return derivative, nil
+	}
+}
+
+func (is *ImageService) openDerivative(imageId int64, name string, key string) (ConvertedImage, error) {
+	file, info, err := is.Derivatives.Open(key)
+	if err != nil {
+		return ConvertedImage{}, err
+	}
+	return ConvertedImage{
+		ImageId:   imageId,
+		Rendition: name,
+		File:      file,
+		Info:      info,
+	}, nil
+}
+
+func (is *ImageService) renderDerivative(ctx context.Context, imageId int64, rendition config.Rendition, key string) error {
+	image, err := is.Database.GetImage(imageId)
+	if errors.Is(err, sql.ErrNoRows) || image.QuarantinedAt.Valid {
+		return ErrImageNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("unable to fetch image from database - %w", err)
+	}
+	options := is.DecodeOptions
+	options.Wait = is.DecodeWait
+	_, err = converter.ConvertImageIntoDerivative(ctx, image, is.FileSystem, is.Derivatives, rendition, key, options)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrImageNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("unable to render derivative - %w", err)
+	}
+	return nil
+}
+
+// Check the parameters against the allowed sizes and qualities and turn them into a
+// rendition. A missing side is left free for fit and required by fill and pad.
+func (is *ImageService) derivativeRendition(params DerivativeParams) (config.Rendition, error) {
+	if params.Width == 0 && params.Height == 0 {
+		return config.Rendition{}, fmt.Errorf("%w - a width or a height is required", ErrInvalidDerivative)
+	}
+	for _, side := range []int{params.Width, params.Height} {
+		if side != 0 && !containsInt(is.Config.DerivativeSizes, side) {
+			return config.Rendition{}, fmt.Errorf("%w - size %d is not one of the allowed sizes", ErrInvalidDerivative, side)
+		}
+	}
+	if params.Quality != 0 && !containsInt(is.Config.DerivativeQualities, params.Quality) {
+		return config.Rendition{}, fmt.Errorf("%w - quality %d is not one of the allowed qualities", ErrInvalidDerivative, params.Quality)
+	}
+
+	rendition := config.Rendition{
+		Width:   params.Width,
+		Height:  params.Height,
+		Mode:    params.Fit,
+		Quality: params.Quality,
+	}
+	switch params.Fit {
+	case "", config.RESIZE_FIT:
+		rendition.Mode = config.RESIZE_FIT
+		if rendition.Width == 0 {
+			rendition.Width = math.MaxInt32
+		}
+		if rendition.Height == 0 {
+			rendition.Height = math.MaxInt32
+		}
+	case config.RESIZE_FILL, config.RESIZE_PAD:
+		if params.Width == 0 || params.Height == 0 {
+			return config.Rendition{}, fmt.Errorf("%w - %s needs both a width and a height", ErrInvalidDerivative, params.Fit)
+		}
+		rendition.Crop = config.CROP_CENTER
+		rendition.Background = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	default:
+		return config.Rendition{}, fmt.Errorf("%w - fit should be fit, fill or pad", ErrInvalidDerivative)
+	}
+	// e.g. 640x0-fit-q0, the name makes up the key and the ETag
+	rendition.Name = fmt.Sprintf("%dx%d-%s-q%d", params.Width, params.Height, rendition.Mode, params.Quality)
+	return rendition, nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/filesystem"
+	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/ksindhwani/imagegram/pkg/internal/converter"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDerivative(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fileSystem := local.New("test host directory", t.TempDir())
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 400, 200))))
+	_, err := fileSystem.Save(context.Background(), "originals/photo.png", &encoded, nil)
+	assert.Nil(t, err)
+	derivatives, err := filesystem.NewCache(fileSystem, DERIVATIVE_SUBDIRECTORY+"/", 1<<20)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		Name               string
+		Params             DerivativeParams
+		ImageError         error
+		ImageCalls         int
+		ExpectedRendition  string
+		ExpectedWidth      int
+		ExpectedHeight     int
+		ExpectedError      error
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:              "Test derivative is rendered",
+			Params:            DerivativeParams{Width: 100},
+			ImageCalls:        1,
+			ExpectedRendition: "100x0-fit-q0",
+			ExpectedWidth:     100,
+			ExpectedHeight:    50,
+		},
+		{
+			Name:              "Test rendered derivative is served from the cache",
+			Params:            DerivativeParams{Width: 100},
+			ExpectedRendition: "100x0-fit-q0",
+			ExpectedWidth:     100,
+			ExpectedHeight:    50,
+		},
+		{
+			Name:              "Test fill with quality",
+			Params:            DerivativeParams{Width: 100, Height: 100, Fit: config.RESIZE_FILL, Quality: 80},
+			ImageCalls:        1,
+			ExpectedRendition: "100x100-fill-q80",
+			ExpectedWidth:     100,
+			ExpectedHeight:    100,
+		},
+		{Name: "Test no size", Params: DerivativeParams{Fit: config.RESIZE_FIT}, ExpectedErrorMatch: ErrInvalidDerivative},
+		{Name: "Test size not allowed", Params: DerivativeParams{Width: 101}, ExpectedErrorMatch: ErrInvalidDerivative},
+		{Name: "Test quality not allowed", Params: DerivativeParams{Width: 100, Quality: 99}, ExpectedErrorMatch: ErrInvalidDerivative},
+		{Name: "Test unknown fit", Params: DerivativeParams{Width: 100, Fit: "stretch"}, ExpectedErrorMatch: ErrInvalidDerivative},
+		{Name: "Test pad needs both sides", Params: DerivativeParams{Width: 100, Fit: config.RESIZE_PAD}, ExpectedErrorMatch: ErrInvalidDerivative},
+		{
+			Name:          "Test unknown image",
+			Params:        DerivativeParams{Height: 100},
+			ImageError:    sql.ErrNoRows,
+			ImageCalls:    1,
+			ExpectedError: ErrImageNotFound,
+		},
+	}
+
+	config := config.Config{
+		DerivativeSizes:          []int{100, 200},
+		DerivativeQualities:      []int{60, 80},
+		ConversionDecodeMemoryMB: 16,
+	}
+	database := mocks.NewMockDatabase(ctrl)
+	imageService := NewImageService(&config, database, fileSystem, derivatives, NewDecodeOptions(&config))
+	for _, test := range tests {
+		database.EXPECT().GetImage(int64(1)).
+			Return(tables.ImageTable{ImageId: 1, StorageKey: "originals/photo.png"}, test.ImageError).
+			Times(test.ImageCalls)
+		derivative, err := imageService.GetDerivative(1, test.Params)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorIs(t, err, test.ExpectedErrorMatch, test.Name)
+			continue
+		}
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, test.ExpectedRendition, derivative.Rendition, test.Name)
+		imageConfig, err := jpeg.DecodeConfig(derivative.File)
+		derivative.File.Close()
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedWidth, imageConfig.Width, test.Name)
+		assert.Equal(t, test.ExpectedHeight, imageConfig.Height, test.Name)
+	}
+	keys, err := fileSystem.List(DERIVATIVE_SUBDIRECTORY + "/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"derivatives/1/100x0-fit-q0.jpg", "derivatives/1/100x100-fill-q80.jpg"}, keys)
+}
+
+func TestGetDerivativeRendersOnceForConcurrentRequests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fileSystem := local.New("test host directory", t.TempDir())
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 400, 200))))
+	_, err := fileSystem.Save(context.Background(), "originals/photo.png", &encoded, nil)
+	assert.Nil(t, err)
+	derivatives, err := filesystem.NewCache(fileSystem, DERIVATIVE_SUBDIRECTORY+"/", 1<<20)
+	assert.Nil(t, err)
+
+	config := config.Config{DerivativeSizes: []int{200}, ConversionDecodeMemoryMB: 16}
+	database := mocks.NewMockDatabase(ctrl)
+	imageService := NewImageService(&config, database, fileSystem, derivatives, NewDecodeOptions(&config))
+
+	// The first request holds the database call until every request has arrived
+	arrived := make(chan struct{})
+	database.EXPECT().GetImage(int64(1)).DoAndReturn(func(imageId int64) (tables.ImageTable, error) {
+		<-arrived
+		return tables.ImageTable{ImageId: 1, StorageKey: "originals/photo.png"}, nil
+	}).Times(1)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			derivative, err := imageService.GetDerivative(1, DerivativeParams{Width: 200})
+			if err == nil {
+				_, err = io.Copy(io.Discard, derivative.File)
+				derivative.File.Close()
+			}
+			errs <- err
+		}()
+	}
+	// Let the other requests reach the render in flight
+	time.Sleep(20 * time.Millisecond)
+	close(arrived)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+}
+
+// Deletes a stored file the first time it is opened, as another request's save
+// evicting it would
+type evictingFileSystem struct {
+	filesystem.FileSystem
+	evicted bool
+}
+
+func (e *evictingFileSystem) Open(key string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	if _, err := e.FileSystem.Stat(key); err == nil && !e.evicted {
+		e.evicted = true
+		if err := e.FileSystem.Delete(key); err != nil {
+			return nil, nil, err
+		}
+	}
+	return e.FileSystem.Open(key)
+}
+
+func TestGetDerivativeRendersAgainWhenEvicted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fileSystem := local.New("test host directory", t.TempDir())
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 400, 200))))
+	_, err := fileSystem.Save(context.Background(), "originals/photo.png", &encoded, nil)
+	assert.Nil(t, err)
+	derivatives, err := filesystem.NewCache(&evictingFileSystem{FileSystem: fileSystem}, DERIVATIVE_SUBDIRECTORY+"/", 1<<20)
+	assert.Nil(t, err)
+
+	config := config.Config{DerivativeSizes: []int{200}, ConversionDecodeMemoryMB: 16}
+	database := mocks.NewMockDatabase(ctrl)
+	imageService := NewImageService(&config, database, fileSystem, derivatives, NewDecodeOptions(&config))
+	database.EXPECT().GetImage(int64(1)).Return(tables.ImageTable{ImageId: 1, StorageKey: "originals/photo.png"}, nil).Times(2)
+
+	derivative, err := imageService.GetDerivative(1, DerivativeParams{Width: 200})
+	assert.Nil(t, err)
+	imageConfig, err := jpeg.DecodeConfig(derivative.File)
+	derivative.File.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, 200, imageConfig.Width)
+}
+
+func TestGetDerivativeRefusedWhenDecodeBusy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fileSystem := local.New("test host directory", t.TempDir())
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 400, 200))))
+	_, err := fileSystem.Save(context.Background(), "originals/photo.png", &encoded, nil)
+	assert.Nil(t, err)
+	derivatives, err := filesystem.NewCache(fileSystem, DERIVATIVE_SUBDIRECTORY+"/", 1<<20)
+	assert.Nil(t, err)
+
+	config := config.Config{DerivativeSizes: []int{200}, ConversionMaxDecodes: 1, ConversionDecodeMemoryMB: 16}
+	database := mocks.NewMockDatabase(ctrl)
+	imageService := NewImageService(&config, database, fileSystem, derivatives, NewDecodeOptions(&config))
+	imageService.DecodeWait = 10 * time.Millisecond
+	database.EXPECT().GetImage(int64(1)).Return(tables.ImageTable{ImageId: 1, StorageKey: "originals/photo.png"}, nil).Times(1)
+
+	// A conversion holds the only decode slot
+	assert.Nil(t, imageService.DecodeOptions.Slots.Acquire(context.Background()))
+	defer imageService.DecodeOptions.Slots.Release()
+	_, err = imageService.GetDerivative(1, DerivativeParams{Width: 200})
+	assert.ErrorIs(t, err, converter.ErrDecodeBusy)
+	keys, err := fileSystem.List(DERIVATIVE_SUBDIRECTORY + "/")
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
@@ -0,0 +1,288 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/database"
+	"github.com/ksindhwani/imagegram/pkg/filesystem"
+	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+)
+
+// Images clients upload straight to storage are stored under this prefix until they
+// are turned into a post
+const DIRECT_UPLOAD_SUBDIRECTORY = UPLOAD_SUBDIRECTORY + "/direct"
+
+var ErrInvalidUploadSignature = errors.New("upload url is invalid or expired")
+
+// DirectUploadService lets clients upload an image to storage without it going
+// through this process, then creates the post with it. File systems that can presign
+// urls are uploaded to directly, the others through a url of this API signed with
+// an HMAC.
+type DirectUploadService struct {
+	Config      config.Config
+	Database    database.Database
+	FileSystem  filesystem.FileSystem
+	PostService *PostService
+	secret      []byte
+}
+
+func NewDirectUploadService(
+	Config *config.Config,
+	database database.Database,
+	fileSystem filesystem.FileSystem,
+	postService *PostService,
+) *DirectUploadService {
+	return &DirectUploadService{
+		Config:      *Config,
+		Database:    database,
+		FileSystem:  fileSystem,
+		PostService: postService,
+		secret:      []byte(Config.UploadSigningSecret),
+	}
+}
+
+// DirectUploadRequest asks for a url to upload an image of Size bytes to
+type DirectUploadRequest struct {
+	UserId   int64  `json:"userId"`
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+}
+
+type DirectUpload struct {
+	UploadId  string            `json:"uploadId"`
+	UploadUrl string            `json:"uploadUrl"` // relative to this API for the local file system
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`   // to send with the upload as they are
+	ExpiresAt time.Time         `json:"expiresAt"` // the url stops working then
+}
+
+// Key a direct upload is stored under until it is turned into a post
+func DirectUploadKey(uploadId string) string {
+	return path.Join(DIRECT_UPLOAD_SUBDIRECTORY, uploadId)
+}
+
+// Register an upload and return where the client sends the image. The image must be
+// of a format allowed and the one its file name says.
+func (ds *DirectUploadService) CreateUpload(request DirectUploadRequest) (DirectUpload, error) {
+	if request.Size <= 0 || request.UserId <= 0 || request.FileName == "" || len(request.FileName) > 255 {
+		return DirectUpload{}, fmt.Errorf("%w - size, file name and user id are required", ErrInvalidUpload)
+	}
+	if request.Size > ds.Config.UploadMaxBytes {
+		return DirectUpload{}, fmt.Errorf("%w - at most %d bytes are accepted", ErrUploadTooLarge, ds.Config.UploadMaxBytes)
+	}
+	format, ok := decoder.ExtensionFormat(path.Ext(request.FileName))
+	if !ok || !decoder.Allowed(format, ds.Config.ImageFormats) {
+		return DirectUpload{}, &decoder.UnsupportedFormatError{Format: format}
+	}
+	contentType := "image/" + format
+
+	uploadId, err := newUploadId()
+	if err != nil {
+		return DirectUpload{}, fmt.Errorf("unable to generate upload id - %w", err)
+	}
+	expiresAt := time.Now().Add(ds.Config.UploadURLExpiry)
+	uploadUrl, err := ds.uploadUrl(uploadId, contentType, request.Size, expiresAt)
+	if err != nil {
+		return DirectUpload{}, fmt.Errorf("unable to sign upload url - %w", err)
+	}
+	err = ds.Database.CreateDirectUpload(tables.DirectUploadTable{
+		UploadId:    uploadId,
+		UserId:      request.UserId,
+		FileName:    request.FileName,
+		ContentType: contentType,
+		Length:      request.Size,
+	}, ds.Config.UploadSessionTTL)
+	if err != nil {
+		return DirectUpload{}, fmt.Errorf("unable to save upload in database - %w", err)
+	}
+	return DirectUpload{
+		UploadId:  uploadId,
+		UploadUrl: uploadUrl,
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"Content-Type": contentType},
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// Presign a PUT to storage when the file system can, the size is signed so nothing
+// larger is accepted. Otherwise sign a url of this API, see ReceiveUpload.
+func (ds *DirectUploadService) uploadUrl(uploadId string, contentType string, size int64, expiresAt time.Time) (string, error) {
+	if presigner, ok := ds.FileSystem.(filesystem.Presigner); ok {
+		return presigner.PresignPut(DirectUploadKey(uploadId), map[string]string{
+			"Content-Type":   contentType,
+			"Content-Length": strconv.FormatInt(size, 10),
+		}, ds.Config.UploadURLExpiry)
+	}
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", ds.sign(uploadId, expires))
+	return "/uploads/" + uploadId + "?" + query.Encode(), nil
+}
+
+// Store the body of a PUT to a url signed by CreateUpload, for file systems that
+// can't presign. The body must be of the content type and size declared.
+func (ds *DirectUploadService) ReceiveUpload(ctx context.Context, uploadId string, expires string, signature string, contentType string, body io.Reader) error {
+	if !ds.validSignature(uploadId, expires, signature) {
+		return ErrInvalidUploadSignature
+	}
+	upload, err := ds.getUpload(uploadId)
+	if err != nil {
+		return err
+	}
+	if upload.PostId != 0 || upload.ClaimedAt.Valid && time.Since(upload.ClaimedAt.Time) < ds.Config.UploadClaimTimeout {
+		// A claim older than that was left by a process that stopped while posting
+		return ErrUploadFinalizing
+	}
+	if contentType != upload.ContentType {
+		return fmt.Errorf("%w - content type should be %s", ErrInvalidUpload, upload.ContentType)
+	}
+
+	key := DirectUploadKey(uploadId)
+	reader := &limitedReader{reader: body, remaining: upload.Length}
+	if _, err := ds.FileSystem.Save(ctx, key, reader, map[string]string{"Content-Type": contentType}); err != nil {
+		return fmt.Errorf("error in saving upload - %w", err)
+	}
+	if reader.remaining > 0 {
+		if err := deleteDirectUploadFile(ds.FileSystem, uploadId); err != nil {
+			log.Printf("unable to delete short upload: %s", err.Error())
+		}
+		return fmt.Errorf("%w - %d of %d bytes received", ErrInvalidUpload, upload.Length-reader.remaining, upload.Length)
+	}
+	return nil
+}
+
+// Create a post with an image the client uploaded. The stored file must be of the
+// size declared and an allowed image of the format its file name says. It is moved
+// under its content addressed key, not read back into storage. Creating the post
+// again returns the same post, uploads that can never make a post are deleted.
+func (ds *DirectUploadService) CreatePost(ctx context.Context, post Post, uploadId string) (PostResponse, error) {
+	upload, err := ds.getUpload(uploadId)
+	if err != nil {
+		return PostResponse{}, err
+	}
+	if upload.UserId != post.UserId {
+		// Don't tell others' uploads apart from missing ones
+		return PostResponse{}, ErrUploadNotFound
+	}
+	if upload.PostId != 0 {
+		return PostResponse{PostId: upload.PostId, Success: true}, nil
+	}
+	err = ds.Database.ClaimDirectUpload(uploadId, ds.Config.UploadClaimTimeout)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PostResponse{}, ErrUploadFinalizing
+	}
+	if err != nil {
+		return PostResponse{}, fmt.Errorf("unable to claim upload - %w", err)
+	}
+
+	response, err := ds.createPost(ctx, post, upload)
+	if err != nil {
+		if isRefusedUpload(err) {
+			if err := removeDirectUpload(ds.Database, ds.FileSystem, uploadId); err != nil {
+				log.Printf("unable to remove refused upload %s: %s", uploadId, err.Error())
+			}
+		} else if err := ds.Database.ReleaseDirectUpload(uploadId); err != nil {
+			log.Printf("unable to release upload %s: %s", uploadId, err.Error())
+		}
+		return PostResponse{}, err
+	}
+	if err := ds.Database.FinishDirectUpload(uploadId, response.PostId); err != nil {
+		// The post exists, the upload is removed when it expires
+		log.Printf("unable to record post %d of upload %s: %s", response.PostId, uploadId, err.Error())
+	}
+	return response, nil
+}
+
+func (ds *DirectUploadService) createPost(ctx context.Context, post Post, upload tables.DirectUploadTable) (PostResponse, error) {
+	key := DirectUploadKey(upload.UploadId)
+	file, info, err := ds.FileSystem.Open(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return PostResponse{}, fmt.Errorf("%w - nothing was uploaded yet", ErrUploadIncomplete)
+	}
+	if err != nil {
+		return PostResponse{}, fmt.Errorf("unable to open upload - %w", err)
+	}
+	if info.Size() != upload.Length {
+		file.Close()
+		return PostResponse{}, fmt.Errorf("%w - %d bytes were uploaded instead of %d", ErrUploadIncomplete, info.Size(), upload.Length)
+	}
+	if _, _, err := ds.PostService.DecodeOptions.Validate(file, upload.FileName); err != nil {
+		file.Close()
+		return PostResponse{}, err
+	}
+	staged, err := stageStored(ctx, ds.FileSystem, key, upload.FileName, file, ds.Config.UploadMaxBytes)
+	if err != nil {
+		file.Close()
+		return PostResponse{}, fmt.Errorf("error in reading file - %w", err)
+	}
+
+	response, err := ds.PostService.CreateStagedPost(ctx, post, staged)
+	if err != nil && !isRefusedUpload(err) {
+		// The client may try again with the same upload
+		staged.keep()
+	}
+	staged.Close()
+	return response, err
+}
+
+func (ds *DirectUploadService) getUpload(uploadId string) (tables.DirectUploadTable, error) {
+	upload, err := ds.Database.GetDirectUpload(uploadId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return upload, ErrUploadNotFound
+	}
+	if err != nil {
+		return upload, fmt.Errorf("unable to fetch upload from database - %w", err)
+	}
+	return upload, nil
+}
+
+func (ds *DirectUploadService) sign(uploadId string, expires string) string {
+	mac := hmac.New(sha256.New, ds.secret)
+	mac.Write([]byte(http.MethodPut + "\n" + uploadId + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (ds *DirectUploadService) validSignature(uploadId string, expires string, signature string) bool {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(ds.sign(uploadId, expires)))
+}
+
+// Delete an upload sent straight to storage and its file
+func removeDirectUpload(database database.Database, fileSystem filesystem.FileSystem, uploadId string) error {
+	if err := deleteDirectUploadFile(fileSystem, uploadId); err != nil {
+		return err
+	}
+	err := database.DeleteDirectUpload(uploadId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("unable to delete upload %s from database - %w", uploadId, err)
+	}
+	return nil
+}
+
+func deleteDirectUploadFile(fileSystem filesystem.FileSystem, uploadId string) error {
+	key := DirectUploadKey(uploadId)
+	if err := fileSystem.Delete(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to delete upload %s - %w", key, err)
+	}
+	return nil
+}
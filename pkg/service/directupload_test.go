@@ -0,0 +1,316 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+// presigningFileSystem is a local file system that presigns like object storage does
+type presigningFileSystem struct {
+	*local.LocalFileSystem
+}
+
+func (pfs presigningFileSystem) PresignPut(key string, headers map[string]string, expires time.Duration) (string, error) {
+	return "https://bucket.example.com/" + key + "?type=" + headers["Content-Type"] + "&length=" + headers["Content-Length"] + "&expires=" + expires.String(), nil
+}
+
+func TestCreateDirectUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		Name               string
+		Request            DirectUploadRequest
+		Presign            bool
+		ExpectedInserts    int
+		ExpectedUrl        string
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:            "Test upload through the API",
+			Request:         DirectUploadRequest{UserId: 1, FileName: "sunset.png", Size: 100},
+			ExpectedInserts: 1,
+			ExpectedUrl:     "/uploads/",
+		},
+		{
+			Name:            "Test upload to presigned url",
+			Request:         DirectUploadRequest{UserId: 1, FileName: "sunset.png", Size: 100},
+			Presign:         true,
+			ExpectedInserts: 1,
+			ExpectedUrl:     "https://bucket.example.com/uploads/direct/",
+		},
+		{Name: "Test missing user", Request: DirectUploadRequest{FileName: "sunset.png", Size: 100}, ExpectedErrorMatch: ErrInvalidUpload},
+		{Name: "Test empty upload", Request: DirectUploadRequest{UserId: 1, FileName: "sunset.png"}, ExpectedErrorMatch: ErrInvalidUpload},
+		{Name: "Test upload too large", Request: DirectUploadRequest{UserId: 1, FileName: "sunset.png", Size: 1001}, ExpectedErrorMatch: ErrUploadTooLarge},
+		{
+			Name:               "Test format not allowed",
+			Request:            DirectUploadRequest{UserId: 1, FileName: "sunset.gif", Size: 100},
+			ExpectedErrorMatch: &decoder.UnsupportedFormatError{Format: "gif"},
+		},
+	}
+
+	config := config.Config{UploadMaxBytes: 1000, UploadSessionTTL: time.Hour, UploadURLExpiry: 15 * time.Minute, ImageFormats: []string{"png"}}
+	for _, test := range tests {
+		db := mocks.NewMockDatabase(ctrl)
+		fileSystem := local.New("test host directory", t.TempDir())
+		uploadService := NewDirectUploadService(&config, db, fileSystem, nil)
+		if test.Presign {
+			uploadService = NewDirectUploadService(&config, db, presigningFileSystem{fileSystem}, nil)
+		}
+		var saved tables.DirectUploadTable
+		db.EXPECT().CreateDirectUpload(gomock.Any(), time.Hour).DoAndReturn(func(upload tables.DirectUploadTable, ttl time.Duration) error {
+			saved = upload
+			return nil
+		}).Times(test.ExpectedInserts)
+
+		upload, err := uploadService.CreateUpload(test.Request)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorContains(t, err, test.ExpectedErrorMatch.Error(), test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, tables.DirectUploadTable{
+			UploadId:    upload.UploadId,
+			UserId:      1,
+			FileName:    "sunset.png",
+			ContentType: "image/png",
+			Length:      100,
+		}, saved, test.Name)
+		assert.Len(t, upload.UploadId, 32, test.Name)
+		assert.True(t, strings.HasPrefix(upload.UploadUrl, test.ExpectedUrl+upload.UploadId+"?"), upload.UploadUrl)
+		assert.Equal(t, "PUT", upload.Method, test.Name)
+		assert.Equal(t, map[string]string{"Content-Type": "image/png"}, upload.Headers, test.Name)
+		assert.WithinDuration(t, time.Now().Add(15*time.Minute), upload.ExpiresAt, time.Minute, test.Name)
+		if test.Presign {
+			assert.True(t, strings.HasSuffix(upload.UploadUrl, "?type=image/png&length=100&expires=15m0s"), upload.UploadUrl)
+		}
+	}
+}
+
+func TestReceiveDirectUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	config := config.Config{UploadSigningSecret: "upload secret", UploadClaimTimeout: time.Minute}
+	db := mocks.NewMockDatabase(ctrl)
+	fileSystem := local.New("test host directory", t.TempDir())
+	uploadService := NewDirectUploadService(&config, db, fileSystem, nil)
+
+	expires := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	upload := tables.DirectUploadTable{UploadId: testUploadId, ContentType: "image/png", Length: 7}
+	claimed := upload
+	claimed.ClaimedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	staleClaim := upload
+	staleClaim.ClaimedAt = sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}
+	tests := []struct {
+		Name               string
+		Expires            string
+		Signature          string
+		ContentType        string
+		Body               string
+		Upload             tables.DirectUploadTable
+		ExpectedStored     bool
+		ExpectedErrorMatch error
+	}{
+		{Name: "Test upload is stored", Expires: expires, ContentType: "image/png", Body: "content", Upload: upload, ExpectedStored: true},
+		{Name: "Test wrong signature", Expires: expires, Signature: "forged", ExpectedErrorMatch: ErrInvalidUploadSignature},
+		{Name: "Test expired url", Expires: expired, ExpectedErrorMatch: ErrInvalidUploadSignature},
+		{Name: "Test wrong content type", Expires: expires, ContentType: "image/jpeg", Body: "content", Upload: upload, ExpectedErrorMatch: ErrInvalidUpload},
+		{Name: "Test body larger than declared", Expires: expires, ContentType: "image/png", Body: "content!", Upload: upload, ExpectedErrorMatch: ErrUploadTooLarge},
+		{Name: "Test body smaller than declared", Expires: expires, ContentType: "image/png", Body: "conten", Upload: upload, ExpectedErrorMatch: ErrInvalidUpload},
+		{Name: "Test upload being posted", Expires: expires, ContentType: "image/png", Body: "content", Upload: claimed, ExpectedErrorMatch: ErrUploadFinalizing},
+		{Name: "Test upload left claimed by a stopped process", Expires: expires, ContentType: "image/png", Body: "content", Upload: staleClaim, ExpectedStored: true},
+		{
+			Name:               "Test upload already posted",
+			Expires:            expires,
+			ContentType:        "image/png",
+			Upload:             tables.DirectUploadTable{UploadId: testUploadId, PostId: 5},
+			ExpectedErrorMatch: ErrUploadFinalizing,
+		},
+	}
+	for _, test := range tests {
+		signature := test.Signature
+		if signature == "" {
+			signature = uploadService.sign(testUploadId, test.Expires)
+		}
+		lookups := 0
+		if test.Upload.UploadId != "" {
+			lookups = 1
+		}
+		db.EXPECT().GetDirectUpload(testUploadId).Return(test.Upload, nil).Times(lookups)
+
+		err := uploadService.ReceiveUpload(context.Background(), testUploadId, test.Expires, signature, test.ContentType, strings.NewReader(test.Body))
+		keys, listErr := fileSystem.List("")
+		assert.Nil(t, listErr, test.Name)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorIs(t, err, test.ExpectedErrorMatch, test.Name)
+			assert.Empty(t, keys, test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, []string{"uploads/direct/" + testUploadId}, keys, test.Name)
+		assert.Nil(t, fileSystem.Delete(keys[0]))
+	}
+
+	// Urls are signed for one upload only
+	query, err := url.ParseQuery("expires=" + expires + "&signature=" + uploadService.sign("ffff", expires))
+	assert.Nil(t, err)
+	assert.False(t, uploadService.validSignature(testUploadId, query.Get("expires"), query.Get("signature")))
+}
+
+func TestCreatePostFromDirectUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 8))))
+	content := encoded.Bytes()
+	contentHash := sha256.Sum256(content)
+	uploadKey := "uploads/direct/" + testUploadId
+	uploaded := tables.DirectUploadTable{
+		UploadId:    testUploadId,
+		UserId:      1,
+		FileName:    "sunset.png",
+		ContentType: "image/png",
+		Length:      int64(len(content)),
+	}
+	staleClaim := uploaded
+	staleClaim.ClaimedAt = sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}
+
+	tests := []struct {
+		Name               string
+		Upload             tables.DirectUploadTable
+		UserId             int64
+		NotUploaded        bool
+		ClaimCalls         int
+		InsertError        error
+		InsertCalls        int
+		ExpectedFinish     int
+		ExpectedRelease    int
+		ExpectedDelete     int
+		ExpectedKeys       []string
+		ExpectedResponse   PostResponse
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:             "Test uploaded image is moved into a post",
+			Upload:           uploaded,
+			ClaimCalls:       1,
+			InsertCalls:      1,
+			ExpectedFinish:   1,
+			ExpectedKeys:     []string{StorageKey(hex.EncodeToString(contentHash[:]), "sunset.png")},
+			ExpectedResponse: PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:             "Test claim left by a stopped process is taken over",
+			Upload:           staleClaim,
+			ClaimCalls:       1,
+			InsertCalls:      1,
+			ExpectedFinish:   1,
+			ExpectedKeys:     []string{StorageKey(hex.EncodeToString(contentHash[:]), "sunset.png")},
+			ExpectedResponse: PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:             "Test creating the post again returns the same post",
+			Upload:           tables.DirectUploadTable{UploadId: testUploadId, UserId: 1, PostId: 5},
+			ExpectedKeys:     []string{uploadKey},
+			ExpectedResponse: PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:               "Test upload of another user",
+			Upload:             uploaded,
+			UserId:             2,
+			ExpectedKeys:       []string{uploadKey},
+			ExpectedErrorMatch: ErrUploadNotFound,
+		},
+		{
+			Name:               "Test nothing uploaded yet",
+			Upload:             uploaded,
+			NotUploaded:        true,
+			ClaimCalls:         1,
+			ExpectedRelease:    1,
+			ExpectedErrorMatch: ErrUploadIncomplete,
+		},
+		{
+			Name:               "Test upload of another size than declared",
+			Upload:             tables.DirectUploadTable{UploadId: testUploadId, UserId: 1, FileName: "sunset.png", Length: 10},
+			ClaimCalls:         1,
+			ExpectedRelease:    1,
+			ExpectedKeys:       []string{uploadKey},
+			ExpectedErrorMatch: ErrUploadIncomplete,
+		},
+		{
+			Name:               "Test upload that isn't what its name says is deleted",
+			Upload:             tables.DirectUploadTable{UploadId: testUploadId, UserId: 1, FileName: "sunset.jpg", Length: int64(len(content))},
+			ClaimCalls:         1,
+			ExpectedDelete:     1,
+			ExpectedErrorMatch: &decoder.FormatMismatchError{Extension: ".jpg", Format: "png"},
+		},
+		{
+			Name:               "Test upload is kept for a retry when the post can't be saved",
+			Upload:             uploaded,
+			ClaimCalls:         1,
+			InsertError:        errors.New("connection refused"),
+			InsertCalls:        1,
+			ExpectedRelease:    1,
+			ExpectedKeys:       []string{StorageKey(hex.EncodeToString(contentHash[:]), "sunset.png"), uploadKey, ORPHAN_SUBDIRECTORY + "/*"},
+			ExpectedErrorMatch: errors.New("connection refused"),
+		},
+	}
+
+	any := gomock.Any()
+	config := config.Config{ImageFormats: []string{"png"}, UploadClaimTimeout: time.Minute}
+	for _, test := range tests {
+		fileSystem := local.New("test host directory", t.TempDir())
+		if !test.NotUploaded {
+			_, err := fileSystem.Save(context.Background(), uploadKey, bytes.NewReader(content), nil)
+			assert.Nil(t, err)
+		}
+		db := mocks.NewMockDatabase(ctrl)
+		postService := NewPostService(&config, db, fileSystem, nil, NewDecodeOptions(&config))
+		uploadService := NewDirectUploadService(&config, db, fileSystem, postService)
+
+		db.EXPECT().GetDirectUpload(testUploadId).Return(test.Upload, nil).Times(1)
+		db.EXPECT().ClaimDirectUpload(testUploadId, time.Minute).Return(nil).Times(test.ClaimCalls)
+		db.EXPECT().GetImageByContentHash(any).Return(tables.ImageTable{}, sql.ErrNoRows).Times(test.InsertCalls)
+		db.EXPECT().InsertNewPost(tables.PostTable{UserId: 1, Caption: "sunset"}, any).Return(int64(5), test.InsertError).Times(test.InsertCalls)
+		db.EXPECT().FinishDirectUpload(testUploadId, int64(5)).Return(nil).Times(test.ExpectedFinish)
+		db.EXPECT().ReleaseDirectUpload(testUploadId).Return(nil).Times(test.ExpectedRelease)
+		db.EXPECT().DeleteDirectUpload(testUploadId).Return(nil).Times(test.ExpectedDelete)
+
+		userId := test.UserId
+		if userId == 0 {
+			userId = 1
+		}
+		response, err := uploadService.CreatePost(context.Background(), Post{UserId: userId, Caption: "sunset"}, testUploadId)
+		keys, listErr := fileSystem.List("")
+		assert.Nil(t, listErr, test.Name)
+		assert.Equal(t, test.ExpectedKeys, orphanNotes(keys), test.Name)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorContains(t, err, test.ExpectedErrorMatch.Error(), test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedResponse, response, test.Name)
+	}
+}
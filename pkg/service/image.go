@@ -1,34 +1,187 @@
 package service
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ksindhwani/imagegram/pkg/config"
 	"github.com/ksindhwani/imagegram/pkg/database"
 	"github.com/ksindhwani/imagegram/pkg/filesystem"
 	"github.com/ksindhwani/imagegram/pkg/internal/converter"
+	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
+	"github.com/ksindhwani/imagegram/pkg/worker"
+)
+
+const CONVERTED_IMAGE_EXTENSION = ".jpg"
+
+var (
+	ErrImageNotFound     = errors.New("image not found")
+	ErrImageNotConverted = errors.New("image conversion is pending")
+	ErrUnknownRendition  = errors.New("unknown rendition")
 )
 
 type ImageService struct {
 	Config     config.Config
 	Database   database.Database
 	FileSystem filesystem.FileSystem
+	// Derivatives keeps the sizes produced on demand within DERIVATIVE_CACHE_MB
+	Derivatives *filesystem.Cache
+	// Rendering collapses identical derivative requests into one render
+	Rendering     *worker.Flight
+	DecodeOptions converter.DecodeOptions
+	// DecodeWait is the longest a derivative waits to be decoded before it is refused
+	DecodeWait time.Duration
 }
 
+// Derivatives are rendered while the client waits, they are refused rather than
+// queued behind the conversions for long
+const derivativeDecodeWait = 2 * time.Second
+
 func NewImageService(
 	Config *config.Config,
 	database database.Database,
+	fileSystem filesystem.FileSystem,
+	derivatives *filesystem.Cache,
+	decodeOptions converter.DecodeOptions,
 ) *ImageService {
 	return &ImageService{
-		Config:   *Config,
-		Database: database,
+		Config:        *Config,
+		Database:      database,
+		FileSystem:    fileSystem,
+		Derivatives:   derivatives,
+		Rendering:     worker.NewFlight(),
+		DecodeOptions: decodeOptions,
+		DecodeWait:    derivativeDecodeWait,
+	}
+}
+
+// NewDecodeOptions bounds decoding to CONVERSION_MAX_DECODES images and
+// CONVERSION_DECODE_MEMORY_MB at once. The bounds are for the whole process, build
+// them once and hand them to every service that decodes.
+func NewDecodeOptions(Config *config.Config) converter.DecodeOptions {
+	return converter.DecodeOptions{
+		Pipeline: DecodePipeline(Config),
+		Slots:    worker.NewSemaphore(Config.ConversionMaxDecodes),
+		Memory:   worker.NewWeightedSemaphore(int64(Config.ConversionDecodeMemoryMB) << 20),
+	}
+}
+
+// DecodePipeline is how every image is read, at upload and when it is converted
+func DecodePipeline(Config *config.Config) decoder.Pipeline {
+	return decoder.Pipeline{
+		Formats: Config.ImageFormats,
+		Limits: decoder.Limits{
+			MaxWidth:  Config.ImageMaxWidth,
+			MaxHeight: Config.ImageMaxHeight,
+			MaxPixels: int64(Config.ImageMaxMegapixels) * 1000000,
+		},
+		GifPosterFrame: Config.GifPosterFrame,
+	}
+}
+
+// ConvertedImage is an open rendition JPEG ready to be streamed to a client.
+type ConvertedImage struct {
+	ImageId   int64
+	Rendition string
+	File      io.ReadSeekCloser
+	Info      fs.FileInfo
+}
+
+// ImageUrl returns the public url a rendition of an image is served from, an empty
+// rendition stands for the default one.
+func ImageUrl(baseURL string, imageId int64, rendition string) string {
+	url := strings.TrimSuffix(baseURL, "/") + "/images/" + strconv.FormatInt(imageId, 10) + CONVERTED_IMAGE_EXTENSION
+	if rendition != "" {
+		url += "?rendition=" + rendition
+	}
+	return url
+}
+
+// ImageUrls returns the url of every rendition of an image by rendition name.
+func ImageUrls(baseURL string, imageId int64, renditions config.Renditions) map[string]string {
+	urls := make(map[string]string, len(renditions))
+	for _, rendition := range renditions {
+		urls[rendition.Name] = ImageUrl(baseURL, imageId, rendition.Name)
+	}
+	return urls
+}
+
+// Open a rendition of an image, the default one when rendition is empty.
+// ErrUnknownRendition is returned for a rendition that isn't configured,
+// ErrImageNotFound when the image does not exist or is quarantined and
+// ErrImageNotConverted while the rendition is still being produced.
+func (is *ImageService) GetConvertedImage(imageId int64, rendition string) (ConvertedImage, error) {
+	name, err := is.renditionName(rendition)
+	if err != nil {
+		return ConvertedImage{}, err
+	}
+	row, err := is.Database.GetImageRendition(imageId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Tell an image waiting for conversion from one that doesn't exist
+		image, err := is.Database.GetImage(imageId)
+		if errors.Is(err, sql.ErrNoRows) || image.QuarantinedAt.Valid {
+			return ConvertedImage{}, ErrImageNotFound
+		}
+		if err != nil {
+			return ConvertedImage{}, fmt.Errorf("unable to fetch image from database - %w", err)
+		}
+		return ConvertedImage{}, ErrImageNotConverted
+	}
+	if err != nil {
+		return ConvertedImage{}, fmt.Errorf("unable to fetch rendition from database - %w", err)
+	}
+
+	file, info, err := is.FileSystem.Open(row.StorageKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ConvertedImage{}, ErrImageNotFound
+	}
+	if err != nil {
+		return ConvertedImage{}, fmt.Errorf("unable to open converted image - %w", err)
+	}
+	return ConvertedImage{
+		ImageId:   row.ImageId,
+		Rendition: row.Name,
+		File:      file,
+		Info:      info,
+	}, nil
+}
+
+// Open a rendition of a post's image, see GetConvertedImage.
+func (is *ImageService) GetConvertedImageForPost(postId int64, rendition string) (ConvertedImage, error) {
+	if _, err := is.renditionName(rendition); err != nil {
+		return ConvertedImage{}, err
+	}
+	image, err := is.Database.GetImageForPost(postId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ConvertedImage{}, ErrImageNotFound
+	}
+	if err != nil {
+		return ConvertedImage{}, fmt.Errorf("unable to fetch image from database - %w", err)
+	}
+	return is.GetConvertedImage(image.ImageId, rendition)
+}
+
+func (is *ImageService) renditionName(rendition string) (string, error) {
+	if rendition == "" {
+		return is.Config.DefaultRendition, nil
+	}
+	if _, ok := is.Config.Renditions.Get(rendition); !ok {
+		return "", ErrUnknownRendition
 	}
+	return rendition, nil
 }
 
-func (is *ImageService) UpdateConvertedLocationsForImages(convertedImages []converter.ImageConversionResponse) error {
+func (is *ImageService) SaveRenditionsForImages(convertedImages []converter.ImageConversionResponse) error {
 	var err error
 	for _, image := range convertedImages {
-		err = is.Database.UpdateImageConvertedData(image)
+		err = is.Database.SaveImageRenditions(renditionRows(image))
 		if err != nil {
 			log.Printf("unable to save image in database: %s", err.Error())
 			continue
@@ -1,78 +1,80 @@
 package service
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
+	"io/fs"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	"github.com/ksindhwani/imagegram/pkg/config"
 	"github.com/ksindhwani/imagegram/pkg/internal/converter"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
 	"github.com/ksindhwani/imagegram/pkg/mocks"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestUpdateConvertedLocationsForImages(t *testing.T) {
+func TestSaveRenditionsForImages(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	tests := []struct {
-		Name                                  string
-		Input                                 []converter.ImageConversionResponse
-		ExpectedUpdateImageConvertedDataError error
-		ExpectedUpdateImageConvertedDataCalls int
-		ExpectedError                         error
+		Name                             string
+		Input                            []converter.ImageConversionResponse
+		ExpectedSaveImageRenditionsError error
+		ExpectedSaveImageRenditionsCalls int
+		ExpectedError                    error
 	}{
 		{
 			Name: "Test All Valid",
 			Input: []converter.ImageConversionResponse{
 				{
-					ImageId:                1,
-					ImageName:              "Test Image",
-					ImageLocation:          "Test location",
-					ConvertedImageName:     "Test converted name",
-					ConvertedImageLocation: "Test converted image location",
-					ConversionStatus:       true,
-					Error:                  nil,
+					ImageId:       1,
+					ImageName:     "Test Image",
+					ImageLocation: "Test location",
+					Renditions: []converter.RenditionResult{
+						{Name: "thumb", Width: 150, Height: 150, StorageKey: "converted/1/thumb.jpg", Location: "Test thumb location", Size: 100},
+					},
+					ConversionStatus: true,
+					Error:            nil,
 				},
 				{
-					ImageId:                2,
-					ImageName:              "Test Imagem 2",
-					ImageLocation:          "Test location 2",
-					ConvertedImageName:     "Test converted name 2",
-					ConvertedImageLocation: "Test converted image location 2",
-					ConversionStatus:       true,
-					Error:                  nil,
+					ImageId:       2,
+					ImageName:     "Test Imagem 2",
+					ImageLocation: "Test location 2",
+					Renditions: []converter.RenditionResult{
+						{Name: "thumb", Width: 150, Height: 150, StorageKey: "converted/2/thumb.jpg", Location: "Test thumb location 2", Size: 200},
+					},
+					ConversionStatus: true,
+					Error:            nil,
 				},
 			},
-			ExpectedUpdateImageConvertedDataError: nil,
-			ExpectedUpdateImageConvertedDataCalls: 2,
-			ExpectedError:                         nil,
+			ExpectedSaveImageRenditionsError: nil,
+			ExpectedSaveImageRenditionsCalls: 2,
+			ExpectedError:                    nil,
 		},
 		{
 			Name: "Test when image gets update query error",
 			Input: []converter.ImageConversionResponse{
 				{
-					ImageId:                1,
-					ImageName:              "Test Image",
-					ImageLocation:          "Test location",
-					ConvertedImageName:     "Test converted name",
-					ConvertedImageLocation: "Test converted image location",
-					ConversionStatus:       true,
-					Error:                  nil,
+					ImageId:          1,
+					ImageName:        "Test Image",
+					ImageLocation:    "Test location",
+					ConversionStatus: true,
+					Error:            nil,
 				},
 				{
-					ImageId:                2,
-					ImageName:              "Test Imagem 2",
-					ImageLocation:          "Test location 2",
-					ConvertedImageName:     "Test converted name 2",
-					ConvertedImageLocation: "Test converted image location 2",
-					ConversionStatus:       true,
-					Error:                  nil,
+					ImageId:          2,
+					ImageName:        "Test Imagem 2",
+					ImageLocation:    "Test location 2",
+					ConversionStatus: true,
+					Error:            nil,
 				},
 			},
-			ExpectedUpdateImageConvertedDataError: errors.New("error in db query"),
-			ExpectedUpdateImageConvertedDataCalls: 2,
-			ExpectedError:                         errors.New("error in db query"),
+			ExpectedSaveImageRenditionsError: errors.New("error in db query"),
+			ExpectedSaveImageRenditionsCalls: 2,
+			ExpectedError:                    errors.New("error in db query"),
 		},
 	}
 
@@ -82,12 +84,127 @@ func TestUpdateConvertedLocationsForImages(t *testing.T) {
 		LocalImageDirectory: "test local directory",
 	}
 	database := mocks.NewMockDatabase(ctrl)
-	imageService := NewImageService(&config, database)
+	imageService := NewImageService(&config, database, nil, nil, NewDecodeOptions(&config))
 	for _, test := range tests {
-		database.EXPECT().UpdateImageConvertedData(any).
-			Return(test.ExpectedUpdateImageConvertedDataError).
-			Times(test.ExpectedUpdateImageConvertedDataCalls)
-		err := imageService.UpdateConvertedLocationsForImages(test.Input)
+		database.EXPECT().SaveImageRenditions(any).
+			Return(test.ExpectedSaveImageRenditionsError).
+			Times(test.ExpectedSaveImageRenditionsCalls)
+		err := imageService.SaveRenditionsForImages(test.Input)
 		assert.Equal(t, test.ExpectedError, err, test.Name)
 	}
 }
+
+func TestGetConvertedImage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		Name                      string
+		Rendition                 string
+		ExpectedRenditionName     string
+		ExpectedGetRendition      tables.ImageRenditionTable
+		ExpectedGetRenditionError error
+		ExpectedGetRenditionCalls int
+		ExpectedGetImageError     error
+		ExpectedGetImageCalls     int
+		ExpectedOpenError         error
+		ExpectedOpenCalls         int
+		ExpectedOpenKey           string
+		ExpectedError             error
+	}{
+		{
+			Name:                      "Test default rendition",
+			ExpectedRenditionName:     "feed",
+			ExpectedGetRendition:      tables.ImageRenditionTable{ImageId: 1, Name: "feed", StorageKey: "converted/1/feed.jpg"},
+			ExpectedGetRenditionCalls: 1,
+			ExpectedOpenCalls:         1,
+			ExpectedOpenKey:           "converted/1/feed.jpg",
+		},
+		{
+			Name:                      "Test named rendition",
+			Rendition:                 "thumb",
+			ExpectedRenditionName:     "thumb",
+			ExpectedGetRendition:      tables.ImageRenditionTable{ImageId: 1, Name: "thumb", StorageKey: "converted/1/thumb.jpg"},
+			ExpectedGetRenditionCalls: 1,
+			ExpectedOpenCalls:         1,
+			ExpectedOpenKey:           "converted/1/thumb.jpg",
+		},
+		{
+			Name:          "Test unknown rendition",
+			Rendition:     "huge",
+			ExpectedError: ErrUnknownRendition,
+		},
+		{
+			Name:                      "Test image not in database",
+			ExpectedRenditionName:     "feed",
+			ExpectedGetRenditionError: sql.ErrNoRows,
+			ExpectedGetRenditionCalls: 1,
+			ExpectedGetImageError:     sql.ErrNoRows,
+			ExpectedGetImageCalls:     1,
+			ExpectedError:             ErrImageNotFound,
+		},
+		{
+			Name:                      "Test conversion pending",
+			ExpectedRenditionName:     "feed",
+			ExpectedGetRenditionError: sql.ErrNoRows,
+			ExpectedGetRenditionCalls: 1,
+			ExpectedGetImageCalls:     1,
+			ExpectedError:             ErrImageNotConverted,
+		},
+		{
+			Name:                      "Test converted file missing from storage",
+			ExpectedRenditionName:     "feed",
+			ExpectedGetRendition:      tables.ImageRenditionTable{ImageId: 1, Name: "feed", StorageKey: "converted/1/feed.jpg"},
+			ExpectedGetRenditionCalls: 1,
+			ExpectedOpenError:         fmt.Errorf("error opening the file in local - %w", fs.ErrNotExist),
+			ExpectedOpenCalls:         1,
+			ExpectedOpenKey:           "converted/1/feed.jpg",
+			ExpectedError:             ErrImageNotFound,
+		},
+		{
+			Name:                      "Test error in db query",
+			ExpectedRenditionName:     "feed",
+			ExpectedGetRenditionError: errors.New("error in db query"),
+			ExpectedGetRenditionCalls: 1,
+			ExpectedError:             fmt.Errorf("unable to fetch rendition from database - %w", errors.New("error in db query")),
+		},
+	}
+
+	config := config.Config{
+		HostImageDirectory:  "test host directory",
+		LocalImageDirectory: "test local directory",
+		Renditions: config.Renditions{
+			{Name: "thumb", Width: 150, Height: 150},
+			{Name: "feed", Width: 600, Height: 600},
+		},
+		DefaultRendition: "feed",
+	}
+	database := mocks.NewMockDatabase(ctrl)
+	fileSystem := mocks.NewMockFileSystem(ctrl)
+	imageService := NewImageService(&config, database, fileSystem, nil, NewDecodeOptions(&config))
+	for _, test := range tests {
+		database.EXPECT().GetImageRendition(int64(1), test.ExpectedRenditionName).
+			Return(test.ExpectedGetRendition, test.ExpectedGetRenditionError).
+			Times(test.ExpectedGetRenditionCalls)
+		database.EXPECT().GetImage(int64(1)).Return(tables.ImageTable{ImageId: 1}, test.ExpectedGetImageError).Times(test.ExpectedGetImageCalls)
+		fileSystem.EXPECT().Open(test.ExpectedOpenKey).Return(nil, nil, test.ExpectedOpenError).Times(test.ExpectedOpenCalls)
+		result, err := imageService.GetConvertedImage(1, test.Rendition)
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+		if err == nil {
+			assert.Equal(t, int64(1), result.ImageId, test.Name)
+			assert.Equal(t, test.ExpectedRenditionName, result.Rendition, test.Name)
+		}
+	}
+}
+
+func TestImageUrls(t *testing.T) {
+	renditions := config.Renditions{
+		{Name: "thumb", Width: 150, Height: 150},
+		{Name: "feed", Width: 600, Height: 600},
+	}
+	assert.Equal(t, "/images/3.jpg", ImageUrl("", 3, ""))
+	assert.Equal(t, map[string]string{
+		"thumb": "https://cdn.imagegram.test/images/3.jpg?rendition=thumb",
+		"feed":  "https://cdn.imagegram.test/images/3.jpg?rendition=feed",
+	}, ImageUrls("https://cdn.imagegram.test/", 3, renditions))
+}
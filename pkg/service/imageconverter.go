@@ -1,38 +1,412 @@
 package service
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/ksindhwani/imagegram/pkg/config"
 	"github.com/ksindhwani/imagegram/pkg/database"
+	"github.com/ksindhwani/imagegram/pkg/filesystem"
 	"github.com/ksindhwani/imagegram/pkg/internal/converter"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/pagination"
 )
 
-const (
-	LENGTH600 = 600
-	WIDTH600  = 600
-)
+const maxLastErrorLength = 1000
+
+var ErrConversionJobNotFound = errors.New("no dead or rejected conversion job found with the given job id")
 
 type ImageConvertorService struct {
-	Config   *config.Config
-	Database database.Database
+	Config     *config.Config
+	Database   database.Database
+	FileSystem filesystem.FileSystem
+	Paginator  *pagination.Paginator
+	// Owner identifies this process on the jobs it leases, each claim adds a token of
+	// its own, see leaseOwner
+	Owner string
+	// DecodeOptions picks the formats converted, rejects images too large to decode and
+	// bounds the images decoded at once and their memory, see NewDecodeOptions
+	DecodeOptions converter.DecodeOptions
+	// Moderation quarantines images matching the blocklist once they are hashed
+	Moderation *ModerationService
 }
 
 func NewImageConvertorService(
 	Config *config.Config,
 	database database.Database,
+	fileSystem filesystem.FileSystem,
+	decodeOptions converter.DecodeOptions,
 ) *ImageConvertorService {
 	return &ImageConvertorService{
-		Config:   Config,
-		Database: database,
+		Config:        Config,
+		Database:      database,
+		FileSystem:    fileSystem,
+		Paginator:     pagination.New(Config.CursorSecret, Config.DefaultPageSize, Config.MaxPageSize),
+		Owner:         workerOwner(),
+		DecodeOptions: decodeOptions,
+		Moderation:    NewModerationService(Config, database, fileSystem),
+	}
+}
+
+type ConversionJob struct {
+	JobId         int64     `json:"jobId"`
+	ImageId       int64     `json:"imageId"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	LeaseOwner    string    `json:"leaseOwner,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+type RequeueResponse struct {
+	Requeued int64 `json:"requeued"`
+	Success  bool  `json:"success"`
+}
+
+// Queue images missing any of the configured renditions, used by the backfill
+func (ics *ImageConvertorService) EnqueueUnconvertedImages() error {
+	names := make([]string, len(ics.Config.Renditions))
+	for i, rendition := range ics.Config.Renditions {
+		names[i] = rendition.Name
+	}
+	if err := ics.Database.EnqueueImagesMissingRenditions(names); err != nil {
+		return fmt.Errorf("unable to queue unconverted images - %w", err)
+	}
+	return nil
+}
+
+// Claim up to limit due conversion jobs and run them. Returns the number of jobs
+// claimed, failures are recorded on the jobs for a later retry.
+func (ics *ImageConvertorService) RunConversionJobs(ctx context.Context, limit int) (int, error) {
+	owner, err := ics.leaseOwner()
+	if err != nil {
+		return 0, err
+	}
+	jobs, err := ics.Database.ClaimConversionJobs(owner, limit, ics.Config.ConversionLeaseDuration, ics.Config.ConversionMaxAttempts)
+	if err != nil {
+		return 0, fmt.Errorf("unable to claim conversion jobs - %w", err)
+	}
+	for _, job := range jobs {
+		ics.runConversionJob(ctx, job)
+	}
+	return len(jobs), nil
+}
+
+// Claim the conversion job of a post's image and run it. Returns false when the job
+// isn't due or another worker runs it.
+func (ics *ImageConvertorService) RunPostConversionJob(ctx context.Context, postId int64) (bool, error) {
+	owner, err := ics.leaseOwner()
+	if err != nil {
+		return false, err
+	}
+	job, err := ics.Database.ClaimPostConversionJob(owner, postId, ics.Config.ConversionLeaseDuration, ics.Config.ConversionMaxAttempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to claim conversion job - %w", err)
+	}
+	ics.runConversionJob(ctx, job)
+	return true, nil
+}
+
+// Run workers that claim and run due jobs one at a time until ctx is cancelled. An
+// idle worker looks again after pollInterval. Jobs that are running when ctx is
+// cancelled carry on under workCtx, cancelling it as well puts them back to pending.
+func (ics *ImageConvertorService) RunConversionWorkers(ctx context.Context, workCtx context.Context, workers int, pollInterval time.Duration) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				count, err := ics.RunConversionJobs(workCtx, 1)
+				if err != nil {
+					log.Printf("conversion worker: %s", err.Error())
+				}
+				if err == nil && count > 0 {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(pollInterval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (ics *ImageConvertorService) runConversionJob(ctx context.Context, job tables.ConversionJobTable) {
+	if job.Attempts > ics.Config.ConversionMaxAttempts {
+		// e.g. CONVERSION_MAX_ATTEMPTS was lowered, don't run an image that may crash the worker again
+		job.Status = tables.CONVERSION_JOB_DEAD
+		job.LastError = fmt.Sprintf("attempt %d is over the %d allowed", job.Attempts, ics.Config.ConversionMaxAttempts)
+		log.Printf("conversion job %d of image %d is dead: %s", job.JobId, job.ImageId, job.LastError)
+		if err := ics.Database.FailConversionJob(job, 0); err != nil {
+			log.Printf("unable to record failure of conversion job %d: %s", job.JobId, err.Error())
+		}
+		return
+	}
+	err := ics.convertImage(ctx, job.ImageId)
+	if err == nil {
+		if err := ics.Database.CompleteConversionJob(job); err != nil {
+			log.Printf("unable to complete conversion job %d: %s", job.JobId, err.Error())
+		}
+		return
+	}
+
+	job.Status = tables.CONVERSION_JOB_PENDING
+	job.LastError = err.Error()
+	if len(job.LastError) > maxLastErrorLength {
+		job.LastError = job.LastError[:maxLastErrorLength]
+	}
+	var retryAfter time.Duration
+	switch {
+	case ctx.Err() != nil:
+		// Interrupted by a shutdown, the image itself may be fine so retry right away
+	case converter.IsRejected(err):
+		// Retrying won't change the file
+		job.Status = tables.CONVERSION_JOB_REJECTED
+		log.Printf("conversion job %d of image %d is rejected: %s", job.JobId, job.ImageId, job.LastError)
+	case job.Attempts >= ics.Config.ConversionMaxAttempts:
+		job.Status = tables.CONVERSION_JOB_DEAD
+		log.Printf("conversion job %d of image %d is dead after %d attempts: %s", job.JobId, job.ImageId, job.Attempts, job.LastError)
+	default:
+		retryAfter = retryDelay(job.Attempts, ics.Config.ConversionRetryBaseDelay, ics.Config.ConversionRetryMaxDelay)
+		log.Printf("conversion job %d of image %d failed, retrying in %s: %s", job.JobId, job.ImageId, retryAfter, job.LastError)
+	}
+	if err := ics.Database.FailConversionJob(job, retryAfter); err != nil {
+		log.Printf("unable to record failure of conversion job %d: %s", job.JobId, err.Error())
+	}
+}
+
+// Produce the renditions, placeholder and perceptual hash an image is missing and
+// record them. Images that have all of them are left alone, images matching the
+// blocklist are quarantined instead.
+func (ics *ImageConvertorService) convertImage(ctx context.Context, imageId int64) error {
+	image, err := ics.Database.GetImage(imageId)
+	if err != nil {
+		return fmt.Errorf("unable to fetch image from database - %w", err)
+	}
+	if image.QuarantinedAt.Valid {
+		return nil
+	}
+	existing, err := ics.Database.GetImageRenditions(imageId)
+	if err != nil {
+		return fmt.Errorf("unable to fetch renditions from database - %w", err)
+	}
+	missing := missingRenditions(ics.Config.Renditions, existing)
+	if len(missing) == 0 && image.BlurHash != "" && image.PerceptualHash.Valid {
+		return nil
+	}
+
+	success, failed, err := converter.ConvertImagesIntoRenditions(ctx, []tables.ImageTable{image}, ics.FileSystem, missing, ics.DecodeOptions)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to convert image - %w", failed[0].Error)
+	}
+	if len(success) == 0 {
+		return errors.New("unable to convert image - not an image file")
+	}
+	// Metadata goes first, an image with all its renditions is not converted again
+	if err := ics.Database.SaveImageMetadata(metadataRow(success[0])); err != nil {
+		return fmt.Errorf("unable to save image metadata in database - %w", err)
+	}
+	if err := ics.Database.SaveImagePlaceholder(placeholderRow(success[0])); err != nil {
+		return fmt.Errorf("unable to save image placeholder in database - %w", err)
+	}
+	if err := ics.Database.SaveImageHash(imageId, success[0].Metadata.PerceptualHash); err != nil {
+		return fmt.Errorf("unable to save image hash in database - %w", err)
+	}
+	// Quarantining deletes the renditions that were just produced
+	blocked, err := ics.Moderation.QuarantineIfBlocked(ctx, image, success[0].Metadata.PerceptualHash, tables.MODERATION_SOURCE_CONVERTER)
+	if err != nil || blocked {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := ics.Database.SaveImageRenditions(renditionRows(success[0])); err != nil {
+		return fmt.Errorf("unable to save renditions in database - %w", err)
+	}
+	return nil
+}
+
+func missingRenditions(renditions config.Renditions, existing []tables.ImageRenditionTable) config.Renditions {
+	var missing config.Renditions
+	for _, rendition := range renditions {
+		found := false
+		for _, row := range existing {
+			if row.Name == rendition.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, rendition)
+		}
+	}
+	return missing
+}
+
+func renditionRows(conversion converter.ImageConversionResponse) []tables.ImageRenditionTable {
+	rows := make([]tables.ImageRenditionTable, len(conversion.Renditions))
+	for i, rendition := range conversion.Renditions {
+		rows[i] = tables.ImageRenditionTable{
+			ImageId:     conversion.ImageId,
+			Name:        rendition.Name,
+			Mode:        rendition.Mode,
+			StorageKey:  rendition.StorageKey,
+			Location:    rendition.Location,
+			Width:       rendition.Width,
+			Height:      rendition.Height,
+			SizeBytes:   rendition.Size,
+			Quality:     rendition.Encoding.Quality,
+			Progressive: rendition.Encoding.Progressive,
+			Chroma:      rendition.Encoding.Chroma,
+		}
+	}
+	return rows
+}
+
+func placeholderRow(conversion converter.ImageConversionResponse) tables.ImageTable {
+	return tables.ImageTable{
+		ImageId:       conversion.ImageId,
+		Width:         conversion.Metadata.Width,
+		Height:        conversion.Metadata.Height,
+		BlurHash:      conversion.Metadata.BlurHash,
+		DominantColor: conversion.Metadata.Color,
+	}
+}
+
+func metadataRow(conversion converter.ImageConversionResponse) tables.ImageMetadataTable {
+	metadata := conversion.Metadata
+	return tables.ImageMetadataTable{
+		ImageId:     conversion.ImageId,
+		Width:       metadata.Width,
+		Height:      metadata.Height,
+		Orientation: metadata.Orientation,
+		CapturedAt:  sql.NullTime{Time: metadata.CapturedAt, Valid: !metadata.CapturedAt.IsZero()},
+		CameraMake:  metadata.CameraMake,
+		CameraModel: metadata.CameraModel,
+	}
+}
+
+// Exponential backoff, the delay doubles with every attempt up to max
+func retryDelay(attempts int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// Get a page of conversion jobs with the given status, newest first
+func (ics *ImageConvertorService) GetConversionJobs(status string, cursor *pagination.Cursor, pageSize int) (pagination.Page, error) {
+	// Fetch one extra row to know whether another page exists
+	rows, err := ics.Database.GetConversionJobs(status, cursor, pageSize+1)
+	if err != nil {
+		return pagination.Page{}, fmt.Errorf("error in fetching conversion jobs - %w", err)
+	}
+	hasMore := len(rows) > pageSize
+	if hasMore {
+		rows = rows[:pageSize]
+	}
+
+	jobs := make([]ConversionJob, len(rows))
+	for i, row := range rows {
+		index := i
+		if cursor.IsPrev() {
+			// Previous pages are read in ascending order
+			index = len(rows) - 1 - i
+		}
+		jobs[index] = ConversionJob{
+			JobId:         row.JobId,
+			ImageId:       row.ImageId,
+			Status:        row.Status,
+			Attempts:      row.Attempts,
+			LastError:     row.LastError,
+			NextAttemptAt: row.NextAttemptAt,
+			LeaseOwner:    row.LeaseOwner,
+			CreatedAt:     row.CreatedAt,
+			UpdatedAt:     row.UpdatedAt,
+		}
+	}
+
+	var first, last *pagination.Cursor
+	if len(jobs) > 0 {
+		first = jobCursor(jobs[0])
+		last = jobCursor(jobs[len(jobs)-1])
+	}
+	return ics.Paginator.NewPage(jobs, cursor, first, last, hasMore), nil
+}
+
+func jobCursor(job ConversionJob) *pagination.Cursor {
+	return &pagination.Cursor{
+		SortKey: job.JobId,
+		Id:      job.JobId,
+	}
+}
+
+// Give a dead or rejected job a fresh set of attempts, e.g. after raising the image limits
+func (ics *ImageConvertorService) RequeueConversionJob(jobId int64) (RequeueResponse, error) {
+	err := ics.Database.RequeueConversionJob(jobId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RequeueResponse{}, ErrConversionJobNotFound
+	}
+	if err != nil {
+		return RequeueResponse{}, fmt.Errorf("error in requeueing conversion job - %w", err)
+	}
+	return RequeueResponse{
+		Requeued: 1,
+		Success:  true,
+	}, nil
+}
+
+// Give every dead job a fresh set of attempts
+func (ics *ImageConvertorService) RequeueDeadConversionJobs() (RequeueResponse, error) {
+	count, err := ics.Database.RequeueDeadConversionJobs()
+	if err != nil {
+		return RequeueResponse{}, fmt.Errorf("error in requeueing conversion jobs - %w", err)
+	}
+	return RequeueResponse{
+		Requeued: count,
+		Success:  true,
+	}, nil
+}
+
+// Lease owner of one claim. The workers of a process share Owner, the token tells
+// apart a job claimed again by another worker once its lease ran out, so the worker
+// that lost it can't complete or fail it.
+func (ics *ImageConvertorService) leaseOwner() (string, error) {
+	token, err := randomHex(8)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate lease token - %w", err)
 	}
+	return ics.Owner + "-" + token, nil
 }
 
-func (ics *ImageConvertorService) ConvertImages() (
-	[]converter.ImageConversionResponse, []converter.ImageConversionResponse, error) {
-	response, err := ics.Database.GetAllImages()
+func workerOwner() string {
+	hostname, err := os.Hostname()
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to fetch images from database - %w", err)
+		hostname = "unknown"
 	}
-	return converter.ConvertImagesIntoJpgAndSize(response, ics.Config, LENGTH600, WIDTH600)
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
 }
@@ -0,0 +1,367 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/ksindhwani/imagegram/pkg/internal/converter"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunConversionJobs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fileSystem := local.New("test host directory", t.TempDir())
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 20, 10))))
+	_, err := fileSystem.Save(context.Background(), "originals/photo.png", bytes.NewReader(encoded.Bytes()), nil)
+	assert.Nil(t, err)
+	_, err = fileSystem.Save(context.Background(), "originals/blocked.png", &encoded, nil)
+	assert.Nil(t, err)
+	_, err = fileSystem.Save(context.Background(), "originals/notes.png", bytes.NewReader([]byte("not an image")), nil)
+	assert.Nil(t, err)
+	encoded.Reset()
+	assert.Nil(t, png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 10, 200))))
+	_, err = fileSystem.Save(context.Background(), "originals/tall.png", &encoded, nil)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		Name                  string
+		Job                   tables.ConversionJobTable
+		Image                 tables.ImageTable
+		ImageError            error
+		NotRun                bool
+		Renditions            []tables.ImageRenditionTable
+		RenditionCalls        int
+		Blocked               bool
+		ExpectedUpdateCalls   int
+		ExpectedQuarantines   int
+		ExpectedSaveCalls     int
+		ExpectedCompleteCalls int
+		ExpectedFailCalls     int
+		ExpectedStatus        string
+		ExpectedRetryAfter    time.Duration
+	}{
+		{
+			Name:                  "Test image is converted",
+			Job:                   tables.ConversionJobTable{JobId: 1, ImageId: 4, Attempts: 1},
+			Image:                 tables.ImageTable{ImageId: 4, PostId: 1, StorageKey: "originals/photo.png"},
+			Renditions:            []tables.ImageRenditionTable{{ImageId: 4, Name: "thumb"}},
+			RenditionCalls:        1,
+			ExpectedUpdateCalls:   1,
+			ExpectedSaveCalls:     1,
+			ExpectedCompleteCalls: 1,
+		},
+		{
+			Name:                  "Test already converted image is completed",
+			Job:                   tables.ConversionJobTable{JobId: 2, ImageId: 5, Attempts: 1},
+			Image:                 tables.ImageTable{ImageId: 5, PostId: 2, StorageKey: "originals/photo.png", BlurHash: "L00000fQfQfQfQfQfQfQfQfQfQfQ", PerceptualHash: sql.NullInt64{Valid: true}},
+			Renditions:            []tables.ImageRenditionTable{{ImageId: 5, Name: "thumb"}, {ImageId: 5, Name: "feed"}},
+			RenditionCalls:        1,
+			ExpectedCompleteCalls: 1,
+		},
+		{
+			Name:                  "Test converted image without a placeholder or hash gets them",
+			Job:                   tables.ConversionJobTable{JobId: 7, ImageId: 10, Attempts: 1},
+			Image:                 tables.ImageTable{ImageId: 10, PostId: 6, StorageKey: "originals/photo.png"},
+			Renditions:            []tables.ImageRenditionTable{{ImageId: 10, Name: "thumb"}, {ImageId: 10, Name: "feed"}},
+			RenditionCalls:        1,
+			ExpectedUpdateCalls:   1,
+			ExpectedCompleteCalls: 1,
+		},
+		{
+			Name:                  "Test image matching the blocklist is quarantined",
+			Job:                   tables.ConversionJobTable{JobId: 8, ImageId: 11, Attempts: 1},
+			Image:                 tables.ImageTable{ImageId: 11, PostId: 7, StorageKey: "originals/blocked.png"},
+			RenditionCalls:        1,
+			Blocked:               true,
+			ExpectedUpdateCalls:   1,
+			ExpectedQuarantines:   1,
+			ExpectedCompleteCalls: 1,
+		},
+		{
+			Name:                  "Test quarantined image is not converted",
+			Job:                   tables.ConversionJobTable{JobId: 9, ImageId: 12, Attempts: 1},
+			Image:                 tables.ImageTable{ImageId: 12, PostId: 8, StorageKey: "quarantine/originals/blocked.png", QuarantinedAt: sql.NullTime{Time: time.Now(), Valid: true}},
+			ExpectedCompleteCalls: 1,
+		},
+		{
+			Name:               "Test failed job is retried with backoff",
+			Job:                tables.ConversionJobTable{JobId: 3, ImageId: 6, Attempts: 2},
+			Image:              tables.ImageTable{ImageId: 6, PostId: 3, StorageKey: "originals/missing.png"},
+			RenditionCalls:     1,
+			ExpectedFailCalls:  1,
+			ExpectedStatus:     tables.CONVERSION_JOB_PENDING,
+			ExpectedRetryAfter: 2 * time.Minute,
+		},
+		{
+			Name:              "Test job of a file that isn't an image is rejected",
+			Job:               tables.ConversionJobTable{JobId: 5, ImageId: 8, Attempts: 1},
+			Image:             tables.ImageTable{ImageId: 8, PostId: 4, StorageKey: "originals/notes.png"},
+			RenditionCalls:    1,
+			ExpectedFailCalls: 1,
+			ExpectedStatus:    tables.CONVERSION_JOB_REJECTED,
+		},
+		{
+			Name:              "Test job of a too large image is rejected",
+			Job:               tables.ConversionJobTable{JobId: 6, ImageId: 9, Attempts: 1},
+			Image:             tables.ImageTable{ImageId: 9, PostId: 5, StorageKey: "originals/tall.png"},
+			RenditionCalls:    1,
+			ExpectedFailCalls: 1,
+			ExpectedStatus:    tables.CONVERSION_JOB_REJECTED,
+		},
+		{
+			Name:              "Test job is dead after max attempts",
+			Job:               tables.ConversionJobTable{JobId: 4, ImageId: 7, Attempts: 3},
+			ImageError:        errors.New("error in database"),
+			ExpectedFailCalls: 1,
+			ExpectedStatus:    tables.CONVERSION_JOB_DEAD,
+		},
+		{
+			Name:              "Test job over max attempts is dead without running",
+			Job:               tables.ConversionJobTable{JobId: 10, ImageId: 13, Attempts: 4},
+			NotRun:            true,
+			ExpectedFailCalls: 1,
+			ExpectedStatus:    tables.CONVERSION_JOB_DEAD,
+		},
+	}
+
+	config := config.Config{
+		ConversionMaxAttempts:    3,
+		ConversionRetryBaseDelay: time.Minute,
+		ConversionRetryMaxDelay:  time.Hour,
+		ConversionLeaseDuration:  time.Minute,
+		ImageMaxHeight:           100,
+		BlocklistMaxDistance:     4,
+		Renditions: config.Renditions{
+			{Name: "thumb", Width: 15, Height: 15},
+			{Name: "feed", Width: 60, Height: 60},
+		},
+	}
+	database := mocks.NewMockDatabase(ctrl)
+	convertor := NewImageConvertorService(&config, database, fileSystem, NewDecodeOptions(&config))
+	for _, test := range tests {
+		job := test.Job
+		job.Status = tables.CONVERSION_JOB_RUNNING
+		job.LeaseOwner = convertor.Owner + "-0123456789abcdef"
+		database.EXPECT().ClaimConversionJobs(leaseOf(convertor.Owner), 1, time.Minute, 3).Return([]tables.ConversionJobTable{job}, nil).Times(1)
+		imageCalls := 1
+		if test.NotRun {
+			imageCalls = 0
+		}
+		database.EXPECT().GetImage(test.Job.ImageId).Return(test.Image, test.ImageError).Times(imageCalls)
+		database.EXPECT().GetImageRenditions(test.Job.ImageId).Return(test.Renditions, nil).Times(test.RenditionCalls)
+		database.EXPECT().SaveImageMetadata(gomock.Any()).DoAndReturn(func(metadata tables.ImageMetadataTable) error {
+			assert.Equal(t, test.Job.ImageId, metadata.ImageId, test.Name)
+			assert.False(t, metadata.CapturedAt.Valid, test.Name)
+			return nil
+		}).Times(test.ExpectedUpdateCalls)
+		database.EXPECT().SaveImagePlaceholder(gomock.Any()).DoAndReturn(func(placeholder tables.ImageTable) error {
+			assert.Equal(t, test.Job.ImageId, placeholder.ImageId, test.Name)
+			assert.Equal(t, 20, placeholder.Width, test.Name)
+			assert.Equal(t, 10, placeholder.Height, test.Name)
+			assert.Len(t, placeholder.BlurHash, 28, test.Name)
+			assert.Equal(t, "#ffffff", placeholder.DominantColor, test.Name)
+			return nil
+		}).Times(test.ExpectedUpdateCalls)
+		database.EXPECT().SaveImageHash(test.Job.ImageId, uint64(0)).Return(nil).Times(test.ExpectedUpdateCalls)
+		blocked, blockedError := tables.BlockedHashTable{BlockedHashId: 2}, error(nil)
+		if !test.Blocked {
+			blocked, blockedError = tables.BlockedHashTable{}, sql.ErrNoRows
+		}
+		database.EXPECT().GetBlockedHashMatch(uint64(0), 4).Return(blocked, 1, blockedError).Times(test.ExpectedUpdateCalls)
+		database.EXPECT().QuarantineImages(test.Image.StorageKey, "quarantine/"+test.Image.StorageKey, gomock.Any(), tables.ModerationEventTable{
+			Action:        tables.MODERATION_ACTION_QUARANTINED,
+			Source:        tables.MODERATION_SOURCE_CONVERTER,
+			BlockedHashId: 2,
+			Distance:      1,
+		}).Return([]tables.ImageTable{{ImageId: test.Image.ImageId, PostId: test.Image.PostId}}, nil).Times(test.ExpectedQuarantines)
+		// Only the missing feed rendition is produced
+		database.EXPECT().SaveImageRenditions(gomock.Any()).DoAndReturn(func(renditions []tables.ImageRenditionTable) error {
+			assert.Len(t, renditions, 1, test.Name)
+			assert.Equal(t, "feed", renditions[0].Name, test.Name)
+			assert.Equal(t, "converted/4/feed.jpg", renditions[0].StorageKey, test.Name)
+			return nil
+		}).Times(test.ExpectedSaveCalls)
+		database.EXPECT().CompleteConversionJob(job).Return(nil).Times(test.ExpectedCompleteCalls)
+		database.EXPECT().FailConversionJob(gomock.Any(), test.ExpectedRetryAfter).DoAndReturn(func(failed tables.ConversionJobTable, retryAfter time.Duration) error {
+			assert.Equal(t, test.ExpectedStatus, failed.Status, test.Name)
+			assert.NotEmpty(t, failed.LastError, test.Name)
+			return nil
+		}).Times(test.ExpectedFailCalls)
+
+		count, err := convertor.RunConversionJobs(context.Background(), 1)
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, 1, count, test.Name)
+	}
+
+	// The blocked original is moved into quarantine and its renditions are gone
+	keys, err := fileSystem.List("")
+	assert.Nil(t, err)
+	assert.Contains(t, keys, "quarantine/originals/blocked.png")
+	assert.NotContains(t, keys, "originals/blocked.png")
+	for _, key := range keys {
+		assert.NotContains(t, key, "converted/11/")
+	}
+}
+
+func TestRunPostConversionJob(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	config := config.Config{ConversionLeaseDuration: time.Minute, ConversionMaxAttempts: 3}
+	database := mocks.NewMockDatabase(ctrl)
+	convertor := NewImageConvertorService(&config, database, nil, NewDecodeOptions(&config))
+
+	// Only the job of the post is claimed
+	var job tables.ConversionJobTable
+	database.EXPECT().ClaimPostConversionJob(leaseOf(convertor.Owner), int64(7), time.Minute, 3).DoAndReturn(
+		func(owner string, postId int64, lease time.Duration, maxAttempts int) (tables.ConversionJobTable, error) {
+			job = tables.ConversionJobTable{JobId: 1, ImageId: 4, Status: tables.CONVERSION_JOB_RUNNING, Attempts: 1, LeaseOwner: owner}
+			return job, nil
+		}).Times(1)
+	database.EXPECT().GetImage(int64(4)).Return(tables.ImageTable{ImageId: 4, PostId: 7, QuarantinedAt: sql.NullTime{Time: time.Now(), Valid: true}}, nil).Times(1)
+	database.EXPECT().CompleteConversionJob(gomock.Any()).DoAndReturn(func(completed tables.ConversionJobTable) error {
+		assert.Equal(t, job, completed)
+		return nil
+	}).Times(1)
+	ran, err := convertor.RunPostConversionJob(context.Background(), 7)
+	assert.Nil(t, err)
+	assert.True(t, ran)
+
+	// Every claim leases under a token of its own, even within a process
+	database.EXPECT().ClaimPostConversionJob(leaseOf(convertor.Owner), int64(7), time.Minute, 3).DoAndReturn(
+		func(owner string, postId int64, lease time.Duration, maxAttempts int) (tables.ConversionJobTable, error) {
+			assert.NotEqual(t, job.LeaseOwner, owner)
+			return tables.ConversionJobTable{}, sql.ErrNoRows
+		}).Times(1)
+	ran, err = convertor.RunPostConversionJob(context.Background(), 7)
+	assert.Nil(t, err)
+	assert.False(t, ran)
+
+	// The job isn't due or another worker has it
+	database.EXPECT().ClaimPostConversionJob(leaseOf(convertor.Owner), int64(8), time.Minute, 3).Return(tables.ConversionJobTable{}, sql.ErrNoRows).Times(1)
+	ran, err = convertor.RunPostConversionJob(context.Background(), 8)
+	assert.Nil(t, err)
+	assert.False(t, ran)
+
+	database.EXPECT().ClaimPostConversionJob(leaseOf(convertor.Owner), int64(9), time.Minute, 3).Return(tables.ConversionJobTable{}, errors.New("error in database")).Times(1)
+	ran, err = convertor.RunPostConversionJob(context.Background(), 9)
+	assert.NotNil(t, err)
+	assert.False(t, ran)
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Attempts      int
+		ExpectedDelay time.Duration
+	}{
+		{Name: "Test first attempt", Attempts: 1, ExpectedDelay: 30 * time.Second},
+		{Name: "Test delay doubles", Attempts: 3, ExpectedDelay: 2 * time.Minute},
+		{Name: "Test delay is capped", Attempts: 10, ExpectedDelay: 5 * time.Minute},
+		{Name: "Test huge attempt count", Attempts: 1000, ExpectedDelay: 5 * time.Minute},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.ExpectedDelay, retryDelay(test.Attempts, 30*time.Second, 5*time.Minute), test.Name)
+	}
+}
+
+func TestRequeueConversionJob(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		Name             string
+		JobId            int64
+		RequeueError     error
+		ExpectedResponse RequeueResponse
+		ExpectedError    error
+	}{
+		{
+			Name:             "Test dead job is requeued",
+			JobId:            1,
+			ExpectedResponse: RequeueResponse{Requeued: 1, Success: true},
+		},
+		{
+			Name:          "Test job is not dead",
+			JobId:         2,
+			RequeueError:  sql.ErrNoRows,
+			ExpectedError: ErrConversionJobNotFound,
+		},
+		{
+			Name:          "Test database error",
+			JobId:         3,
+			RequeueError:  errors.New("error in database"),
+			ExpectedError: errors.New("error in requeueing conversion job - error in database"),
+		},
+	}
+
+	database := mocks.NewMockDatabase(ctrl)
+	convertor := NewImageConvertorService(&config.Config{}, database, nil, converter.DecodeOptions{})
+	for _, test := range tests {
+		database.EXPECT().RequeueConversionJob(test.JobId).Return(test.RequeueError).Times(1)
+		response, err := convertor.RequeueConversionJob(test.JobId)
+		assert.Equal(t, test.ExpectedResponse, response, test.Name)
+		if test.ExpectedError == nil {
+			assert.Nil(t, err, test.Name)
+		} else {
+			assert.EqualError(t, err, test.ExpectedError.Error(), test.Name)
+		}
+	}
+}
+
+func TestRunConversionWorkersStopsWhenCancelled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	config := config.Config{ConversionLeaseDuration: time.Minute, ConversionMaxAttempts: 3}
+	database := mocks.NewMockDatabase(ctrl)
+	convertor := NewImageConvertorService(&config, database, nil, NewDecodeOptions(&config))
+	database.EXPECT().ClaimConversionJobs(leaseOf(convertor.Owner), 1, time.Minute, 3).Return(nil, nil).MinTimes(2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		convertor.RunConversionWorkers(ctx, context.Background(), 2, time.Hour)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("conversion workers did not stop")
+	}
+}
+
+// leaseMatcher matches the lease owner of a claim by a process's workers
+type leaseMatcher struct {
+	owner string
+}
+
+func leaseOf(owner string) gomock.Matcher {
+	return leaseMatcher{owner: owner}
+}
+
+func (m leaseMatcher) Matches(x interface{}) bool {
+	lease, ok := x.(string)
+	return ok && strings.HasPrefix(lease, m.owner+"-") && len(lease) > len(m.owner)+1
+}
+
+func (m leaseMatcher) String() string {
+	return "is leased by " + m.owner
+}
@@ -0,0 +1,434 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/database"
+	"github.com/ksindhwani/imagegram/pkg/filesystem"
+	"github.com/ksindhwani/imagegram/pkg/internal/converter"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/pagination"
+)
+
+// Originals of quarantined images are moved under this prefix, out of reach of the
+// public endpoints but kept for review
+const QUARANTINE_SUBDIRECTORY = "quarantine"
+
+const (
+	// Images posted before a hash was blocked are quarantined this many at a time
+	quarantinePageSize = 100
+	maxReasonLength    = 255
+)
+
+var (
+	ErrBlockedHashNotFound   = errors.New("no blocked hash found with the given id")
+	ErrInvalidBlocklistEntry = errors.New("invalid blocklist entry")
+)
+
+// BlockedImageError refuses an upload matching the blocklist
+type BlockedImageError struct {
+	BlockedHashId int64
+	Distance      int
+}
+
+func (e *BlockedImageError) Error() string {
+	return fmt.Sprintf("image matches blocked hash %d", e.BlockedHashId)
+}
+
+type ModerationService struct {
+	Config     config.Config
+	Database   database.Database
+	FileSystem filesystem.FileSystem
+	Paginator  *pagination.Paginator
+}
+
+func NewModerationService(
+	Config *config.Config,
+	database database.Database,
+	fileSystem filesystem.FileSystem,
+) *ModerationService {
+	return &ModerationService{
+		Config:     *Config,
+		Database:   database,
+		FileSystem: fileSystem,
+		Paginator:  pagination.New(Config.CursorSecret, Config.DefaultPageSize, Config.MaxPageSize),
+	}
+}
+
+type BlockedHash struct {
+	BlockedHashId int64      `json:"blockedHashId"`
+	Hash          string     `json:"hash"` // 16 hex digits
+	Reason        string     `json:"reason,omitempty"`
+	CreatedAt     *time.Time `json:"createdAt,omitempty"` // missing for hashes just added
+}
+
+type ModerationEvent struct {
+	EventId       int64     `json:"eventId"`
+	Action        string    `json:"action"`
+	Source        string    `json:"source"`
+	BlockedHashId int64     `json:"blockedHashId"`
+	Distance      int       `json:"distance"`
+	ImageId       int64     `json:"imageId,omitempty"`
+	PostId        int64     `json:"postId,omitempty"`
+	UserId        int64     `json:"userId,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type BlocklistResponse struct {
+	Added       []BlockedHash `json:"added"`
+	Existing    int           `json:"existing"`    // hashes that were on the blocklist already
+	Quarantined int           `json:"quarantined"` // images already posted that matched the added hashes
+	Success     bool          `json:"success"`
+}
+
+// FormatHash writes a perceptual hash the way the blocklist takes it, as 16 hex digits
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func ParseHash(value string) (uint64, error) {
+	if len(value) != 16 {
+		return 0, fmt.Errorf("%w - %q should be 16 hex digits", ErrInvalidBlocklistEntry, value)
+	}
+	hash, err := strconv.ParseUint(value, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w - %q should be 16 hex digits", ErrInvalidBlocklistEntry, value)
+	}
+	return hash, nil
+}
+
+// Read a blocklist import, one hash per line optionally followed by a reason. Blank
+// lines and lines starting with # are skipped.
+func ParseBlocklist(reader io.Reader) ([]tables.BlockedHashTable, error) {
+	var hashes []tables.BlockedHashTable
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		value, reason := text, ""
+		if i := strings.IndexAny(text, " \t"); i >= 0 {
+			value, reason = text[:i], text[i+1:]
+		}
+		hash, err := ParseHash(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		blocked, err := blockedHashRow(hash, reason)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		hashes = append(hashes, blocked)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func blockedHashRow(hash uint64, reason string) (tables.BlockedHashTable, error) {
+	reason = strings.TrimSpace(reason)
+	if len(reason) > maxReasonLength {
+		return tables.BlockedHashTable{}, fmt.Errorf("%w - reason is longer than %d characters", ErrInvalidBlocklistEntry, maxReasonLength)
+	}
+	return tables.BlockedHashTable{PerceptualHash: hash, Reason: reason}, nil
+}
+
+// Add hashes to the blocklist and quarantine the images already posted that match them
+func (ms *ModerationService) BlockHashes(ctx context.Context, hashes []tables.BlockedHashTable) (BlocklistResponse, error) {
+	added, err := ms.Database.SaveBlockedHashes(hashes)
+	if err != nil {
+		return BlocklistResponse{}, fmt.Errorf("error in saving blocked hashes - %w", err)
+	}
+	response := BlocklistResponse{
+		Added:    make([]BlockedHash, len(added)),
+		Existing: len(hashes) - len(added),
+		Success:  true,
+	}
+	for i, blocked := range added {
+		response.Added[i] = blockedHash(blocked)
+		quarantined, err := ms.quarantineMatches(ctx, blocked)
+		response.Quarantined += quarantined
+		if err != nil {
+			return response, fmt.Errorf("error in quarantining images matching blocked hash %d - %w", blocked.BlockedHashId, err)
+		}
+	}
+	return response, nil
+}
+
+// Add a hash written as 16 hex digits to the blocklist, see BlockHashes
+func (ms *ModerationService) BlockHash(ctx context.Context, value string, reason string) (BlocklistResponse, error) {
+	hash, err := ParseHash(value)
+	if err != nil {
+		return BlocklistResponse{}, err
+	}
+	blocked, err := blockedHashRow(hash, reason)
+	if err != nil {
+		return BlocklistResponse{}, err
+	}
+	return ms.BlockHashes(ctx, []tables.BlockedHashTable{blocked})
+}
+
+// Add the perceptual hash of an image already posted to the blocklist.
+// ErrImageNotConverted is returned until the image is hashed.
+func (ms *ModerationService) BlockImage(ctx context.Context, imageId int64, reason string) (BlocklistResponse, error) {
+	image, err := ms.Database.GetImage(imageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return BlocklistResponse{}, ErrImageNotFound
+	}
+	if err != nil {
+		return BlocklistResponse{}, fmt.Errorf("unable to fetch image from database - %w", err)
+	}
+	if !image.PerceptualHash.Valid {
+		return BlocklistResponse{}, ErrImageNotConverted
+	}
+	blocked, err := blockedHashRow(uint64(image.PerceptualHash.Int64), reason)
+	if err != nil {
+		return BlocklistResponse{}, err
+	}
+	return ms.BlockHashes(ctx, []tables.BlockedHashTable{blocked})
+}
+
+// Quarantine the posted images within BLOCKLIST_MAX_DISTANCE of a newly blocked hash.
+// Quarantined images drop out of the search, so it is repeated until none is left.
+func (ms *ModerationService) quarantineMatches(ctx context.Context, blocked tables.BlockedHashTable) (int, error) {
+	count := 0
+	for {
+		matches, err := ms.Database.GetSimilarImages(blocked.PerceptualHash, ms.Config.BlocklistMaxDistance, quarantinePageSize)
+		if err != nil || len(matches) == 0 {
+			return count, err
+		}
+		progress := 0
+		for _, match := range matches {
+			image, err := ms.Database.GetImage(match.ImageId)
+			if err != nil {
+				return count, err
+			}
+			quarantined, err := ms.Quarantine(ctx, image, blocked, match.Distance, tables.MODERATION_SOURCE_BLOCKLIST)
+			if err != nil {
+				return count, err
+			}
+			count += quarantined
+			progress += quarantined
+		}
+		if progress == 0 {
+			return count, nil
+		}
+	}
+}
+
+// Find the blocked hash closest to hash, ok is false when none is within
+// BLOCKLIST_MAX_DISTANCE
+func (ms *ModerationService) Match(hash uint64) (blocked tables.BlockedHashTable, distance int, ok bool, err error) {
+	blocked, distance, err = ms.Database.GetBlockedHashMatch(hash, ms.Config.BlocklistMaxDistance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return tables.BlockedHashTable{}, 0, false, nil
+	}
+	if err != nil {
+		return tables.BlockedHashTable{}, 0, false, fmt.Errorf("error in matching the blocklist - %w", err)
+	}
+	return blocked, distance, true, nil
+}
+
+// Refuse an upload matching the blocklist with a BlockedImageError and record it
+func (ms *ModerationService) CheckUpload(userId int64, hash uint64) error {
+	blocked, distance, ok, err := ms.Match(hash)
+	if err != nil || !ok {
+		return err
+	}
+	err = ms.Database.SaveModerationEvent(tables.ModerationEventTable{
+		Action:        tables.MODERATION_ACTION_REJECTED,
+		Source:        tables.MODERATION_SOURCE_UPLOAD,
+		BlockedHashId: blocked.BlockedHashId,
+		Distance:      distance,
+		UserId:        sql.NullInt64{Int64: userId, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("error in saving moderation event - %w", err)
+	}
+	return &BlockedImageError{BlockedHashId: blocked.BlockedHashId, Distance: distance}
+}
+
+// Quarantine an image when its perceptual hash matches the blocklist. Returns
+// whether it matched.
+func (ms *ModerationService) QuarantineIfBlocked(ctx context.Context, image tables.ImageTable, hash uint64, source string) (bool, error) {
+	blocked, distance, ok, err := ms.Match(hash)
+	if err != nil || !ok {
+		return false, err
+	}
+	if _, err := ms.Quarantine(ctx, image, blocked, distance, source); err != nil {
+		return true, fmt.Errorf("error in quarantining image - %w", err)
+	}
+	return true, nil
+}
+
+// Hide an image and every other image sharing its original. The original is moved
+// under QUARANTINE_SUBDIRECTORY, the renditions and derivatives are deleted and a
+// moderation event is recorded for each image. Returns the number of images
+// quarantined.
+func (ms *ModerationService) Quarantine(ctx context.Context, image tables.ImageTable, blocked tables.BlockedHashTable, distance int, source string) (int, error) {
+	if image.QuarantinedAt.Valid {
+		return 0, nil
+	}
+	quarantineKey := path.Join(QUARANTINE_SUBDIRECTORY, image.StorageKey)
+	// Copied first so the images never point at a missing original. An original
+	// that is already gone leaves nothing to keep, the images are hidden anyway.
+	location, err := filesystem.Copy(ctx, ms.FileSystem, image.StorageKey, quarantineKey, map[string]string{
+		"original-filename": image.ImageFileName,
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, fmt.Errorf("unable to copy original into quarantine - %w", err)
+	}
+	quarantined, err := ms.Database.QuarantineImages(image.StorageKey, quarantineKey, location, tables.ModerationEventTable{
+		Action:        tables.MODERATION_ACTION_QUARANTINED,
+		Source:        source,
+		BlockedHashId: blocked.BlockedHashId,
+		Distance:      distance,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to quarantine images in database - %w", err)
+	}
+	if len(quarantined) == 0 {
+		return 0, nil
+	}
+
+	ms.deleteFile(image.StorageKey)
+	for _, image := range quarantined {
+		log.Printf("image %d of post %d is quarantined, it matches blocked hash %d", image.ImageId, image.PostId, blocked.BlockedHashId)
+		imageDirectory := strconv.FormatInt(image.ImageId, 10) + "/"
+		for _, prefix := range []string{
+			path.Join(converter.CONVERTED_IMAGE_SUBDIRECTORY, imageDirectory) + "/",
+			path.Join(DERIVATIVE_SUBDIRECTORY, imageDirectory) + "/",
+		} {
+			keys, err := ms.FileSystem.List(prefix)
+			if err != nil {
+				log.Printf("unable to list %s of quarantined image: %s", prefix, err.Error())
+				continue
+			}
+			for _, key := range keys {
+				ms.deleteFile(key)
+			}
+		}
+	}
+	return len(quarantined), nil
+}
+
+func (ms *ModerationService) deleteFile(key string) {
+	if err := ms.FileSystem.Delete(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("unable to delete %s of quarantined image: %s", key, err.Error())
+	}
+}
+
+// Remove a hash from the blocklist, images quarantined because of it stay quarantined
+func (ms *ModerationService) UnblockHash(blockedHashId int64) error {
+	err := ms.Database.DeleteBlockedHash(blockedHashId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrBlockedHashNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error in deleting blocked hash - %w", err)
+	}
+	return nil
+}
+
+// Get a page of the blocklist, newest first
+func (ms *ModerationService) GetBlockedHashes(cursor *pagination.Cursor, pageSize int) (pagination.Page, error) {
+	// Fetch one extra row to know whether another page exists
+	rows, err := ms.Database.GetBlockedHashes(cursor, pageSize+1)
+	if err != nil {
+		return pagination.Page{}, fmt.Errorf("error in fetching blocked hashes - %w", err)
+	}
+	hasMore := len(rows) > pageSize
+	if hasMore {
+		rows = rows[:pageSize]
+	}
+
+	hashes := make([]BlockedHash, len(rows))
+	for i, row := range rows {
+		index := i
+		if cursor.IsPrev() {
+			// Previous pages are read in ascending order
+			index = len(rows) - 1 - i
+		}
+		hashes[index] = blockedHash(row)
+	}
+
+	var first, last *pagination.Cursor
+	if len(hashes) > 0 {
+		first = idCursor(hashes[0].BlockedHashId)
+		last = idCursor(hashes[len(hashes)-1].BlockedHashId)
+	}
+	return ms.Paginator.NewPage(hashes, cursor, first, last, hasMore), nil
+}
+
+// Get a page of moderation events, newest first
+func (ms *ModerationService) GetModerationEvents(cursor *pagination.Cursor, pageSize int) (pagination.Page, error) {
+	// Fetch one extra row to know whether another page exists
+	rows, err := ms.Database.GetModerationEvents(cursor, pageSize+1)
+	if err != nil {
+		return pagination.Page{}, fmt.Errorf("error in fetching moderation events - %w", err)
+	}
+	hasMore := len(rows) > pageSize
+	if hasMore {
+		rows = rows[:pageSize]
+	}
+
+	events := make([]ModerationEvent, len(rows))
+	for i, row := range rows {
+		index := i
+		if cursor.IsPrev() {
+			// Previous pages are read in ascending order
+			index = len(rows) - 1 - i
+		}
+		events[index] = ModerationEvent{
+			EventId:       row.EventId,
+			Action:        row.Action,
+			Source:        row.Source,
+			BlockedHashId: row.BlockedHashId,
+			Distance:      row.Distance,
+			ImageId:       row.ImageId.Int64,
+			PostId:        row.PostId.Int64,
+			UserId:        row.UserId.Int64,
+			CreatedAt:     row.CreatedAt,
+		}
+	}
+
+	var first, last *pagination.Cursor
+	if len(events) > 0 {
+		first = idCursor(events[0].EventId)
+		last = idCursor(events[len(events)-1].EventId)
+	}
+	return ms.Paginator.NewPage(events, cursor, first, last, hasMore), nil
+}
+
+func blockedHash(row tables.BlockedHashTable) BlockedHash {
+	hash := BlockedHash{
+		BlockedHashId: row.BlockedHashId,
+		Hash:          FormatHash(row.PerceptualHash),
+		Reason:        row.Reason,
+	}
+	if !row.CreatedAt.IsZero() {
+		hash.CreatedAt = &row.CreatedAt
+	}
+	return hash
+}
+
+func idCursor(id int64) *pagination.Cursor {
+	return &pagination.Cursor{
+		SortKey: id,
+		Id:      id,
+	}
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/database"
+	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	tests := []struct {
+		Name               string
+		Input              string
+		ExpectedResponse   []tables.BlockedHashTable
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:  "Test hashes with and without reasons",
+			Input: "# exported from review\n\n00ff00ff00ff00ff\nFFFFFFFFFFFFFFFE\tspam wave 12\n  0000000000000001  \n",
+			ExpectedResponse: []tables.BlockedHashTable{
+				{PerceptualHash: 0x00ff00ff00ff00ff},
+				{PerceptualHash: 0xfffffffffffffffe, Reason: "spam wave 12"},
+				{PerceptualHash: 1},
+			},
+		},
+		{Name: "Test empty file", Input: "\n# nothing yet\n"},
+		{Name: "Test short hash", Input: "00ff00ff\n", ExpectedErrorMatch: ErrInvalidBlocklistEntry},
+		{Name: "Test hash that isn't hex", Input: "00ff00ff00ff00fg\n", ExpectedErrorMatch: ErrInvalidBlocklistEntry},
+		{Name: "Test reason too long", Input: "00ff00ff00ff00ff " + strings.Repeat("x", 256), ExpectedErrorMatch: ErrInvalidBlocklistEntry},
+	}
+	for _, test := range tests {
+		hashes, err := ParseBlocklist(strings.NewReader(test.Input))
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorIs(t, err, test.ExpectedErrorMatch, test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedResponse, hashes, test.Name)
+	}
+	assert.Equal(t, "00ff00ff00ff00ff", FormatHash(0x00ff00ff00ff00ff))
+}
+
+func TestBlockHashesQuarantinesPostedImages(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fileSystem := local.New("test host directory", t.TempDir())
+	for _, key := range []string{
+		"originals/ab/cd/abcd.png",
+		"converted/3/feed.jpg",
+		"converted/30/feed.jpg",
+		"derivatives/3/100x0-fit-q0.jpg",
+	} {
+		_, err := fileSystem.Save(context.Background(), key, strings.NewReader("bytes of "+key), nil)
+		assert.Nil(t, err)
+	}
+
+	config := config.Config{BlocklistMaxDistance: 4}
+	db := mocks.NewMockDatabase(ctrl)
+	moderationService := NewModerationService(&config, db, fileSystem)
+
+	hashes := []tables.BlockedHashTable{{PerceptualHash: 0xff}, {PerceptualHash: 0xf0, Reason: "known"}}
+	db.EXPECT().SaveBlockedHashes(hashes).Return([]tables.BlockedHashTable{{BlockedHashId: 7, PerceptualHash: 0xff}}, nil).Times(1)
+	gomock.InOrder(
+		db.EXPECT().GetSimilarImages(uint64(0xff), 4, quarantinePageSize).Return([]database.SimilarImageResult{{ImageId: 3, PostId: 2, Distance: 1}}, nil),
+		db.EXPECT().GetSimilarImages(uint64(0xff), 4, quarantinePageSize).Return(nil, nil),
+	)
+	db.EXPECT().GetImage(int64(3)).Return(tables.ImageTable{ImageId: 3, PostId: 2, StorageKey: "originals/ab/cd/abcd.png"}, nil).Times(1)
+	// Image 4 shares the original of image 3 and is quarantined with it
+	db.EXPECT().QuarantineImages("originals/ab/cd/abcd.png", "quarantine/originals/ab/cd/abcd.png", gomock.Any(), tables.ModerationEventTable{
+		Action:        tables.MODERATION_ACTION_QUARANTINED,
+		Source:        tables.MODERATION_SOURCE_BLOCKLIST,
+		BlockedHashId: 7,
+		Distance:      1,
+	}).Return([]tables.ImageTable{{ImageId: 3, PostId: 2}, {ImageId: 4, PostId: 5}}, nil).Times(1)
+
+	response, err := moderationService.BlockHashes(context.Background(), hashes)
+	assert.Nil(t, err)
+	assert.Equal(t, BlocklistResponse{
+		Added:       []BlockedHash{{BlockedHashId: 7, Hash: "00000000000000ff"}},
+		Existing:    1,
+		Quarantined: 2,
+		Success:     true,
+	}, response)
+
+	keys, err := fileSystem.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"converted/30/feed.jpg", "quarantine/originals/ab/cd/abcd.png"}, keys)
+}
+
+func TestCheckUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		Name               string
+		MatchResponse      tables.BlockedHashTable
+		MatchDistance      int
+		MatchError         error
+		ExpectedEventCalls int
+		ExpectedError      error
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:               "Test upload matching the blocklist is refused",
+			MatchResponse:      tables.BlockedHashTable{BlockedHashId: 7},
+			MatchDistance:      2,
+			ExpectedEventCalls: 1,
+			ExpectedError:      &BlockedImageError{BlockedHashId: 7, Distance: 2},
+		},
+		{Name: "Test upload not on the blocklist", MatchError: sql.ErrNoRows},
+		{Name: "Test error in matching", MatchError: errors.New("connection refused"), ExpectedErrorMatch: errors.New("connection refused")},
+	}
+
+	config := config.Config{BlocklistMaxDistance: 3}
+	db := mocks.NewMockDatabase(ctrl)
+	moderationService := NewModerationService(&config, db, nil)
+	for _, test := range tests {
+		db.EXPECT().GetBlockedHashMatch(uint64(0xabc), 3).Return(test.MatchResponse, test.MatchDistance, test.MatchError).Times(1)
+		db.EXPECT().SaveModerationEvent(tables.ModerationEventTable{
+			Action:        tables.MODERATION_ACTION_REJECTED,
+			Source:        tables.MODERATION_SOURCE_UPLOAD,
+			BlockedHashId: 7,
+			Distance:      2,
+			UserId:        sql.NullInt64{Int64: 9, Valid: true},
+		}).Return(nil).Times(test.ExpectedEventCalls)
+
+		err := moderationService.CheckUpload(9, 0xabc)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorContains(t, err, test.ExpectedErrorMatch.Error(), test.Name)
+			continue
+		}
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+	}
+}
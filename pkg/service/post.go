@@ -1,31 +1,57 @@
 package service
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"mime/multipart"
+	"io"
+	"log"
 	"time"
 
 	"github.com/ksindhwani/imagegram/pkg/config"
 	"github.com/ksindhwani/imagegram/pkg/database"
 	"github.com/ksindhwani/imagegram/pkg/filesystem"
+	"github.com/ksindhwani/imagegram/pkg/internal/converter"
 	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/pagination"
 )
 
 type PostService struct {
-	Config     config.Config
-	Database   database.Database
-	FileSystem filesystem.FileSystem
+	Config          config.Config
+	Database        database.Database
+	FileSystem      filesystem.FileSystem
+	Paginator       *pagination.Paginator
+	ConversionQueue ConversionQueue
+	// DecodeOptions checks uploads the same way the converter checks what it decodes,
+	// uploads hashed are decoded within the same bounds, see NewDecodeOptions
+	DecodeOptions converter.DecodeOptions
+	// Moderation refuses uploads matching the blocklist
+	Moderation *ModerationService
+	// DecodeWait is the longest an upload waits to be decoded before it is refused
+	DecodeWait time.Duration
 }
 
+// Uploads are hashed while the client waits, they are refused rather than queued
+// behind the conversions for long
+const uploadDecodeWait = 2 * time.Second
+
 func NewPostService(
 	Config *config.Config,
 	database database.Database,
 	fileSystem filesystem.FileSystem,
+	conversionQueue ConversionQueue,
+	decodeOptions converter.DecodeOptions,
 ) *PostService {
 	return &PostService{
-		Config:     *Config,
-		Database:   database,
-		FileSystem: fileSystem,
+		Config:          *Config,
+		Database:        database,
+		FileSystem:      fileSystem,
+		Paginator:       pagination.New(Config.CursorSecret, Config.DefaultPageSize, Config.MaxPageSize),
+		ConversionQueue: conversionQueue,
+		DecodeOptions:   decodeOptions,
+		Moderation:      NewModerationService(Config, database, fileSystem),
+		DecodeWait:      uploadDecodeWait,
 	}
 }
 
@@ -36,91 +62,321 @@ type Post struct {
 }
 
 type PostCommentResponse struct {
-	PostId        int64     `json:"postId"`
-	UserId        int64     `json:"userId"`
-	Caption       string    `json:"caption"`
-	ImageName     string    `json:"imageName"`
-	ImageLocation string    `json:"imageLocation"`
-	CreatedAt     time.Time `json:"createdAt"`
-	Comments      []Comment `json:"comments"`
+	PostId       int64             `json:"postId"`
+	UserId       int64             `json:"userId"`
+	Caption      string            `json:"caption"`
+	ImageName    string            `json:"imageName"`
+	ImageUrl     string            `json:"imageUrl"`
+	ImageUrls    map[string]string `json:"imageUrls"`             // url of every rendition by name
+	Placeholder  *ImagePlaceholder `json:"placeholder,omitempty"` // missing until the image is converted
+	CommentCount int64             `json:"commentCount"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	Comments     []Comment         `json:"comments"`
+}
+
+// ImagePlaceholder lets clients draw a post before its image arrives
+type ImagePlaceholder struct {
+	BlurHash      string `json:"blurHash"`
+	DominantColor string `json:"dominantColor"`
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
 }
+
 type PostResponse struct {
-	PostId  int64 `json:"postId"`
-	Success bool  `json:"success"`
+	PostId      int64 `json:"postId"`
+	Success     bool  `json:"success"`
+	DuplicateOf int64 `json:"duplicateOf,omitempty"` // image the upload is a near duplicate of, see DUPLICATE_POLICY
+}
+
+// Create a post with its image. The image is stored under a key derived from its
+// content, identical bytes uploaded again reuse the stored original.
+func (ps *PostService) CreateNewPost(ctx context.Context, post Post, fileName string, file io.Reader) (PostResponse, error) {
+	upload, err := ps.StageUpload(ctx, fileName, file)
+	if err != nil {
+		return PostResponse{}, err
+	}
+	defer upload.Close()
+	return ps.CreateStagedPost(ctx, post, upload)
+}
+
+// Hash an upload and stage it so the post can be created once the rest of the
+// request is read. Uploads over UPLOAD_MAX_BYTES fail with ErrUploadTooLarge. The
+// caller closes the upload.
+func (ps *PostService) StageUpload(ctx context.Context, fileName string, file io.Reader) (*StagedUpload, error) {
+	upload, err := stageContent(ctx, ps.FileSystem, fileName, file, ps.Config.UploadMaxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error in reading file - %w", err)
+	}
+	return upload, nil
+}
+
+// Stage an upload whose header is too large to check as it streams in, see
+// decoder.ErrHeaderTooLarge, and check the staged copy instead. The caller closes
+// the upload.
+func (ps *PostService) StageAndValidate(ctx context.Context, fileName string, file io.Reader) (*StagedUpload, error) {
+	upload, err := ps.StageUpload(ctx, fileName, file)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := ps.DecodeOptions.Validate(upload.content, fileName); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	return upload, nil
 }
 
-func (ps *PostService) CreateNewPost(post Post, fileName string, file multipart.File) (PostResponse, error) {
-	destinatinoUrl, err := ps.FileSystem.SaveFile(fileName, file)
+// Create a post with an image staged by StageUpload
+func (ps *PostService) CreateStagedPost(ctx context.Context, post Post, upload *StagedUpload) (PostResponse, error) {
+	var hash uint64
+	var err error
+	checkDuplicates := ps.Config.DuplicatePolicy != config.DUPLICATE_POLICY_OFF && ps.Config.DuplicatePolicy != ""
+	checkBlocklist := ps.Config.BlocklistCheckUploads
+	if checkBlocklist {
+		// Uploads aren't decoded to be matched against an empty blocklist
+		checkBlocklist, err = ps.Database.HasBlockedHashes()
+		if err != nil {
+			return PostResponse{}, fmt.Errorf("error in reading blocklist - %w", err)
+		}
+	}
+	if checkBlocklist || checkDuplicates {
+		hash, err = ps.perceptualHash(ctx, upload.content)
+		if err != nil {
+			return PostResponse{}, fmt.Errorf("error in hashing image - %w", err)
+		}
+	}
+	if checkBlocklist {
+		if err := ps.Moderation.CheckUpload(post.UserId, hash); err != nil {
+			return PostResponse{}, err
+		}
+	}
+	var duplicate *database.SimilarImageResult
+	if checkDuplicates {
+		duplicate, err = ps.findDuplicate(hash)
+		if err != nil {
+			return PostResponse{}, fmt.Errorf("error in checking for duplicates - %w", err)
+		}
+	}
+	if duplicate != nil && ps.Config.DuplicatePolicy == config.DUPLICATE_POLICY_REJECT {
+		return PostResponse{}, &DuplicateImageError{*duplicate}
+	}
+
+	storageKey, destinatinoUrl, created, err := ps.storeOriginal(ctx, upload)
 	if err != nil {
 		return PostResponse{}, fmt.Errorf("error in saving file - %w", err)
 	}
-	postId, err := ps.savePost(post, fileName, destinatinoUrl)
+
+	image := tables.ImageTable{
+		ImageFileName: upload.FileName,
+		StorageKey:    storageKey,
+		ContentHash:   upload.ContentHash,
+		Location:      destinatinoUrl,
+	}
+	if duplicate != nil {
+		image.DuplicateOf = duplicate.ImageId
+	}
+	postId, err := ps.savePost(post, image)
 	if err != nil {
+		ps.leaveOrphanedOriginal(image, upload, created)
 		return PostResponse{}, fmt.Errorf("error in saving post in database - %w", err)
 	}
+	ps.enqueueConversion(postId)
 	return PostResponse{
-		PostId:  postId,
-		Success: true,
+		PostId:      postId,
+		Success:     true,
+		DuplicateOf: image.DuplicateOf,
 	}, nil
 }
 
-func (ps *PostService) GetAllPosts(cursor int, pageSize int) (map[int64]PostCommentResponse, error) {
-	posts, err := ps.Database.GetAllPostWithLast2Comments(cursor, pageSize)
+// DuplicateImageError rejects an upload looking like an image already posted
+type DuplicateImageError struct {
+	database.SimilarImageResult
+}
+
+func (e *DuplicateImageError) Error() string {
+	return fmt.Sprintf("image is a near duplicate of image %d of post %d", e.ImageId, e.PostId)
+}
+
+// Decode an upload to compute its perceptual hash, the content is rewound afterwards.
+// converter.ErrDecodeBusy is returned when decoding doesn't free up within
+// uploadDecodeWait.
+func (ps *PostService) perceptualHash(ctx context.Context, content io.Reader) (uint64, error) {
+	seeker, ok := content.(io.ReadSeeker)
+	if !ok {
+		return 0, errors.New("upload can't be rewound")
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	img, release, err := ps.DecodeOptions.DecodeWithin(ctx, seeker, ps.DecodeWait)
 	if err != nil {
-		return nil, fmt.Errorf("error - %w", err)
+		return 0, err
 	}
+	defer release()
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return converter.PerceptualHash(img), nil
+}
 
-	response, err := parseDataIntoResponseFormat(posts)
+// Find the closest image within DUPLICATE_MAX_DISTANCE of an upload, nil when there
+// is none
+func (ps *PostService) findDuplicate(hash uint64) (*database.SimilarImageResult, error) {
+	similar, err := ps.Database.GetSimilarImages(hash, ps.Config.DuplicateMaxDistance, 1)
+	if err != nil || len(similar) == 0 {
+		return nil, err
+	}
+	return &similar[0], nil
+}
+
+// Wake a conversion worker for the new post. When the queue is full the job stays
+// pending until the converter command picks it up.
+func (ps *PostService) enqueueConversion(postId int64) {
+	if ps.ConversionQueue == nil {
+		return
+	}
+	if !ps.ConversionQueue.Enqueue(postId) {
+		log.Printf("conversion queue is full, image of post %d is left for the converter", postId)
+	}
+}
+
+// Store the original unless the same content is already stored. Returns the storage
+// key, its location and whether this call created the file.
+func (ps *PostService) storeOriginal(ctx context.Context, upload *StagedUpload) (string, string, bool, error) {
+	existing, err := ps.Database.GetImageByContentHash(upload.ContentHash)
+	if err == nil {
+		return existing.StorageKey, existing.Location, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", "", false, err
+	}
+
+	storageKey := StorageKey(upload.ContentHash, upload.FileName)
+	location, err := upload.store(ctx, storageKey)
 	if err != nil {
-		return nil, fmt.Errorf("error - %w", err)
+		return "", "", false, err
 	}
-	return response, nil
+	return storageKey, location, true, nil
 }
 
-func parseDataIntoResponseFormat(posts []database.AllPostsJoinQueryResult) (map[int64]PostCommentResponse, error) {
-	postsMap := make(map[int64]PostCommentResponse)
+// Leave an original stored for a post that couldn't be saved to the upload cleanup.
+// A concurrent upload of the same bytes may have stored it too and not saved its
+// post yet, it can't be told apart from an orphan here. Content the client stored
+// is copied back so the post can be created again.
+func (ps *PostService) leaveOrphanedOriginal(image tables.ImageTable, upload *StagedUpload, created bool) {
+	if !created {
+		return
+	}
+	// Not the request's context, the original must be noted even when the client left
+	ctx := context.Background()
+	if err := upload.restore(ctx, image.StorageKey); err != nil {
+		log.Printf("unable to restore upload of failed post from %s: %s", image.StorageKey, err.Error())
+	}
+	if err := noteOrphanedOriginal(ctx, ps.FileSystem, image.StorageKey); err != nil {
+		log.Printf("unable to note image %s of failed post: %s", image.StorageKey, err.Error())
+	}
+}
+
+// Get a page of posts along with the latest comments of each post. Posts are loaded
+// first and their comments are then fetched in one batch for the whole page.
+func (ps *PostService) GetAllPosts(cursor *pagination.Cursor, pageSize int) (pagination.Page, error) {
+	// Fetch one extra post to know whether another page exists
+	posts, err := ps.Database.GetPosts(cursor, pageSize+1)
+	if err != nil {
+		return pagination.Page{}, fmt.Errorf("error - %w", err)
+	}
+	hasMore := len(posts) > pageSize
+	if hasMore {
+		posts = posts[:pageSize]
+	}
+	if cursor.IsPrev() {
+		// Previous pages are read in ascending order
+		for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+			posts[i], posts[j] = posts[j], posts[i]
+		}
+	}
+
+	postIds := make([]int64, len(posts))
+	for i, post := range posts {
+		postIds[i] = post.PostId
+	}
+	comments, err := ps.Database.GetLastCommentsForPosts(postIds, ps.Config.FeedCommentsPerPost)
+	if err != nil {
+		return pagination.Page{}, fmt.Errorf("error - %w", err)
+	}
+
+	response := parseDataIntoResponseFormat(posts, comments, ps.Config.PublicBaseURL, ps.Config.Renditions)
+	var first, last *pagination.Cursor
+	if len(response) > 0 {
+		first = postCursor(response[0])
+		last = postCursor(response[len(response)-1])
+	}
+	return ps.Paginator.NewPage(response, cursor, first, last, hasMore), nil
+}
+
+func postCursor(post PostCommentResponse) *pagination.Cursor {
+	return &pagination.Cursor{
+		SortKey: post.CommentCount,
+		Id:      post.PostId,
+	}
+}
+
+// Attach the comments to their posts, keeping the order of the posts page
+func parseDataIntoResponseFormat(
+	posts []database.PostQueryResult,
+	comments []tables.CommentTable,
+	baseURL string,
+	renditions config.Renditions,
+) []PostCommentResponse {
+	postComments := make(map[int64][]Comment)
+	for _, comment := range comments {
+		postComments[comment.PostId] = append(postComments[comment.PostId], Comment{
+			CommentId: comment.CommentId,
+			PostId:    comment.PostId,
+			UserId:    comment.UserId,
+			Content:   comment.Comment,
+			CreatedAt: comment.CreatedAt,
+		})
+	}
+
+	response := make([]PostCommentResponse, 0, len(posts))
 	for _, post := range posts {
-		key := post.PostId
-		if _, ok := postsMap[key]; ok {
-			postCommentValue := postsMap[key]
-			comment := Comment{
-				PostId:    key,
-				UserId:    post.CommentUserId,
-				Content:   post.Comment,
-				CreatedAt: post.CommentCreatedAt,
-			}
-			postCommentValue.Comments = append(postCommentValue.Comments, comment)
-			postsMap[key] = postCommentValue
-		} else {
-			postsMap[key] = PostCommentResponse{
-				PostId:        key,
-				UserId:        post.UserId,
-				Caption:       post.Caption,
-				CreatedAt:     post.CreatedAt,
-				ImageName:     post.PostImageName,
-				ImageLocation: post.PostImageLocation,
-				Comments: []Comment{
-					{
-						PostId:    key,
-						UserId:    post.CommentUserId,
-						Content:   post.Comment,
-						CreatedAt: post.CommentCreatedAt,
-					},
-				},
-			}
+		postCommentList, ok := postComments[post.PostId]
+		if !ok {
+			postCommentList = []Comment{}
 		}
+		response = append(response, PostCommentResponse{
+			PostId:       post.PostId,
+			UserId:       post.UserId,
+			Caption:      post.Caption,
+			CommentCount: post.CommentCount,
+			CreatedAt:    post.CreatedAt,
+			ImageName:    post.PostImageName,
+			ImageUrl:     ImageUrl(baseURL, post.ImageId, ""),
+			ImageUrls:    ImageUrls(baseURL, post.ImageId, renditions),
+			Placeholder:  imagePlaceholder(post),
+			Comments:     postCommentList,
+		})
 	}
-	return postsMap, nil
+	return response
 }
 
-func (ps *PostService) savePost(post Post, fileName string, destinatinoUrl string) (int64, error) {
+func imagePlaceholder(post database.PostQueryResult) *ImagePlaceholder {
+	if post.BlurHash == "" {
+		return nil
+	}
+	return &ImagePlaceholder{
+		BlurHash:      post.BlurHash,
+		DominantColor: post.DominantColor,
+		Width:         post.ImageWidth,
+		Height:        post.ImageHeight,
+	}
+}
+
+func (ps *PostService) savePost(post Post, imageTableRow tables.ImageTable) (int64, error) {
 	postTableRow := tables.PostTable{
 		Caption: post.Caption,
 		UserId:  post.UserId,
 	}
-	imageTableRow := tables.ImageTable{
-		ImageFileName: fileName,
-		Location:      destinatinoUrl,
-	}
 	return ps.Database.InsertNewPost(postTableRow, imageTableRow)
 }
@@ -1,17 +1,30 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
-	"mime/multipart"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/ksindhwani/imagegram/pkg/config"
 	"github.com/ksindhwani/imagegram/pkg/database"
+	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/ksindhwani/imagegram/pkg/internal/converter"
+	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
 	"github.com/ksindhwani/imagegram/pkg/mocks"
+	"github.com/ksindhwani/imagegram/pkg/pagination"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/tiff"
 )
 
 func TestCreateNewPost(t *testing.T) {
@@ -21,7 +34,7 @@ func TestCreateNewPost(t *testing.T) {
 	type NewPostInput struct {
 		post     Post
 		fileName string
-		file     multipart.File
+		file     io.Reader
 	}
 
 	tests := []struct {
@@ -33,6 +46,7 @@ func TestCreateNewPost(t *testing.T) {
 		ExpectedInsertNewPostError    error
 		ExpectedSaveFileCalls         int
 		ExpectedInsertNewPostCalls    int
+		ExpectedOrphanCalls           int
 		ExpectedResponse              PostResponse
 		ExpectedError                 error
 	}{
@@ -45,7 +59,7 @@ func TestCreateNewPost(t *testing.T) {
 					CreatedAt: time.Now(),
 				},
 				fileName: "test.png",
-				file:     nil,
+				file:     strings.NewReader("test image bytes"),
 			},
 			ExpectedSaveFileResponse:      "/images/test.png",
 			ExpectedSaveFileError:         nil,
@@ -53,6 +67,7 @@ func TestCreateNewPost(t *testing.T) {
 			ExpectedInsertNewPostError:    nil,
 			ExpectedSaveFileCalls:         1,
 			ExpectedInsertNewPostCalls:    1,
+			ExpectedOrphanCalls:           0,
 			ExpectedResponse: PostResponse{
 				PostId:  1,
 				Success: true,
@@ -68,7 +83,7 @@ func TestCreateNewPost(t *testing.T) {
 					CreatedAt: time.Now(),
 				},
 				fileName: "test.png",
-				file:     nil,
+				file:     strings.NewReader("test image bytes"),
 			},
 			ExpectedSaveFileResponse:      "",
 			ExpectedSaveFileError:         errors.New("directory not exist"),
@@ -76,6 +91,7 @@ func TestCreateNewPost(t *testing.T) {
 			ExpectedInsertNewPostError:    nil,
 			ExpectedSaveFileCalls:         1,
 			ExpectedInsertNewPostCalls:    0,
+			ExpectedOrphanCalls:           0,
 			ExpectedResponse:              PostResponse{},
 			ExpectedError:                 fmt.Errorf("error in saving file - %w", errors.New("directory not exist")),
 		},
@@ -88,7 +104,7 @@ func TestCreateNewPost(t *testing.T) {
 					CreatedAt: time.Now(),
 				},
 				fileName: "test.png",
-				file:     nil,
+				file:     strings.NewReader("test image bytes"),
 			},
 			ExpectedSaveFileResponse:      "/images/test.png",
 			ExpectedSaveFileError:         nil,
@@ -96,6 +112,7 @@ func TestCreateNewPost(t *testing.T) {
 			ExpectedInsertNewPostError:    errors.New("error in database"),
 			ExpectedSaveFileCalls:         1,
 			ExpectedInsertNewPostCalls:    1,
+			ExpectedOrphanCalls:           1,
 			ExpectedResponse:              PostResponse{},
 			ExpectedError:                 fmt.Errorf("error in saving post in database - %w", errors.New("error in database")),
 		},
@@ -108,7 +125,7 @@ func TestCreateNewPost(t *testing.T) {
 					CreatedAt: time.Now(),
 				},
 				fileName: "test.png",
-				file:     nil,
+				file:     strings.NewReader("test image bytes"),
 			},
 			ExpectedSaveFileResponse:      "/images/test.png",
 			ExpectedSaveFileError:         nil,
@@ -116,6 +133,7 @@ func TestCreateNewPost(t *testing.T) {
 			ExpectedInsertNewPostError:    errors.New("rollback"),
 			ExpectedSaveFileCalls:         1,
 			ExpectedInsertNewPostCalls:    1,
+			ExpectedOrphanCalls:           1,
 			ExpectedResponse:              PostResponse{},
 			ExpectedError:                 fmt.Errorf("error in saving post in database - %w", errors.New("rollback")),
 		},
@@ -128,7 +146,7 @@ func TestCreateNewPost(t *testing.T) {
 					CreatedAt: time.Now(),
 				},
 				fileName: "test.png",
-				file:     nil,
+				file:     strings.NewReader("test image bytes"),
 			},
 			ExpectedSaveFileResponse:      "/images/test.png",
 			ExpectedSaveFileError:         nil,
@@ -136,6 +154,7 @@ func TestCreateNewPost(t *testing.T) {
 			ExpectedInsertNewPostError:    errors.New("error in commit"),
 			ExpectedSaveFileCalls:         1,
 			ExpectedInsertNewPostCalls:    1,
+			ExpectedOrphanCalls:           1,
 			ExpectedResponse:              PostResponse{},
 			ExpectedError:                 fmt.Errorf("error in saving post in database - %w", errors.New("error in commit")),
 		},
@@ -148,7 +167,7 @@ func TestCreateNewPost(t *testing.T) {
 					CreatedAt: time.Now(),
 				},
 				fileName: "test.png",
-				file:     nil,
+				file:     strings.NewReader("test image bytes"),
 			},
 			ExpectedSaveFileResponse:      "/images/test.png",
 			ExpectedSaveFileError:         nil,
@@ -156,6 +175,7 @@ func TestCreateNewPost(t *testing.T) {
 			ExpectedInsertNewPostError:    errors.New("error in sql prepare statement"),
 			ExpectedSaveFileCalls:         1,
 			ExpectedInsertNewPostCalls:    1,
+			ExpectedOrphanCalls:           1,
 			ExpectedResponse:              PostResponse{},
 			ExpectedError:                 fmt.Errorf("error in saving post in database - %w", errors.New("error in sql prepare statement")),
 		},
@@ -168,7 +188,7 @@ func TestCreateNewPost(t *testing.T) {
 					CreatedAt: time.Now(),
 				},
 				fileName: "test.png",
-				file:     nil,
+				file:     strings.NewReader("test image bytes"),
 			},
 			ExpectedSaveFileResponse:      "/images/test.png",
 			ExpectedSaveFileError:         nil,
@@ -176,6 +196,7 @@ func TestCreateNewPost(t *testing.T) {
 			ExpectedInsertNewPostError:    errors.New("can't find the column"),
 			ExpectedSaveFileCalls:         1,
 			ExpectedInsertNewPostCalls:    1,
+			ExpectedOrphanCalls:           1,
 			ExpectedResponse:              PostResponse{},
 			ExpectedError:                 fmt.Errorf("error in saving post in database - %w", errors.New("can't find the column")),
 		},
@@ -186,159 +207,549 @@ func TestCreateNewPost(t *testing.T) {
 		HostImageDirectory:  "test host directory",
 		LocalImageDirectory: "test local directory",
 	}
+	// sha256 of "test image bytes"
+	contentHash := "9e08806e41774313bbd15abbe9cf2e26576582ba849f30d15eedbb4f9b405ed2"
+	storageKey := StorageKey(contentHash, "test.png")
 	localFileSystem := mocks.NewMockFileSystem(ctrl)
 	database := mocks.NewMockDatabase(ctrl)
-	postService := NewPostService(&config, database, localFileSystem)
+	conversionQueue := &recordingQueue{}
+	postService := NewPostService(&config, database, localFileSystem, conversionQueue, NewDecodeOptions(&config))
 	for _, test := range tests {
-		localFileSystem.EXPECT().SaveFile(any, any).Return(test.ExpectedSaveFileResponse, test.ExpectedSaveFileError).Times(test.ExpectedSaveFileCalls)
-		database.EXPECT().InsertNewPost(any, any).Return(test.ExpectedInsertNewPostResponse, test.ExpectedInsertNewPostError).Times(test.ExpectedInsertNewPostCalls)
-		result, err := postService.CreateNewPost(test.Input.post, test.Input.fileName, test.Input.file)
+		database.EXPECT().GetImageByContentHash(contentHash).Return(tables.ImageTable{}, sql.ErrNoRows).Times(1)
+		localFileSystem.EXPECT().Save(any, storageKey, any, any).Return(test.ExpectedSaveFileResponse, test.ExpectedSaveFileError).Times(test.ExpectedSaveFileCalls)
+		database.EXPECT().InsertNewPost(any, tables.ImageTable{
+			ImageFileName: "test.png",
+			StorageKey:    storageKey,
+			ContentHash:   contentHash,
+			Location:      test.ExpectedSaveFileResponse,
+		}).Return(test.ExpectedInsertNewPostResponse, test.ExpectedInsertNewPostError).Times(test.ExpectedInsertNewPostCalls)
+		// The original is left for the upload cleanup, another upload may point to it
+		localFileSystem.EXPECT().Save(any, gomock.Not(storageKey), any, any).DoAndReturn(
+			func(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+				assert.True(t, strings.HasPrefix(key, ORPHAN_SUBDIRECTORY+"/"), test.Name)
+				note, err := io.ReadAll(reader)
+				assert.Nil(t, err, test.Name)
+				assert.Equal(t, storageKey, string(note), test.Name)
+				return key, nil
+			}).Times(test.ExpectedOrphanCalls)
+		conversionQueue.postIds = nil
+		result, err := postService.CreateNewPost(context.Background(), test.Input.post, test.Input.fileName, test.Input.file)
 		assert.Equal(t, test.ExpectedResponse, result, test.Name)
 		assert.Equal(t, test.ExpectedError, err, test.Name)
+		if test.ExpectedError == nil {
+			assert.Equal(t, []int64{test.ExpectedResponse.PostId}, conversionQueue.postIds, test.Name)
+		} else {
+			assert.Empty(t, conversionQueue.postIds, test.Name)
+		}
 	}
 }
 
+type recordingQueue struct {
+	postIds []int64
+}
+
+func (q *recordingQueue) Enqueue(postId int64) bool {
+	q.postIds = append(q.postIds, postId)
+	return true
+}
+
+func TestCreateNewPostReusesStoredContent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	any := gomock.Any()
+	config := config.Config{
+		HostImageDirectory:  "test host directory",
+		LocalImageDirectory: "test local directory",
+	}
+	contentHash := "9e08806e41774313bbd15abbe9cf2e26576582ba849f30d15eedbb4f9b405ed2"
+	existing := tables.ImageTable{
+		ImageId:       3,
+		ImageFileName: "first upload.png",
+		StorageKey:    StorageKey(contentHash, "first upload.png"),
+		ContentHash:   contentHash,
+		Location:      "/images/" + StorageKey(contentHash, "first upload.png"),
+	}
+	localFileSystem := mocks.NewMockFileSystem(ctrl)
+	database := mocks.NewMockDatabase(ctrl)
+	postService := NewPostService(&config, database, localFileSystem, nil, NewDecodeOptions(&config))
+
+	database.EXPECT().GetImageByContentHash(contentHash).Return(existing, nil).Times(1)
+	localFileSystem.EXPECT().Save(any, any, any, any).Times(0)
+	database.EXPECT().InsertNewPost(any, tables.ImageTable{
+		ImageFileName: "second upload.PNG",
+		StorageKey:    existing.StorageKey,
+		ContentHash:   contentHash,
+		Location:      existing.Location,
+	}).Return(int64(2), nil).Times(1)
+
+	result, err := postService.CreateNewPost(context.Background(), Post{UserId: 1}, "second upload.PNG", strings.NewReader("test image bytes"))
+	assert.Nil(t, err)
+	assert.Equal(t, PostResponse{PostId: 2, Success: true}, result)
+}
+
+func TestCreateNewPostStreamsUploadThroughStaging(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	contentHash := "9e08806e41774313bbd15abbe9cf2e26576582ba849f30d15eedbb4f9b405ed2"
+	tests := []struct {
+		Name          string
+		Existing      tables.ImageTable
+		ExistingError error
+		InsertError   error
+		ExpectedKeys  []string
+		ExpectedError error
+	}{
+		{
+			Name:          "Test streamed upload is moved under its content key",
+			ExistingError: sql.ErrNoRows,
+			ExpectedKeys:  []string{StorageKey(contentHash, "sunset.png")},
+		},
+		{
+			Name:     "Test staged copy of content already stored is deleted",
+			Existing: tables.ImageTable{ImageId: 3, StorageKey: "originals/kept.png"},
+		},
+		{
+			Name:          "Test original is left to the cleanup when the post can't be saved",
+			ExistingError: sql.ErrNoRows,
+			InsertError:   errors.New("connection refused"),
+			ExpectedKeys:  []string{StorageKey(contentHash, "sunset.png"), ORPHAN_SUBDIRECTORY + "/*"},
+			ExpectedError: fmt.Errorf("error in saving post in database - %w", errors.New("connection refused")),
+		},
+	}
+
+	any := gomock.Any()
+	config := config.Config{}
+	for _, test := range tests {
+		fileSystem := local.New("test host directory", t.TempDir())
+		database := mocks.NewMockDatabase(ctrl)
+		postService := NewPostService(&config, database, fileSystem, nil, NewDecodeOptions(&config))
+
+		database.EXPECT().GetImageByContentHash(contentHash).Return(test.Existing, test.ExistingError).MinTimes(1)
+		database.EXPECT().InsertNewPost(any, any).Return(int64(2), test.InsertError).Times(1)
+
+		// Not seekable, like a part of a multipart request
+		file := io.MultiReader(strings.NewReader("test image "), strings.NewReader("bytes"))
+		_, err := postService.CreateNewPost(context.Background(), Post{UserId: 1}, "sunset.png", file)
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+		keys, err := fileSystem.List("")
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedKeys, orphanNotes(keys), test.Name)
+	}
+
+	// Uploads over the limit are refused while they stream in
+	fileSystem := local.New("test host directory", t.TempDir())
+	limited := config
+	limited.UploadMaxBytes = 10
+	postService := NewPostService(&limited, mocks.NewMockDatabase(ctrl), fileSystem, nil, NewDecodeOptions(&limited))
+	for _, file := range []io.Reader{
+		io.MultiReader(strings.NewReader("test image "), strings.NewReader("bytes")),
+		strings.NewReader("test image bytes"),
+	} {
+		_, err := postService.CreateNewPost(context.Background(), Post{UserId: 1}, "sunset.png", file)
+		assert.ErrorIs(t, err, ErrUploadTooLarge)
+	}
+	keys, err := fileSystem.List("")
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestStageAndValidate(t *testing.T) {
+	var encodedTiff bytes.Buffer
+	assert.Nil(t, tiff.Encode(&encodedTiff, image.NewRGBA(image.Rect(0, 0, 600, 600)), nil))
+
+	tests := []struct {
+		Name               string
+		FileName           string
+		ExpectedErrorMatch error
+	}{
+		{Name: "Test staged copy of a large header is checked", FileName: "large.tiff"},
+		{Name: "Test staged copy that isn't what its name says is deleted", FileName: "large.png", ExpectedErrorMatch: &decoder.FormatMismatchError{Extension: ".png", Format: "tiff"}},
+	}
+
+	config := config.Config{}
+	for _, test := range tests {
+		fileSystem := local.New("test host directory", t.TempDir())
+		postService := NewPostService(&config, nil, fileSystem, nil, NewDecodeOptions(&config))
+
+		// Not seekable, like a part of a multipart request
+		_, content, err := postService.DecodeOptions.Validate(io.MultiReader(bytes.NewReader(encodedTiff.Bytes())), test.FileName)
+		assert.ErrorIs(t, err, decoder.ErrHeaderTooLarge, test.Name)
+		upload, err := postService.StageAndValidate(context.Background(), test.FileName, content)
+		if test.ExpectedErrorMatch != nil {
+			assert.Equal(t, test.ExpectedErrorMatch, err, test.Name)
+			keys, err := fileSystem.List("")
+			assert.Nil(t, err, test.Name)
+			assert.Empty(t, keys, test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		staged, err := io.ReadAll(upload.content)
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, encodedTiff.Bytes(), staged, test.Name)
+		upload.Close()
+	}
+}
+
+func TestCreateNewPostDuplicatePolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.Gray{Y: uint8(x * 4)})
+		}
+	}
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, img))
+	hash := converter.PerceptualHash(img)
+	duplicate := database.SimilarImageResult{ImageId: 3, PostId: 2, Distance: 1}
+
+	tests := []struct {
+		Name               string
+		Policy             string
+		CheckBlocklist     bool
+		BlockedHashId      int64 // blocked hash the upload matches, 0 for none
+		EmptyBlocklist     bool
+		DecodeBusy         bool
+		GetSimilarResponse []database.SimilarImageResult
+		GetSimilarCalls    int
+		ExpectedInsertRow  tables.ImageTable
+		ExpectedInsertCall int
+		ExpectedResponse   PostResponse
+		ExpectedError      error
+	}{
+		{
+			Name:               "Test duplicates are not looked for when the policy is off",
+			Policy:             config.DUPLICATE_POLICY_OFF,
+			ExpectedInsertCall: 1,
+			ExpectedResponse:   PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:               "Test near duplicate is flagged",
+			Policy:             config.DUPLICATE_POLICY_FLAG,
+			GetSimilarResponse: []database.SimilarImageResult{duplicate},
+			GetSimilarCalls:    1,
+			ExpectedInsertRow:  tables.ImageTable{DuplicateOf: 3},
+			ExpectedInsertCall: 1,
+			ExpectedResponse:   PostResponse{PostId: 5, Success: true, DuplicateOf: 3},
+		},
+		{
+			Name:               "Test unique image is posted under the reject policy",
+			Policy:             config.DUPLICATE_POLICY_REJECT,
+			GetSimilarCalls:    1,
+			ExpectedInsertCall: 1,
+			ExpectedResponse:   PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:               "Test near duplicate is rejected",
+			Policy:             config.DUPLICATE_POLICY_REJECT,
+			GetSimilarResponse: []database.SimilarImageResult{duplicate},
+			GetSimilarCalls:    1,
+			ExpectedError:      &DuplicateImageError{duplicate},
+		},
+		{
+			Name:               "Test upload not on the blocklist is posted",
+			Policy:             config.DUPLICATE_POLICY_OFF,
+			CheckBlocklist:     true,
+			ExpectedInsertCall: 1,
+			ExpectedResponse:   PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:           "Test upload on the blocklist is refused",
+			Policy:         config.DUPLICATE_POLICY_FLAG,
+			CheckBlocklist: true,
+			BlockedHashId:  8,
+			ExpectedError:  &BlockedImageError{BlockedHashId: 8},
+		},
+		{
+			Name:               "Test upload isn't decoded for an empty blocklist",
+			Policy:             config.DUPLICATE_POLICY_OFF,
+			CheckBlocklist:     true,
+			EmptyBlocklist:     true,
+			DecodeBusy:         true,
+			ExpectedInsertCall: 1,
+			ExpectedResponse:   PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:           "Test upload is refused while every decode slot is taken",
+			Policy:         config.DUPLICATE_POLICY_FLAG,
+			CheckBlocklist: true,
+			DecodeBusy:     true,
+			ExpectedError:  fmt.Errorf("error in hashing image - %w", converter.ErrDecodeBusy),
+		},
+	}
+
+	any := gomock.Any()
+	for _, test := range tests {
+		config := config.Config{
+			DuplicatePolicy:       test.Policy,
+			DuplicateMaxDistance:  4,
+			BlocklistCheckUploads: test.CheckBlocklist,
+			BlocklistMaxDistance:  2,
+			ConversionMaxDecodes:  1,
+		}
+		localFileSystem := mocks.NewMockFileSystem(ctrl)
+		database := mocks.NewMockDatabase(ctrl)
+		postService := NewPostService(&config, database, localFileSystem, nil, NewDecodeOptions(&config))
+
+		blockedError, blockedCalls := sql.ErrNoRows, 0
+		if test.BlockedHashId != 0 {
+			blockedError, blockedCalls = nil, 1
+		}
+		hasBlockedCalls, checkCalls := 0, 0
+		if test.CheckBlocklist {
+			hasBlockedCalls = 1
+			if !test.EmptyBlocklist && !test.DecodeBusy {
+				checkCalls = 1
+			}
+		}
+		database.EXPECT().HasBlockedHashes().Return(!test.EmptyBlocklist, nil).Times(hasBlockedCalls)
+		database.EXPECT().GetBlockedHashMatch(hash, 2).Return(tables.BlockedHashTable{BlockedHashId: test.BlockedHashId}, 0, blockedError).Times(checkCalls)
+		database.EXPECT().SaveModerationEvent(any).Return(nil).Times(blockedCalls)
+		database.EXPECT().GetSimilarImages(hash, 4, 1).Return(test.GetSimilarResponse, nil).Times(test.GetSimilarCalls)
+		database.EXPECT().GetImageByContentHash(any).Return(tables.ImageTable{}, sql.ErrNoRows).Times(test.ExpectedInsertCall)
+		// The whole upload is stored even though it was decoded to be hashed
+		localFileSystem.EXPECT().Save(any, any, any, any).DoAndReturn(
+			func(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+				saved, err := io.ReadAll(reader)
+				assert.Nil(t, err, test.Name)
+				assert.Equal(t, encoded.Bytes(), saved, test.Name)
+				return "/images/" + key, nil
+			}).Times(test.ExpectedInsertCall)
+		database.EXPECT().InsertNewPost(any, any).DoAndReturn(
+			func(post tables.PostTable, image tables.ImageTable) (int64, error) {
+				assert.Equal(t, test.ExpectedInsertRow.DuplicateOf, image.DuplicateOf, test.Name)
+				return 5, nil
+			}).Times(test.ExpectedInsertCall)
+
+		if test.DecodeBusy {
+			assert.Nil(t, postService.DecodeOptions.Slots.Acquire(context.Background()), test.Name)
+			postService.DecodeWait = 10 * time.Millisecond
+		}
+
+		result, err := postService.CreateNewPost(context.Background(), Post{UserId: 1}, "meme.png", bytes.NewReader(encoded.Bytes()))
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+		assert.Equal(t, test.ExpectedResponse, result, test.Name)
+	}
+}
+
+func TestStorageKey(t *testing.T) {
+	hash := "9e08806e41774313bbd15abbe9cf2e26576582ba849f30d15eedbb4f9b405ed2"
+	assert.Equal(t, "originals/"+hash[0:2]+"/"+hash[2:4]+"/"+hash+".png", StorageKey(hash, "Holiday Photo.PNG"))
+	assert.Equal(t, "originals/"+hash[0:2]+"/"+hash[2:4]+"/"+hash, StorageKey(hash, "../../etc/x"))
+	assert.Equal(t, "originals/"+hash[0:2]+"/"+hash[2:4]+"/"+hash, StorageKey(hash, "photo.p/ng"))
+}
+
 func TestGetAllPosts(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
+	paginator := pagination.New("test cursor secret", 10, 50)
+	postCreatedAt := time.Date(2023, 6, 26, 0, 0, 0, 1, &time.Location{})
+	commentCreatedAt := time.Date(2023, 6, 26, 0, 0, 0, 3, &time.Location{})
+
 	type GetAllPostsInput struct {
-		cursor   int
+		cursor   *pagination.Cursor
 		pageSize int
 	}
 
 	tests := []struct {
-		Name                                         string
-		Input                                        GetAllPostsInput
-		ExpectedIGetAllPostWithLast2CommentsResponse []database.AllPostsJoinQueryResult
-		ExpectedIGetAllPostWithLast2CommentsError    error
-		ExpectedGetAllPostWithLast2CommentsCalls     int
-		ExpectedResponse                             map[int64]PostCommentResponse
-		ExpectedError                                error
+		Name                                 string
+		Input                                GetAllPostsInput
+		ExpectedGetPostsResponse             []database.PostQueryResult
+		ExpectedGetPostsError                error
+		ExpectedGetLastCommentsPostIds       []int64
+		ExpectedGetLastCommentsResponse      []tables.CommentTable
+		ExpectedGetLastCommentsError         error
+		ExpectedGetLastCommentsForPostsCalls int
+		ExpectedResponse                     pagination.Page
+		ExpectedError                        error
 	}{
 		{
 			Name: "Test All Valid ",
 			Input: GetAllPostsInput{
-				cursor:   0,
+				cursor:   nil,
 				pageSize: 10,
 			},
-			ExpectedIGetAllPostWithLast2CommentsResponse: []database.AllPostsJoinQueryResult{
+			ExpectedGetPostsResponse: []database.PostQueryResult{
 				{
-					PostId:            1,
-					UserId:            1,
-					Caption:           "test Caption post user 1",
-					CreatedAt:         time.Date(2023, 6, 26, 0, 0, 0, 1, &time.Location{}),
-					PostImageName:     "test.png",
-					PostImageLocation: "/images/test.png",
-					CommentId:         1,
-					CommentUserId:     2,
-					Comment:           "comment by user 2",
-					CommentCreatedAt:  time.Date(2023, 6, 26, 0, 0, 0, 3, &time.Location{}),
-				},
-				{
-					PostId:            1,
-					UserId:            1,
-					Caption:           "test Caption post user 1",
-					CreatedAt:         time.Date(2023, 6, 26, 0, 0, 0, 1, &time.Location{}),
-					PostImageName:     "test.png",
-					PostImageLocation: "/images/test.png",
-					CommentId:         1,
-					CommentUserId:     3,
-					Comment:           "comment by user 3",
-					CommentCreatedAt:  time.Date(2023, 6, 26, 0, 0, 0, 2, &time.Location{}),
-				},
-			},
-			ExpectedIGetAllPostWithLast2CommentsError: nil,
-			ExpectedGetAllPostWithLast2CommentsCalls:  1,
-			ExpectedResponse: map[int64]PostCommentResponse{
-				1: {
 					PostId:        1,
 					UserId:        1,
 					Caption:       "test Caption post user 1",
-					CreatedAt:     time.Date(2023, 6, 26, 0, 0, 0, 1, &time.Location{}),
-					ImageName:     "test.png",
-					ImageLocation: "/images/test.png",
+					CommentCount:  2,
+					CreatedAt:     postCreatedAt,
+					ImageId:       4,
+					PostImageName: "test.png",
+					ImageWidth:    1080,
+					ImageHeight:   720,
+					BlurHash:      "LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+					DominantColor: "#a0b0c0",
+				},
+			},
+			ExpectedGetLastCommentsPostIds: []int64{1},
+			ExpectedGetLastCommentsResponse: []tables.CommentTable{
+				{CommentId: 2, PostId: 1, UserId: 3, Comment: "comment by user 3", CreatedAt: commentCreatedAt},
+				{CommentId: 1, PostId: 1, UserId: 2, Comment: "comment by user 2", CreatedAt: commentCreatedAt},
+			},
+			ExpectedGetLastCommentsForPostsCalls: 1,
+			ExpectedResponse: pagination.Page{
+				Data: []PostCommentResponse{{
+					PostId:       1,
+					UserId:       1,
+					Caption:      "test Caption post user 1",
+					CommentCount: 2,
+					CreatedAt:    postCreatedAt,
+					ImageName:    "test.png",
+					ImageUrl:     "https://cdn.imagegram.test/images/4.jpg", ImageUrls: map[string]string{"thumb": "https://cdn.imagegram.test/images/4.jpg?rendition=thumb"},
+					Placeholder: &ImagePlaceholder{BlurHash: "LEHV6nWB2yk8pyo0adR*.7kCMdnj", DominantColor: "#a0b0c0", Width: 1080, Height: 720},
 					Comments: []Comment{
-						{
-							PostId:    1,
-							UserId:    2,
-							Content:   "comment by user 2",
-							CreatedAt: time.Date(2023, 6, 26, 0, 0, 0, 3, &time.Location{}),
-						},
-						{
-							PostId:    1,
-							UserId:    3,
-							Content:   "comment by user 3",
-							CreatedAt: time.Date(2023, 6, 26, 0, 0, 0, 2, &time.Location{}),
-						},
+						{CommentId: 2, PostId: 1, UserId: 3, Content: "comment by user 3", CreatedAt: commentCreatedAt},
+						{CommentId: 1, PostId: 1, UserId: 2, Content: "comment by user 2", CreatedAt: commentCreatedAt},
 					},
+				}},
+			},
+			ExpectedError: nil,
+		},
+		{
+			Name: "Test post without comments and next page",
+			Input: GetAllPostsInput{
+				cursor:   &pagination.Cursor{SortKey: 3, Id: 7, Direction: pagination.NEXT},
+				pageSize: 1,
+			},
+			ExpectedGetPostsResponse: []database.PostQueryResult{
+				{PostId: 5, UserId: 1, Caption: "fifth", CommentCount: 0, CreatedAt: postCreatedAt, ImageId: 15},
+				{PostId: 4, UserId: 1, Caption: "fourth", CommentCount: 0, CreatedAt: postCreatedAt, ImageId: 14},
+			},
+			ExpectedGetLastCommentsPostIds:       []int64{5},
+			ExpectedGetLastCommentsResponse:      nil,
+			ExpectedGetLastCommentsForPostsCalls: 1,
+			ExpectedResponse: pagination.Page{
+				Data: []PostCommentResponse{
+					{PostId: 5, UserId: 1, Caption: "fifth", CommentCount: 0, CreatedAt: postCreatedAt, ImageUrl: "https://cdn.imagegram.test/images/15.jpg", ImageUrls: map[string]string{"thumb": "https://cdn.imagegram.test/images/15.jpg?rendition=thumb"}, Comments: []Comment{}},
 				},
+				NextCursor: paginator.Encode(pagination.Cursor{SortKey: 0, Id: 5, Direction: pagination.NEXT}),
+				PrevCursor: paginator.Encode(pagination.Cursor{SortKey: 0, Id: 5, Direction: pagination.PREV}),
 			},
 			ExpectedError: nil,
 		},
 		{
-			Name: "Test all pages are traversed ",
+			Name: "Test last page has no next cursor",
 			Input: GetAllPostsInput{
-				cursor:   11,
-				pageSize: 10,
+				cursor:   &pagination.Cursor{SortKey: 0, Id: 5, Direction: pagination.NEXT},
+				pageSize: 2,
+			},
+			ExpectedGetPostsResponse: []database.PostQueryResult{
+				{PostId: 4, UserId: 1, Caption: "fourth", CommentCount: 0, CreatedAt: postCreatedAt, ImageId: 14},
+				{PostId: 2, UserId: 1, Caption: "second", CommentCount: 0, CreatedAt: postCreatedAt, ImageId: 12},
+			},
+			ExpectedGetLastCommentsPostIds:       []int64{4, 2},
+			ExpectedGetLastCommentsResponse:      nil,
+			ExpectedGetLastCommentsForPostsCalls: 1,
+			ExpectedResponse: pagination.Page{
+				Data: []PostCommentResponse{
+					{PostId: 4, UserId: 1, Caption: "fourth", CommentCount: 0, CreatedAt: postCreatedAt, ImageUrl: "https://cdn.imagegram.test/images/14.jpg", ImageUrls: map[string]string{"thumb": "https://cdn.imagegram.test/images/14.jpg?rendition=thumb"}, Comments: []Comment{}},
+					{PostId: 2, UserId: 1, Caption: "second", CommentCount: 0, CreatedAt: postCreatedAt, ImageUrl: "https://cdn.imagegram.test/images/12.jpg", ImageUrls: map[string]string{"thumb": "https://cdn.imagegram.test/images/12.jpg?rendition=thumb"}, Comments: []Comment{}},
+				},
+				PrevCursor: paginator.Encode(pagination.Cursor{SortKey: 0, Id: 4, Direction: pagination.PREV}),
 			},
-			ExpectedIGetAllPostWithLast2CommentsResponse: []database.AllPostsJoinQueryResult{},
-			ExpectedIGetAllPostWithLast2CommentsError:    nil,
-			ExpectedGetAllPostWithLast2CommentsCalls:     1,
-			ExpectedResponse:                             map[int64]PostCommentResponse{},
-			ExpectedError:                                nil,
+			ExpectedError: nil,
 		},
 		{
-			Name: "Test when error in row scaning after join query",
+			Name: "Test previous page keeps feed order",
 			Input: GetAllPostsInput{
-				cursor:   0,
+				cursor:   &pagination.Cursor{SortKey: 1, Id: 2, Direction: pagination.PREV},
+				pageSize: 2,
+			},
+			ExpectedGetPostsResponse: []database.PostQueryResult{
+				{PostId: 3, UserId: 1, Caption: "third", CommentCount: 1, CreatedAt: postCreatedAt, ImageId: 13},
+				{PostId: 9, UserId: 1, Caption: "ninth", CommentCount: 4, CreatedAt: postCreatedAt, ImageId: 19},
+			},
+			ExpectedGetLastCommentsPostIds:       []int64{9, 3},
+			ExpectedGetLastCommentsResponse:      nil,
+			ExpectedGetLastCommentsForPostsCalls: 1,
+			ExpectedResponse: pagination.Page{
+				Data: []PostCommentResponse{
+					{PostId: 9, UserId: 1, Caption: "ninth", CommentCount: 4, CreatedAt: postCreatedAt, ImageUrl: "https://cdn.imagegram.test/images/19.jpg", ImageUrls: map[string]string{"thumb": "https://cdn.imagegram.test/images/19.jpg?rendition=thumb"}, Comments: []Comment{}},
+					{PostId: 3, UserId: 1, Caption: "third", CommentCount: 1, CreatedAt: postCreatedAt, ImageUrl: "https://cdn.imagegram.test/images/13.jpg", ImageUrls: map[string]string{"thumb": "https://cdn.imagegram.test/images/13.jpg?rendition=thumb"}, Comments: []Comment{}},
+				},
+				NextCursor: paginator.Encode(pagination.Cursor{SortKey: 1, Id: 3, Direction: pagination.NEXT}),
+			},
+			ExpectedError: nil,
+		},
+		{
+			Name: "Test all pages are traversed ",
+			Input: GetAllPostsInput{
+				cursor:   &pagination.Cursor{SortKey: 0, Id: 11, Direction: pagination.NEXT},
 				pageSize: 10,
 			},
-			ExpectedIGetAllPostWithLast2CommentsResponse: nil,
-			ExpectedIGetAllPostWithLast2CommentsError:    errors.New("error in row scanning"),
-			ExpectedGetAllPostWithLast2CommentsCalls:     1,
-			ExpectedResponse:                             nil,
-			ExpectedError:                                fmt.Errorf("error - %w", errors.New("error in row scanning")),
+			ExpectedGetPostsResponse:             []database.PostQueryResult{},
+			ExpectedGetLastCommentsPostIds:       []int64{},
+			ExpectedGetLastCommentsForPostsCalls: 1,
+			ExpectedResponse:                     pagination.Page{Data: []PostCommentResponse{}},
+			ExpectedError:                        nil,
 		},
 		{
 			Name: "Test when error in db query execution",
 			Input: GetAllPostsInput{
-				cursor:   0,
+				cursor:   nil,
 				pageSize: 10,
 			},
-			ExpectedIGetAllPostWithLast2CommentsResponse: nil,
-			ExpectedIGetAllPostWithLast2CommentsError:    errors.New("error in db query execution"),
-			ExpectedGetAllPostWithLast2CommentsCalls:     1,
-			ExpectedResponse:                             nil,
-			ExpectedError:                                fmt.Errorf("error - %w", errors.New("error in db query execution")),
+			ExpectedGetPostsError:                errors.New("error in db query execution"),
+			ExpectedGetLastCommentsForPostsCalls: 0,
+			ExpectedResponse:                     pagination.Page{},
+			ExpectedError:                        fmt.Errorf("error - %w", errors.New("error in db query execution")),
 		},
 		{
-			Name: "Test when error in rows after join",
+			Name: "Test when error in loading comments",
 			Input: GetAllPostsInput{
-				cursor:   0,
+				cursor:   nil,
 				pageSize: 10,
 			},
-			ExpectedIGetAllPostWithLast2CommentsResponse: nil,
-			ExpectedIGetAllPostWithLast2CommentsError:    errors.New("error in rows after join"),
-			ExpectedGetAllPostWithLast2CommentsCalls:     1,
-			ExpectedResponse:                             nil,
-			ExpectedError:                                fmt.Errorf("error - %w", errors.New("error in rows after join")),
+			ExpectedGetPostsResponse: []database.PostQueryResult{
+				{PostId: 1, UserId: 1, Caption: "first", CommentCount: 1, CreatedAt: postCreatedAt},
+			},
+			ExpectedGetLastCommentsPostIds:       []int64{1},
+			ExpectedGetLastCommentsError:         errors.New("error in row scanning"),
+			ExpectedGetLastCommentsForPostsCalls: 1,
+			ExpectedResponse:                     pagination.Page{},
+			ExpectedError:                        fmt.Errorf("error - %w", errors.New("error in row scanning")),
 		},
 	}
 
-	any := gomock.Any()
 	config := config.Config{
 		HostImageDirectory:  "test host directory",
 		LocalImageDirectory: "test local directory",
+		CursorSecret:        "test cursor secret",
+		DefaultPageSize:     10,
+		MaxPageSize:         50,
+		FeedCommentsPerPost: 2,
+		PublicBaseURL:       "https://cdn.imagegram.test/",
+		Renditions:          config.Renditions{{Name: "thumb", Width: 150, Height: 150}},
 	}
 	database := mocks.NewMockDatabase(ctrl)
-	postService := NewPostService(&config, database, nil)
+	postService := NewPostService(&config, database, nil, nil, NewDecodeOptions(&config))
 	for _, test := range tests {
-		database.EXPECT().GetAllPostWithLast2Comments(any, any).
-			Return(test.ExpectedIGetAllPostWithLast2CommentsResponse, test.ExpectedIGetAllPostWithLast2CommentsError).
-			Times(test.ExpectedGetAllPostWithLast2CommentsCalls)
+		database.EXPECT().GetPosts(test.Input.cursor, test.Input.pageSize+1).
+			Return(test.ExpectedGetPostsResponse, test.ExpectedGetPostsError).
+			Times(1)
+		database.EXPECT().GetLastCommentsForPosts(test.ExpectedGetLastCommentsPostIds, 2).
+			Return(test.ExpectedGetLastCommentsResponse, test.ExpectedGetLastCommentsError).
+			Times(test.ExpectedGetLastCommentsForPostsCalls)
 		result, err := postService.GetAllPosts(test.Input.cursor, test.Input.pageSize)
 		assert.Equal(t, test.ExpectedResponse, result, test.Name)
 		assert.Equal(t, test.ExpectedError, err, test.Name)
 	}
 }
+
+// Keys with the random names of orphan notes replaced by *
+func orphanNotes(keys []string) []string {
+	for i, key := range keys {
+		if strings.HasPrefix(key, ORPHAN_SUBDIRECTORY+"/") {
+			keys[i] = ORPHAN_SUBDIRECTORY + "/*"
+		}
+	}
+	return keys
+}
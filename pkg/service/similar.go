@@ -0,0 +1,55 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidDistance = errors.New("invalid distance")
+
+// SimilarImage is an image looking like another one, Distance is the number of bits
+// their perceptual hashes differ by
+type SimilarImage struct {
+	ImageId  int64  `json:"imageId"`
+	PostId   int64  `json:"postId"`
+	Distance int    `json:"distance"`
+	ImageUrl string `json:"imageUrl"`
+}
+
+// Get the images whose perceptual hash is at most maxDistance bits from the image's,
+// closest first. ErrImageNotConverted is returned until the image is hashed.
+func (is *ImageService) GetSimilarImages(imageId int64, maxDistance int) ([]SimilarImage, error) {
+	if maxDistance < 0 || maxDistance > is.Config.SimilarMaxDistance {
+		return nil, fmt.Errorf("%w - distance should be between 0 and %d", ErrInvalidDistance, is.Config.SimilarMaxDistance)
+	}
+	image, err := is.Database.GetImage(imageId)
+	if errors.Is(err, sql.ErrNoRows) || image.QuarantinedAt.Valid {
+		return nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch image from database - %w", err)
+	}
+	if !image.PerceptualHash.Valid {
+		return nil, ErrImageNotConverted
+	}
+
+	// One extra as the image itself is among the results
+	results, err := is.Database.GetSimilarImages(uint64(image.PerceptualHash.Int64), maxDistance, is.Config.MaxPageSize+1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch similar images - %w", err)
+	}
+	similar := make([]SimilarImage, 0, len(results))
+	for _, result := range results {
+		if result.ImageId == imageId || len(similar) == is.Config.MaxPageSize {
+			continue
+		}
+		similar = append(similar, SimilarImage{
+			ImageId:  result.ImageId,
+			PostId:   result.PostId,
+			Distance: result.Distance,
+			ImageUrl: ImageUrl(is.Config.PublicBaseURL, result.ImageId, ""),
+		})
+	}
+	return similar, nil
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/database"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSimilarImages(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	hashed := tables.ImageTable{ImageId: 1, PerceptualHash: sql.NullInt64{Int64: -2, Valid: true}}
+	tests := []struct {
+		Name               string
+		Distance           int
+		GetImageResponse   tables.ImageTable
+		GetImageError      error
+		GetImageCalls      int
+		GetSimilarResponse []database.SimilarImageResult
+		GetSimilarError    error
+		GetSimilarCalls    int
+		ExpectedResponse   []SimilarImage
+		ExpectedError      error
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:             "Test similar images without the image itself",
+			Distance:         4,
+			GetImageResponse: hashed,
+			GetImageCalls:    1,
+			GetSimilarResponse: []database.SimilarImageResult{
+				{ImageId: 1, PostId: 1, Distance: 0},
+				{ImageId: 5, PostId: 4, Distance: 1},
+				{ImageId: 2, PostId: 2, Distance: 3},
+				{ImageId: 9, PostId: 8, Distance: 4},
+			},
+			GetSimilarCalls: 1,
+			ExpectedResponse: []SimilarImage{
+				{ImageId: 5, PostId: 4, Distance: 1, ImageUrl: "https://cdn.example.com/images/5.jpg"},
+				{ImageId: 2, PostId: 2, Distance: 3, ImageUrl: "https://cdn.example.com/images/2.jpg"},
+			},
+		},
+		{
+			Name:             "Test no similar images",
+			Distance:         0,
+			GetImageResponse: hashed,
+			GetImageCalls:    1,
+			GetSimilarCalls:  1,
+			ExpectedResponse: []SimilarImage{},
+		},
+		{Name: "Test distance over the limit", Distance: 7, ExpectedErrorMatch: ErrInvalidDistance},
+		{Name: "Test negative distance", Distance: -1, ExpectedErrorMatch: ErrInvalidDistance},
+		{
+			Name:          "Test unknown image",
+			Distance:      4,
+			GetImageError: sql.ErrNoRows,
+			GetImageCalls: 1,
+			ExpectedError: ErrImageNotFound,
+		},
+		{
+			Name:             "Test image not hashed yet",
+			Distance:         4,
+			GetImageResponse: tables.ImageTable{ImageId: 1},
+			GetImageCalls:    1,
+			ExpectedError:    ErrImageNotConverted,
+		},
+		{
+			Name:             "Test error in query",
+			Distance:         4,
+			GetImageResponse: hashed,
+			GetImageCalls:    1,
+			GetSimilarError:  errors.New("connection refused"),
+			GetSimilarCalls:  1,
+			ExpectedError:    fmt.Errorf("unable to fetch similar images - %w", errors.New("connection refused")),
+		},
+	}
+
+	config := config.Config{
+		PublicBaseURL:      "https://cdn.example.com",
+		MaxPageSize:        2,
+		SimilarMaxDistance: 6,
+	}
+	database := mocks.NewMockDatabase(ctrl)
+	imageService := NewImageService(&config, database, nil, nil, NewDecodeOptions(&config))
+	for _, test := range tests {
+		database.EXPECT().GetImage(int64(1)).Return(test.GetImageResponse, test.GetImageError).Times(test.GetImageCalls)
+		database.EXPECT().GetSimilarImages(^uint64(1), test.Distance, 3).
+			Return(test.GetSimilarResponse, test.GetSimilarError).
+			Times(test.GetSimilarCalls)
+		response, err := imageService.GetSimilarImages(1, test.Distance)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorIs(t, err, test.ExpectedErrorMatch, test.Name)
+			continue
+		}
+		assert.Equal(t, test.ExpectedError, err, test.Name)
+		assert.Equal(t, test.ExpectedResponse, response, test.Name)
+	}
+}
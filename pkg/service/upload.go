@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ksindhwani/imagegram/pkg/filesystem"
+)
+
+const ORIGINAL_IMAGE_SUBDIRECTORY = "originals"
+
+// Uploads streamed in are stored under this prefix while they are checked, then
+// moved under their content addressed key
+const STAGING_SUBDIRECTORY = UPLOAD_SUBDIRECTORY + "/staging"
+
+// Originals stored for a post that couldn't be saved are noted under this prefix,
+// the upload cleanup deletes them once no image points to them
+const ORPHAN_SUBDIRECTORY = UPLOAD_SUBDIRECTORY + "/orphans"
+
+var safeExtension = regexp.MustCompile(`^\.[a-z0-9]{1,10}$`)
+
+// StorageKey returns the content addressed key an original is stored under, e.g.
+// originals/9f/86/9f86d08...0a08.png. The hash is sharded into two levels of
+// subdirectories so no directory grows too large. Only the extension of the client
+// supplied file name is kept, and only when it is a plain extension.
+func StorageKey(contentHash string, fileName string) string {
+	extension := strings.ToLower(path.Ext(fileName))
+	if !safeExtension.MatchString(extension) {
+		extension = ""
+	}
+	return path.Join(ORIGINAL_IMAGE_SUBDIRECTORY, contentHash[0:2], contentHash[2:4], contentHash+extension)
+}
+
+// StagedUpload is the content of an upload, hashed and ready to be read again.
+// Close it once done, content still staged is deleted.
+type StagedUpload struct {
+	FileName    string
+	ContentHash string
+	content     io.ReadSeeker
+	file        io.Closer // staged file open for reading, nil when the content wasn't staged
+	stagedKey   string    // where the content is staged, empty once moved or when not staged
+	movedFrom   string    // where the content was staged before store moved it
+	stored      bool      // the content was stored by the client, it is kept for a retry
+	fileSystem  filesystem.FileSystem
+}
+
+// Seekable readers are hashed and rewound in place. Anything else is streamed to the
+// file system under STAGING_SUBDIRECTORY while it is hashed, nothing is buffered.
+// Content over maxBytes fails with ErrUploadTooLarge, 0 doesn't limit it.
+func stageContent(ctx context.Context, fileSystem filesystem.FileSystem, fileName string, reader io.Reader, maxBytes int64) (*StagedUpload, error) {
+	upload := &StagedUpload{FileName: fileName, fileSystem: fileSystem}
+	hash := sha256.New()
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		size, err := io.Copy(hash, seeker)
+		if err != nil {
+			return nil, err
+		}
+		if maxBytes > 0 && size > maxBytes {
+			return nil, ErrUploadTooLarge
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		upload.ContentHash = hex.EncodeToString(hash.Sum(nil))
+		upload.content = seeker
+		return upload, nil
+	}
+
+	if maxBytes > 0 {
+		reader = &limitedReader{reader: reader, remaining: maxBytes}
+	}
+	name, err := randomHex(16)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate staging key - %w", err)
+	}
+	upload.stagedKey = path.Join(STAGING_SUBDIRECTORY, name)
+	_, err = fileSystem.Save(ctx, upload.stagedKey, io.TeeReader(reader, hash), originalMetadata(fileName))
+	if err != nil {
+		upload.Close()
+		return nil, err
+	}
+	file, _, err := fileSystem.Open(upload.stagedKey)
+	if err != nil {
+		upload.Close()
+		return nil, err
+	}
+	upload.ContentHash = hex.EncodeToString(hash.Sum(nil))
+	upload.content = file
+	upload.file = file
+	return upload, nil
+}
+
+// Stage file, the content already stored under key, e.g. uploaded by a client straight
+// to storage. Like content staged by stageContent it is moved under its content
+// addressed key, or deleted on Close. The caller closes file when staging fails.
+func stageStored(ctx context.Context, fileSystem filesystem.FileSystem, key string, fileName string, file io.ReadSeekCloser, maxBytes int64) (*StagedUpload, error) {
+	upload, err := stageContent(ctx, fileSystem, fileName, file, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	upload.file = file
+	upload.stagedKey = key
+	upload.stored = true
+	return upload, nil
+}
+
+// Store the content under key and return its location. Staged content is moved
+// there, the rest is saved.
+func (su *StagedUpload) store(ctx context.Context, key string) (string, error) {
+	if su.stagedKey == "" {
+		return su.fileSystem.Save(ctx, key, su.content, originalMetadata(su.FileName))
+	}
+	su.closeFile()
+	location, err := su.fileSystem.Move(ctx, su.stagedKey, key)
+	if err != nil {
+		return "", err
+	}
+	su.stagedKey, su.movedFrom = "", su.stagedKey
+	return location, nil
+}
+
+// Put a copy of content the client stored back where it was before store moved it
+// under key, so the client can retry. key is left as it is, another upload of the
+// same content may already point to it.
+func (su *StagedUpload) restore(ctx context.Context, key string) error {
+	if !su.stored || su.movedFrom == "" {
+		return nil
+	}
+	file, _, err := su.fileSystem.Open(key)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := su.fileSystem.Save(ctx, su.movedFrom, file, originalMetadata(su.FileName)); err != nil {
+		return err
+	}
+	su.stagedKey, su.movedFrom = su.movedFrom, ""
+	return nil
+}
+
+// Note an original stored for a post that couldn't be saved. It isn't deleted right
+// away, an upload of the same content may have stored it too and be about to point
+// to it, see removeOrphanedOriginals.
+func noteOrphanedOriginal(ctx context.Context, fileSystem filesystem.FileSystem, key string) error {
+	name, err := randomHex(16)
+	if err != nil {
+		return fmt.Errorf("unable to generate orphan key - %w", err)
+	}
+	_, err = fileSystem.Save(ctx, path.Join(ORPHAN_SUBDIRECTORY, name), strings.NewReader(key), nil)
+	return err
+}
+
+func (su *StagedUpload) Close() {
+	su.closeFile()
+	if su.stagedKey == "" {
+		return
+	}
+	if err := su.fileSystem.Delete(su.stagedKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("unable to delete staged upload %s: %s", su.stagedKey, err.Error())
+	}
+	su.stagedKey = ""
+}
+
+// Keep the staged content where it is, Close no longer deletes it
+func (su *StagedUpload) keep() {
+	su.stagedKey = ""
+}
+
+func (su *StagedUpload) closeFile() {
+	if su.file != nil {
+		su.file.Close()
+		su.file = nil
+	}
+}
+
+func originalMetadata(fileName string) map[string]string {
+	return map[string]string{
+		"original-filename": fileName,
+	}
+}
+
+// limitedReader fails with ErrUploadTooLarge once more than remaining bytes are read
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.reader.Read(p)
+	lr.remaining -= int64(n)
+	if lr.remaining < 0 {
+		return 0, ErrUploadTooLarge
+	}
+	return n, err
+}
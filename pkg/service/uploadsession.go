@@ -0,0 +1,583 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/database"
+	"github.com/ksindhwani/imagegram/pkg/filesystem"
+	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+)
+
+// Chunks of resumable uploads are stored under this prefix until the upload is
+// finalized into a post
+const UPLOAD_SUBDIRECTORY = "uploads"
+
+// Expired uploads are removed this many at a time
+const uploadCleanupPageSize = 100
+
+var (
+	ErrUploadNotFound       = errors.New("no upload found with the given id")
+	ErrInvalidUpload        = errors.New("invalid upload")
+	ErrUploadTooLarge       = errors.New("upload is too large")
+	ErrUploadOffsetMismatch = errors.New("offset doesn't match the upload's")
+	ErrUploadIncomplete     = errors.New("upload is incomplete")
+	ErrUploadFinalizing     = errors.New("upload is being finalized")
+	ErrUnsupportedChecksum  = errors.New("unsupported checksum")
+	ErrChecksumMismatch     = errors.New("checksum doesn't match the chunk")
+)
+
+// Checksum algorithms chunks can be verified with, by their name in the Upload-Checksum header
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// UploadSessionService receives an image in chunks over as many requests as the
+// client needs, then creates the post with it
+type UploadSessionService struct {
+	Config      config.Config
+	Database    database.Database
+	FileSystem  filesystem.FileSystem
+	PostService *PostService
+}
+
+func NewUploadSessionService(
+	Config *config.Config,
+	database database.Database,
+	fileSystem filesystem.FileSystem,
+	postService *PostService,
+) *UploadSessionService {
+	return &UploadSessionService{
+		Config:      *Config,
+		Database:    database,
+		FileSystem:  fileSystem,
+		PostService: postService,
+	}
+}
+
+type UploadSession struct {
+	UploadId  string    `json:"uploadId"`
+	Offset    int64     `json:"offset"` // bytes received so far, the next chunk starts here
+	Length    int64     `json:"length"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	PostId    int64     `json:"postId,omitempty"` // set once the upload is finalized
+}
+
+// ChecksumAlgorithms lists the algorithms WriteChunk verifies, sorted
+func ChecksumAlgorithms() []string {
+	algorithms := make([]string, 0, len(checksumAlgorithms))
+	for algorithm := range checksumAlgorithms {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	return algorithms
+}
+
+// Start an upload of length bytes for a post
+func (us *UploadSessionService) CreateUpload(post Post, fileName string, length int64) (UploadSession, error) {
+	if length <= 0 || post.UserId <= 0 || fileName == "" || len(fileName) > 255 {
+		return UploadSession{}, fmt.Errorf("%w - length, file name and user id are required", ErrInvalidUpload)
+	}
+	if length > us.Config.UploadMaxBytes {
+		return UploadSession{}, fmt.Errorf("%w - at most %d bytes are accepted", ErrUploadTooLarge, us.Config.UploadMaxBytes)
+	}
+	uploadId, err := newUploadId()
+	if err != nil {
+		return UploadSession{}, fmt.Errorf("unable to generate upload id - %w", err)
+	}
+	err = us.Database.CreateUploadSession(tables.UploadSessionTable{
+		UploadId: uploadId,
+		UserId:   post.UserId,
+		Caption:  post.Caption,
+		FileName: fileName,
+		Length:   length,
+	}, us.Config.UploadSessionTTL)
+	if err != nil {
+		return UploadSession{}, fmt.Errorf("unable to save upload in database - %w", err)
+	}
+	return us.GetUpload(uploadId)
+}
+
+func (us *UploadSessionService) GetUpload(uploadId string) (UploadSession, error) {
+	session, err := us.Database.GetUploadSession(uploadId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UploadSession{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return UploadSession{}, fmt.Errorf("unable to fetch upload from database - %w", err)
+	}
+	return uploadSession(session), nil
+}
+
+// Store the chunk read from body at offset, which must be the upload's current
+// offset. checksum is empty or "<algorithm> <base64 digest>", a chunk that doesn't
+// match it is dropped. Without a checksum the bytes received before body fails are
+// kept, so a client losing its connection resumes from where it got to.
+func (us *UploadSessionService) WriteChunk(uploadId string, offset int64, checksum string, body io.Reader) (UploadSession, error) {
+	var digest hash.Hash
+	var expected []byte
+	if checksum != "" {
+		var err error
+		digest, expected, err = parseChecksum(checksum)
+		if err != nil {
+			return UploadSession{}, err
+		}
+	}
+	session, err := us.GetUpload(uploadId)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	if offset != session.Offset {
+		return session, fmt.Errorf("%w - upload is at offset %d", ErrUploadOffsetMismatch, session.Offset)
+	}
+
+	chunk := &chunkReader{reader: body, remaining: session.Length - session.Offset, hash: digest}
+	suffix, err := randomHex(4)
+	if err != nil {
+		return session, fmt.Errorf("unable to generate chunk key - %w", err)
+	}
+	key := path.Join(UPLOAD_SUBDIRECTORY, uploadId, fmt.Sprintf("%020d-%s", offset, suffix))
+	// Not the request's context, it is cancelled when the client goes away and the
+	// bytes received until then are worth keeping
+	if _, err := us.FileSystem.Save(context.Background(), key, chunk, nil); err != nil {
+		us.deletePart(key)
+		if errors.Is(err, ErrUploadTooLarge) {
+			return session, fmt.Errorf("%w - only %d bytes are left", ErrUploadTooLarge, session.Length-session.Offset)
+		}
+		return session, fmt.Errorf("error in saving chunk - %w", err)
+	}
+	if digest != nil && (chunk.err != nil || !bytes.Equal(digest.Sum(nil), expected)) {
+		us.deletePart(key)
+		if chunk.err != nil {
+			return session, fmt.Errorf("error in reading chunk - %w", chunk.err)
+		}
+		return session, ErrChecksumMismatch
+	}
+	if chunk.size == 0 {
+		us.deletePart(key)
+		return session, nil
+	}
+
+	err = us.Database.SaveUploadPart(tables.UploadPartTable{
+		UploadId:   uploadId,
+		Offset:     offset,
+		Size:       chunk.size,
+		StorageKey: key,
+	}, us.Config.UploadSessionTTL)
+	if err != nil {
+		us.deletePart(key)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Another request wrote at this offset first, or the upload is being finalized
+			return session, ErrUploadOffsetMismatch
+		}
+		return session, fmt.Errorf("unable to save chunk in database - %w", err)
+	}
+	if chunk.err != nil {
+		log.Printf("upload %s interrupted at offset %d: %s", uploadId, offset+chunk.size, chunk.err.Error())
+	}
+	session.Offset += chunk.size
+	session.ExpiresAt = time.Now().Add(us.Config.UploadSessionTTL)
+	return session, nil
+}
+
+// Create the post with a complete upload. Finalizing an upload again returns the same
+// post. Uploads that can never make a post, e.g. not an allowed image, are deleted.
+func (us *UploadSessionService) FinalizeUpload(ctx context.Context, uploadId string) (PostResponse, error) {
+	session, err := us.Database.GetUploadSession(uploadId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PostResponse{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return PostResponse{}, fmt.Errorf("unable to fetch upload from database - %w", err)
+	}
+	if session.PostId != 0 {
+		return PostResponse{PostId: session.PostId, Success: true}, nil
+	}
+	if session.Offset < session.Length {
+		return PostResponse{}, fmt.Errorf("%w - %d of %d bytes received", ErrUploadIncomplete, session.Offset, session.Length)
+	}
+	err = us.Database.ClaimUploadSession(uploadId, us.Config.UploadClaimTimeout)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PostResponse{}, ErrUploadFinalizing
+	}
+	if err != nil {
+		return PostResponse{}, fmt.Errorf("unable to claim upload - %w", err)
+	}
+
+	response, err := us.createPost(ctx, session)
+	if err != nil {
+		if isRefusedUpload(err) {
+			if err := us.removeUpload(uploadId); err != nil {
+				log.Printf("unable to remove refused upload %s: %s", uploadId, err.Error())
+			}
+		} else if err := us.Database.ReleaseUploadSession(uploadId); err != nil {
+			log.Printf("unable to release upload %s: %s", uploadId, err.Error())
+		}
+		return PostResponse{}, err
+	}
+
+	if err := us.Database.FinishUploadSession(uploadId, response.PostId); err != nil {
+		// The post exists, the chunks are removed with the upload when it expires
+		log.Printf("unable to record post %d of upload %s: %s", response.PostId, uploadId, err.Error())
+		return response, nil
+	}
+	if err := us.deleteParts(uploadId); err != nil {
+		log.Printf("unable to delete chunks of upload %s: %s", uploadId, err.Error())
+	}
+	return response, nil
+}
+
+func (us *UploadSessionService) createPost(ctx context.Context, session tables.UploadSessionTable) (PostResponse, error) {
+	parts, err := us.Database.GetUploadParts(session.UploadId)
+	if err != nil {
+		return PostResponse{}, fmt.Errorf("unable to fetch chunks from database - %w", err)
+	}
+	var size int64
+	for _, part := range parts {
+		if part.Offset != size {
+			return PostResponse{}, fmt.Errorf("chunk at offset %d is missing", size)
+		}
+		size += part.Size
+	}
+	if size != session.Length {
+		return PostResponse{}, fmt.Errorf("chunks add up to %d of %d bytes", size, session.Length)
+	}
+
+	file := &partsReader{fileSystem: us.FileSystem, parts: parts}
+	defer file.Close()
+	post := Post{UserId: session.UserId, Caption: session.Caption}
+	_, content, err := us.PostService.DecodeOptions.Validate(file, session.FileName)
+	if errors.Is(err, decoder.ErrHeaderTooLarge) {
+		upload, err := us.PostService.StageAndValidate(ctx, session.FileName, content)
+		if err != nil {
+			return PostResponse{}, err
+		}
+		defer upload.Close()
+		return us.PostService.CreateStagedPost(ctx, post, upload)
+	}
+	if err != nil {
+		return PostResponse{}, err
+	}
+	return us.PostService.CreateNewPost(ctx, post, session.FileName, content)
+}
+
+// Stop an upload and delete what was received of it
+func (us *UploadSessionService) DeleteUpload(uploadId string) error {
+	session, err := us.Database.GetUploadSession(uploadId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUploadNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("unable to fetch upload from database - %w", err)
+	}
+	if session.PostId == 0 && session.FinalizedAt.Valid && time.Since(session.FinalizedAt.Time) < us.Config.UploadClaimTimeout {
+		// A claim older than that was left by a process that stopped while posting
+		return ErrUploadFinalizing
+	}
+	if err := us.deleteParts(uploadId); err != nil {
+		return err
+	}
+	err = us.Database.DeleteUploadSession(uploadId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUploadNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("unable to delete upload from database - %w", err)
+	}
+	return nil
+}
+
+// Delete the uploads left idle past UPLOAD_SESSION_TTL and what was received of
+// them, direct uploads never posted within that time and uploads staged that long
+// ago by requests that never finished.
+// Returns the number of uploads deleted.
+func (us *UploadSessionService) RemoveExpiredUploads() (int, error) {
+	removed := 0
+	for {
+		uploadIds, err := us.Database.GetExpiredUploadSessions(uploadCleanupPageSize)
+		if err != nil {
+			return removed, fmt.Errorf("unable to fetch expired uploads - %w", err)
+		}
+		for _, uploadId := range uploadIds {
+			if err := us.removeUpload(uploadId); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+		if len(uploadIds) < uploadCleanupPageSize {
+			break
+		}
+	}
+
+	for {
+		uploadIds, err := us.Database.GetExpiredDirectUploads(uploadCleanupPageSize)
+		if err != nil {
+			return removed, fmt.Errorf("unable to fetch expired direct uploads - %w", err)
+		}
+		for _, uploadId := range uploadIds {
+			if err := removeDirectUpload(us.Database, us.FileSystem, uploadId); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+		if len(uploadIds) < uploadCleanupPageSize {
+			break
+		}
+	}
+
+	keys, err := us.FileSystem.List(STAGING_SUBDIRECTORY + "/")
+	if err != nil {
+		return removed, fmt.Errorf("unable to list staged uploads - %w", err)
+	}
+	for _, key := range keys {
+		info, err := us.FileSystem.Stat(key)
+		if err != nil || time.Since(info.ModTime()) < us.Config.UploadSessionTTL {
+			// Gone meanwhile or still in use
+			continue
+		}
+		us.deletePart(key)
+		removed++
+	}
+
+	orphans, err := us.removeOrphanedOriginals()
+	return removed + orphans, err
+}
+
+// Delete the originals noted by posts that couldn't be saved once UPLOAD_SESSION_TTL
+// passed and no image points to them. An original stored again since, by an upload
+// of the same content, is left to that upload.
+// Returns the number of originals deleted.
+func (us *UploadSessionService) removeOrphanedOriginals() (int, error) {
+	notes, err := us.FileSystem.List(ORPHAN_SUBDIRECTORY + "/")
+	if err != nil {
+		return 0, fmt.Errorf("unable to list orphaned originals - %w", err)
+	}
+	removed := 0
+	for _, note := range notes {
+		info, err := us.FileSystem.Stat(note)
+		if err != nil || time.Since(info.ModTime()) < us.Config.UploadSessionTTL {
+			continue
+		}
+		key, err := us.readNote(note)
+		if err != nil {
+			return removed, err
+		}
+		_, err = us.Database.GetImageByStorageKey(key)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return removed, fmt.Errorf("unable to fetch image of %s from database - %w", key, err)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			original, statErr := us.FileSystem.Stat(key)
+			if statErr == nil && time.Since(original.ModTime()) >= us.Config.UploadSessionTTL {
+				if err := us.FileSystem.Delete(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return removed, fmt.Errorf("unable to delete orphaned original %s - %w", key, err)
+				}
+				removed++
+			}
+		}
+		us.deletePart(note)
+	}
+	return removed, nil
+}
+
+func (us *UploadSessionService) readNote(key string) (string, error) {
+	file, _, err := us.FileSystem.Open(key)
+	if err != nil {
+		return "", fmt.Errorf("unable to open %s - %w", key, err)
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, 1024))
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s - %w", key, err)
+	}
+	return string(content), nil
+}
+
+// Remove expired uploads every UPLOAD_CLEANUP_INTERVAL until ctx is cancelled
+func (us *UploadSessionService) RunUploadCleanup(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(us.Config.UploadCleanupInterval):
+		}
+		removed, err := us.RemoveExpiredUploads()
+		if err != nil {
+			log.Printf("upload cleanup: %s", err.Error())
+		}
+		if removed > 0 {
+			log.Printf("upload cleanup: removed %d expired uploads", removed)
+		}
+	}
+}
+
+func (us *UploadSessionService) removeUpload(uploadId string) error {
+	if err := us.deleteParts(uploadId); err != nil {
+		return err
+	}
+	err := us.Database.DeleteUploadSession(uploadId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("unable to delete upload %s from database - %w", uploadId, err)
+	}
+	return nil
+}
+
+// Delete the stored chunks of an upload, including any a failed request left behind
+func (us *UploadSessionService) deleteParts(uploadId string) error {
+	keys, err := us.FileSystem.List(path.Join(UPLOAD_SUBDIRECTORY, uploadId) + "/")
+	if err != nil {
+		return fmt.Errorf("unable to list chunks of upload %s - %w", uploadId, err)
+	}
+	for _, key := range keys {
+		if err := us.FileSystem.Delete(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to delete chunk %s - %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (us *UploadSessionService) deletePart(key string) {
+	if err := us.FileSystem.Delete(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("unable to delete chunk %s: %s", key, err.Error())
+	}
+}
+
+// isRefusedUpload tells whether the post was refused for what the file is, trying
+// again won't make a difference
+func isRefusedUpload(err error) bool {
+	var unsupported *decoder.UnsupportedFormatError
+	var mismatch *decoder.FormatMismatchError
+	var tooLarge *decoder.TooLargeError
+	var duplicate *DuplicateImageError
+	var blocked *BlockedImageError
+	return errors.As(err, &unsupported) ||
+		errors.As(err, &mismatch) ||
+		errors.As(err, &tooLarge) ||
+		errors.Is(err, decoder.ErrInvalidImage) ||
+		errors.As(err, &duplicate) ||
+		errors.As(err, &blocked)
+}
+
+func uploadSession(session tables.UploadSessionTable) UploadSession {
+	return UploadSession{
+		UploadId:  session.UploadId,
+		Offset:    session.Offset,
+		Length:    session.Length,
+		ExpiresAt: session.ExpiresAt,
+		PostId:    session.PostId,
+	}
+}
+
+func parseChecksum(checksum string) (hash.Hash, []byte, error) {
+	algorithm, encoded, _ := strings.Cut(strings.TrimSpace(checksum), " ")
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w - %q", ErrUnsupportedChecksum, algorithm)
+	}
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w - digest should be base64 - %s", ErrUnsupportedChecksum, err.Error())
+	}
+	return newHash(), expected, nil
+}
+
+func newUploadId() (string, error) {
+	return randomHex(16)
+}
+
+// Hex of length random bytes, for keys that must not collide
+func randomHex(length int) (string, error) {
+	value := make([]byte, length)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(value), nil
+}
+
+// chunkReader counts and hashes a chunk as it is stored and refuses more than
+// remaining bytes. A failing body, usually a client going away, ends the chunk
+// instead of failing it, the error is kept in err.
+type chunkReader struct {
+	reader    io.Reader
+	remaining int64
+	hash      hash.Hash // nil when the chunk has no checksum
+	size      int64
+	err       error
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.size += int64(n)
+	if cr.size > cr.remaining {
+		return 0, ErrUploadTooLarge
+	}
+	if cr.hash != nil {
+		cr.hash.Write(p[:n])
+	}
+	if err != nil && err != io.EOF {
+		cr.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// partsReader reads the chunks of an upload one after the other as a single file
+type partsReader struct {
+	fileSystem filesystem.FileSystem
+	parts      []tables.UploadPartTable
+	current    io.ReadCloser
+}
+
+func (pr *partsReader) Read(p []byte) (int, error) {
+	for {
+		if pr.current == nil {
+			if len(pr.parts) == 0 {
+				return 0, io.EOF
+			}
+			file, _, err := pr.fileSystem.Open(pr.parts[0].StorageKey)
+			if err != nil {
+				return 0, fmt.Errorf("unable to open chunk at offset %d - %w", pr.parts[0].Offset, err)
+			}
+			pr.current = file
+			pr.parts = pr.parts[1:]
+		}
+		n, err := pr.current.Read(p)
+		if err == io.EOF {
+			pr.current.Close()
+			pr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (pr *partsReader) Close() error {
+	if pr.current == nil {
+		return nil
+	}
+	return pr.current.Close()
+}
@@ -0,0 +1,480 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ksindhwani/imagegram/pkg/config"
+	"github.com/ksindhwani/imagegram/pkg/filesystem/local"
+	"github.com/ksindhwani/imagegram/pkg/internal/decoder"
+	"github.com/ksindhwani/imagegram/pkg/internal/tables"
+	"github.com/ksindhwani/imagegram/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+const testUploadId = "0123456789abcdef0123456789abcdef"
+
+func TestCreateUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	expiresAt := time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Name               string
+		Post               Post
+		FileName           string
+		Length             int64
+		CreateError        error
+		CreateCalls        int
+		ExpectedResponse   UploadSession
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:             "Test upload is created",
+			Post:             Post{UserId: 1, Caption: "sunset"},
+			FileName:         "sunset.png",
+			Length:           1000,
+			CreateCalls:      1,
+			ExpectedResponse: UploadSession{UploadId: testUploadId, Length: 1000, ExpiresAt: expiresAt},
+		},
+		{Name: "Test upload over the limit", Post: Post{UserId: 1}, FileName: "a.png", Length: 1001, ExpectedErrorMatch: ErrUploadTooLarge},
+		{Name: "Test empty upload", Post: Post{UserId: 1}, FileName: "a.png", ExpectedErrorMatch: ErrInvalidUpload},
+		{Name: "Test upload without user", FileName: "a.png", Length: 10, ExpectedErrorMatch: ErrInvalidUpload},
+		{Name: "Test upload without file name", Post: Post{UserId: 1}, Length: 10, ExpectedErrorMatch: ErrInvalidUpload},
+		{
+			Name:               "Test error in saving upload",
+			Post:               Post{UserId: 1},
+			FileName:           "a.png",
+			Length:             10,
+			CreateError:        errors.New("connection refused"),
+			CreateCalls:        1,
+			ExpectedErrorMatch: errors.New("connection refused"),
+		},
+	}
+
+	config := config.Config{UploadMaxBytes: 1000, UploadSessionTTL: time.Hour}
+	db := mocks.NewMockDatabase(ctrl)
+	uploadService := NewUploadSessionService(&config, db, nil, nil)
+	for _, test := range tests {
+		var uploadId string
+		db.EXPECT().CreateUploadSession(gomock.Any(), time.Hour).DoAndReturn(
+			func(session tables.UploadSessionTable, ttl time.Duration) error {
+				assert.Len(t, session.UploadId, 32, test.Name)
+				assert.Equal(t, test.Post.Caption, session.Caption, test.Name)
+				assert.Equal(t, test.Length, session.Length, test.Name)
+				uploadId = session.UploadId
+				return test.CreateError
+			}).Times(test.CreateCalls)
+		if test.CreateError == nil && test.CreateCalls > 0 {
+			db.EXPECT().GetUploadSession(gomock.Any()).DoAndReturn(
+				func(id string) (tables.UploadSessionTable, error) {
+					assert.Equal(t, uploadId, id, test.Name)
+					return tables.UploadSessionTable{UploadId: testUploadId, Length: test.Length, ExpiresAt: expiresAt}, nil
+				}).Times(1)
+		}
+
+		response, err := uploadService.CreateUpload(test.Post, test.FileName, test.Length)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorContains(t, err, test.ExpectedErrorMatch.Error(), test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedResponse, response, test.Name)
+	}
+}
+
+// failingReader returns its content then fails, like a connection dropping
+type failingReader struct {
+	reader io.Reader
+}
+
+func (fr failingReader) Read(p []byte) (int, error) {
+	n, err := fr.reader.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset by peer")
+	}
+	return n, err
+}
+
+func TestWriteChunk(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sum := sha256.Sum256([]byte("hello"))
+	checksum := "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+	tests := []struct {
+		Name               string
+		Offset             int64
+		Checksum           string
+		Body               io.Reader
+		GetSessionError    error
+		SavePartError      error
+		SavePartCalls      int
+		ExpectedPartSize   int64
+		ExpectedOffset     int64
+		ExpectedChunks     int
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:             "Test chunk is stored",
+			Offset:           5,
+			Body:             strings.NewReader("hello"),
+			SavePartCalls:    1,
+			ExpectedPartSize: 5,
+			ExpectedOffset:   10,
+			ExpectedChunks:   1,
+		},
+		{
+			Name:             "Test chunk matching its checksum is stored",
+			Offset:           5,
+			Checksum:         checksum,
+			Body:             strings.NewReader("hello"),
+			SavePartCalls:    1,
+			ExpectedPartSize: 5,
+			ExpectedOffset:   10,
+			ExpectedChunks:   1,
+		},
+		{
+			Name:               "Test chunk not matching its checksum is dropped",
+			Offset:             5,
+			Checksum:           checksum,
+			Body:               strings.NewReader("hellO"),
+			ExpectedErrorMatch: ErrChecksumMismatch,
+		},
+		{Name: "Test unknown checksum algorithm", Offset: 5, Checksum: "crc32 AAAAAA==", Body: strings.NewReader("hello"), ExpectedErrorMatch: ErrUnsupportedChecksum},
+		{Name: "Test chunk at the wrong offset", Offset: 0, Body: strings.NewReader("hello"), ExpectedErrorMatch: ErrUploadOffsetMismatch},
+		{Name: "Test chunk past the upload's length", Offset: 5, Body: strings.NewReader("hello world"), ExpectedErrorMatch: ErrUploadTooLarge},
+		{Name: "Test unknown upload", Offset: 5, Body: strings.NewReader("hello"), GetSessionError: sql.ErrNoRows, ExpectedErrorMatch: ErrUploadNotFound},
+		{
+			Name:             "Test bytes received before the connection dropped are kept",
+			Offset:           5,
+			Body:             failingReader{strings.NewReader("hel")},
+			SavePartCalls:    1,
+			ExpectedPartSize: 3,
+			ExpectedOffset:   8,
+			ExpectedChunks:   1,
+		},
+		{
+			Name:               "Test interrupted chunk with a checksum is dropped",
+			Offset:             5,
+			Checksum:           checksum,
+			Body:               failingReader{strings.NewReader("hel")},
+			ExpectedErrorMatch: errors.New("connection reset by peer"),
+		},
+		{Name: "Test empty chunk", Offset: 5, Body: strings.NewReader(""), ExpectedOffset: 5},
+		{
+			Name:               "Test another request wrote the chunk first",
+			Offset:             5,
+			Body:               strings.NewReader("hello"),
+			SavePartError:      sql.ErrNoRows,
+			SavePartCalls:      1,
+			ExpectedPartSize:   5,
+			ExpectedErrorMatch: ErrUploadOffsetMismatch,
+		},
+	}
+
+	config := config.Config{UploadSessionTTL: time.Hour}
+	for _, test := range tests {
+		fileSystem := local.New("test host directory", t.TempDir())
+		db := mocks.NewMockDatabase(ctrl)
+		uploadService := NewUploadSessionService(&config, db, fileSystem, nil)
+
+		db.EXPECT().GetUploadSession(testUploadId).
+			Return(tables.UploadSessionTable{UploadId: testUploadId, Offset: 5, Length: 10}, test.GetSessionError).
+			AnyTimes()
+		db.EXPECT().SaveUploadPart(gomock.Any(), time.Hour).DoAndReturn(
+			func(part tables.UploadPartTable, ttl time.Duration) error {
+				assert.Equal(t, test.Offset, part.Offset, test.Name)
+				assert.Equal(t, test.ExpectedPartSize, part.Size, test.Name)
+				assert.True(t, strings.HasPrefix(part.StorageKey, "uploads/"+testUploadId+"/00000000000000000005-"), test.Name)
+				return test.SavePartError
+			}).Times(test.SavePartCalls)
+
+		response, err := uploadService.WriteChunk(testUploadId, test.Offset, test.Checksum, test.Body)
+		keys, listErr := fileSystem.List(UPLOAD_SUBDIRECTORY + "/")
+		assert.Nil(t, listErr, test.Name)
+		assert.Len(t, keys, test.ExpectedChunks, test.Name)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorContains(t, err, test.ExpectedErrorMatch.Error(), test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedOffset, response.Offset, test.Name)
+	}
+}
+
+func TestFinalizeUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var encoded bytes.Buffer
+	assert.Nil(t, png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 8))))
+	content := encoded.Bytes()
+	contentHash := sha256.Sum256(content)
+	half := int64(len(content) / 2)
+	parts := []tables.UploadPartTable{
+		{UploadId: testUploadId, Offset: 0, Size: half, StorageKey: "uploads/" + testUploadId + "/0"},
+		{UploadId: testUploadId, Offset: half, Size: int64(len(content)) - half, StorageKey: "uploads/" + testUploadId + "/1"},
+	}
+	complete := tables.UploadSessionTable{
+		UploadId: testUploadId,
+		UserId:   1,
+		Caption:  "sunset",
+		FileName: "sunset.png",
+		Length:   int64(len(content)),
+		Offset:   int64(len(content)),
+	}
+	staleClaim := complete
+	staleClaim.FinalizedAt = sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}
+
+	tests := []struct {
+		Name               string
+		FileName           string
+		Session            tables.UploadSessionTable
+		ClaimCalls         int
+		InsertError        error
+		InsertCalls        int
+		ExpectedFinish     int
+		ExpectedRelease    int
+		ExpectedDelete     int
+		ExpectedKeys       []string
+		ExpectedResponse   PostResponse
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:             "Test complete upload becomes a post",
+			Session:          complete,
+			ClaimCalls:       1,
+			InsertCalls:      1,
+			ExpectedFinish:   1,
+			ExpectedKeys:     []string{StorageKey(hex.EncodeToString(contentHash[:]), "sunset.png")},
+			ExpectedResponse: PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:             "Test claim left by a stopped process is taken over",
+			Session:          staleClaim,
+			ClaimCalls:       1,
+			InsertCalls:      1,
+			ExpectedFinish:   1,
+			ExpectedKeys:     []string{StorageKey(hex.EncodeToString(contentHash[:]), "sunset.png")},
+			ExpectedResponse: PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:             "Test finalizing again returns the same post",
+			Session:          tables.UploadSessionTable{UploadId: testUploadId, PostId: 5},
+			ExpectedKeys:     []string{parts[0].StorageKey, parts[1].StorageKey},
+			ExpectedResponse: PostResponse{PostId: 5, Success: true},
+		},
+		{
+			Name:               "Test incomplete upload",
+			Session:            tables.UploadSessionTable{UploadId: testUploadId, Length: 100, Offset: 10},
+			ExpectedKeys:       []string{parts[0].StorageKey, parts[1].StorageKey},
+			ExpectedErrorMatch: ErrUploadIncomplete,
+		},
+		{
+			Name:               "Test upload that isn't what its name says is deleted",
+			FileName:           "sunset.jpg",
+			Session:            complete,
+			ClaimCalls:         1,
+			ExpectedDelete:     1,
+			ExpectedErrorMatch: &decoder.FormatMismatchError{Extension: ".jpg", Format: "png"},
+		},
+		{
+			Name:               "Test upload is released for a retry when the post can't be saved",
+			Session:            complete,
+			ClaimCalls:         1,
+			InsertError:        errors.New("connection refused"),
+			InsertCalls:        1,
+			ExpectedRelease:    1,
+			ExpectedKeys:       []string{StorageKey(hex.EncodeToString(contentHash[:]), "sunset.png"), parts[0].StorageKey, parts[1].StorageKey, ORPHAN_SUBDIRECTORY + "/*"},
+			ExpectedErrorMatch: errors.New("connection refused"),
+		},
+	}
+
+	any := gomock.Any()
+	config := config.Config{ImageFormats: []string{"png"}, UploadClaimTimeout: time.Minute}
+	for _, test := range tests {
+		fileSystem := local.New("test host directory", t.TempDir())
+		for _, part := range parts {
+			_, err := fileSystem.Save(context.Background(), part.StorageKey, bytes.NewReader(content[part.Offset:part.Offset+part.Size]), nil)
+			assert.Nil(t, err)
+		}
+		db := mocks.NewMockDatabase(ctrl)
+		postService := NewPostService(&config, db, fileSystem, nil, NewDecodeOptions(&config))
+		uploadService := NewUploadSessionService(&config, db, fileSystem, postService)
+
+		session := test.Session
+		if test.FileName != "" {
+			session.FileName = test.FileName
+		}
+		db.EXPECT().GetUploadSession(testUploadId).Return(session, nil).Times(1)
+		db.EXPECT().ClaimUploadSession(testUploadId, time.Minute).Return(nil).Times(test.ClaimCalls)
+		db.EXPECT().GetUploadParts(testUploadId).Return(parts, nil).Times(test.ClaimCalls)
+		db.EXPECT().GetImageByContentHash(any).Return(tables.ImageTable{}, sql.ErrNoRows).Times(test.InsertCalls)
+		db.EXPECT().InsertNewPost(tables.PostTable{UserId: 1, Caption: "sunset"}, any).Return(int64(5), test.InsertError).Times(test.InsertCalls)
+		db.EXPECT().FinishUploadSession(testUploadId, int64(5)).Return(nil).Times(test.ExpectedFinish)
+		db.EXPECT().ReleaseUploadSession(testUploadId).Return(nil).Times(test.ExpectedRelease)
+		db.EXPECT().DeleteUploadSession(testUploadId).Return(nil).Times(test.ExpectedDelete)
+
+		response, err := uploadService.FinalizeUpload(context.Background(), testUploadId)
+		keys, listErr := fileSystem.List("")
+		assert.Nil(t, listErr, test.Name)
+		assert.Equal(t, test.ExpectedKeys, orphanNotes(keys), test.Name)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorContains(t, err, test.ExpectedErrorMatch.Error(), test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedResponse, response, test.Name)
+	}
+}
+
+func TestDeleteUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		Name               string
+		FinalizedAt        sql.NullTime
+		ExpectedDelete     int
+		ExpectedErrorMatch error
+	}{
+		{
+			Name:           "Test upload is deleted",
+			ExpectedDelete: 1,
+		},
+		{
+			Name:               "Test upload being posted is kept",
+			FinalizedAt:        sql.NullTime{Time: time.Now(), Valid: true},
+			ExpectedErrorMatch: ErrUploadFinalizing,
+		},
+		{
+			Name:           "Test upload left claimed by a stopped process is deleted",
+			FinalizedAt:    sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true},
+			ExpectedDelete: 1,
+		},
+	}
+
+	for _, test := range tests {
+		fileSystem := local.New("test host directory", t.TempDir())
+		chunkKey := "uploads/" + testUploadId + "/0"
+		_, err := fileSystem.Save(context.Background(), chunkKey, strings.NewReader("chunk"), nil)
+		assert.Nil(t, err)
+		db := mocks.NewMockDatabase(ctrl)
+		uploadService := NewUploadSessionService(&config.Config{UploadClaimTimeout: time.Minute}, db, fileSystem, nil)
+
+		session := tables.UploadSessionTable{UploadId: testUploadId, Length: 10, Offset: 10, FinalizedAt: test.FinalizedAt}
+		db.EXPECT().GetUploadSession(testUploadId).Return(session, nil).Times(1)
+		db.EXPECT().DeleteUploadSession(testUploadId).Return(nil).Times(test.ExpectedDelete)
+
+		err = uploadService.DeleteUpload(testUploadId)
+		keys, listErr := fileSystem.List("")
+		assert.Nil(t, listErr, test.Name)
+		if test.ExpectedErrorMatch != nil {
+			assert.ErrorIs(t, err, test.ExpectedErrorMatch, test.Name)
+			assert.Equal(t, []string{chunkKey}, keys, test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		assert.Empty(t, keys, test.Name)
+	}
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	directory := t.TempDir()
+	fileSystem := local.New("test host directory", directory)
+	for _, key := range []string{
+		"uploads/" + testUploadId + "/0",
+		"uploads/" + testUploadId + "/5",
+		"uploads/ffff/0",
+		"uploads/direct/" + testUploadId,
+		"uploads/staging/stale",
+		"uploads/staging/recent",
+	} {
+		_, err := fileSystem.Save(context.Background(), key, strings.NewReader("chunk"), nil)
+		assert.Nil(t, err)
+	}
+	staleTime := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(directory, "uploads", "staging", "stale"), staleTime, staleTime))
+	db := mocks.NewMockDatabase(ctrl)
+	uploadService := NewUploadSessionService(&config.Config{UploadSessionTTL: time.Hour}, db, fileSystem, nil)
+
+	db.EXPECT().GetExpiredUploadSessions(uploadCleanupPageSize).Return([]string{testUploadId}, nil).Times(1)
+	db.EXPECT().DeleteUploadSession(testUploadId).Return(nil).Times(1)
+	// The second upload was never sent
+	db.EXPECT().GetExpiredDirectUploads(uploadCleanupPageSize).Return([]string{testUploadId, "ffff"}, nil).Times(1)
+	db.EXPECT().DeleteDirectUpload(testUploadId).Return(nil).Times(1)
+	db.EXPECT().DeleteDirectUpload("ffff").Return(nil).Times(1)
+
+	removed, err := uploadService.RemoveExpiredUploads()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, removed)
+	keys, err := fileSystem.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"uploads/ffff/0", "uploads/staging/recent"}, keys)
+}
+
+func TestRemoveOrphanedOriginals(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	directory := t.TempDir()
+	fileSystem := local.New("test host directory", directory)
+	staleTime := time.Now().Add(-2 * time.Hour)
+	save := func(key string, content string, stale bool) {
+		_, err := fileSystem.Save(context.Background(), key, strings.NewReader(content), nil)
+		assert.Nil(t, err)
+		if stale {
+			assert.Nil(t, os.Chtimes(filepath.Join(directory, filepath.FromSlash(key)), staleTime, staleTime))
+		}
+	}
+	// Nothing points to it
+	save("originals/aa/aa/orphan.png", "image", true)
+	save(ORPHAN_SUBDIRECTORY+"/1", "originals/aa/aa/orphan.png", true)
+	// Another upload of the same content saved its post
+	save("originals/bb/bb/shared.png", "image", true)
+	save(ORPHAN_SUBDIRECTORY+"/2", "originals/bb/bb/shared.png", true)
+	// Stored again since by an upload that may not have saved its post yet
+	save("originals/cc/cc/restored.png", "image", false)
+	save(ORPHAN_SUBDIRECTORY+"/3", "originals/cc/cc/restored.png", true)
+	// Noted too recently
+	save("originals/dd/dd/recent.png", "image", true)
+	save(ORPHAN_SUBDIRECTORY+"/4", "originals/dd/dd/recent.png", false)
+
+	db := mocks.NewMockDatabase(ctrl)
+	uploadService := NewUploadSessionService(&config.Config{UploadSessionTTL: time.Hour}, db, fileSystem, nil)
+	db.EXPECT().GetExpiredUploadSessions(uploadCleanupPageSize).Return(nil, nil).Times(1)
+	db.EXPECT().GetExpiredDirectUploads(uploadCleanupPageSize).Return(nil, nil).Times(1)
+	db.EXPECT().GetImageByStorageKey("originals/aa/aa/orphan.png").Return(tables.ImageTable{}, sql.ErrNoRows).Times(1)
+	db.EXPECT().GetImageByStorageKey("originals/bb/bb/shared.png").Return(tables.ImageTable{ImageId: 2}, nil).Times(1)
+	db.EXPECT().GetImageByStorageKey("originals/cc/cc/restored.png").Return(tables.ImageTable{}, sql.ErrNoRows).Times(1)
+
+	removed, err := uploadService.RemoveExpiredUploads()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	keys, err := fileSystem.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"originals/bb/bb/shared.png",
+		"originals/cc/cc/restored.png",
+		"originals/dd/dd/recent.png",
+		ORPHAN_SUBDIRECTORY + "/4",
+	}, keys)
+}
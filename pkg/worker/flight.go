@@ -0,0 +1,44 @@
+package worker
+
+import "sync"
+
+// Flight collapses concurrent calls doing the same work, callers asking for a key
+// while a call for it runs wait for that call and share its error
+type Flight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done chan struct{}
+	err  error
+}
+
+func NewFlight() *Flight {
+	return &Flight{
+		calls: make(map[string]*call),
+	}
+}
+
+// Do runs fn unless a call for key is running, in which case it waits for that
+// call and returns its error instead
+func (f *Flight) Do(key string, fn func() error) error {
+	f.mu.Lock()
+	if running, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		<-running.done
+		return running.err
+	}
+	c := &call{done: make(chan struct{})}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.calls, key)
+		f.mu.Unlock()
+		close(c.done)
+	}()
+	c.err = fn()
+	return c.err
+}
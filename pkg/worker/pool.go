@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"context"
+	"sync"
+)
+
+// Task is a unit of work run by the pool. The context is cancelled when the pool
+// is forced to stop before the task finishes.
+type Task func(ctx context.Context)
+
+// Pool runs submitted tasks on a fixed number of goroutines. Tasks wait in a
+// bounded queue, Submit never blocks and reports false when the queue is full.
+type Pool struct {
+	tasks       chan Task
+	concurrency int
+	wg          sync.WaitGroup
+	mu          sync.RWMutex
+	stopped     bool
+	cancel      context.CancelFunc
+}
+
+func New(concurrency int, queueSize int) *Pool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &Pool{
+		tasks:       make(chan Task, queueSize),
+		concurrency: concurrency,
+	}
+}
+
+// Start launches the workers. Cancelling ctx cancels the context of running tasks.
+func (p *Pool) Start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	for i := 0; i < p.concurrency; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				task(ctx)
+			}
+		}()
+	}
+}
+
+// Submit queues a task, returning false when the queue is full or the pool is shutting down.
+func (p *Pool) Submit(task Task) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return false
+	}
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops accepting tasks and waits for queued and running ones to finish.
+// When ctx ends first the running tasks are cancelled and ctx's error is returned.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.tasks)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		if p.cancel != nil {
+			p.cancel()
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,129 @@
+package worker
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolRunsAndDrainsTasks(t *testing.T) {
+	pool := New(2, 10)
+	pool.Start(context.Background())
+
+	var completed int32
+	for i := 0; i < 10; i++ {
+		assert.True(t, pool.Submit(func(ctx context.Context) {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&completed, 1)
+		}))
+	}
+
+	assert.Nil(t, pool.Shutdown(context.Background()))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&completed))
+	assert.False(t, pool.Submit(func(ctx context.Context) {}))
+}
+
+func TestPoolRejectsWhenQueueIsFull(t *testing.T) {
+	pool := New(1, 1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	pool.Start(context.Background())
+
+	assert.True(t, pool.Submit(func(ctx context.Context) {
+		close(started)
+		<-release
+	}))
+	<-started
+	assert.True(t, pool.Submit(func(ctx context.Context) {}))
+	assert.False(t, pool.Submit(func(ctx context.Context) {}))
+
+	close(release)
+	assert.Nil(t, pool.Shutdown(context.Background()))
+}
+
+func TestPoolShutdownCancelsRunningTasksOnTimeout(t *testing.T) {
+	pool := New(1, 1)
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	pool.Start(context.Background())
+
+	pool.Submit(func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, pool.Shutdown(ctx))
+	<-cancelled
+}
+
+func TestSemaphore(t *testing.T) {
+	semaphore := NewSemaphore(1)
+	assert.Nil(t, semaphore.Acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, semaphore.Acquire(ctx))
+
+	semaphore.Release()
+	assert.Nil(t, semaphore.Acquire(context.Background()))
+}
+
+func TestWeightedSemaphore(t *testing.T) {
+	semaphore := NewWeightedSemaphore(10)
+	weight, err := semaphore.Acquire(context.Background(), 6)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), weight)
+
+	// 6 + 5 doesn't fit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = semaphore.Acquire(ctx, 5)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// A waiter is granted once enough weight is released
+	granted := make(chan int64)
+	go func() {
+		weight, _ := semaphore.Acquire(context.Background(), 50)
+		granted <- weight
+	}()
+	time.Sleep(5 * time.Millisecond)
+	semaphore.Release(6)
+	assert.Equal(t, int64(10), <-granted, "weight above the capacity is capped")
+
+	semaphore.Release(10)
+	weight, err = semaphore.Acquire(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), weight)
+}
+
+func TestFlightCollapsesConcurrentCalls(t *testing.T) {
+	flight := NewFlight()
+	var runs int32
+	release := make(chan struct{})
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			errs <- flight.Do("key", func() error {
+				atomic.AddInt32(&runs, 1)
+				<-release
+				return context.Canceled
+			})
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, context.Canceled, <-errs)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+
+	// Once done the next call runs again
+	assert.Nil(t, flight.Do("key", func() error { return nil }))
+}
@@ -0,0 +1,31 @@
+package worker
+
+import "context"
+
+// Semaphore bounds how many goroutines do something at once
+type Semaphore struct {
+	slots chan struct{}
+}
+
+func NewSemaphore(size int) *Semaphore {
+	if size < 1 {
+		size = 1
+	}
+	return &Semaphore{
+		slots: make(chan struct{}, size),
+	}
+}
+
+// Acquire waits for a free slot, giving up with ctx's error when ctx ends first
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Semaphore) Release() {
+	<-s.slots
+}
@@ -0,0 +1,95 @@
+package worker
+
+import (
+	"context"
+	"sync"
+)
+
+// WeightedSemaphore bounds the total weight, e.g. bytes of memory, held at once.
+// Waiters are served in order so large requests aren't starved by small ones.
+type WeightedSemaphore struct {
+	capacity int64
+	mu       sync.Mutex
+	used     int64
+	waiters  []*weightedWaiter
+}
+
+type weightedWaiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+func NewWeightedSemaphore(capacity int64) *WeightedSemaphore {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &WeightedSemaphore{
+		capacity: capacity,
+	}
+}
+
+// Acquire waits until weight fits, giving up with ctx's error when ctx ends first.
+// A weight above the capacity is capped so it can still run alone. Returns the
+// weight to release.
+func (s *WeightedSemaphore) Acquire(ctx context.Context, weight int64) (int64, error) {
+	if weight > s.capacity {
+		weight = s.capacity
+	}
+	s.mu.Lock()
+	if len(s.waiters) == 0 && s.used+weight <= s.capacity {
+		s.used += weight
+		s.mu.Unlock()
+		return weight, nil
+	}
+	waiter := &weightedWaiter{weight: weight, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, waiter)
+	s.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return weight, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-waiter.ready:
+			// Granted while giving up, hand it back
+			s.used -= weight
+			s.notify()
+		default:
+			s.remove(waiter)
+			// The head of the queue may fit now that this waiter is gone
+			s.notify()
+		}
+		return 0, ctx.Err()
+	}
+}
+
+func (s *WeightedSemaphore) Release(weight int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= weight
+	s.notify()
+}
+
+// Grant waiters in order while they fit
+func (s *WeightedSemaphore) notify() {
+	for len(s.waiters) > 0 {
+		next := s.waiters[0]
+		if s.used+next.weight > s.capacity {
+			return
+		}
+		s.used += next.weight
+		s.waiters = s.waiters[1:]
+		close(next.ready)
+	}
+}
+
+func (s *WeightedSemaphore) remove(waiter *weightedWaiter) {
+	for i, w := range s.waiters {
+		if w == waiter {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
+}